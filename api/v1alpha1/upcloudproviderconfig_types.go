@@ -0,0 +1,87 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UpCloudProviderConfigSpec defines the account-wide settings shared by the
+// UpCloudVMs that reference the config
+type UpCloudProviderConfigSpec struct {
+	// CredentialsRef points at a Secret holding the UpCloud API credentials of the account.
+	// As the config is cluster-scoped, the namespace must be set.
+	// When unset, the controller falls back to the UPCLOUD_USERNAME/UPCLOUD_PASSWORD env vars of the manager.
+	CredentialsRef *CredentialsReference `json:"credentialsRef,omitempty"`
+
+	// Zone is used for VMs that do not set one.
+	Zone string `json:"zone,omitempty"`
+	// Plan is used for VMs that do not set one.
+	Plan string `json:"plan,omitempty"`
+	// StorageTier of the storage created for VMs. Defaults to "maxiops".
+	StorageTier string `json:"storageTier,omitempty"`
+
+	// APIEndpoint overrides the UpCloud API base URL.
+	APIEndpoint string `json:"apiEndpoint,omitempty"`
+	// RequestTimeout bounds each request to the UpCloud API.
+	RequestTimeout *metav1.Duration `json:"requestTimeout,omitempty"`
+}
+
+// UpCloudProviderConfigStatus defines the observed state of UpCloudProviderConfig
+type UpCloudProviderConfigStatus struct {
+	// Ready is true once the account has been validated with the configured credentials.
+	Ready bool `json:"ready"`
+	// Message explains why the config is not ready.
+	Message string `json:"message,omitempty"`
+	// Username of the validated account.
+	Username string `json:"username,omitempty"`
+	// Credits is the account's credit balance at the last check.
+	Credits string `json:"credits,omitempty"`
+	// LastCheckedTime is when the account was last validated.
+	LastCheckedTime *metav1.Time `json:"lastCheckedTime,omitempty"`
+	// ObservedGeneration is the generation of the spec the status reflects.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Ready",type=boolean,JSONPath=`.status.ready`
+// +kubebuilder:printcolumn:name="Credits",type=string,JSONPath=`.status.credits`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// UpCloudProviderConfig is the Schema for the upcloudproviderconfigs API
+type UpCloudProviderConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UpCloudProviderConfigSpec   `json:"spec,omitempty"`
+	Status UpCloudProviderConfigStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// UpCloudProviderConfigList contains a list of UpCloudProviderConfig
+type UpCloudProviderConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UpCloudProviderConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UpCloudProviderConfig{}, &UpCloudProviderConfigList{})
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UpCloudStorageSpec defines the desired state of UpCloudStorage
+type UpCloudStorageSpec struct {
+	// Size of the storage in GB. It can grow, UpCloud never shrinks a storage.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=4096
+	// +kubebuilder:validation:XValidation:rule="self >= oldSelf",message="storage cannot shrink"
+	Size int `json:"size"`
+	// Tier of the storage. Defaults to the tier of the UpCloudProviderConfig, or maxiops.
+	// +kubebuilder:validation:Enum=maxiops;standard;hdd
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="tier is immutable"
+	// +optional
+	Tier string `json:"tier,omitempty"`
+	// Zone is the UpCloud zone ID, such as fi-hel1. Defaults to the zone of the
+	// UpCloudProviderConfig. A storage only attaches to servers of its zone.
+	// +kubebuilder:validation:Pattern=`^[a-z]{2}-[a-z]{3}[0-9]+$`
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="zone is immutable"
+	// +optional
+	Zone string `json:"zone,omitempty"`
+	// Labels are set on the storage in UpCloud. The vm-controller-owner label
+	// is set by the controller and may not be given.
+	// +kubebuilder:validation:XValidation:rule="!('vm-controller-owner' in self)",message="the vm-controller-owner label is set by the controller"
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Encrypted creates the storage encrypted at rest.
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="encrypted is immutable"
+	// +optional
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// CredentialsRef points at a Secret in the storage's namespace holding the UpCloud API
+	// credentials for this storage. When unset, the credentials of the UpCloudProviderConfig
+	// or the manager are used.
+	CredentialsRef *LocalCredentialsReference `json:"credentialsRef,omitempty"`
+	// ProviderConfigRef names the UpCloudProviderConfig holding the account settings for this storage.
+	ProviderConfigRef *UpCloudProviderConfigReference `json:"providerConfigRef,omitempty"`
+}
+
+// Conditions of an UpCloudStorage, besides Ready and Synced of the UpCloudVM.
+const (
+	// ConditionAttached is True while the storage is attached to a server.
+	ConditionAttached = "Attached"
+)
+
+// UpCloudStorageStatus defines the observed state of UpCloudStorage
+type UpCloudStorageStatus struct {
+	// UUID of the storage in UpCloud.
+	UUID string `json:"uuid,omitempty"`
+	// State is Creating, Available, Attached, Lost or Deleting.
+	State string `json:"state,omitempty"`
+	// StorageState is the state of the storage as last reported by UpCloud,
+	// e.g. "online" or "maintenance".
+	StorageState string `json:"storageState,omitempty"`
+	// Size, Tier and Zone of the storage as last reported by UpCloud.
+	Size int    `json:"size,omitempty"`
+	Tier string `json:"tier,omitempty"`
+	Zone string `json:"zone,omitempty"`
+	// ServerUUID is the server the storage is attached to.
+	ServerUUID string `json:"serverUUID,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was computed for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe the storage's readiness.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.size`
+// +kubebuilder:printcolumn:name="Zone",type=string,JSONPath=`.status.zone`
+// +kubebuilder:printcolumn:name="Server",type=string,JSONPath=`.status.serverUUID`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// UpCloudStorage is the Schema for the upcloudstorages API. It is a disk with a
+// lifecycle of its own, attached to UpCloudVMs through their spec.storageRefs.
+type UpCloudStorage struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UpCloudStorageSpec   `json:"spec,omitempty"`
+	Status UpCloudStorageStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// UpCloudStorageList contains a list of UpCloudStorage
+type UpCloudStorageList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UpCloudStorage `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UpCloudStorage{}, &UpCloudStorageList{})
+}
@@ -22,30 +22,469 @@ import (
 )
 
 // UpCloudVMSpec defines the desired state of UpCloudVM
+// +kubebuilder:validation:XValidation:rule="[has(self.storagetemplate), has(self.templateSelector), has(self.snapshotRef)].filter(x, x).size() == 1",message="exactly one of storagetemplate, templateSelector and snapshotRef must be set"
 type UpCloudVMSpec struct {
-	CPU             int                `json:"cpu"`
-	Memory          int                `json:"memory"`
-	StorageSize     int                `json:"storagesize"`
-	Zone            string             `json:"zone"`
-	Plan            string             `json:"plan"`
-	TimeZone        string             `json:"timezone"`
-	StorageTemplate string             `json:"storagetemplate"`
-	LoginUser       *request.LoginUser `json:"login_user,omitempty"`
-	UserData        string             `json:"user_data,omitempty"`
+	// CPU is the number of CPU cores. It must match a named plan and can be left unset with one.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=128
+	// +optional
+	CPU int `json:"cpu,omitempty"`
+	// Memory is the amount of memory in MiB. It must match a named plan and can be left unset with one.
+	// +kubebuilder:validation:Minimum=1024
+	// +kubebuilder:validation:Maximum=1048576
+	// +optional
+	Memory int `json:"memory,omitempty"`
+	// StorageSize is the size of the system disk in GB. Defaulted by the webhook. Raising it
+	// grows the disk, stopping the server when UpCloud cannot grow it online; disks never shrink.
+	// +kubebuilder:validation:Minimum=10
+	// +kubebuilder:validation:Maximum=4096
+	// +optional
+	StorageSize int `json:"storagesize,omitempty"`
+	// ResizeFilesystem also grows the last partition and its filesystem when a disk is grown.
+	// UpCloud only does so on a stopped server and keeps a backup of the disk as it was, so
+	// every resize stops the server. Otherwise the guest has to grow its filesystem itself.
+	// +optional
+	ResizeFilesystem bool `json:"resizeFilesystem,omitempty"`
+	// StorageTier of the system disk. Defaulted by the webhook from the UpCloudProviderConfig
+	// or the manager.
+	// +kubebuilder:validation:Enum=maxiops;standard;hdd
+	// +optional
+	StorageTier string `json:"storageTier,omitempty"`
+	// Zone is the UpCloud zone ID, such as fi-hel1. Defaulted by the webhook from the
+	// UpCloudProviderConfig or the manager.
+	// +kubebuilder:validation:Pattern=`^[a-z]{2}-[a-z]{3}[0-9]+$`
+	// +optional
+	Zone string `json:"zone,omitempty"`
+	// Plan is an UpCloud plan name, such as 2xCPU-4GB, or "custom" to size the server by
+	// CPU and Memory alone. Defaults to custom when CPU or Memory is set, otherwise to the
+	// plan of the UpCloudProviderConfig or the manager.
+	// +kubebuilder:validation:Pattern=`^(custom|([A-Z]+-)?[0-9]+xCPU-[0-9]+GB(-[0-9]+GB)?)$`
+	// +optional
+	Plan string `json:"plan,omitempty"`
+	// TimeZone of the server, such as UTC or Europe/Helsinki. Defaulted by the webhook.
+	// +optional
+	TimeZone string `json:"timezone,omitempty"`
+	// StorageTemplate is the UUID of the template storage the system disk is cloned from.
+	// Either it or TemplateSelector must be set.
+	// +kubebuilder:validation:Pattern=`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`
+	// +optional
+	StorageTemplate string `json:"storagetemplate,omitempty"`
+	// TemplateSelector picks the template by title or OS instead of by UUID. It is
+	// resolved when the server is created, and the UUID is kept in status.templateUUID.
+	// +optional
+	TemplateSelector *TemplateSelector `json:"templateSelector,omitempty"`
+	// SnapshotRef creates the server with the disks cloned from a completed
+	// UpCloudVMSnapshot of the VM's namespace instead of from a template.
+	// +optional
+	SnapshotRef *SnapshotReference `json:"snapshotRef,omitempty"`
+	// StorageDevices are the disks of the server besides the system disk. Disks added to the
+	// list are created and attached, grown ones resized, and removed ones detached but kept.
+	// +listType=map
+	// +listMapKey=title
+	// +kubebuilder:validation:MaxItems=15
+	// +optional
+	StorageDevices []StorageDevice `json:"storageDevices,omitempty"`
+	// StorageRefs attach UpCloudStorages of the VM's namespace to the server. Their data
+	// outlives the VM: removing a reference or deleting the VM only detaches the storage.
+	// +listType=map
+	// +listMapKey=name
+	// +kubebuilder:validation:MaxItems=15
+	// +optional
+	StorageRefs []StorageReference `json:"storageRefs,omitempty"`
+	LoginUser   *request.LoginUser `json:"login_user,omitempty"`
+	UserData    string             `json:"user_data,omitempty"`
+
+	// CredentialsRef points at a Secret in the VM's namespace holding the UpCloud API credentials for this VM.
+	// When unset, the controller falls back to the UPCLOUD_USERNAME/UPCLOUD_PASSWORD env vars of the manager.
+	CredentialsRef *LocalCredentialsReference `json:"credentialsRef,omitempty"`
+	// ProviderConfigRef names the UpCloudProviderConfig holding the account settings for this VM.
+	// Its zone and plan are used when the VM does not set them, and its credentials when the VM has no CredentialsRef.
+	ProviderConfigRef *UpCloudProviderConfigReference `json:"providerConfigRef,omitempty"`
+	// AutoCorrectDrift makes the controller revert changes made to the server outside Kubernetes,
+	// such as a resize or stop in the UpCloud console, when it finds them on its periodic resync.
+	// Otherwise drift is only reported in the Drifted condition.
+	AutoCorrectDrift bool `json:"autoCorrectDrift,omitempty"`
+	// RecreatePolicy says what to do when the server is deleted outside Kubernetes.
+	// Defaults to Never, which marks the VM Lost.
+	// +kubebuilder:default=Never
+	RecreatePolicy RecreatePolicy `json:"recreatePolicy,omitempty"`
+	// DeletionPolicy says what happens to the server and its disks when the UpCloudVM is
+	// deleted. Defaults to Delete.
+	// +kubebuilder:default=Delete
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// DeletionProtection makes the validating webhook refuse to delete the UpCloudVM, and
+	// the controller keep its server should the deletion get through anyway. Set it to
+	// false before deleting the VM.
+	// +optional
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+	// DisruptionPolicy says whether changes to the plan, CPU or memory, which need the server
+	// to be stopped, are applied right away. Defaults to Allow.
+	// +kubebuilder:default=Allow
+	DisruptionPolicy DisruptionPolicy `json:"disruptionPolicy,omitempty"`
+	// StopTimeout is how long the server may take to shut down after a soft stop before it is
+	// stopped hard. Defaults to 2 minutes.
+	StopTimeout *metav1.Duration `json:"stopTimeout,omitempty"`
+	// PowerState is whether the server should run. A Stopped server keeps its disks and
+	// addresses and can be started again by setting Running. Defaults to Running.
+	// +kubebuilder:default=Running
+	PowerState PowerState `json:"powerState,omitempty"`
+	// StopType is how the server is stopped for a Stopped PowerState or restarted for the
+	// RestartAnnotation: soft asks the OS to shut down and stops the server hard once
+	// StopTimeout has passed, hard stops it right away. Defaults to soft.
+	// +kubebuilder:validation:Enum=soft;hard
+	// +optional
+	StopType string `json:"stopType,omitempty"`
+	// BackupPolicy has the controller back the disks of the server up on a cron schedule
+	// and prune the backups it took once they are past their retention. Only the policy
+	// prunes them: the backups are retained in UpCloud when the policy is removed or the
+	// UpCloudVM is deleted.
+	// +optional
+	BackupPolicy *BackupPolicy `json:"backupPolicy,omitempty"`
 
 	//Comment for further improvement:
 	// - What is the size limit for this UserData? if it has the same size limit as OpenStack, then we might need to encode it with base64
 }
 
+// RecreatePolicy says what happens to an UpCloudVM whose server was deleted outside Kubernetes.
+// +kubebuilder:validation:Enum=Recreate;Never
+type RecreatePolicy string
+
+const (
+	// RecreatePolicyRecreate creates a new server from the spec.
+	RecreatePolicyRecreate RecreatePolicy = "Recreate"
+	// RecreatePolicyNever keeps the VM without a server and sets its Lost condition.
+	RecreatePolicyNever RecreatePolicy = "Never"
+)
+
+// DeletionPolicy says what happens in UpCloud when an UpCloudVM is deleted.
+// +kubebuilder:validation:Enum=Delete;DeleteServerKeepStorage;Orphan
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the server and its disks.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyDeleteServerKeepStorage deletes the server but keeps its disks.
+	DeletionPolicyDeleteServerKeepStorage DeletionPolicy = "DeleteServerKeepStorage"
+	// DeletionPolicyOrphan leaves the server and its disks as they are.
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+)
+
+// RetainedResourcesAnnotation is set on an UpCloudVM as its finalizer is released to list
+// the UpCloud resources its DeletionPolicy kept, as server/<uuid> and storage/<uuid>
+// separated by commas.
+const RetainedResourcesAnnotation = "infrastructure.github.com/retained-resources"
+
+// PowerState is the desired power state of the server of an UpCloudVM.
+// +kubebuilder:validation:Enum=Running;Stopped
+type PowerState string
+
+const (
+	// PowerStateRunning keeps the server started.
+	PowerStateRunning PowerState = "Running"
+	// PowerStateStopped keeps the server stopped.
+	PowerStateStopped PowerState = "Stopped"
+)
+
+// DisruptionPolicy says whether the controller may stop a server to apply a change.
+// +kubebuilder:validation:Enum=Allow;RequireApproval
+type DisruptionPolicy string
+
+const (
+	// DisruptionPolicyAllow stops the server whenever a change needs it.
+	DisruptionPolicyAllow DisruptionPolicy = "Allow"
+	// DisruptionPolicyRequireApproval waits until the UpCloudVM is annotated with
+	// ApproveRestartAnnotation. The annotation is removed once the server is stopped,
+	// so every restart needs a new approval.
+	DisruptionPolicyRequireApproval DisruptionPolicy = "RequireApproval"
+)
+
+// ApproveRestartAnnotation approves stopping the server of an UpCloudVM whose
+// DisruptionPolicy is RequireApproval. Any non-empty value approves.
+const ApproveRestartAnnotation = "infrastructure.github.com/approve-restart"
+
+// RestartAnnotation requests a restart of the server of an UpCloudVM. Its value is the
+// RFC 3339 time of the request; the server is restarted once for every request later
+// than status.lastRestartTime, regardless of the DisruptionPolicy.
+const RestartAnnotation = "infrastructure.github.com/restart"
+
+// RestoreSnapshotAnnotation names an UpCloudVMSnapshot of the UpCloudVM to restore its
+// disks from. The server is stopped like for a plan change, the disks are restored and
+// the server started again, then the annotation is removed.
+const RestoreSnapshotAnnotation = "infrastructure.github.com/restore-snapshot"
+
+// TemplateSelector picks a public or private template storage. Exactly one of
+// Title, TitlePattern and OS must be set.
+// +kubebuilder:validation:XValidation:rule="[has(self.title), has(self.titlePattern), has(self.os)].filter(x, x).size() == 1",message="exactly one of title, titlePattern and os must be set"
+// +kubebuilder:validation:XValidation:rule="!has(self.version) || has(self.os)",message="version can only be set with os"
+type TemplateSelector struct {
+	// Title is the exact title of the template, such as "Ubuntu Server 24.04 LTS (Noble Numbat)".
+	// +optional
+	Title string `json:"title,omitempty"`
+	// TitlePattern is a regular expression matched against the template titles. The newest
+	// matching version is used.
+	// +optional
+	TitlePattern string `json:"titlePattern,omitempty"`
+	// OS is the name the template titles start with, such as Ubuntu or Debian.
+	// +optional
+	OS string `json:"os,omitempty"`
+	// Version of the OS, such as 22.04 or 12. Defaults to latest, the newest version
+	// UpCloud offers.
+	// +optional
+	Version string `json:"version,omitempty"`
+}
+
+// StorageAction says where the disk of a StorageDevice comes from.
+// +kubebuilder:validation:Enum=create;clone;attach
+type StorageAction string
+
+const (
+	// StorageActionCreate creates an empty disk.
+	StorageActionCreate StorageAction = "create"
+	// StorageActionClone clones the disk from another storage.
+	StorageActionClone StorageAction = "clone"
+	// StorageActionAttach attaches an existing storage. It is detached, not deleted, with the VM.
+	StorageActionAttach StorageAction = "attach"
+)
+
+// StorageDevice is a disk of the server besides the system disk.
+type StorageDevice struct {
+	// Title identifies the disk among the disks of the VM. Created and cloned disks carry it
+	// in UpCloud; renaming an entry replaces its disk.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=64
+	Title string `json:"title"`
+	// Action says whether the disk is created empty, cloned from Storage, or Storage itself
+	// is attached. Defaults to create.
+	// +kubebuilder:default=create
+	// +optional
+	Action StorageAction `json:"action,omitempty"`
+	// Storage is the UUID of the storage to clone or attach.
+	// +kubebuilder:validation:Pattern=`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`
+	// +optional
+	Storage string `json:"storage,omitempty"`
+	// Size of the disk in GB. Required to create a disk; a cloned or attached disk is grown
+	// to it when smaller.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=4096
+	// +optional
+	Size int `json:"size,omitempty"`
+	// Tier of a created or cloned disk. Defaults to the tier of the system disk.
+	// +kubebuilder:validation:Enum=maxiops;standard;hdd
+	// +optional
+	Tier string `json:"tier,omitempty"`
+	// Address of the disk on the server, such as virtio, scsi or virtio:2. Defaults to the
+	// next free virtio address.
+	// +kubebuilder:validation:Pattern=`^(virtio|scsi|ide)(:[0-9]+(:[0-9]+)?)?$`
+	// +optional
+	Address string `json:"address,omitempty"`
+	// Encrypted encrypts a created or cloned disk at rest.
+	// +optional
+	Encrypted bool `json:"encrypted,omitempty"`
+	// BackupRule has UpCloud back a created or cloned disk up on a schedule.
+	// +optional
+	BackupRule *BackupRule `json:"backupRule,omitempty"`
+}
+
+// SnapshotReference names an UpCloudVMSnapshot.
+type SnapshotReference struct {
+	// Name of the UpCloudVMSnapshot in the VM's namespace.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// StorageReference attaches an UpCloudStorage to the server.
+type StorageReference struct {
+	// Name of the UpCloudStorage in the VM's namespace.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// Address of the disk on the server, such as virtio, scsi or virtio:2. Defaults to the
+	// next free virtio address.
+	// +kubebuilder:validation:Pattern=`^(virtio|scsi|ide)(:[0-9]+(:[0-9]+)?)?$`
+	// +optional
+	Address string `json:"address,omitempty"`
+}
+
+// BackupRule schedules the UpCloud backups of a disk.
+type BackupRule struct {
+	// Interval is daily or the day of the week the backup is taken.
+	// +kubebuilder:validation:Enum=daily;mon;tue;wed;thu;fri;sat;sun
+	Interval string `json:"interval"`
+	// Time is the time of day in UTC, as hhmm.
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3])[0-5][0-9]$`
+	Time string `json:"time"`
+	// Retention is how many days backups are kept.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=1095
+	Retention int `json:"retention"`
+}
+
+// BackupPolicy schedules backups of the disks of an UpCloudVM taken by the controller.
+// Unlike the BackupRule of a disk it takes any cron schedule and can keep a number of
+// backups rather than days' worth.
+type BackupPolicy struct {
+	// Schedule is a cron expression in UTC: minute, hour, day of month, month and day of
+	// week, such as "0 3 * * *", or one of @hourly, @daily, @weekly and @monthly.
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+	// KeepLast is how many backups of each disk are kept. Defaults to 7 when MaxAge is unset.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	KeepLast int `json:"keepLast,omitempty"`
+	// MaxAge deletes backups older than it, e.g. "720h".
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+	// Disks are the titles of the disks to back up, as listed in status.storageDevices; the
+	// system disk is titled after the VM. Defaults to every disk of the server.
+	// +optional
+	Disks []string `json:"disks,omitempty"`
+}
+
+// DefaultBackupKeepLast is the KeepLast of a BackupPolicy that sets neither it nor MaxAge.
+const DefaultBackupKeepLast = 7
+
+// PolicyBackup is a backup taken by the BackupPolicy of an UpCloudVM.
+type PolicyBackup struct {
+	// StorageUUID is the disk the backup was taken of.
+	StorageUUID string `json:"storageUUID"`
+	// Title of the disk.
+	Title string `json:"title,omitempty"`
+	// BackupUUID is the UUID of the backup storage in UpCloud.
+	BackupUUID string `json:"backupUUID"`
+	// Time is when the backup was taken.
+	Time metav1.Time `json:"time"`
+}
+
+// TemplateVersionLatest selects the newest version of an OS.
+const TemplateVersionLatest = "latest"
+
+// CredentialsReference points at a Secret holding UpCloud API credentials from a
+// cluster-scoped resource. The Secret must contain either "username" and "password" keys
+// or a "token" key.
+type CredentialsReference struct {
+	// Name of the Secret.
+	Name string `json:"name"`
+	// Namespace of the Secret.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// LocalCredentialsReference points at a Secret holding UpCloud API credentials in the
+// namespace of the referencing resource, so that a namespace cannot use the credentials of
+// another. The Secret holds the same keys as for a CredentialsReference.
+type LocalCredentialsReference struct {
+	// Name of the Secret.
+	Name string `json:"name"`
+}
+
+// UpCloudProviderConfigReference names a cluster-scoped UpCloudProviderConfig.
+type UpCloudProviderConfigReference struct {
+	// Name of the UpCloudProviderConfig.
+	Name string `json:"name"`
+}
+
+// Condition types of an UpCloudVM.
+const (
+	// ConditionReady is True once the server is provisioned and started in UpCloud.
+	ConditionReady = "Ready"
+	// ConditionProvisioned is True once a server exists in UpCloud for the VM.
+	ConditionProvisioned = "Provisioned"
+	// ConditionCredentialsValid is True when the VM's UpCloud credentials
+	// and UpCloudProviderConfig can be used.
+	ConditionCredentialsValid = "CredentialsValid"
+	// ConditionSynced is True when the server matches the spec as of
+	// status.observedGeneration, and False when applying it failed.
+	ConditionSynced = "Synced"
+	// ConditionDeleting is True while the server is torn down.
+	ConditionDeleting = "Deleting"
+	// ConditionDrifted is True when the server was changed outside Kubernetes
+	// and no longer matches the spec. Its message lists the fields that differ.
+	ConditionDrifted = "Drifted"
+	// ConditionLost is True when the server was deleted outside Kubernetes
+	// and the RecreatePolicy does not allow creating it again.
+	ConditionLost = "Lost"
+	// ConditionInvalidSpec is True when the zone, plan or template of the spec
+	// is not offered by the UpCloud account. Its message lists the valid choices.
+	ConditionInvalidSpec = "InvalidSpec"
+	// ConditionBackedUp is True when the last run of the BackupPolicy backed up every
+	// disk it selects, and False when it failed.
+	ConditionBackedUp = "BackedUp"
+)
+
 // UpCloudVMStatus defines the observed state of UpCloudVM
 type UpCloudVMStatus struct {
 	VMID      string `json:"vmID,omitempty"`
 	State     string `json:"state,omitempty"`
 	IPAddress string `json:"ipAddress,omitempty"`
+	// Message explains the current State, e.g. why the credentials could not be used.
+	Message string `json:"message,omitempty"`
+	// ServerState is the state of the server as last reported by UpCloud,
+	// e.g. "started", "stopped" or "maintenance".
+	ServerState string `json:"serverState,omitempty"`
+	// IPAddresses are all addresses of the server, IPAddress being the first.
+	IPAddresses []string `json:"ipAddresses,omitempty"`
+	// Plan, CPU and Memory are the size of the server as last reported by UpCloud.
+	Plan   string `json:"plan,omitempty"`
+	CPU    int    `json:"cpu,omitempty"`
+	Memory int    `json:"memory,omitempty"`
+	// StorageSize is the size in GB of the system disk as last reported by UpCloud.
+	StorageSize int `json:"storageSize,omitempty"`
+	// StorageDevices are the disks attached to the server.
+	StorageDevices []StorageDeviceStatus `json:"storageDevices,omitempty"`
+	// LastSyncTime is when the server was last read from UpCloud.
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+	// StopRequestedTime is when the controller asked the server to shut down
+	// to apply a change, cleared once it has stopped.
+	StopRequestedTime *metav1.Time `json:"stopRequestedTime,omitempty"`
+	// HardStopRequestedTime is when the controller stopped the server hard as it
+	// had not shut down within the stop timeout, cleared once it has stopped.
+	HardStopRequestedTime *metav1.Time `json:"hardStopRequestedTime,omitempty"`
+	// LastRestartTime is the time of the last request of the RestartAnnotation handled.
+	LastRestartTime *metav1.Time `json:"lastRestartTime,omitempty"`
+	// TemplateUUID is the template the server's system disk was cloned from. A server
+	// created again after being lost is cloned from the same template.
+	TemplateUUID string `json:"templateUUID,omitempty"`
+	// AppliedSpecHash is the hash of the last spec applied to the server.
+	// While the spec hashes the same a reconcile only reads the server.
+	AppliedSpecHash string `json:"appliedSpecHash,omitempty"`
+	// LastBackupTime is when the BackupPolicy last ran.
+	LastBackupTime *metav1.Time `json:"lastBackupTime,omitempty"`
+	// NextBackupTime is when the BackupPolicy runs next.
+	NextBackupTime *metav1.Time `json:"nextBackupTime,omitempty"`
+	// Backups are the backups the BackupPolicy took and has not pruned yet, oldest first.
+	// +optional
+	Backups []PolicyBackup `json:"backups,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was computed for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe the VM's readiness, see the Condition* constants.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// StorageDeviceStatus is a disk attached to the server as reported by UpCloud.
+type StorageDeviceStatus struct {
+	UUID  string `json:"uuid"`
+	Title string `json:"title,omitempty"`
+	// Address on the server, empty while a disk of spec.storageDevices waits to be attached.
+	Address string `json:"address,omitempty"`
+	// Size in GiB.
+	Size int    `json:"size"`
+	Tier string `json:"tier,omitempty"`
+	// Managed is set for the disks of spec.storageDevices. They are detached when removed
+	// from the spec; other disks are left alone.
+	Managed bool `json:"managed,omitempty"`
+	// StorageRef is the UpCloudStorage of spec.storageRefs the disk is, detached when the
+	// reference is removed.
+	StorageRef string `json:"storageRef,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="IP",type=string,JSONPath=`.status.ipAddress`
+// +kubebuilder:printcolumn:name="Disk",type=integer,JSONPath=`.status.storageSize`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // UpCloudVM is the Schema for the upcloudvms API
 type UpCloudVM struct {
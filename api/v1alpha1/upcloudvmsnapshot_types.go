@@ -0,0 +1,108 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UpCloudVMSnapshotSpec defines the desired state of UpCloudVMSnapshot
+type UpCloudVMSnapshotSpec struct {
+	// VMRef names the UpCloudVM of the snapshot's namespace whose disks are backed up.
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="vmRef is immutable"
+	VMRef UpCloudVMReference `json:"vmRef"`
+}
+
+// UpCloudVMReference names an UpCloudVM.
+type UpCloudVMReference struct {
+	// Name of the UpCloudVM.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// SnapshotBackup is the UpCloud backup of one disk of the server.
+type SnapshotBackup struct {
+	// StorageUUID is the disk the backup was taken of.
+	StorageUUID string `json:"storageUUID"`
+	// Title and Address of the disk on the server.
+	Title   string `json:"title,omitempty"`
+	Address string `json:"address,omitempty"`
+	// Size of the disk in GB.
+	Size int `json:"size,omitempty"`
+	// BackupUUID is the UUID of the backup storage in UpCloud.
+	BackupUUID string `json:"backupUUID"`
+	// State of the backup as last reported by UpCloud, "online" once complete.
+	State string `json:"state,omitempty"`
+}
+
+// UpCloudVMSnapshotStatus defines the observed state of UpCloudVMSnapshot
+type UpCloudVMSnapshotStatus struct {
+	// State is Pending, InProgress, Completed, Failed or Deleting.
+	State string `json:"state,omitempty"`
+	// VMID is the UUID of the server the snapshot was taken of.
+	VMID string `json:"vmID,omitempty"`
+	// Zone of the server and its backups.
+	Zone string `json:"zone,omitempty"`
+	// CredentialsRef and ProviderConfigRef are those of the UpCloudVM when the backups
+	// were taken. The backups are followed and deleted with them, even once the VM is gone.
+	// +optional
+	CredentialsRef *LocalCredentialsReference `json:"credentialsRef,omitempty"`
+	// +optional
+	ProviderConfigRef *UpCloudProviderConfigReference `json:"providerConfigRef,omitempty"`
+	// Backups of the disks of the server, the system disk first.
+	// +optional
+	Backups []SnapshotBackup `json:"backups,omitempty"`
+	// CompletionTime is when every backup was complete.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was computed for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe the snapshot's readiness.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="VM",type=string,JSONPath=`.spec.vmRef.name`
+// +kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
+// +kubebuilder:printcolumn:name="Completed",type=date,JSONPath=`.status.completionTime`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// UpCloudVMSnapshot is the Schema for the upcloudvmsnapshots API. It backs up every disk
+// of an UpCloudVM at one point in time. Deleting it deletes the backups.
+type UpCloudVMSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UpCloudVMSnapshotSpec   `json:"spec,omitempty"`
+	Status UpCloudVMSnapshotStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// UpCloudVMSnapshotList contains a list of UpCloudVMSnapshot
+type UpCloudVMSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UpCloudVMSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UpCloudVMSnapshot{}, &UpCloudVMSnapshotList{})
+}
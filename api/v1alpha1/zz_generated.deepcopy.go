@@ -22,16 +22,429 @@ package v1alpha1
 
 import (
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupPolicy) DeepCopyInto(out *BackupPolicy) {
+	*out = *in
+	if in.MaxAge != nil {
+		in, out := &in.MaxAge, &out.MaxAge
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupPolicy.
+func (in *BackupPolicy) DeepCopy() *BackupPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupRule) DeepCopyInto(out *BackupRule) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupRule.
+func (in *BackupRule) DeepCopy() *BackupRule {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CredentialsReference) DeepCopyInto(out *CredentialsReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CredentialsReference.
+func (in *CredentialsReference) DeepCopy() *CredentialsReference {
+	if in == nil {
+		return nil
+	}
+	out := new(CredentialsReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LocalCredentialsReference) DeepCopyInto(out *LocalCredentialsReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LocalCredentialsReference.
+func (in *LocalCredentialsReference) DeepCopy() *LocalCredentialsReference {
+	if in == nil {
+		return nil
+	}
+	out := new(LocalCredentialsReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PolicyBackup) DeepCopyInto(out *PolicyBackup) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PolicyBackup.
+func (in *PolicyBackup) DeepCopy() *PolicyBackup {
+	if in == nil {
+		return nil
+	}
+	out := new(PolicyBackup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotBackup) DeepCopyInto(out *SnapshotBackup) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotBackup.
+func (in *SnapshotBackup) DeepCopy() *SnapshotBackup {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotBackup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotReference) DeepCopyInto(out *SnapshotReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotReference.
+func (in *SnapshotReference) DeepCopy() *SnapshotReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageDevice) DeepCopyInto(out *StorageDevice) {
+	*out = *in
+	if in.BackupRule != nil {
+		in, out := &in.BackupRule, &out.BackupRule
+		*out = new(BackupRule)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageDevice.
+func (in *StorageDevice) DeepCopy() *StorageDevice {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageDevice)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageDeviceStatus) DeepCopyInto(out *StorageDeviceStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageDeviceStatus.
+func (in *StorageDeviceStatus) DeepCopy() *StorageDeviceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageDeviceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageReference) DeepCopyInto(out *StorageReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageReference.
+func (in *StorageReference) DeepCopy() *StorageReference {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TemplateSelector) DeepCopyInto(out *TemplateSelector) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TemplateSelector.
+func (in *TemplateSelector) DeepCopy() *TemplateSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(TemplateSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudProviderConfig) DeepCopyInto(out *UpCloudProviderConfig) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudProviderConfig.
+func (in *UpCloudProviderConfig) DeepCopy() *UpCloudProviderConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudProviderConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UpCloudProviderConfig) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudProviderConfigList) DeepCopyInto(out *UpCloudProviderConfigList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]UpCloudProviderConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudProviderConfigList.
+func (in *UpCloudProviderConfigList) DeepCopy() *UpCloudProviderConfigList {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudProviderConfigList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UpCloudProviderConfigList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudProviderConfigReference) DeepCopyInto(out *UpCloudProviderConfigReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudProviderConfigReference.
+func (in *UpCloudProviderConfigReference) DeepCopy() *UpCloudProviderConfigReference {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudProviderConfigReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudProviderConfigSpec) DeepCopyInto(out *UpCloudProviderConfigSpec) {
+	*out = *in
+	if in.CredentialsRef != nil {
+		in, out := &in.CredentialsRef, &out.CredentialsRef
+		*out = new(CredentialsReference)
+		**out = **in
+	}
+	if in.RequestTimeout != nil {
+		in, out := &in.RequestTimeout, &out.RequestTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudProviderConfigSpec.
+func (in *UpCloudProviderConfigSpec) DeepCopy() *UpCloudProviderConfigSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudProviderConfigSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudProviderConfigStatus) DeepCopyInto(out *UpCloudProviderConfigStatus) {
+	*out = *in
+	if in.LastCheckedTime != nil {
+		in, out := &in.LastCheckedTime, &out.LastCheckedTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudProviderConfigStatus.
+func (in *UpCloudProviderConfigStatus) DeepCopy() *UpCloudProviderConfigStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudProviderConfigStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudStorage) DeepCopyInto(out *UpCloudStorage) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudStorage.
+func (in *UpCloudStorage) DeepCopy() *UpCloudStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UpCloudStorage) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudStorageList) DeepCopyInto(out *UpCloudStorageList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]UpCloudStorage, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudStorageList.
+func (in *UpCloudStorageList) DeepCopy() *UpCloudStorageList {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudStorageList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UpCloudStorageList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudStorageSpec) DeepCopyInto(out *UpCloudStorageSpec) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.CredentialsRef != nil {
+		in, out := &in.CredentialsRef, &out.CredentialsRef
+		*out = new(LocalCredentialsReference)
+		**out = **in
+	}
+	if in.ProviderConfigRef != nil {
+		in, out := &in.ProviderConfigRef, &out.ProviderConfigRef
+		*out = new(UpCloudProviderConfigReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudStorageSpec.
+func (in *UpCloudStorageSpec) DeepCopy() *UpCloudStorageSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudStorageSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudStorageStatus) DeepCopyInto(out *UpCloudStorageStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudStorageStatus.
+func (in *UpCloudStorageStatus) DeepCopy() *UpCloudStorageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudStorageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *UpCloudVM) DeepCopyInto(out *UpCloudVM) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudVM.
@@ -84,14 +497,187 @@ func (in *UpCloudVMList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudVMReference) DeepCopyInto(out *UpCloudVMReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudVMReference.
+func (in *UpCloudVMReference) DeepCopy() *UpCloudVMReference {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudVMReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudVMSnapshot) DeepCopyInto(out *UpCloudVMSnapshot) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudVMSnapshot.
+func (in *UpCloudVMSnapshot) DeepCopy() *UpCloudVMSnapshot {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudVMSnapshot)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UpCloudVMSnapshot) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudVMSnapshotList) DeepCopyInto(out *UpCloudVMSnapshotList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]UpCloudVMSnapshot, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudVMSnapshotList.
+func (in *UpCloudVMSnapshotList) DeepCopy() *UpCloudVMSnapshotList {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudVMSnapshotList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UpCloudVMSnapshotList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudVMSnapshotSpec) DeepCopyInto(out *UpCloudVMSnapshotSpec) {
+	*out = *in
+	out.VMRef = in.VMRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudVMSnapshotSpec.
+func (in *UpCloudVMSnapshotSpec) DeepCopy() *UpCloudVMSnapshotSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudVMSnapshotSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpCloudVMSnapshotStatus) DeepCopyInto(out *UpCloudVMSnapshotStatus) {
+	*out = *in
+	if in.CredentialsRef != nil {
+		in, out := &in.CredentialsRef, &out.CredentialsRef
+		*out = new(LocalCredentialsReference)
+		**out = **in
+	}
+	if in.ProviderConfigRef != nil {
+		in, out := &in.ProviderConfigRef, &out.ProviderConfigRef
+		*out = new(UpCloudProviderConfigReference)
+		**out = **in
+	}
+	if in.Backups != nil {
+		in, out := &in.Backups, &out.Backups
+		*out = make([]SnapshotBackup, len(*in))
+		copy(*out, *in)
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudVMSnapshotStatus.
+func (in *UpCloudVMSnapshotStatus) DeepCopy() *UpCloudVMSnapshotStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(UpCloudVMSnapshotStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *UpCloudVMSpec) DeepCopyInto(out *UpCloudVMSpec) {
 	*out = *in
+	if in.TemplateSelector != nil {
+		in, out := &in.TemplateSelector, &out.TemplateSelector
+		*out = new(TemplateSelector)
+		**out = **in
+	}
+	if in.SnapshotRef != nil {
+		in, out := &in.SnapshotRef, &out.SnapshotRef
+		*out = new(SnapshotReference)
+		**out = **in
+	}
+	if in.StorageDevices != nil {
+		in, out := &in.StorageDevices, &out.StorageDevices
+		*out = make([]StorageDevice, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.StorageRefs != nil {
+		in, out := &in.StorageRefs, &out.StorageRefs
+		*out = make([]StorageReference, len(*in))
+		copy(*out, *in)
+	}
 	if in.LoginUser != nil {
 		in, out := &in.LoginUser, &out.LoginUser
 		*out = new(request.LoginUser)
 		*in = DeepCopyInto(*out)
 	}
+	if in.CredentialsRef != nil {
+		in, out := &in.CredentialsRef, &out.CredentialsRef
+		*out = new(LocalCredentialsReference)
+		**out = **in
+	}
+	if in.ProviderConfigRef != nil {
+		in, out := &in.ProviderConfigRef, &out.ProviderConfigRef
+		*out = new(UpCloudProviderConfigReference)
+		**out = **in
+	}
+	if in.StopTimeout != nil {
+		in, out := &in.StopTimeout, &out.StopTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.BackupPolicy != nil {
+		in, out := &in.BackupPolicy, &out.BackupPolicy
+		*out = new(BackupPolicy)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // Manual add a DeepCopyInto method for "LoginUser" type
@@ -122,6 +708,54 @@ func (in *UpCloudVMSpec) DeepCopy() *UpCloudVMSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *UpCloudVMStatus) DeepCopyInto(out *UpCloudVMStatus) {
 	*out = *in
+	if in.IPAddresses != nil {
+		in, out := &in.IPAddresses, &out.IPAddresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.StorageDevices != nil {
+		in, out := &in.StorageDevices, &out.StorageDevices
+		*out = make([]StorageDeviceStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
+	if in.StopRequestedTime != nil {
+		in, out := &in.StopRequestedTime, &out.StopRequestedTime
+		*out = (*in).DeepCopy()
+	}
+	if in.HardStopRequestedTime != nil {
+		in, out := &in.HardStopRequestedTime, &out.HardStopRequestedTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastRestartTime != nil {
+		in, out := &in.LastRestartTime, &out.LastRestartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastBackupTime != nil {
+		in, out := &in.LastBackupTime, &out.LastBackupTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextBackupTime != nil {
+		in, out := &in.NextBackupTime, &out.NextBackupTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Backups != nil {
+		in, out := &in.Backups, &out.Backups
+		*out = make([]PolicyBackup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpCloudVMStatus.
@@ -20,6 +20,7 @@ import (
 	"crypto/tls"
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -36,7 +37,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	infrastructurev1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
 	"github.com/harper1011/vm-controller/internal/controller"
+	webhookinfrastructurev1alpha1 "github.com/harper1011/vm-controller/internal/webhook/v1alpha1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -58,6 +61,9 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var upCloudAPIURL string
+	var resyncInterval time.Duration
+	var vmDefaults webhookinfrastructurev1alpha1.UpCloudVMDefaults
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -69,6 +75,20 @@ func main() {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&upCloudAPIURL, "upcloud-api-url", "",
+		"Override the UpCloud API base URL, e.g. to use the test/upcloudsim simulator. Defaults to the public API.")
+	flag.DurationVar(&resyncInterval, "resync-interval", controller.DefaultResyncInterval,
+		"How often running VMs are read from UpCloud to refresh their status and detect drift.")
+	flag.StringVar(&vmDefaults.Zone, "default-zone", "",
+		"Zone of new UpCloudVMs that neither set one nor get one from their UpCloudProviderConfig.")
+	flag.StringVar(&vmDefaults.Plan, "default-plan", "",
+		"Plan of new UpCloudVMs that neither set one nor get one from their UpCloudProviderConfig.")
+	flag.StringVar(&vmDefaults.TimeZone, "default-timezone", "UTC",
+		"Time zone of new UpCloudVMs that do not set one.")
+	flag.IntVar(&vmDefaults.StorageSize, "default-storage-size", 25,
+		"Size in GB of the system disk of new UpCloudVMs that do not set one.")
+	flag.StringVar(&vmDefaults.StorageTier, "default-storage-tier", "maxiops",
+		"Storage tier of new UpCloudVMs that neither set one nor get one from their UpCloudProviderConfig.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -144,13 +164,64 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controller.UpCloudVMReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	// UpCloud clients are shared by the controllers and the webhook, and
+	// health-checked in the background
+	clients := cloud.NewPool()
+	if err := mgr.Add(clients); err != nil {
+		setupLog.Error(err, "unable to set up UpCloud client pool")
+		os.Exit(1)
+	}
+
+	vmReconciler := &controller.UpCloudVMReconciler{
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		APIBaseURL:     upCloudAPIURL,
+		Clients:        clients,
+		Recorder:       mgr.GetEventRecorderFor("upcloudvm-controller"),
+		ResyncInterval: resyncInterval,
+		Catalogs:       cloud.NewCatalogCache(),
+	}
+	if err = vmReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "UpCloudVM")
 		os.Exit(1)
 	}
+	if err = (&controller.UpCloudProviderConfigReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		APIBaseURL: upCloudAPIURL,
+		Clients:    clients,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UpCloudProviderConfig")
+		os.Exit(1)
+	}
+	if err = (&controller.UpCloudStorageReconciler{
+		Client:         mgr.GetClient(),
+		Scheme:         mgr.GetScheme(),
+		APIBaseURL:     upCloudAPIURL,
+		Clients:        clients,
+		Recorder:       mgr.GetEventRecorderFor("upcloudstorage-controller"),
+		ResyncInterval: resyncInterval,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UpCloudStorage")
+		os.Exit(1)
+	}
+	if err = (&controller.UpCloudVMSnapshotReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		APIBaseURL: upCloudAPIURL,
+		Clients:    clients,
+		Recorder:   mgr.GetEventRecorderFor("upcloudvmsnapshot-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UpCloudVMSnapshot")
+		os.Exit(1)
+	}
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = webhookinfrastructurev1alpha1.SetupUpCloudVMWebhookWithManager(mgr, vmDefaults, vmReconciler); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "UpCloudVM")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -0,0 +1,264 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+)
+
+// DefaultCatalogTTL is how long a CatalogCache keeps a catalog when no TTL
+// is configured.
+const DefaultCatalogTTL = time.Hour
+
+// CustomPlan sizes a server by its CPU and memory alone. It is valid in
+// every zone and not listed by GetPlans.
+const CustomPlan = "custom"
+
+// Catalog is what servers of an UpCloud account can be created from: the
+// zones, plans and template storages the API lists.
+type Catalog struct {
+	Zones     []upcloud.Zone
+	Plans     []upcloud.Plan
+	Templates []upcloud.Storage
+	// FetchedAt is when the catalog was read from UpCloud.
+	FetchedAt time.Time
+}
+
+// FetchCatalog reads the catalog of the account behind p.
+func FetchCatalog(ctx context.Context, p Provider) (*Catalog, error) {
+	zones, err := p.GetZones(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UpCloud zones: %w", err)
+	}
+	plans, err := p.GetPlans(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UpCloud plans: %w", err)
+	}
+	templates, err := p.GetStorages(ctx, &request.GetStoragesRequest{Type: upcloud.StorageTypeTemplate})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UpCloud templates: %w", err)
+	}
+	return &Catalog{
+		Zones:     zones.Zones,
+		Plans:     plans.Plans,
+		Templates: templates.Storages,
+		FetchedAt: time.Now(),
+	}, nil
+}
+
+// CheckZone returns an error listing the valid zones unless the account
+// offers the zone. An empty zone is not checked.
+func (c *Catalog) CheckZone(zone string) error {
+	if zone == "" {
+		return nil
+	}
+	ids := make([]string, 0, len(c.Zones))
+	for _, z := range c.Zones {
+		if z.ID == zone {
+			return nil
+		}
+		ids = append(ids, z.ID)
+	}
+	sort.Strings(ids)
+	return fmt.Errorf("zone %q does not exist, valid zones: %s", zone, strings.Join(ids, ", "))
+}
+
+// CheckPlan returns an error listing the valid plans unless the account
+// offers the plan. An empty plan is not checked.
+func (c *Catalog) CheckPlan(plan string) error {
+	if plan == "" || plan == CustomPlan {
+		return nil
+	}
+	names := make([]string, 0, len(c.Plans)+1)
+	for _, p := range c.Plans {
+		if p.Name == plan {
+			return nil
+		}
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	names = append(names, CustomPlan)
+	return fmt.Errorf("plan %q does not exist, valid plans: %s", plan, strings.Join(names, ", "))
+}
+
+// CheckTemplate returns an error listing the valid templates unless uuid
+// is a template storage of the account. An empty UUID is not checked.
+func (c *Catalog) CheckTemplate(uuid string) error {
+	if uuid == "" {
+		return nil
+	}
+	for _, t := range c.Templates {
+		if t.UUID == uuid {
+			return nil
+		}
+	}
+	return fmt.Errorf("template %q does not exist, valid templates: %s", uuid, c.templateChoices())
+}
+
+// templateChoices lists the templates of the catalog for error messages.
+func (c *Catalog) templateChoices() string {
+	choices := make([]string, 0, len(c.Templates))
+	for _, t := range c.Templates {
+		choices = append(choices, fmt.Sprintf("%s (%s)", t.UUID, t.Title))
+	}
+	sort.Strings(choices)
+	return strings.Join(choices, ", ")
+}
+
+// TemplateSelector picks a template by its title or OS. Exactly one of
+// Title, TitlePattern and OS is set; Version only applies to OS.
+type TemplateSelector struct {
+	Title        string
+	TitlePattern string
+	OS           string
+	Version      string
+}
+
+// String describes the selector for error messages.
+func (s TemplateSelector) String() string {
+	switch {
+	case s.Title != "":
+		return fmt.Sprintf("title %q", s.Title)
+	case s.TitlePattern != "":
+		return fmt.Sprintf("title pattern %q", s.TitlePattern)
+	case s.Version != "" && s.Version != "latest":
+		return fmt.Sprintf("OS %q version %q", s.OS, s.Version)
+	default:
+		return fmt.Sprintf("OS %q", s.OS)
+	}
+}
+
+// versionPattern finds the version in a template title, e.g. 24.04 in
+// "Ubuntu Server 24.04 LTS (Noble Numbat)".
+var versionPattern = regexp.MustCompile(`\b[0-9]+(?:\.[0-9]+)*\b`)
+
+// ResolveTemplate returns the template the selector picks. When several
+// templates match, the one with the highest version in its title wins.
+func (c *Catalog) ResolveTemplate(s TemplateSelector) (upcloud.Storage, error) {
+	var match func(title string) bool
+	switch {
+	case s.Title != "":
+		match = func(title string) bool { return title == s.Title }
+	case s.TitlePattern != "":
+		pattern, err := regexp.Compile(s.TitlePattern)
+		if err != nil {
+			return upcloud.Storage{}, fmt.Errorf("invalid title pattern: %w", err)
+		}
+		match = pattern.MatchString
+	case s.OS != "":
+		match = func(title string) bool {
+			rest, ok := cutPrefixFold(title, s.OS)
+			if !ok || (rest != "" && rest[0] != ' ') {
+				return false
+			}
+			if s.Version == "" || s.Version == "latest" {
+				return true
+			}
+			version := versionPattern.FindString(rest)
+			return version == s.Version || strings.HasPrefix(version, s.Version+".")
+		}
+	default:
+		return upcloud.Storage{}, errors.New("the template selector sets neither a title, a title pattern nor an OS")
+	}
+
+	var matches []upcloud.Storage
+	for _, t := range c.Templates {
+		if match(t.Title) {
+			matches = append(matches, t)
+		}
+	}
+	if len(matches) == 0 {
+		return upcloud.Storage{}, fmt.Errorf("no template matches %s, valid templates: %s", s, c.templateChoices())
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if cmp := compareVersions(versionPattern.FindString(matches[i].Title), versionPattern.FindString(matches[j].Title)); cmp != 0 {
+			return cmp > 0
+		}
+		return matches[i].UUID < matches[j].UUID
+	})
+	return matches[0], nil
+}
+
+// cutPrefixFold is strings.CutPrefix ignoring case.
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// compareVersions compares dotted versions numerically, a missing version
+// being the oldest.
+func compareVersions(a, b string) int {
+	if a == "" || b == "" {
+		return len(a) - len(b)
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x - y
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// CatalogCache caches the Catalog of each Provider, so validating a spec
+// costs no API calls until the catalog expires.
+//
+// A nil CatalogCache fetches the catalog on every Get.
+type CatalogCache struct {
+	// TTL is how long a catalog is kept. Defaults to DefaultCatalogTTL.
+	TTL time.Duration
+
+	mu       sync.Mutex
+	catalogs map[Provider]*Catalog
+}
+
+// NewCatalogCache returns an empty CatalogCache.
+func NewCatalogCache() *CatalogCache {
+	return &CatalogCache{catalogs: map[Provider]*Catalog{}}
+}
+
+// Get returns the cached catalog of p, fetching it when it is missing or
+// has expired. Expired catalogs of other providers are dropped.
+func (c *CatalogCache) Get(ctx context.Context, p Provider) (*Catalog, error) {
+	if c == nil {
+		return FetchCatalog(ctx, p)
+	}
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultCatalogTTL
+	}
+
+	c.mu.Lock()
+	for key, catalog := range c.catalogs {
+		if time.Since(catalog.FetchedAt) > ttl {
+			delete(c.catalogs, key)
+		}
+	}
+	catalog, ok := c.catalogs[p]
+	c.mu.Unlock()
+	if ok {
+		return catalog, nil
+	}
+
+	catalog, err := FetchCatalog(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.catalogs[p] = catalog
+	c.mu.Unlock()
+	return catalog, nil
+}
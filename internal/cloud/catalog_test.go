@@ -0,0 +1,120 @@
+package cloud
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+
+	"github.com/harper1011/vm-controller/test/upcloudsim"
+)
+
+func TestCatalogCache(t *testing.T) {
+	sim := upcloudsim.New(upcloudsim.Options{})
+	defer sim.Close()
+	ctx := context.Background()
+	svc := NewProvider(Credentials{Username: upcloudsim.DefaultUsername, Password: upcloudsim.DefaultPassword},
+		ClientSettings{BaseURL: sim.URL}.options()...)
+	cache := NewCatalogCache()
+
+	catalog, err := cache.Get(ctx, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Zones) != len(upcloudsim.Zones) || len(catalog.Plans) != len(upcloudsim.Plans) ||
+		len(catalog.Templates) != len(upcloudsim.Templates) {
+		t.Fatalf("unexpected catalog %+v", catalog)
+	}
+	if _, err := cache.Get(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Requests("GET /plan"); got != 1 {
+		t.Errorf("expected the catalog to be fetched once, got %d fetches", got)
+	}
+
+	cache.TTL = time.Nanosecond
+	if _, err := cache.Get(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Requests("GET /plan"); got != 2 {
+		t.Errorf("expected an expired catalog to be fetched again, got %d fetches", got)
+	}
+}
+
+func TestCatalogChecks(t *testing.T) {
+	sim := upcloudsim.New(upcloudsim.Options{})
+	defer sim.Close()
+	svc := NewProvider(Credentials{Username: upcloudsim.DefaultUsername, Password: upcloudsim.DefaultPassword},
+		ClientSettings{BaseURL: sim.URL}.options()...)
+	catalog, err := FetchCatalog(context.Background(), svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, err := range []error{
+		catalog.CheckZone(""), catalog.CheckZone("fi-hel1"),
+		catalog.CheckPlan(""), catalog.CheckPlan("1xCPU-1GB"), catalog.CheckPlan(CustomPlan),
+		catalog.CheckTemplate(""), catalog.CheckTemplate("01000000-0000-4000-8000-000030220200"),
+	} {
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+
+	if err := catalog.CheckZone("xx-abc1"); err == nil || !strings.Contains(err.Error(), "valid zones: de-fra1, fi-hel1") {
+		t.Errorf("expected the valid zones to be listed, got %v", err)
+	}
+	if err := catalog.CheckPlan("3xCPU-3GB"); err == nil || !strings.Contains(err.Error(), "1xCPU-1GB") ||
+		!strings.HasSuffix(err.Error(), CustomPlan) {
+		t.Errorf("expected the valid plans to be listed, got %v", err)
+	}
+	if err := catalog.CheckTemplate("01000000-0000-4000-8000-000000000000"); err == nil ||
+		!strings.Contains(err.Error(), "01000000-0000-4000-8000-000020070100 (Debian GNU/Linux 12 (Bookworm))") {
+		t.Errorf("expected the valid templates to be listed, got %v", err)
+	}
+}
+
+func TestResolveTemplate(t *testing.T) {
+	catalog := &Catalog{Templates: []upcloud.Storage{
+		{UUID: "01000000-0000-4000-8000-000020060100", Title: "Debian GNU/Linux 11 (Bullseye)"},
+		{UUID: "01000000-0000-4000-8000-000020070100", Title: "Debian GNU/Linux 12 (Bookworm)"},
+		{UUID: "01000000-0000-4000-8000-000030200200", Title: "Ubuntu Server 20.04 LTS (Focal Fossa)"},
+		{UUID: "01000000-0000-4000-8000-000030220200", Title: "Ubuntu Server 22.04 LTS (Jammy Jellyfish)"},
+		{UUID: "01000000-0000-4000-8000-000030240200", Title: "Ubuntu Server 24.04 LTS (Noble Numbat)"},
+	}}
+
+	for _, tc := range []struct {
+		selector TemplateSelector
+		want     string
+	}{
+		{TemplateSelector{Title: "Debian GNU/Linux 11 (Bullseye)"}, "01000000-0000-4000-8000-000020060100"},
+		{TemplateSelector{TitlePattern: `^Ubuntu Server 2[02]\.`}, "01000000-0000-4000-8000-000030220200"},
+		{TemplateSelector{OS: "ubuntu"}, "01000000-0000-4000-8000-000030240200"},
+		{TemplateSelector{OS: "Ubuntu", Version: "latest"}, "01000000-0000-4000-8000-000030240200"},
+		{TemplateSelector{OS: "Ubuntu", Version: "20.04"}, "01000000-0000-4000-8000-000030200200"},
+		{TemplateSelector{OS: "Debian", Version: "11"}, "01000000-0000-4000-8000-000020060100"},
+	} {
+		template, err := catalog.ResolveTemplate(tc.selector)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.selector, err)
+		} else if template.UUID != tc.want {
+			t.Errorf("%s: expected %s, got %s (%s)", tc.selector, tc.want, template.UUID, template.Title)
+		}
+	}
+
+	for _, selector := range []TemplateSelector{
+		{Title: "Ubuntu Server 24.04"},
+		{TitlePattern: "^CentOS"},
+		{OS: "Ubuntu", Version: "18.04"},
+		{OS: "Deb"},
+	} {
+		if _, err := catalog.ResolveTemplate(selector); err == nil || !strings.Contains(err.Error(), "valid templates: ") {
+			t.Errorf("%s: expected the valid templates to be listed, got %v", selector, err)
+		}
+	}
+	if _, err := catalog.ResolveTemplate(TemplateSelector{TitlePattern: "("}); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
@@ -0,0 +1,59 @@
+package cloud
+
+import (
+	"errors"
+	"net/http"
+
+	upCloudClient "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/service"
+)
+
+// Credentials authenticate against the UpCloud API, either with an API
+// user's username and password or with an API token.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Validate reports whether exactly one way of authenticating is configured.
+func (c Credentials) Validate() error {
+	switch {
+	case c.Token != "" && (c.Username != "" || c.Password != ""):
+		return errors.New("either a token or a username and password must be specified, not both")
+	case c.Token != "":
+		return nil
+	case c.Username == "":
+		return errors.New("Username must be specified")
+	case c.Password == "":
+		return errors.New("Password must be specified")
+	}
+	return nil
+}
+
+// NewProvider returns a Provider backed by the UpCloud Go SDK that
+// authenticates with the given credentials.
+func NewProvider(creds Credentials, opts ...upCloudClient.ConfigFn) Provider {
+	if creds.Token == "" {
+		return NewUpCloudProvider(creds.Username, creds.Password, opts...)
+	}
+	// The SDK only speaks basic auth, so swap in the token on the way out.
+	// The HTTP client goes first so options like WithTimeout still apply to it.
+	httpClient := upCloudClient.NewDefaultHTTPClient()
+	httpClient.Transport = &bearerTransport{token: creds.Token, next: httpClient.Transport}
+	opts = append([]upCloudClient.ConfigFn{upCloudClient.WithHTTPClient(httpClient)}, opts...)
+	return service.New(upCloudClient.New("", "", opts...))
+}
+
+// bearerTransport replaces the Authorization header of each request with
+// an API token.
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,44 @@
+package cloud
+
+import (
+	"context"
+	"testing"
+
+	upCloudClient "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
+
+	"github.com/harper1011/vm-controller/test/upcloudsim"
+)
+
+func TestCredentialsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		creds Credentials
+		valid bool
+	}{
+		{"username and password", Credentials{Username: "u", Password: "p"}, true},
+		{"token", Credentials{Token: "t"}, true},
+		{"empty", Credentials{}, false},
+		{"missing password", Credentials{Username: "u"}, false},
+		{"token and password", Credentials{Username: "u", Password: "p", Token: "t"}, false},
+	} {
+		if err := tc.creds.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: Validate() = %v, want valid=%v", tc.name, err, tc.valid)
+		}
+	}
+}
+
+func TestNewProviderWithToken(t *testing.T) {
+	sim := upcloudsim.New(upcloudsim.Options{Token: "secret-token"})
+	defer sim.Close()
+	ctx := context.Background()
+
+	svc := NewProvider(Credentials{Token: "secret-token"}, upCloudClient.WithBaseURL(sim.URL))
+	if _, err := svc.GetAccount(ctx); err != nil {
+		t.Fatalf("token authentication failed: %v", err)
+	}
+
+	svc = NewProvider(Credentials{Token: "wrong"}, upCloudClient.WithBaseURL(sim.URL))
+	if _, err := svc.GetAccount(ctx); err == nil {
+		t.Fatal("expected a wrong token to be rejected")
+	}
+}
@@ -0,0 +1,848 @@
+// Package fake provides an in-memory cloud.Provider for tests.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// Zones are the zones every fake provider offers.
+var Zones = []upcloud.Zone{
+	{ID: "de-fra1", Description: "Frankfurt #1", Public: upcloud.True},
+	{ID: "fi-hel1", Description: "Helsinki #1", Public: upcloud.True},
+	{ID: "nl-ams1", Description: "Amsterdam #1", Public: upcloud.True},
+}
+
+// Plans are the plans every fake provider offers.
+var Plans = []upcloud.Plan{
+	{Name: "1xCPU-1GB", CoreNumber: 1, MemoryAmount: 1024, StorageSize: 25, StorageTier: "maxiops"},
+	{Name: "1xCPU-2GB", CoreNumber: 1, MemoryAmount: 2048, StorageSize: 50, StorageTier: "maxiops"},
+	{Name: "2xCPU-4GB", CoreNumber: 2, MemoryAmount: 4096, StorageSize: 80, StorageTier: "maxiops"},
+	{Name: "4xCPU-8GB", CoreNumber: 4, MemoryAmount: 8192, StorageSize: 160, StorageTier: "maxiops"},
+}
+
+// Templates are the public template storages every fake provider offers,
+// keyed by UUID.
+var Templates = map[string]string{
+	"01000000-0000-4000-8000-000030220200": "Ubuntu Server 22.04 LTS (Jammy Jellyfish)",
+	"01000000-0000-4000-8000-000030240200": "Ubuntu Server 24.04 LTS (Noble Numbat)",
+	"01000000-0000-4000-8000-000020070100": "Debian GNU/Linux 12 (Bookworm)",
+}
+
+// Provider is an in-memory cloud.Provider. Servers change state instantly:
+// a created or started server is immediately "started", a stopped one
+// immediately "stopped". Like UpCloud, it only changes the plan, CPU,
+// memory and disk sizes of stopped servers, unless ResizeOnline lets disks
+// grow on running ones. Storages are online right away.
+type Provider struct {
+	mu       sync.Mutex
+	next     int
+	account  upcloud.Account
+	servers  map[string]*upcloud.ServerDetails
+	storages map[string]*upcloud.StorageDetails
+	failures map[string]error
+	calls    map[string]int
+	// ignoreSoftStop leaves servers running on soft stops
+	ignoreSoftStop bool
+	// resizeOnline lets disks of running servers grow
+	resizeOnline bool
+}
+
+var _ cloud.Provider = (*Provider)(nil)
+
+// NewProvider returns a fake provider without servers, offering Zones,
+// Plans and Templates.
+func NewProvider() *Provider {
+	p := &Provider{
+		account:  upcloud.Account{UserName: "fake", Credits: 1000},
+		servers:  map[string]*upcloud.ServerDetails{},
+		storages: map[string]*upcloud.StorageDetails{},
+		failures: map[string]error{},
+		calls:    map[string]int{},
+	}
+	for uuid, title := range Templates {
+		p.storages[uuid] = &upcloud.StorageDetails{Storage: upcloud.Storage{
+			UUID:         uuid,
+			Title:        title,
+			Access:       upcloud.StorageAccessPublic,
+			Type:         upcloud.StorageTypeTemplate,
+			TemplateType: upcloud.StorageTemplateTypeCloudInit,
+			State:        upcloud.StorageStateOnline,
+			Size:         4,
+		}}
+	}
+	return p
+}
+
+// FailNext makes the next call to the named method (e.g. "CreateServer")
+// return err.
+func (p *Provider) FailNext(method string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[method] = err
+}
+
+// Calls returns how many times the named method has been called.
+func (p *Provider) Calls(method string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[method]
+}
+
+// Server returns a copy of the server with the given UUID, if it exists.
+func (p *Provider) Server(uuid string) (upcloud.ServerDetails, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.servers[uuid]
+	if !ok {
+		return upcloud.ServerDetails{}, false
+	}
+	return *s, true
+}
+
+// Servers returns the number of servers currently known to the fake.
+func (p *Provider) Servers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.servers)
+}
+
+// SetServerState forces a server into the given state, simulating a change
+// made outside the controller.
+func (p *Provider) SetServerState(uuid, state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.servers[uuid]; ok {
+		s.State = state
+	}
+}
+
+// SetStorageState forces a storage into the given state, e.g. maintenance
+// while UpCloud restores a backup onto it.
+func (p *Provider) SetStorageState(uuid, state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if st, ok := p.storages[uuid]; ok {
+		st.State = state
+	}
+}
+
+// IgnoreSoftStop makes soft stops leave servers running, like a guest that
+// does not react to the ACPI shutdown. Hard stops still work.
+func (p *Provider) IgnoreSoftStop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ignoreSoftStop = true
+}
+
+// ResizeOnline lets disks of running servers grow, as UpCloud does for
+// some storages.
+func (p *Provider) ResizeOnline() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resizeOnline = true
+}
+
+// RemoveServer deletes a server behind the controller's back.
+func (p *Provider) RemoveServer(uuid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.servers, uuid)
+}
+
+// NotFound returns the Problem the UpCloud API reports for a missing resource.
+func NotFound(code, title string) *upcloud.Problem {
+	return &upcloud.Problem{
+		Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + code,
+		Title:  title,
+		Status: http.StatusNotFound,
+	}
+}
+
+// enter records a call and returns an injected failure, if any. The caller
+// must hold p.mu.
+func (p *Provider) enter(method string) error {
+	p.calls[method]++
+	if err, ok := p.failures[method]; ok {
+		delete(p.failures, method)
+		return err
+	}
+	return nil
+}
+
+func (p *Provider) uuid(prefix byte) string {
+	p.next++
+	return fmt.Sprintf("%02x%06x-0000-4000-8000-%012x", prefix, p.next, p.next)
+}
+
+func (p *Provider) server(uuid string) (*upcloud.ServerDetails, error) {
+	s, ok := p.servers[uuid]
+	if !ok {
+		return nil, NotFound(upcloud.ErrCodeServerNotFound, fmt.Sprintf("Server %s not found", uuid))
+	}
+	return s, nil
+}
+
+// deletableServer returns the server if it is stopped, as UpCloud refuses
+// to delete running servers.
+func (p *Provider) deletableServer(uuid string) (*upcloud.ServerDetails, error) {
+	s, err := p.server(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if s.State != upcloud.ServerStateStopped {
+		return nil, &upcloud.Problem{
+			Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + upcloud.ErrCodeServerStateIllegal,
+			Title:  fmt.Sprintf("Server %s must be stopped before it can be deleted", uuid),
+			Status: http.StatusBadRequest,
+		}
+	}
+	return s, nil
+}
+
+func copyServer(s *upcloud.ServerDetails) *upcloud.ServerDetails {
+	c := *s
+	c.Labels = append(upcloud.LabelSlice(nil), s.Labels...)
+	c.IPAddresses = append(upcloud.IPAddressSlice(nil), s.IPAddresses...)
+	c.StorageDevices = append(upcloud.ServerStorageDeviceSlice(nil), s.StorageDevices...)
+	return &c
+}
+
+// GetAccount implements cloud.Provider.
+func (p *Provider) GetAccount(_ context.Context) (*upcloud.Account, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("GetAccount"); err != nil {
+		return nil, err
+	}
+	a := p.account
+	return &a, nil
+}
+
+// GetServersWithFilters implements cloud.Provider. Only label filters are
+// supported.
+func (p *Provider) GetServersWithFilters(_ context.Context, r *request.GetServersWithFiltersRequest) (*upcloud.Servers, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("GetServersWithFilters"); err != nil {
+		return nil, err
+	}
+	servers := &upcloud.Servers{}
+	for _, s := range p.servers {
+		if matchesFilters(s.Labels, r.Filters) {
+			servers.Servers = append(servers.Servers, s.Server)
+		}
+	}
+	sort.Slice(servers.Servers, func(i, j int) bool {
+		return servers.Servers[i].UUID < servers.Servers[j].UUID
+	})
+	return servers, nil
+}
+
+func matchesFilters(labels upcloud.LabelSlice, filters []request.QueryFilter) bool {
+	for _, f := range filters {
+		found := false
+		for _, l := range labels {
+			switch f := f.(type) {
+			case request.FilterLabel:
+				found = found || (l.Key == f.Key && l.Value == f.Value)
+			case request.FilterLabelKey:
+				found = found || l.Key == f.Key
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// GetServerDetails implements cloud.Provider.
+func (p *Provider) GetServerDetails(_ context.Context, r *request.GetServerDetailsRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("GetServerDetails"); err != nil {
+		return nil, err
+	}
+	s, err := p.server(r.UUID)
+	if err != nil {
+		return nil, err
+	}
+	return copyServer(s), nil
+}
+
+// CreateServer implements cloud.Provider.
+func (p *Provider) CreateServer(_ context.Context, r *request.CreateServerRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("CreateServer"); err != nil {
+		return nil, err
+	}
+	s := &upcloud.ServerDetails{
+		Server: upcloud.Server{
+			UUID:         p.uuid(0x00),
+			Title:        r.Title,
+			Hostname:     r.Hostname,
+			Plan:         r.Plan,
+			Zone:         r.Zone,
+			CoreNumber:   r.CoreNumber,
+			MemoryAmount: r.MemoryAmount,
+			State:        upcloud.ServerStateStarted,
+		},
+		Timezone: r.TimeZone,
+	}
+	if r.Labels != nil {
+		s.Labels = append(s.Labels, *r.Labels...)
+	}
+	s.IPAddresses = upcloud.IPAddressSlice{{
+		Access:  upcloud.IPAddressAccessUtility,
+		Address: fmt.Sprintf("10.0.%d.%d", p.next/256, p.next%256),
+		Family:  upcloud.IPAddressFamilyIPv4,
+	}}
+	for _, d := range r.StorageDevices {
+		var st *upcloud.StorageDetails
+		if d.Action == request.CreateServerStorageDeviceActionAttach {
+			var ok bool
+			if st, ok = p.storages[d.Storage]; !ok {
+				return nil, NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", d.Storage))
+			}
+		} else {
+			st = p.newStorage(r.Zone, d.Title, d.Tier, d.Size, d.Encrypted, d.BackupRule)
+			if d.Action == request.CreateServerStorageDeviceActionClone {
+				// Record the template the disk was cloned from
+				st.Origin = d.Storage
+			}
+		}
+		st.ServerUUIDs = upcloud.ServerUUIDSlice{s.UUID}
+		attachDevice(s, st, d.Address)
+	}
+	p.servers[s.UUID] = s
+	return copyServer(s), nil
+}
+
+// newStorage registers an online normal storage. The caller must hold p.mu.
+func (p *Provider) newStorage(zone, title, tier string, size int, encrypted upcloud.Boolean, rule *upcloud.BackupRule) *upcloud.StorageDetails {
+	if tier == "" {
+		tier = upcloud.StorageTierMaxIOPS
+	}
+	st := &upcloud.StorageDetails{
+		Storage: upcloud.Storage{
+			UUID:      p.uuid(0x01),
+			Title:     title,
+			Access:    upcloud.StorageAccessPrivate,
+			Size:      size,
+			Tier:      tier,
+			Type:      upcloud.StorageTypeNormal,
+			State:     upcloud.StorageStateOnline,
+			Zone:      zone,
+			Encrypted: encrypted,
+		},
+		BackupRule: rule,
+	}
+	p.storages[st.UUID] = st
+	return st
+}
+
+// attachDevice adds st to the server at address, or at the next free
+// address of its bus when address names none.
+func attachDevice(s *upcloud.ServerDetails, st *upcloud.StorageDetails, address string) {
+	if address == "" {
+		address = "virtio"
+	}
+	if !strings.Contains(address, ":") {
+		used := map[string]bool{}
+		for _, d := range s.StorageDevices {
+			used[d.Address] = true
+		}
+		bus := address
+		for i := 0; ; i++ {
+			if address = fmt.Sprintf("%s:%d", bus, i); !used[address] {
+				break
+			}
+		}
+	}
+	s.StorageDevices = append(s.StorageDevices, upcloud.ServerStorageDevice{
+		Address:   address,
+		UUID:      st.UUID,
+		Size:      st.Size,
+		Tier:      st.Tier,
+		Title:     st.Title,
+		Encrypted: st.Encrypted,
+		Type:      upcloud.StorageTypeDisk,
+	})
+}
+
+// AddStorage creates a detached disk, as if made in the UpCloud console,
+// and returns its UUID.
+func (p *Provider) AddStorage(zone, title string, size int) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.newStorage(zone, title, "", size, upcloud.False, nil).UUID
+}
+
+// ModifyServer implements cloud.Provider.
+func (p *Provider) ModifyServer(_ context.Context, r *request.ModifyServerRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("ModifyServer"); err != nil {
+		return nil, err
+	}
+	s, err := p.server(r.UUID)
+	if err != nil {
+		return nil, err
+	}
+	resize := (r.Plan != "" && r.Plan != s.Plan) ||
+		(r.CoreNumber != 0 && r.CoreNumber != s.CoreNumber) ||
+		(r.MemoryAmount != 0 && r.MemoryAmount != s.MemoryAmount)
+	if resize && s.State != upcloud.ServerStateStopped {
+		return nil, &upcloud.Problem{
+			Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + upcloud.ErrCodeServerStateIllegal,
+			Title:  fmt.Sprintf("Server %s must be stopped before its plan, CPU or memory can be changed", r.UUID),
+			Status: http.StatusConflict,
+		}
+	}
+	if r.Title != "" {
+		s.Title = r.Title
+	}
+	if r.Plan != "" {
+		s.Plan = r.Plan
+	}
+	if r.CoreNumber != 0 {
+		s.CoreNumber = r.CoreNumber
+	}
+	if r.MemoryAmount != 0 {
+		s.MemoryAmount = r.MemoryAmount
+	}
+	if r.TimeZone != "" {
+		s.Timezone = r.TimeZone
+	}
+	if r.Labels != nil {
+		s.Labels = append(upcloud.LabelSlice(nil), *r.Labels...)
+	}
+	return copyServer(s), nil
+}
+
+// StartServer implements cloud.Provider.
+func (p *Provider) StartServer(_ context.Context, r *request.StartServerRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("StartServer"); err != nil {
+		return nil, err
+	}
+	s, err := p.server(r.UUID)
+	if err != nil {
+		return nil, err
+	}
+	s.State = upcloud.ServerStateStarted
+	return copyServer(s), nil
+}
+
+// StopServer implements cloud.Provider.
+func (p *Provider) StopServer(_ context.Context, r *request.StopServerRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("StopServer"); err != nil {
+		return nil, err
+	}
+	s, err := p.server(r.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if r.StopType != request.ServerStopTypeHard && p.ignoreSoftStop {
+		return copyServer(s), nil
+	}
+	s.State = upcloud.ServerStateStopped
+	return copyServer(s), nil
+}
+
+// RestartServer implements cloud.Provider. Like UpCloud, it only restarts
+// started servers, which are started again right away.
+func (p *Provider) RestartServer(_ context.Context, r *request.RestartServerRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("RestartServer"); err != nil {
+		return nil, err
+	}
+	s, err := p.server(r.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if s.State != upcloud.ServerStateStarted {
+		return nil, &upcloud.Problem{
+			Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + upcloud.ErrCodeServerStateIllegal,
+			Title:  fmt.Sprintf("Server %s must be started before it can be restarted", r.UUID),
+			Status: http.StatusBadRequest,
+		}
+	}
+	return copyServer(s), nil
+}
+
+// WaitForServerState implements cloud.Provider. Because state changes are
+// instant, it fails rather than blocks when the server is not in the
+// requested state.
+func (p *Provider) WaitForServerState(_ context.Context, r *request.WaitForServerStateRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("WaitForServerState"); err != nil {
+		return nil, err
+	}
+	s, err := p.server(r.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if r.DesiredState != "" && s.State != r.DesiredState {
+		return nil, fmt.Errorf("server %s is %s, not %s", r.UUID, s.State, r.DesiredState)
+	}
+	if r.UndesiredState != "" && s.State == r.UndesiredState {
+		return nil, fmt.Errorf("server %s is still %s", r.UUID, s.State)
+	}
+	return copyServer(s), nil
+}
+
+// DeleteServer implements cloud.Provider.
+func (p *Provider) DeleteServer(_ context.Context, r *request.DeleteServerRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("DeleteServer"); err != nil {
+		return err
+	}
+	s, err := p.deletableServer(r.UUID)
+	if err != nil {
+		return err
+	}
+	for _, d := range s.StorageDevices {
+		if st, ok := p.storages[d.UUID]; ok {
+			st.ServerUUIDs = nil
+		}
+	}
+	delete(p.servers, r.UUID)
+	return nil
+}
+
+// DeleteServerAndStorages implements cloud.Provider.
+func (p *Provider) DeleteServerAndStorages(_ context.Context, r *request.DeleteServerAndStoragesRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("DeleteServerAndStorages"); err != nil {
+		return err
+	}
+	s, err := p.deletableServer(r.UUID)
+	if err != nil {
+		return err
+	}
+	for _, d := range s.StorageDevices {
+		delete(p.storages, d.UUID)
+	}
+	delete(p.servers, r.UUID)
+	return nil
+}
+
+// GetZones implements cloud.Provider.
+func (p *Provider) GetZones(_ context.Context) (*upcloud.Zones, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("GetZones"); err != nil {
+		return nil, err
+	}
+	return &upcloud.Zones{Zones: append([]upcloud.Zone(nil), Zones...)}, nil
+}
+
+// GetPlans implements cloud.Provider.
+func (p *Provider) GetPlans(_ context.Context) (*upcloud.Plans, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("GetPlans"); err != nil {
+		return nil, err
+	}
+	return &upcloud.Plans{Plans: append([]upcloud.Plan(nil), Plans...)}, nil
+}
+
+// GetStorages implements cloud.Provider. It honours the Access, Type and
+// label filters of the request, sorted by UUID.
+func (p *Provider) GetStorages(_ context.Context, r *request.GetStoragesRequest) (*upcloud.Storages, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("GetStorages"); err != nil {
+		return nil, err
+	}
+	result := &upcloud.Storages{}
+	for _, st := range p.storages {
+		if (r.Access != "" && st.Access != r.Access) || (r.Type != "" && st.Type != r.Type) {
+			continue
+		}
+		if !matchesFilters(st.Labels, r.Filters) {
+			continue
+		}
+		result.Storages = append(result.Storages, st.Storage)
+	}
+	sort.Slice(result.Storages, func(i, j int) bool { return result.Storages[i].UUID < result.Storages[j].UUID })
+	return result, nil
+}
+
+// GetStorageDetails implements cloud.Provider.
+func (p *Provider) GetStorageDetails(_ context.Context, r *request.GetStorageDetailsRequest) (*upcloud.StorageDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("GetStorageDetails"); err != nil {
+		return nil, err
+	}
+	st, ok := p.storages[r.UUID]
+	if !ok {
+		return nil, NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", r.UUID))
+	}
+	c := *st
+	return &c, nil
+}
+
+// CreateStorage implements cloud.Provider.
+func (p *Provider) CreateStorage(_ context.Context, r *request.CreateStorageRequest) (*upcloud.StorageDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("CreateStorage"); err != nil {
+		return nil, err
+	}
+	st := p.newStorage(r.Zone, r.Title, r.Tier, r.Size, r.Encrypted, r.BackupRule)
+	st.Labels = append([]upcloud.Label(nil), r.Labels...)
+	c := *st
+	return &c, nil
+}
+
+// CloneStorage implements cloud.Provider. The clone is online right away.
+func (p *Provider) CloneStorage(_ context.Context, r *request.CloneStorageRequest) (*upcloud.StorageDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("CloneStorage"); err != nil {
+		return nil, err
+	}
+	src, ok := p.storages[r.UUID]
+	if !ok {
+		return nil, NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", r.UUID))
+	}
+	tier := r.Tier
+	if tier == "" {
+		tier = src.Tier
+	}
+	st := p.newStorage(r.Zone, r.Title, tier, src.Size, r.Encrypted, nil)
+	st.Origin = src.UUID
+	c := *st
+	return &c, nil
+}
+
+// ModifyStorage implements cloud.Provider. Like UpCloud, it refuses to
+// shrink a disk or, unless ResizeOnline was called, resize one of a
+// running server. The size of the server's device follows the storage.
+func (p *Provider) ModifyStorage(_ context.Context, r *request.ModifyStorageRequest) (*upcloud.StorageDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("ModifyStorage"); err != nil {
+		return nil, err
+	}
+	st, ok := p.storages[r.UUID]
+	if !ok {
+		return nil, NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", r.UUID))
+	}
+	if r.Size != 0 && r.Size < st.Size {
+		return nil, &upcloud.Problem{
+			Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + upcloud.ErrCodeStorageInvalid,
+			Title:  fmt.Sprintf("Storage %s cannot shrink from %d GB to %d GB", r.UUID, st.Size, r.Size),
+			Status: http.StatusBadRequest,
+		}
+	}
+	if r.Size != 0 && r.Size != st.Size && !p.resizeOnline {
+		if err := p.requireStopped(st); err != nil {
+			return nil, err
+		}
+	}
+	if r.Title != "" {
+		st.Title = r.Title
+	}
+	if r.Size != 0 {
+		st.Size = r.Size
+	}
+	if r.BackupRule != nil {
+		st.BackupRule = r.BackupRule
+	}
+	if r.Labels != nil {
+		st.Labels = append([]upcloud.Label(nil), (*r.Labels)...)
+	}
+	for _, uuid := range st.ServerUUIDs {
+		if s, ok := p.servers[uuid]; ok {
+			for i := range s.StorageDevices {
+				if s.StorageDevices[i].UUID == st.UUID {
+					s.StorageDevices[i].Size = st.Size
+					s.StorageDevices[i].Title = st.Title
+				}
+			}
+		}
+	}
+	c := *st
+	return &c, nil
+}
+
+// requireStopped returns the error UpCloud gives for changing a storage
+// attached to a server that is not stopped.
+func (p *Provider) requireStopped(st *upcloud.StorageDetails) error {
+	for _, uuid := range st.ServerUUIDs {
+		if s, ok := p.servers[uuid]; ok && s.State != upcloud.ServerStateStopped {
+			return &upcloud.Problem{
+				Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + upcloud.ErrCodeServerStateIllegal,
+				Title:  fmt.Sprintf("Server %s must be stopped to change storage %s", uuid, st.UUID),
+				Status: http.StatusBadRequest,
+			}
+		}
+	}
+	return nil
+}
+
+// ResizeStorageFilesystem implements cloud.Provider. Like UpCloud, it
+// only resizes storages of stopped servers and returns a backup of the
+// storage as it was.
+func (p *Provider) ResizeStorageFilesystem(_ context.Context, r *request.ResizeStorageFilesystemRequest) (*upcloud.ResizeStorageFilesystemBackup, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("ResizeStorageFilesystem"); err != nil {
+		return nil, err
+	}
+	st, ok := p.storages[r.UUID]
+	if !ok {
+		return nil, NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", r.UUID))
+	}
+	if err := p.requireStopped(st); err != nil {
+		return nil, err
+	}
+	backup := p.newStorage(st.Zone, st.Title+" (resize backup)", st.Tier, st.Size, st.Encrypted, nil)
+	backup.Type = upcloud.StorageTypeBackup
+	backup.Origin = st.UUID
+	return &upcloud.ResizeStorageFilesystemBackup{
+		Access: backup.Access,
+		Origin: backup.Origin,
+		Size:   backup.Size,
+		State:  backup.State,
+		Title:  backup.Title,
+		Type:   backup.Type,
+		UUID:   backup.UUID,
+		Zone:   backup.Zone,
+	}, nil
+}
+
+// DeleteStorage implements cloud.Provider. Like UpCloud, it refuses to
+// delete an attached storage.
+func (p *Provider) DeleteStorage(_ context.Context, r *request.DeleteStorageRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("DeleteStorage"); err != nil {
+		return err
+	}
+	st, ok := p.storages[r.UUID]
+	if !ok {
+		return NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", r.UUID))
+	}
+	if len(st.ServerUUIDs) > 0 {
+		return &upcloud.Problem{
+			Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + upcloud.ErrCodeStorageAttached,
+			Title:  fmt.Sprintf("Storage %s is attached to a server", st.UUID),
+			Status: http.StatusConflict,
+		}
+	}
+	delete(p.storages, r.UUID)
+	return nil
+}
+
+// CreateBackup implements cloud.Provider. The backup is online right away.
+func (p *Provider) CreateBackup(_ context.Context, r *request.CreateBackupRequest) (*upcloud.StorageDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("CreateBackup"); err != nil {
+		return nil, err
+	}
+	st, ok := p.storages[r.UUID]
+	if !ok {
+		return nil, NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", r.UUID))
+	}
+	backup := p.newStorage(st.Zone, r.Title, st.Tier, st.Size, st.Encrypted, nil)
+	backup.Type = upcloud.StorageTypeBackup
+	backup.Origin = st.UUID
+	backup.Created = time.Now().UTC()
+	c := *backup
+	return &c, nil
+}
+
+// RestoreBackup implements cloud.Provider. Like UpCloud, it only restores
+// storages of stopped servers.
+func (p *Provider) RestoreBackup(_ context.Context, r *request.RestoreBackupRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("RestoreBackup"); err != nil {
+		return err
+	}
+	backup, ok := p.storages[r.UUID]
+	if !ok || backup.Type != upcloud.StorageTypeBackup {
+		return NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Backup %s not found", r.UUID))
+	}
+	st, ok := p.storages[backup.Origin]
+	if !ok {
+		return NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", backup.Origin))
+	}
+	return p.requireStopped(st)
+}
+
+// AttachStorage implements cloud.Provider.
+func (p *Provider) AttachStorage(_ context.Context, r *request.AttachStorageRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("AttachStorage"); err != nil {
+		return nil, err
+	}
+	s, err := p.server(r.ServerUUID)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := p.storages[r.StorageUUID]
+	if !ok {
+		return nil, NotFound(upcloud.ErrCodeStorageNotFound, fmt.Sprintf("Storage %s not found", r.StorageUUID))
+	}
+	if len(st.ServerUUIDs) > 0 {
+		return nil, &upcloud.Problem{
+			Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + upcloud.ErrCodeStorageAttached,
+			Title:  fmt.Sprintf("Storage %s is already attached", st.UUID),
+			Status: http.StatusConflict,
+		}
+	}
+	st.ServerUUIDs = upcloud.ServerUUIDSlice{s.UUID}
+	attachDevice(s, st, r.Address)
+	return copyServer(s), nil
+}
+
+// DetachStorage implements cloud.Provider.
+func (p *Provider) DetachStorage(_ context.Context, r *request.DetachStorageRequest) (*upcloud.ServerDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.enter("DetachStorage"); err != nil {
+		return nil, err
+	}
+	s, err := p.server(r.ServerUUID)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range s.StorageDevices {
+		if d.Address != r.Address {
+			continue
+		}
+		if st, ok := p.storages[d.UUID]; ok {
+			st.ServerUUIDs = nil
+		}
+		s.StorageDevices = append(s.StorageDevices[:i:i], s.StorageDevices[i+1:]...)
+		return copyServer(s), nil
+	}
+	return nil, NotFound(upcloud.ErrCodeDeviceAddressNotInUse, fmt.Sprintf("No storage at %s of server %s", r.Address, r.ServerUUID))
+}
@@ -0,0 +1,217 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	upCloudClient "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DefaultHealthCheckInterval is how often a Pool checks its clients when
+// no interval is configured.
+const DefaultHealthCheckInterval = 5 * time.Minute
+
+// idleTimeout is how long a client may go unused before the health check
+// drops it, e.g. after the credentials it was built with changed.
+const idleTimeout = 30 * time.Minute
+
+// errUnchecked marks a client that has not been checked yet.
+var errUnchecked = errors.New("client not checked yet")
+
+// ClientSettings are the SDK client options a Provider is built with.
+type ClientSettings struct {
+	// BaseURL overrides the UpCloud API endpoint.
+	BaseURL string
+	// Timeout bounds each request. Zero keeps the SDK default.
+	Timeout time.Duration
+}
+
+func (s ClientSettings) options() []upCloudClient.ConfigFn {
+	var opts []upCloudClient.ConfigFn
+	if s.BaseURL != "" {
+		opts = append(opts, upCloudClient.WithBaseURL(s.BaseURL))
+	}
+	if s.Timeout > 0 {
+		opts = append(opts, upCloudClient.WithTimeout(s.Timeout))
+	}
+	return opts
+}
+
+// Pool caches SDK-backed Providers by the credentials and settings they are
+// built with, so reconciles of the same account share one client. A client
+// is checked with GetAccount when it is built and then on a timer by Start,
+// not on every Get. Changed credentials get a new client; the old one is
+// dropped once idle.
+//
+// Concurrent Gets of a new client build and check it once.
+//
+// A nil Pool builds a new, unchecked client on every Get.
+type Pool struct {
+	// HealthCheckInterval is how often Start checks the cached clients.
+	// Defaults to DefaultHealthCheckInterval.
+	HealthCheckInterval time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+}
+
+type pooledClient struct {
+	provider Provider
+	// account identifies the client in logs without leaking secrets
+	account  string
+	lastUsed time.Time
+	// err is the result of the last check
+	err error
+	// checking is held while the client is checked, so that one check
+	// serves every Get waiting for it
+	checking sync.Mutex
+}
+
+// NewPool returns an empty Pool.
+func NewPool() *Pool {
+	return &Pool{clients: map[string]*pooledClient{}}
+}
+
+// poolKey identifies a client by a hash of its credentials and settings.
+func poolKey(creds Credentials, settings ClientSettings) string {
+	h := sha256.New()
+	for _, s := range []string{creds.Username, creds.Password, creds.Token,
+		settings.BaseURL, strconv.FormatInt(int64(settings.Timeout), 10)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the cached client for the credentials and settings, building
+// it on first use. New clients, and clients that failed their last health
+// check, are checked before they are returned.
+func (p *Pool) Get(ctx context.Context, creds Credentials, settings ClientSettings) (Provider, error) {
+	provider, _, err := p.get(ctx, creds, settings)
+	return provider, err
+}
+
+// Account returns the account of the credentials, read through the cached
+// client. The check of a client Get builds serves as the read, so a new
+// client costs a single GetAccount.
+func (p *Pool) Account(ctx context.Context, creds Credentials, settings ClientSettings) (*upcloud.Account, error) {
+	provider, account, err := p.get(ctx, creds, settings)
+	if err != nil || account != nil {
+		return account, err
+	}
+	return provider.GetAccount(ctx)
+}
+
+// get implements Get. It also returns the account when it checked the
+// client.
+func (p *Pool) get(ctx context.Context, creds Credentials, settings ClientSettings) (Provider, *upcloud.Account, error) {
+	if p == nil {
+		return NewProvider(creds, settings.options()...), nil, nil
+	}
+	key := poolKey(creds, settings)
+
+	p.mu.Lock()
+	c, ok := p.clients[key]
+	if !ok {
+		account := creds.Username
+		if creds.Token != "" {
+			account = "token"
+		}
+		c = &pooledClient{
+			provider: NewProvider(creds, settings.options()...),
+			account:  account,
+			err:      errUnchecked,
+		}
+		p.clients[key] = c
+	}
+	c.lastUsed = time.Now()
+	err := c.err
+	p.mu.Unlock()
+	if err == nil {
+		return c.provider, nil, nil
+	}
+
+	c.checking.Lock()
+	defer c.checking.Unlock()
+	p.mu.Lock()
+	err = c.err
+	p.mu.Unlock()
+	if err == nil {
+		// Checked while this Get waited
+		return c.provider, nil, nil
+	}
+	account, err := c.provider.GetAccount(ctx)
+	p.mu.Lock()
+	c.err = err
+	p.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.provider, account, nil
+}
+
+// Len returns the number of cached clients.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients)
+}
+
+// CheckHealth checks every cached client with GetAccount and drops the
+// clients that have been idle for too long.
+func (p *Pool) CheckHealth(ctx context.Context) {
+	p.mu.Lock()
+	clients := make([]*pooledClient, 0, len(p.clients))
+	for key, c := range p.clients {
+		if time.Since(c.lastUsed) > idleTimeout {
+			delete(p.clients, key)
+			continue
+		}
+		clients = append(clients, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range clients {
+		c.checking.Lock()
+		_, err := c.provider.GetAccount(ctx)
+		c.checking.Unlock()
+		if err != nil {
+			log.FromContext(ctx).Error(err, "UpCloud client failed its health check", "account", c.account)
+		}
+		p.mu.Lock()
+		c.err = err
+		p.mu.Unlock()
+	}
+}
+
+// Start checks the cached clients every HealthCheckInterval until ctx is
+// done. It implements manager.Runnable.
+func (p *Pool) Start(ctx context.Context) error {
+	interval := p.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			p.CheckHealth(ctx)
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable: every
+// replica checks its own clients.
+func (p *Pool) NeedLeaderElection() bool {
+	return false
+}
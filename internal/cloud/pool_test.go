@@ -0,0 +1,129 @@
+package cloud
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/harper1011/vm-controller/test/upcloudsim"
+)
+
+func TestPoolReusesClients(t *testing.T) {
+	sim := upcloudsim.New(upcloudsim.Options{})
+	defer sim.Close()
+	ctx := context.Background()
+	pool := NewPool()
+	creds := Credentials{Username: upcloudsim.DefaultUsername, Password: upcloudsim.DefaultPassword}
+	settings := ClientSettings{BaseURL: sim.URL}
+
+	first, err := pool.Get(ctx, creds, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.Get(ctx, creds, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected the same client for the same credentials")
+	}
+	if got := sim.Requests("GET /account"); got != 1 {
+		t.Errorf("expected the client to be checked once, got %d checks", got)
+	}
+
+	_, err = pool.Get(ctx, Credentials{Username: upcloudsim.DefaultUsername, Password: "changed"}, settings)
+	if err == nil {
+		t.Fatal("expected the changed credentials to be checked and rejected")
+	}
+	if pool.Len() != 2 {
+		t.Errorf("expected a new client for changed credentials, got %d clients", pool.Len())
+	}
+}
+
+func TestPoolChecksNewClientsOnce(t *testing.T) {
+	sim := upcloudsim.New(upcloudsim.Options{})
+	defer sim.Close()
+	ctx := context.Background()
+	pool := NewPool()
+	creds := Credentials{Username: upcloudsim.DefaultUsername, Password: upcloudsim.DefaultPassword}
+	settings := ClientSettings{BaseURL: sim.URL}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pool.Get(ctx, creds, settings); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := sim.Requests("GET /account"); got != 1 {
+		t.Errorf("expected concurrent Gets to check the client once, got %d checks", got)
+	}
+}
+
+func TestPoolAccount(t *testing.T) {
+	sim := upcloudsim.New(upcloudsim.Options{})
+	defer sim.Close()
+	ctx := context.Background()
+	pool := NewPool()
+	creds := Credentials{Username: upcloudsim.DefaultUsername, Password: upcloudsim.DefaultPassword}
+	settings := ClientSettings{BaseURL: sim.URL}
+
+	account, err := pool.Account(ctx, creds, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.UserName != upcloudsim.DefaultUsername {
+		t.Errorf("expected the account of %s, got %s", upcloudsim.DefaultUsername, account.UserName)
+	}
+	if got := sim.Requests("GET /account"); got != 1 {
+		t.Errorf("expected the check of the new client to serve as the read, got %d calls", got)
+	}
+	if _, err := pool.Account(ctx, creds, settings); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Requests("GET /account"); got != 2 {
+		t.Errorf("expected a cached client to read the account again, got %d calls", got)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	sim := upcloudsim.New(upcloudsim.Options{})
+	defer sim.Close()
+	ctx := context.Background()
+	pool := NewPool()
+	creds := Credentials{Username: upcloudsim.DefaultUsername, Password: upcloudsim.DefaultPassword}
+	settings := ClientSettings{BaseURL: sim.URL}
+
+	if _, err := pool.Get(ctx, creds, settings); err != nil {
+		t.Fatal(err)
+	}
+	sim.InjectFailure(upcloudsim.Failure{
+		Method: http.MethodGet,
+		Path:   "/account",
+		Status: http.StatusServiceUnavailable,
+		Code:   "SERVICE_UNAVAILABLE",
+	})
+	pool.CheckHealth(ctx)
+	if got := sim.Requests("GET /account"); got != 2 {
+		t.Fatalf("expected the health check to call GetAccount, got %d calls", got)
+	}
+
+	// The unhealthy client is checked again before it is handed out
+	if _, err := pool.Get(ctx, creds, settings); err != nil {
+		t.Fatalf("expected the client to recover: %v", err)
+	}
+	if got := sim.Requests("GET /account"); got != 3 {
+		t.Errorf("expected the unhealthy client to be checked on Get, got %d calls", got)
+	}
+	if _, err := pool.Get(ctx, creds, settings); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Requests("GET /account"); got != 3 {
+		t.Errorf("expected no check for a healthy client, got %d calls", got)
+	}
+}
@@ -0,0 +1,49 @@
+package cloud
+
+import (
+	"context"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	upCloudClient "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/service"
+)
+
+// Provider is the subset of the UpCloud API used by the controllers.
+// The method signatures mirror the UpCloud Go SDK so *service.Service
+// satisfies it without an adapter.
+type Provider interface {
+	GetAccount(ctx context.Context) (*upcloud.Account, error)
+	GetZones(ctx context.Context) (*upcloud.Zones, error)
+	GetPlans(ctx context.Context) (*upcloud.Plans, error)
+
+	GetServersWithFilters(ctx context.Context, r *request.GetServersWithFiltersRequest) (*upcloud.Servers, error)
+	GetServerDetails(ctx context.Context, r *request.GetServerDetailsRequest) (*upcloud.ServerDetails, error)
+	CreateServer(ctx context.Context, r *request.CreateServerRequest) (*upcloud.ServerDetails, error)
+	ModifyServer(ctx context.Context, r *request.ModifyServerRequest) (*upcloud.ServerDetails, error)
+	StartServer(ctx context.Context, r *request.StartServerRequest) (*upcloud.ServerDetails, error)
+	StopServer(ctx context.Context, r *request.StopServerRequest) (*upcloud.ServerDetails, error)
+	RestartServer(ctx context.Context, r *request.RestartServerRequest) (*upcloud.ServerDetails, error)
+	WaitForServerState(ctx context.Context, r *request.WaitForServerStateRequest) (*upcloud.ServerDetails, error)
+	DeleteServer(ctx context.Context, r *request.DeleteServerRequest) error
+	DeleteServerAndStorages(ctx context.Context, r *request.DeleteServerAndStoragesRequest) error
+
+	GetStorages(ctx context.Context, r *request.GetStoragesRequest) (*upcloud.Storages, error)
+	GetStorageDetails(ctx context.Context, r *request.GetStorageDetailsRequest) (*upcloud.StorageDetails, error)
+	CreateStorage(ctx context.Context, r *request.CreateStorageRequest) (*upcloud.StorageDetails, error)
+	CloneStorage(ctx context.Context, r *request.CloneStorageRequest) (*upcloud.StorageDetails, error)
+	ModifyStorage(ctx context.Context, r *request.ModifyStorageRequest) (*upcloud.StorageDetails, error)
+	ResizeStorageFilesystem(ctx context.Context, r *request.ResizeStorageFilesystemRequest) (*upcloud.ResizeStorageFilesystemBackup, error)
+	DeleteStorage(ctx context.Context, r *request.DeleteStorageRequest) error
+	CreateBackup(ctx context.Context, r *request.CreateBackupRequest) (*upcloud.StorageDetails, error)
+	RestoreBackup(ctx context.Context, r *request.RestoreBackupRequest) error
+	AttachStorage(ctx context.Context, r *request.AttachStorageRequest) (*upcloud.ServerDetails, error)
+	DetachStorage(ctx context.Context, r *request.DetachStorageRequest) (*upcloud.ServerDetails, error)
+}
+
+var _ Provider = (*service.Service)(nil)
+
+// NewUpCloudProvider returns a Provider backed by the UpCloud Go SDK.
+func NewUpCloudProvider(username, password string, opts ...upCloudClient.ConfigFn) Provider {
+	return service.New(upCloudClient.New(username, password, opts...))
+}
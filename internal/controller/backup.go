@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+	"github.com/harper1011/vm-controller/internal/schedule"
+)
+
+// backupTimeFormat stamps the titles of the backups of a BackupPolicy.
+const backupTimeFormat = "20060102-1504"
+
+// policyBackupPrefix starts the titles of the backups of a BackupPolicy,
+// telling them apart from backups taken by hand or for snapshots.
+const policyBackupPrefix = "vm-controller "
+
+// runBackupPolicy backs the disks of the VM up when its BackupPolicy is due
+// and prunes the backups past their retention. The returned result brings
+// the VM back for the next run at the latest.
+func (r *UpCloudVMReconciler) runBackupPolicy(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, result ctrl.Result) (ctrl.Result, error) {
+	policy := vm.Spec.BackupPolicy
+	if policy == nil {
+		// Backups taken before are left alone
+		vm.Status.NextBackupTime = nil
+		meta.RemoveStatusCondition(&vm.Status.Conditions, v1alpha1.ConditionBackedUp)
+		return result, nil
+	}
+	cron, err := schedule.Parse(policy.Schedule)
+	if err != nil {
+		// The webhook rejects such schedules
+		vm.Status.NextBackupTime = nil
+		setCondition(vm, v1alpha1.ConditionBackedUp, metav1.ConditionFalse, ReasonInvalidSchedule,
+			fmt.Sprintf("invalid schedule %q: %s", policy.Schedule, err))
+		return result, nil
+	}
+
+	now := time.Now()
+	if due := vm.Status.NextBackupTime; due != nil && !now.Before(due.Time) {
+		missing, err := r.takePolicyBackups(ctx, svc, vm, due.Time, now)
+		if err != nil {
+			r.reportProblem(vm, v1alpha1.ConditionBackedUp, metav1.ConditionFalse, ReasonBackupFailed, err)
+			return ctrl.Result{}, err
+		}
+		vm.Status.LastBackupTime = &metav1.Time{Time: now}
+		if len(missing) > 0 {
+			setCondition(vm, v1alpha1.ConditionBackedUp, metav1.ConditionFalse, ReasonBackupDiskNotFound,
+				"the server has no disk titled "+strings.Join(missing, ", "))
+		} else {
+			setCondition(vm, v1alpha1.ConditionBackedUp, metav1.ConditionTrue, ReasonBackupsTaken, "")
+		}
+	}
+	if err := r.pruneBackups(ctx, svc, vm, now); err != nil {
+		r.reportProblem(vm, v1alpha1.ConditionBackedUp, metav1.ConditionFalse, ReasonBackupFailed, err)
+		return ctrl.Result{}, err
+	}
+
+	// Computed on every pass, so a new schedule takes effect right away
+	next := cron.Next(now)
+	if next.IsZero() {
+		vm.Status.NextBackupTime = nil
+		setCondition(vm, v1alpha1.ConditionBackedUp, metav1.ConditionFalse, ReasonInvalidSchedule,
+			fmt.Sprintf("schedule %q does not run in the next five years", policy.Schedule))
+		return result, nil
+	}
+	vm.Status.NextBackupTime = &metav1.Time{Time: next}
+	if wait := next.Sub(now); result.RequeueAfter == 0 || wait < result.RequeueAfter {
+		result.RequeueAfter = wait
+	}
+	return result, nil
+}
+
+// takePolicyBackups backs up the disks the BackupPolicy selects for the run
+// scheduled at due. Disks already backed up for that run by an attempt that
+// failed halfway, or whose status update was lost, are skipped. Disks not
+// attached yet are left for the next run. It returns the selected titles
+// the server has no disk for.
+func (r *UpCloudVMReconciler) takePolicyBackups(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, due, now time.Time) ([]string, error) {
+	if err := recoverPolicyBackups(ctx, svc, vm); err != nil {
+		return nil, err
+	}
+	policy := vm.Spec.BackupPolicy
+	found := map[string]bool{}
+	taken := 0
+	for _, disk := range vm.Status.StorageDevices {
+		if disk.UUID == "" || disk.Address == "" || len(policy.Disks) > 0 && !containsString(policy.Disks, disk.Title) {
+			continue
+		}
+		found[disk.Title] = true
+		if backedUpSince(vm, disk.UUID, due) {
+			continue
+		}
+		backup, err := svc.CreateBackup(ctx, &request.CreateBackupRequest{
+			UUID:  disk.UUID,
+			Title: policyBackupTitle(disk.Title, now),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up disk %s: %w", disk.Title, err)
+		}
+		vm.Status.Backups = append(vm.Status.Backups, v1alpha1.PolicyBackup{
+			StorageUUID: disk.UUID,
+			Title:       disk.Title,
+			BackupUUID:  backup.UUID,
+			Time:        metav1.Time{Time: now},
+		})
+		taken++
+	}
+	if taken > 0 {
+		r.event(vm, corev1.EventTypeNormal, EventBackupsTaken,
+			"Backed up %d disks of UpCloud server %s", taken, vm.Status.VMID)
+	}
+	var missing []string
+	for _, title := range policy.Disks {
+		if !found[title] {
+			missing = append(missing, title)
+		}
+	}
+	return missing, nil
+}
+
+// pruneBackups deletes the backups of the BackupPolicy that are past its
+// KeepLast or MaxAge. A backup that cannot be deleted is tried again on
+// the next pass.
+func (r *UpCloudVMReconciler) pruneBackups(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, now time.Time) error {
+	policy := vm.Spec.BackupPolicy
+	keepLast := policy.KeepLast
+	if keepLast == 0 && policy.MaxAge == nil {
+		keepLast = v1alpha1.DefaultBackupKeepLast
+	}
+	// Backups are listed oldest first, count the newer ones of each disk
+	backups := vm.Status.Backups
+	expired := make([]bool, len(backups))
+	newer := map[string]int{}
+	for i := len(backups) - 1; i >= 0; i-- {
+		newer[backups[i].StorageUUID]++
+		expired[i] = keepLast > 0 && newer[backups[i].StorageUUID] > keepLast ||
+			policy.MaxAge != nil && now.Sub(backups[i].Time.Time) > policy.MaxAge.Duration
+	}
+
+	kept := make([]v1alpha1.PolicyBackup, 0, len(backups))
+	pruned := 0
+	for i, backup := range backups {
+		if !expired[i] {
+			kept = append(kept, backup)
+			continue
+		}
+		err := svc.DeleteStorage(ctx, &request.DeleteStorageRequest{UUID: backup.BackupUUID})
+		if err != nil && !isStorageNotFound(err) {
+			vm.Status.Backups = append(kept, backups[i:]...)
+			return fmt.Errorf("failed to delete backup %s of disk %s: %w", backup.BackupUUID, backup.Title, err)
+		}
+		pruned++
+	}
+	vm.Status.Backups = kept
+	if pruned > 0 {
+		r.event(vm, corev1.EventTypeNormal, EventBackupsPruned,
+			"Deleted %d backups past the retention of the backup policy", pruned)
+	}
+	return nil
+}
+
+// recoverPolicyBackups adds the BackupPolicy backups of the VM's disks
+// that UpCloud has but the status lost, e.g. when its update failed after
+// the backups were taken, so they are neither taken again nor left past
+// their retention.
+func recoverPolicyBackups(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM) error {
+	backups, err := titledBackups(ctx, svc, policyBackupPrefix)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, backup := range vm.Status.Backups {
+		known[backup.BackupUUID] = true
+	}
+	recovered := false
+	for _, disk := range vm.Status.StorageDevices {
+		if disk.UUID == "" {
+			continue
+		}
+		for _, backup := range backups[disk.UUID] {
+			if known[backup.UUID] {
+				continue
+			}
+			vm.Status.Backups = append(vm.Status.Backups, v1alpha1.PolicyBackup{
+				StorageUUID: disk.UUID,
+				Title:       disk.Title,
+				BackupUUID:  backup.UUID,
+				Time:        metav1.Time{Time: backup.Created},
+			})
+			recovered = true
+		}
+	}
+	if recovered {
+		// pruneBackups counts on the oldest coming first
+		sort.SliceStable(vm.Status.Backups, func(i, j int) bool {
+			return vm.Status.Backups[i].Time.Before(&vm.Status.Backups[j].Time)
+		})
+	}
+	return nil
+}
+
+// backedUpSince reports whether the BackupPolicy backed the disk up at or
+// after t.
+func backedUpSince(vm *v1alpha1.UpCloudVM, uuid string, t time.Time) bool {
+	for _, backup := range vm.Status.Backups {
+		if backup.StorageUUID == uuid && !backup.Time.Time.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyBackupTitle returns the title of a backup of the disk taken at t,
+// cut to what UpCloud accepts.
+func policyBackupTitle(diskTitle string, t time.Time) string {
+	stamp := " " + t.UTC().Format(backupTimeFormat)
+	room := max(maxBackupTitle-utf8.RuneCountInString(policyBackupPrefix+stamp), 0)
+	if utf8.RuneCountInString(diskTitle) > room {
+		diskTitle = string([]rune(diskTitle)[:room])
+	}
+	return policyBackupPrefix + diskTitle + stamp
+}
+
+// titledBackups returns the backups in UpCloud whose title starts with
+// prefix, by the UUID of the disk they were taken of. Such a prefix is how
+// backups whose UUID was not written to a status are found again.
+func titledBackups(ctx context.Context, svc cloud.Provider, prefix string) (map[string][]upcloud.Storage, error) {
+	storages, err := svc.GetStorages(ctx, &request.GetStoragesRequest{
+		Access: upcloud.StorageAccessPrivate,
+		Type:   upcloud.StorageTypeBackup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UpCloud backups: %w", err)
+	}
+	backups := map[string][]upcloud.Storage{}
+	for _, backup := range storages.Storages {
+		if strings.HasPrefix(backup.Title, prefix) {
+			backups[backup.Origin] = append(backups[backup.Origin], backup)
+		}
+	}
+	return backups, nil
+}
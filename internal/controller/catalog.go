@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// Catalog returns the zones, plans and templates offered to the UpCloud
+// account of the VM, as resolved by a reconcile. The validating webhook
+// checks new specs against it.
+func (r *UpCloudVMReconciler) Catalog(ctx context.Context, vm *v1alpha1.UpCloudVM) (*cloud.Catalog, error) {
+	config, err := r.getProviderConfig(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	err, svc := r.getService(ctx, vm, config)
+	if err != nil {
+		return nil, err
+	}
+	return r.Catalogs.Get(ctx, svc)
+}
+
+// checkCatalog checks the zone, plan and template against the catalog of
+// the account and reports the result in the InvalidSpec condition. Empty
+// values are not checked. Given a selector, the template is resolved from
+// it instead. It returns the template to clone and false when the spec
+// cannot be fulfilled. A catalog that cannot be read does not hold the VM
+// back, unless the template is only known from the selector.
+func (r *UpCloudVMReconciler) checkCatalog(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM,
+	zone, plan, template string, selector *v1alpha1.TemplateSelector) (string, bool, error) {
+	catalog, err := r.Catalogs.Get(ctx, svc)
+	if err != nil {
+		if selector != nil {
+			return "", false, err
+		}
+		log.FromContext(ctx).Error(err, "Failed to read the UpCloud catalog, not checking the spec")
+		return template, true, nil
+	}
+	var problems []string
+	for _, err := range []error{catalog.CheckZone(zone), catalog.CheckPlan(plan), catalog.CheckTemplate(template)} {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if selector != nil {
+		resolved, err := catalog.ResolveTemplate(cloud.TemplateSelector(*selector))
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		template = resolved.UUID
+	}
+	if len(problems) == 0 {
+		setCondition(vm, v1alpha1.ConditionInvalidSpec, metav1.ConditionFalse, ReasonSpecValid, "")
+		return template, true, nil
+	}
+	message := strings.Join(problems, "; ")
+	if invalid := meta.FindStatusCondition(vm.Status.Conditions, v1alpha1.ConditionInvalidSpec); invalid == nil ||
+		invalid.Status != metav1.ConditionTrue || invalid.Message != message {
+		r.event(vm, corev1.EventTypeWarning, EventInvalidSpec, "%s", message)
+	}
+	setCondition(vm, v1alpha1.ConditionInvalidSpec, metav1.ConditionTrue, ReasonInvalidSpec, message)
+	return "", false, nil
+}
+
+// templateSource returns the template UUID the VM's server is cloned from,
+// or the selector to resolve it with. A server created again after being
+// lost keeps the template of the first one.
+func templateSource(vm *v1alpha1.UpCloudVM) (string, *v1alpha1.TemplateSelector) {
+	switch {
+	case vm.Spec.StorageTemplate != "":
+		return vm.Spec.StorageTemplate, nil
+	case vm.Status.TemplateUUID != "":
+		return vm.Status.TemplateUUID, nil
+	default:
+		return "", vm.Spec.TemplateSelector
+	}
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+)
+
+// Reasons of the UpCloudVM conditions. A failed UpCloud API call reports the
+// error code of its upcloud.Problem instead, e.g. "ServerNotFound".
+const (
+	ReasonCredentialsValid      = "CredentialsValid"
+	ReasonServerCreated         = "ServerCreated"
+	ReasonServerAdopted         = "ServerAdopted"
+	ReasonNotProvisioned        = "NotProvisioned"
+	ReasonCreateFailed          = "CreateFailed"
+	ReasonServerStarted         = "ServerStarted"
+	ReasonSynced                = "Synced"
+	ReasonSyncFailed            = "SyncFailed"
+	ReasonDeleting              = "Deleting"
+	ReasonServerStopping        = "ServerStopping"
+	ReasonDeleteFailed          = "DeleteFailed"
+	ReasonDeletionProtected     = "DeletionProtected"
+	ReasonNoDrift               = "NoDrift"
+	ReasonSpecDrifted           = "SpecDrifted"
+	ReasonServerNotFound        = "ServerNotFound"
+	ReasonRecreating            = "Recreating"
+	ReasonStopping              = "Stopping"
+	ReasonRestartNotApproved    = "RestartNotApproved"
+	ReasonSpecValid             = "SpecValid"
+	ReasonInvalidSpec           = "InvalidSpec"
+	ReasonPreparingStorage      = "PreparingStorage"
+	ReasonDiskShrinkRefused     = "DiskShrinkRefused"
+	ReasonSnapshotNotReady      = "SnapshotNotReady"
+	ReasonSnapshotRestoreFailed = "SnapshotRestoreFailed"
+	ReasonBackupsTaken          = "BackupsTaken"
+	ReasonBackupDiskNotFound    = "BackupDiskNotFound"
+	ReasonInvalidSchedule       = "InvalidSchedule"
+)
+
+// setCondition sets a condition of the VM for its current generation.
+func setCondition(vm *v1alpha1.UpCloudVM, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&vm.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: vm.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setProblemCondition sets a condition of the VM because of err, taking the
+// reason from the UpCloud error code when err is a Problem. Most conditions
+// turn False on failure, while Deleting stays True.
+func setProblemCondition(vm *v1alpha1.UpCloudVM, conditionType string, status metav1.ConditionStatus, fallbackReason string, err error) {
+	reason, message := problemReason(err, fallbackReason)
+	setCondition(vm, conditionType, status, reason, message)
+}
+
+// problemReason returns a condition reason and message for err. Problems
+// returned by the UpCloud API keep their error code and correlation ID so
+// they can be looked up with UpCloud support.
+func problemReason(err error, fallbackReason string) (string, string) {
+	var problem *upcloud.Problem
+	if !errors.As(err, &problem) {
+		return fallbackReason, err.Error()
+	}
+	reason := conditionReason(problem.ErrorCode())
+	if reason == "" {
+		reason = fallbackReason
+	}
+	var sb strings.Builder
+	sb.WriteString(problem.Title)
+	for _, param := range problem.InvalidParams {
+		fmt.Fprintf(&sb, "; %s: %s", param.Name, param.Reason)
+	}
+	fmt.Fprintf(&sb, " (error code %s", problem.ErrorCode())
+	if problem.CorrelationID != "" {
+		fmt.Fprintf(&sb, ", correlation ID %s", problem.CorrelationID)
+	}
+	sb.WriteString(")")
+	return reason, sb.String()
+}
+
+// conditionReason turns an UpCloud error code or server state, such as
+// SERVER_NOT_FOUND or maintenance, into a CamelCase condition reason.
+func conditionReason(code string) string {
+	var sb strings.Builder
+	for _, word := range strings.FieldsFunc(code, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+	}) {
+		sb.WriteString(strings.ToUpper(word[:1]) + strings.ToLower(word[1:]))
+	}
+	return sb.String()
+}
+
+// setServerState records the state UpCloud reports for the server and
+// derives the Ready condition from it.
+func setServerState(vm *v1alpha1.UpCloudVM, serverState string) {
+	vm.Status.ServerState = serverState
+	if serverState == upcloud.ServerStateStarted {
+		setCondition(vm, v1alpha1.ConditionReady, metav1.ConditionTrue, ReasonServerStarted, "")
+		return
+	}
+	setCondition(vm, v1alpha1.ConditionReady, metav1.ConditionFalse, "Server"+conditionReason(serverState),
+		fmt.Sprintf("UpCloud server %s is %s", vm.Status.VMID, serverState))
+}
@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	apiError "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// Keys read from a credentials Secret. A Secret holds either a username and
+// password or an API token.
+const (
+	SecretKeyUsername = "username"
+	SecretKeyPassword = "password"
+	SecretKeyToken    = "token"
+)
+
+// Status states of an UpCloudVM that cannot be reconciled until an object
+// it references changes.
+const (
+	StateCredentialsError       = "CredentialsError"
+	StateProviderConfigNotReady = "ProviderConfigNotReady"
+)
+
+// blockedError reports a referenced object, such as a credentials Secret,
+// that cannot be used. Retrying does not help until the object changes,
+// which the controller's watches pick up.
+type blockedError struct {
+	state string
+	err   error
+}
+
+func (e *blockedError) Error() string { return e.err.Error() }
+
+func (e *blockedError) Unwrap() error { return e.err }
+
+func credentialsError(format string, args ...interface{}) *blockedError {
+	return &blockedError{state: StateCredentialsError, err: fmt.Errorf(format, args...)}
+}
+
+// envCredentials returns the credentials from the manager's
+// UPCLOUD_USERNAME/UPCLOUD_PASSWORD env vars. They do not change while the
+// manager runs, so unusable ones block the object like a malformed Secret.
+func envCredentials() (cloud.Credentials, error) {
+	creds := cloud.Credentials{
+		Username: os.Getenv("UPCLOUD_USERNAME"),
+		Password: os.Getenv("UPCLOUD_PASSWORD"),
+	}
+	if err := creds.Validate(); err != nil {
+		return cloud.Credentials{}, credentialsError("no credentialsRef and the manager's UPCLOUD_USERNAME/UPCLOUD_PASSWORD are unusable: %w", err)
+	}
+	return creds, nil
+}
+
+// readCredentials reads the credentials from the named Secret.
+func readCredentials(ctx context.Context, c client.Reader, name types.NamespacedName) (cloud.Credentials, error) {
+	var secret corev1.Secret
+	if err := c.Get(ctx, name, &secret); err != nil {
+		if apiError.IsNotFound(err) {
+			return cloud.Credentials{}, credentialsError("credentials Secret %s not found", name)
+		}
+		return cloud.Credentials{}, fmt.Errorf("failed to get credentials Secret %s: %w", name, err)
+	}
+	creds := cloud.Credentials{
+		Username: string(secret.Data[SecretKeyUsername]),
+		Password: string(secret.Data[SecretKeyPassword]),
+		Token:    string(secret.Data[SecretKeyToken]),
+	}
+	if err := creds.Validate(); err != nil {
+		return cloud.Credentials{}, credentialsError("credentials Secret %s is malformed: %w", name, err)
+	}
+	return creds, nil
+}
+
+// vmCredentialsSecret returns the Secret referenced by vm, in the VM's
+// namespace.
+func vmCredentialsSecret(vm *v1alpha1.UpCloudVM) types.NamespacedName {
+	return credentialsSecret(vm.Spec.CredentialsRef, vm.Namespace)
+}
+
+// credentialsSecret returns the Secret ref points at. Namespaced objects
+// only read Secrets of their own namespace, which is never taken from the
+// reference.
+func credentialsSecret(ref *v1alpha1.LocalCredentialsReference, namespace string) types.NamespacedName {
+	return types.NamespacedName{Name: ref.Name, Namespace: namespace}
+}
+
+// readyProviderConfig returns the UpCloudProviderConfig ref points at once
+// its account has been validated, or nil without a reference.
+func readyProviderConfig(ctx context.Context, c client.Reader, ref *v1alpha1.UpCloudProviderConfigReference) (*v1alpha1.UpCloudProviderConfig, error) {
+	if ref == nil {
+		return nil, nil
+	}
+	var config v1alpha1.UpCloudProviderConfig
+	if err := c.Get(ctx, types.NamespacedName{Name: ref.Name}, &config); err != nil {
+		if apiError.IsNotFound(err) {
+			return nil, &blockedError{state: StateProviderConfigNotReady,
+				err: fmt.Errorf("UpCloudProviderConfig %s not found", ref.Name)}
+		}
+		return nil, fmt.Errorf("failed to get UpCloudProviderConfig %s: %w", ref.Name, err)
+	}
+	if !config.Status.Ready {
+		reason := config.Status.Message
+		if reason == "" {
+			reason = "account not validated yet"
+		}
+		return nil, &blockedError{state: StateProviderConfigNotReady,
+			err: fmt.Errorf("UpCloudProviderConfig %s is not ready: %s", ref.Name, reason)}
+	}
+	return &config, nil
+}
+
+// configCredentials returns the credentials of an UpCloudProviderConfig.
+func configCredentials(ctx context.Context, c client.Reader, config *v1alpha1.UpCloudProviderConfig) (cloud.Credentials, error) {
+	ref := config.Spec.CredentialsRef
+	if ref == nil {
+		return envCredentials()
+	}
+	if ref.Namespace == "" {
+		return cloud.Credentials{}, credentialsError("credentialsRef of UpCloudProviderConfig %s must set a namespace", config.Name)
+	}
+	return readCredentials(ctx, c, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace})
+}
+
+// clientSettings returns the settings for a client talking to the API
+// endpoint of config, falling back to baseURL.
+func clientSettings(baseURL string, config *v1alpha1.UpCloudProviderConfig) cloud.ClientSettings {
+	settings := cloud.ClientSettings{BaseURL: baseURL}
+	if config == nil {
+		return settings
+	}
+	if config.Spec.APIEndpoint != "" {
+		settings.BaseURL = config.Spec.APIEndpoint
+	}
+	if config.Spec.RequestTimeout != nil {
+		settings.Timeout = config.Spec.RequestTimeout.Duration
+	}
+	return settings
+}
+
+// referencedService returns the UpCloud API client for the credentials
+// Secret ref of an object in namespace, falling back to the credentials of
+// its UpCloudProviderConfig and then to the manager's environment. As for
+// UpCloudVMs, fixed is used instead of an SDK client when set, and only
+// after a referenced Secret was found valid.
+func referencedService(ctx context.Context, c client.Reader, fixed cloud.Provider, clients *cloud.Pool, baseURL string,
+	ref *v1alpha1.LocalCredentialsReference, namespace string, config *v1alpha1.UpCloudProviderConfig) (cloud.Provider, error) {
+	if fixed != nil && ref == nil {
+		return fixed, nil
+	}
+	var creds cloud.Credentials
+	var err error
+	switch {
+	case ref != nil:
+		creds, err = readCredentials(ctx, c, credentialsSecret(ref, namespace))
+	case config != nil:
+		creds, err = configCredentials(ctx, c, config)
+	default:
+		creds, err = envCredentials()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fixed != nil {
+		return fixed, nil
+	}
+	return clients.Get(ctx, creds, clientSettings(baseURL, config))
+}
@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+)
+
+// titleLabelKey is the server label holding the name of the UpCloudVM.
+const titleLabelKey = "title"
+
+// DefaultResyncInterval is how often a running VM is read from UpCloud to
+// detect drift when the reconciler sets no ResyncInterval.
+const DefaultResyncInterval = 10 * time.Minute
+
+// recordServer copies what UpCloud reports about the server into the status.
+func recordServer(vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) {
+	setServerState(vm, serverDetails.State)
+	vm.Status.IPAddress = serverIPAddress(serverDetails)
+	vm.Status.IPAddresses = nil
+	for _, ip := range serverDetails.IPAddresses {
+		vm.Status.IPAddresses = append(vm.Status.IPAddresses, ip.Address)
+	}
+	vm.Status.Plan = serverDetails.Plan
+	vm.Status.CPU = serverDetails.CoreNumber
+	vm.Status.Memory = serverDetails.MemoryAmount
+	vm.Status.StorageSize = 0
+	if len(serverDetails.StorageDevices) > 0 {
+		vm.Status.StorageSize = serverDetails.StorageDevices[0].Size
+	}
+	previous := vm.Status.StorageDevices
+	managed := map[string]bool{}
+	refs := map[string]string{}
+	for _, d := range previous {
+		managed[d.UUID] = d.Managed
+		refs[d.UUID] = d.StorageRef
+	}
+	vm.Status.StorageDevices = nil
+	attached := map[string]bool{}
+	for i, d := range serverDetails.StorageDevices {
+		attached[d.UUID] = true
+		vm.Status.StorageDevices = append(vm.Status.StorageDevices, v1alpha1.StorageDeviceStatus{
+			UUID:    d.UUID,
+			Title:   d.Title,
+			Address: d.Address,
+			Size:    d.Size,
+			Tier:    d.Tier,
+			// The first disk is the system disk, never one of spec.storageDevices
+			Managed:    i > 0 && refs[d.UUID] == "" && (managed[d.UUID] || specDevice(vm, d.UUID, d.Title) != nil),
+			StorageRef: refs[d.UUID],
+		})
+	}
+	// Disks of the spec that are not attached yet, or were detached outside
+	// Kubernetes, stay listed until they are attached
+	for _, d := range previous {
+		if d.Managed && !attached[d.UUID] {
+			d.Address = ""
+			vm.Status.StorageDevices = append(vm.Status.StorageDevices, d)
+		}
+	}
+	now := metav1.Now()
+	vm.Status.LastSyncTime = &now
+}
+
+// specDrift lists the fields of the spec the server no longer matches, as
+// "field: spec <want>, server <got>". Fields the spec leaves unset are not
+// compared. The disks are looked up in the status recorded by recordServer.
+func specDrift(vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) []string {
+	var drift []string
+	compare := func(field string, want, got interface{}, set bool) {
+		if set && want != got {
+			drift = append(drift, fmt.Sprintf("%s: spec %v, server %v", field, want, got))
+		}
+	}
+	compare("title", vm.Name, serverDetails.Title, true)
+	compare("plan", vm.Spec.Plan, serverDetails.Plan, vm.Spec.Plan != "")
+	compare("cpu", vm.Spec.CPU, serverDetails.CoreNumber, vm.Spec.CPU != 0)
+	compare("memory", vm.Spec.Memory, serverDetails.MemoryAmount, vm.Spec.Memory != 0)
+	compare("timezone", vm.Spec.TimeZone, serverDetails.Timezone, vm.Spec.TimeZone != "")
+	if len(serverDetails.StorageDevices) > 0 {
+		compare("storagesize", vm.Spec.StorageSize, serverDetails.StorageDevices[0].Size, vm.Spec.StorageSize != 0)
+	}
+	compare("state", desiredServerState(vm), serverDetails.State,
+		serverDetails.State == upcloud.ServerStateStarted || serverDetails.State == upcloud.ServerStateStopped)
+	for i := range vm.Spec.StorageDevices {
+		device := &vm.Spec.StorageDevices[i]
+		if disk := deviceDisk(vm, device); disk == nil || disk.Address == "" {
+			drift = append(drift, fmt.Sprintf("disk %s: spec attached, server detached", device.Title))
+		}
+	}
+	for _, ref := range vm.Spec.StorageRefs {
+		if refDisk(vm, ref.Name) == nil {
+			drift = append(drift, fmt.Sprintf("storageRef %s: spec attached, server detached", ref.Name))
+		}
+	}
+	return drift
+}
+
+// specHash returns the hash recorded in AppliedSpecHash once the spec has
+// been applied to the server.
+func specHash(vm *v1alpha1.UpCloudVM) string {
+	data, err := json.Marshal(vm.Spec)
+	if err != nil {
+		// The spec always marshals, it came from JSON
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(vm.Name+"\x00"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// modifyRequest returns the ModifyServerRequest changing only the fields of
+// the server that differ from the spec, or nil when the server matches it.
+func modifyRequest(vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) *request.ModifyServerRequest {
+	req := &request.ModifyServerRequest{UUID: serverDetails.UUID}
+	changed := false
+	if vm.Name != serverDetails.Title {
+		req.Title = vm.Name
+		changed = true
+	}
+	if vm.Spec.Plan != "" && vm.Spec.Plan != serverDetails.Plan {
+		req.Plan = vm.Spec.Plan
+		changed = true
+	}
+	if vm.Spec.CPU != 0 && vm.Spec.CPU != serverDetails.CoreNumber {
+		req.CoreNumber = vm.Spec.CPU
+		changed = true
+	}
+	if vm.Spec.Memory != 0 && vm.Spec.Memory != serverDetails.MemoryAmount {
+		req.MemoryAmount = vm.Spec.Memory
+		changed = true
+	}
+	if vm.Spec.TimeZone != "" && vm.Spec.TimeZone != serverDetails.Timezone {
+		req.TimeZone = vm.Spec.TimeZone
+		changed = true
+	}
+	if labels, ok := setLabel(serverDetails.Labels, titleLabelKey, vm.Name); ok {
+		req.Labels = &labels
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return req
+}
+
+// setLabel returns a copy of labels with key set to value, and whether that
+// changed anything. A key present more than once is collapsed into one label.
+func setLabel(labels upcloud.LabelSlice, key, value string) (upcloud.LabelSlice, bool) {
+	result := make(upcloud.LabelSlice, 0, len(labels)+1)
+	found := 0
+	changed := false
+	for _, l := range labels {
+		if l.Key != key {
+			result = append(result, l)
+			continue
+		}
+		found++
+		if found == 1 {
+			changed = changed || l.Value != value
+			result = append(result, upcloud.Label{Key: key, Value: value})
+		}
+	}
+	if found == 0 {
+		result = append(result, upcloud.Label{Key: key, Value: value})
+	}
+	return result, changed || found != 1
+}
+
+// setDrifted reports the drift found by specDrift in the Drifted condition.
+func setDrifted(vm *v1alpha1.UpCloudVM, drift []string) {
+	if len(drift) == 0 {
+		setCondition(vm, v1alpha1.ConditionDrifted, metav1.ConditionFalse, ReasonNoDrift, "")
+		return
+	}
+	setCondition(vm, v1alpha1.ConditionDrifted, metav1.ConditionTrue, ReasonSpecDrifted, strings.Join(drift, "; "))
+}
+
+// resyncInterval returns how long a running VM waits for its next resync.
+func (r *UpCloudVMReconciler) resyncInterval() time.Duration {
+	if r.ResyncInterval > 0 {
+		return r.ResyncInterval
+	}
+	return DefaultResyncInterval
+}
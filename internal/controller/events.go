@@ -0,0 +1,59 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+)
+
+// Reasons of the Events recorded for an UpCloudVM. Warnings about a failed
+// UpCloud API call use the error code of its upcloud.Problem instead.
+const (
+	EventCreateRequested        = "CreateRequested"
+	EventServerAdopted          = "ServerAdopted"
+	EventServerStarted          = "ServerStarted"
+	EventSpecApplied            = "SpecApplied"
+	EventResizeRequiresStop     = "ResizeRequiresStop"
+	EventDeleteStarted          = "DeleteStarted"
+	EventDeleteCompleted        = "DeleteCompleted"
+	EventDeleteWaits            = "DeleteWaits"
+	EventDriftDetected          = "DriftDetected"
+	EventCorrectingDrift        = "CorrectingDrift"
+	EventServerLost             = "ServerLost"
+	EventRestartNotApproved     = "RestartNotApproved"
+	EventSoftStopTimedOut       = "SoftStopTimedOut"
+	EventInvalidSpec            = "InvalidSpec"
+	EventStorageCreated         = "StorageCreated"
+	EventStorageAttached        = "StorageAttached"
+	EventStorageResized         = "StorageResized"
+	EventStorageDetached        = "StorageDetached"
+	EventDiskShrinkRefused      = "DiskShrinkRefused"
+	EventFilesystemResized      = "FilesystemResized"
+	EventFilesystemResizeFailed = "FilesystemResizeFailed"
+	EventSnapshotRestored       = "SnapshotRestored"
+	EventSnapshotRestoreFailed  = "SnapshotRestoreFailed"
+	EventBackupsTaken           = "BackupsTaken"
+	EventBackupsPruned          = "BackupsPruned"
+	EventServerStopping         = "ServerStopping"
+	EventServerRestarted        = "ServerRestarted"
+	EventResourcesRetained      = "ResourcesRetained"
+	EventDeletionProtected      = "DeletionProtected"
+)
+
+// event records an Event for the VM. Events are dropped when the reconciler
+// has no Recorder, as in tests that do not check them.
+func (r *UpCloudVMReconciler) event(vm *v1alpha1.UpCloudVM, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(vm, eventType, reason, messageFmt, args...)
+}
+
+// reportProblem sets a condition of the VM because of err and records a
+// Warning with the UpCloud error code and correlation ID of the failure.
+func (r *UpCloudVMReconciler) reportProblem(vm *v1alpha1.UpCloudVM, conditionType string, status metav1.ConditionStatus, fallbackReason string, err error) {
+	setProblemCondition(vm, conditionType, status, fallbackReason, err)
+	reason, message := problemReason(err, fallbackReason)
+	r.event(vm, corev1.EventTypeWarning, reason, "%s", message)
+}
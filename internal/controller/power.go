@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// wantsStopped reports whether the VM's PowerState parks its server.
+func wantsStopped(vm *v1alpha1.UpCloudVM) bool {
+	return vm.Spec.PowerState == v1alpha1.PowerStateStopped
+}
+
+// desiredServerState returns the UpCloud state the VM's PowerState asks for.
+func desiredServerState(vm *v1alpha1.UpCloudVM) string {
+	if wantsStopped(vm) {
+		return upcloud.ServerStateStopped
+	}
+	return upcloud.ServerStateStarted
+}
+
+// stopForPowerState shuts down the server of a VM whose PowerState is
+// Stopped, the way its StopType says. Parking a VM is asked for, so the
+// DisruptionPolicy does not apply. The VM stays Stopping until waitForStop
+// sees the server stopped.
+func (r *UpCloudVMReconciler) stopForPowerState(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM) (ctrl.Result, error) {
+	req := &request.StopServerRequest{
+		UUID:     vm.Status.VMID,
+		StopType: request.ServerStopTypeHard,
+	}
+	if vm.Spec.StopType != request.ServerStopTypeHard {
+		req.StopType = request.ServerStopTypeSoft
+		req.Timeout = stopTimeout(vm)
+	}
+	if _, err := svc.StopServer(ctx, req); err != nil {
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return ctrl.Result{}, fmt.Errorf("failed to stop UpCloud VM: %w", err)
+	}
+	r.event(vm, corev1.EventTypeNormal, EventServerStopping,
+		"Stopping UpCloud server %s as the powerState is Stopped", vm.Status.VMID)
+	now := metav1.Now()
+	vm.Status.StopRequestedTime = &now
+	setState(vm, StateStopping)
+	setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonStopping,
+		"stopping the server, the powerState is Stopped")
+	return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+}
+
+// restartRequested returns the time of the RestartAnnotation request that
+// has not been handled yet, if there is one. The webhook rejects values that
+// are not RFC 3339 times, such values are ignored.
+func restartRequested(vm *v1alpha1.UpCloudVM) *metav1.Time {
+	value := vm.Annotations[v1alpha1.RestartAnnotation]
+	if value == "" {
+		return nil
+	}
+	requested, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil
+	}
+	if last := vm.Status.LastRestartTime; last != nil && !requested.After(last.Time) {
+		return nil
+	}
+	return &metav1.Time{Time: requested}
+}
+
+// restartServer restarts the server for a pending RestartAnnotation
+// request. A stopped server has nothing to restart and the request is only
+// recorded as handled. It returns true when the reconcile should end with
+// the returned result, as the server is restarting or in maintenance.
+func (r *UpCloudVMReconciler) restartServer(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) (bool, ctrl.Result, error) {
+	requested := restartRequested(vm)
+	if requested == nil {
+		return false, ctrl.Result{}, nil
+	}
+	switch serverDetails.State {
+	case upcloud.ServerStateStopped:
+		vm.Status.LastRestartTime = requested
+		return false, ctrl.Result{}, nil
+	case upcloud.ServerStateStarted:
+	default:
+		// Wait for the server to leave maintenance
+		return true, ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+
+	req := &request.RestartServerRequest{
+		UUID:     vm.Status.VMID,
+		StopType: request.ServerStopTypeHard,
+	}
+	if vm.Spec.StopType != request.ServerStopTypeHard {
+		// Like waitForStop, stop the server hard once the soft stop times out
+		req.StopType = request.ServerStopTypeSoft
+		req.Timeout = stopTimeout(vm)
+		req.TimeoutAction = request.RestartTimeoutActionDestroy
+	}
+	if _, err := svc.RestartServer(ctx, req); err != nil {
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return true, ctrl.Result{}, fmt.Errorf("failed to restart UpCloud VM: %w", err)
+	}
+	r.event(vm, corev1.EventTypeNormal, EventServerRestarted,
+		"Restarting UpCloud server %s as requested at %s", vm.Status.VMID, requested.UTC().Format(time.RFC3339))
+	vm.Status.LastRestartTime = requested
+	// Poll the server until it is running again
+	setState(vm, StateStarting)
+	return true, ctrl.Result{RequeueAfter: serverPollInterval}, nil
+}
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// defaultStopTimeout is how long a soft stop may take when the VM sets no
+// StopTimeout.
+const defaultStopTimeout = 2 * time.Minute
+
+// stopRequiredChanges lists the changes of the spec that UpCloud only
+// applies to stopped servers: plan, CPU and memory. Disks that cannot grow
+// online are found by resizeDisks.
+func stopRequiredChanges(vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) []string {
+	var changes []string
+	if vm.Spec.Plan != "" && vm.Spec.Plan != serverDetails.Plan {
+		changes = append(changes, fmt.Sprintf("plan %s to %s", serverDetails.Plan, vm.Spec.Plan))
+	}
+	if vm.Spec.CPU != 0 && vm.Spec.CPU != serverDetails.CoreNumber {
+		changes = append(changes, fmt.Sprintf("cpu %d to %d", serverDetails.CoreNumber, vm.Spec.CPU))
+	}
+	if vm.Spec.Memory != 0 && vm.Spec.Memory != serverDetails.MemoryAmount {
+		changes = append(changes, fmt.Sprintf("memory %d to %d", serverDetails.MemoryAmount, vm.Spec.Memory))
+	}
+	return changes
+}
+
+// stopTimeout returns how long the VM's server may take to shut down.
+func stopTimeout(vm *v1alpha1.UpCloudVM) time.Duration {
+	if vm.Spec.StopTimeout != nil && vm.Spec.StopTimeout.Duration > 0 {
+		return vm.Spec.StopTimeout.Duration
+	}
+	return defaultStopTimeout
+}
+
+// stopForChange asks the server to shut down so the changes can be applied,
+// unless the VM's DisruptionPolicy wants the restart approved first. The
+// VM stays Stopping until waitForStop sees the server stopped.
+func (r *UpCloudVMReconciler) stopForChange(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, changes []string) (ctrl.Result, error) {
+	summary := strings.Join(changes, ", ")
+	if vm.Spec.DisruptionPolicy == v1alpha1.DisruptionPolicyRequireApproval && vm.Annotations[v1alpha1.ApproveRestartAnnotation] == "" {
+		message := fmt.Sprintf("changing %s needs the server to be stopped, annotate the UpCloudVM with %s to approve",
+			summary, v1alpha1.ApproveRestartAnnotation)
+		if vm.Status.State != StateAwaitingApproval {
+			r.event(vm, corev1.EventTypeWarning, EventRestartNotApproved, "%s", message)
+		}
+		setState(vm, StateAwaitingApproval)
+		setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonRestartNotApproved, message)
+		// The annotation triggers a reconcile, no need to poll
+		return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+	}
+	if _, ok := vm.Annotations[v1alpha1.ApproveRestartAnnotation]; ok {
+		// Every restart needs its own approval
+		delete(vm.Annotations, v1alpha1.ApproveRestartAnnotation)
+		if err := r.update(ctx, vm); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	_, err := svc.StopServer(ctx, &request.StopServerRequest{
+		UUID:     vm.Status.VMID,
+		StopType: request.ServerStopTypeSoft,
+		Timeout:  stopTimeout(vm),
+	})
+	if err != nil {
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return ctrl.Result{}, fmt.Errorf("failed to stop UpCloud VM: %w", err)
+	}
+	r.event(vm, corev1.EventTypeNormal, EventResizeRequiresStop,
+		"Stopping UpCloud server %s to change %s", vm.Status.VMID, summary)
+	now := metav1.Now()
+	vm.Status.StopRequestedTime = &now
+	setState(vm, StateStopping)
+	setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonStopping,
+		fmt.Sprintf("stopping the server to change %s", summary))
+	return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+}
+
+// waitForStop polls a server asked to shut down by stopForChange, stopping
+// it hard once the soft stop has taken longer than the VM's StopTimeout. The
+// hard stop is only asked for once. It returns true once the server is
+// stopped and the change can be applied.
+func (r *UpCloudVMReconciler) waitForStop(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM) (bool, ctrl.Result, error) {
+	serverDetails, err := svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{
+		UUID: vm.Status.VMID,
+	})
+	if err != nil {
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return false, ctrl.Result{}, fmt.Errorf("failed to get UpCloud VM: %w", err)
+	}
+	recordServer(vm, serverDetails)
+	if serverDetails.State == upcloud.ServerStateStopped {
+		vm.Status.StopRequestedTime = nil
+		vm.Status.HardStopRequestedTime = nil
+		return true, ctrl.Result{}, nil
+	}
+
+	if vm.Status.StopRequestedTime == nil {
+		// The time of the request was not recorded, give the soft stop its
+		// timeout from now rather than cutting it short
+		now := metav1.Now()
+		vm.Status.StopRequestedTime = &now
+	}
+	requested := vm.Status.StopRequestedTime
+	if serverDetails.State == upcloud.ServerStateStarted && vm.Status.HardStopRequestedTime == nil &&
+		time.Since(requested.Time) > stopTimeout(vm) {
+		_, err := svc.StopServer(ctx, &request.StopServerRequest{
+			UUID:     vm.Status.VMID,
+			StopType: request.ServerStopTypeHard,
+		})
+		if err != nil {
+			r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+			return false, ctrl.Result{}, fmt.Errorf("failed to stop UpCloud VM: %w", err)
+		}
+		r.event(vm, corev1.EventTypeWarning, EventSoftStopTimedOut,
+			"UpCloud server %s did not shut down within %s, stopped it hard", vm.Status.VMID, stopTimeout(vm))
+		now := metav1.Now()
+		vm.Status.HardStopRequestedTime = &now
+	}
+	return false, ctrl.Result{RequeueAfter: serverPollInterval}, nil
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apiError "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// completedSnapshot returns the UpCloudVMSnapshot of the VM's namespace
+// with the given name, and a message saying why it cannot be used yet
+// when it is missing or not completed.
+func (r *UpCloudVMReconciler) completedSnapshot(ctx context.Context, vm *v1alpha1.UpCloudVM, name string) (*v1alpha1.UpCloudVMSnapshot, string, error) {
+	var snapshot v1alpha1.UpCloudVMSnapshot
+	err := r.Get(ctx, types.NamespacedName{Namespace: vm.Namespace, Name: name}, &snapshot)
+	if apiError.IsNotFound(err) {
+		return nil, fmt.Sprintf("UpCloudVMSnapshot %s not found", name), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if snapshot.Status.State != StateCompleted {
+		return &snapshot, fmt.Sprintf("UpCloudVMSnapshot %s is %s", name, stateOrPending(snapshot.Status.State)), nil
+	}
+	return &snapshot, "", nil
+}
+
+// snapshotStorageDevices returns the disks of a server created from the
+// snapshot: the system disk and data disks cloned from the backups, in the
+// order they were taken.
+func snapshotStorageDevices(vm *v1alpha1.UpCloudVM, snapshot *v1alpha1.UpCloudVMSnapshot, tier string) []request.CreateServerStorageDevice {
+	devices := make([]request.CreateServerStorageDevice, 0, len(snapshot.Status.Backups))
+	for i, backup := range snapshot.Status.Backups {
+		device := request.CreateServerStorageDevice{
+			Action:  request.CreateServerStorageDeviceActionClone,
+			Storage: backup.BackupUUID,
+			Title:   backup.Title,
+			Size:    backup.Size,
+			Tier:    tier,
+		}
+		if i == 0 {
+			// The system disk is named after the VM and may grow
+			device.Title = vm.Name
+			device.Size = max(vm.Spec.StorageSize, backup.Size)
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// restoreSnapshot restores the disks of the VM's server from the snapshot
+// named by its RestoreSnapshotAnnotation. The server is stopped like for a
+// plan change and started again once the restored disks are back online,
+// unless it was stopped before. The annotation is removed once used, or
+// when the snapshot cannot be restored onto this server.
+func (r *UpCloudVMReconciler) restoreSnapshot(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) (ctrl.Result, error) {
+	name := vm.Annotations[v1alpha1.RestoreSnapshotAnnotation]
+	snapshot, waiting, err := r.completedSnapshot(ctx, vm, name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if snapshot == nil || snapshot.Status.VMID != "" && snapshot.Status.VMID != vm.Status.VMID {
+		message := waiting
+		if snapshot != nil {
+			message = fmt.Sprintf("UpCloudVMSnapshot %s was taken of server %s, not of %s",
+				name, snapshot.Status.VMID, vm.Status.VMID)
+		}
+		r.event(vm, corev1.EventTypeWarning, EventSnapshotRestoreFailed, "%s", message)
+		setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSnapshotRestoreFailed, message)
+		setSettledState(vm, serverDetails.State)
+		delete(vm.Annotations, v1alpha1.RestoreSnapshotAnnotation)
+		return ctrl.Result{RequeueAfter: r.resyncInterval()}, r.update(ctx, vm)
+	}
+	if waiting != "" {
+		setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSnapshotNotReady, waiting)
+		setSettledState(vm, serverDetails.State)
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+
+	switch serverDetails.State {
+	case upcloud.ServerStateStopped:
+	case upcloud.ServerStateStarted:
+		return r.stopForChange(ctx, svc, vm, []string{"the disks to UpCloudVMSnapshot " + name})
+	default:
+		// Wait for the server to leave maintenance
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	for _, backup := range snapshot.Status.Backups {
+		if err := svc.RestoreBackup(ctx, &request.RestoreBackupRequest{UUID: backup.BackupUUID}); err != nil {
+			r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSnapshotRestoreFailed, err)
+			return ctrl.Result{}, fmt.Errorf("failed to restore backup %s: %w", backup.BackupUUID, err)
+		}
+	}
+	r.event(vm, corev1.EventTypeNormal, EventSnapshotRestored,
+		"Restored %d disks of UpCloud server %s from UpCloudVMSnapshot %s", len(snapshot.Status.Backups), vm.Status.VMID, name)
+	delete(vm.Annotations, v1alpha1.RestoreSnapshotAnnotation)
+	if err := r.update(ctx, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+	setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionTrue, ReasonSynced, "")
+	if vm.Status.State == StateStopping {
+		// Stopped for the restore, poll the server until it is running again
+		setState(vm, StateStarting)
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	setSettledState(vm, serverDetails.State)
+	return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+}
@@ -0,0 +1,628 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	apiError "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// defaultStorageBus is the bus disks are attached to when the spec names
+// no address.
+const defaultStorageBus = "virtio"
+
+// providesDevice reports whether the disk with the given UUID and title is
+// the one of the spec's storage device: attached storages are known by
+// their UUID, created and cloned disks by their title.
+func providesDevice(device *v1alpha1.StorageDevice, uuid, title string) bool {
+	if device.Action == v1alpha1.StorageActionAttach {
+		return uuid == device.Storage
+	}
+	return title == device.Title
+}
+
+// specDevice returns the storage device of the spec the disk provides, or nil.
+func specDevice(vm *v1alpha1.UpCloudVM, uuid, title string) *v1alpha1.StorageDevice {
+	for i := range vm.Spec.StorageDevices {
+		if providesDevice(&vm.Spec.StorageDevices[i], uuid, title) {
+			return &vm.Spec.StorageDevices[i]
+		}
+	}
+	return nil
+}
+
+// deviceDisk returns the disk in the status providing the storage device, or nil.
+func deviceDisk(vm *v1alpha1.UpCloudVM, device *v1alpha1.StorageDevice) *v1alpha1.StorageDeviceStatus {
+	for i := range vm.Status.StorageDevices {
+		disk := &vm.Status.StorageDevices[i]
+		if disk.Managed && providesDevice(device, disk.UUID, disk.Title) {
+			return disk
+		}
+	}
+	return nil
+}
+
+// createServerStorageDevice returns the device creating, cloning or
+// attaching the disk along with the server. Disks without a tier get the
+// tier of the system disk.
+func createServerStorageDevice(device *v1alpha1.StorageDevice, tier string) request.CreateServerStorageDevice {
+	action := string(device.Action)
+	if action == "" {
+		action = request.CreateServerStorageDeviceActionCreate
+	}
+	if device.Tier != "" {
+		tier = device.Tier
+	}
+	d := request.CreateServerStorageDevice{
+		Action:     action,
+		Address:    device.Address,
+		Storage:    device.Storage,
+		Title:      device.Title,
+		Size:       device.Size,
+		BackupRule: backupRule(device.BackupRule),
+	}
+	if action != request.CreateServerStorageDeviceActionAttach {
+		d.Tier = tier
+		d.Encrypted = upcloud.FromBool(device.Encrypted)
+	}
+	return d
+}
+
+// backupRule converts the backup rule of the spec for the UpCloud API.
+func backupRule(rule *v1alpha1.BackupRule) *upcloud.BackupRule {
+	if rule == nil {
+		return nil
+	}
+	return &upcloud.BackupRule{Interval: rule.Interval, Time: rule.Time, Retention: rule.Retention}
+}
+
+// diskResize is a disk of the server that the spec wants to have another size.
+type diskResize struct {
+	uuid  string
+	title string
+	from  int
+	to    int
+}
+
+func (d diskResize) String() string {
+	return fmt.Sprintf("disk %s size %d to %d GB", d.title, d.from, d.to)
+}
+
+// systemDisk returns the system disk in the status, or nil before the
+// server was read.
+func systemDisk(vm *v1alpha1.UpCloudVM) *v1alpha1.StorageDeviceStatus {
+	if len(vm.Status.StorageDevices) == 0 || vm.Status.StorageDevices[0].Managed {
+		return nil
+	}
+	return &vm.Status.StorageDevices[0]
+}
+
+// diskResizes lists the attached disks, the system disk included, whose
+// size differs from the spec. Shrinking ones are refused by diskShrinks.
+func diskResizes(vm *v1alpha1.UpCloudVM) []diskResize {
+	var resizes []diskResize
+	if disk := systemDisk(vm); disk != nil && vm.Spec.StorageSize != 0 && vm.Spec.StorageSize != disk.Size {
+		resizes = append(resizes, diskResize{uuid: disk.UUID, title: disk.Title, from: disk.Size, to: vm.Spec.StorageSize})
+	}
+	for i := range vm.Spec.StorageDevices {
+		device := &vm.Spec.StorageDevices[i]
+		if disk := deviceDisk(vm, device); disk != nil && disk.Address != "" && device.Size != 0 && device.Size != disk.Size {
+			resizes = append(resizes, diskResize{uuid: disk.UUID, title: device.Title, from: disk.Size, to: device.Size})
+		}
+	}
+	return resizes
+}
+
+// diskShrinks lists the disks the spec wants smaller than they are.
+// UpCloud cannot shrink a disk.
+func diskShrinks(vm *v1alpha1.UpCloudVM) []string {
+	var shrinks []string
+	for _, resize := range diskResizes(vm) {
+		if resize.to < resize.from {
+			shrinks = append(shrinks, fmt.Sprintf("disk %s is %d GB, the spec asks for %d GB", resize.title, resize.from, resize.to))
+		}
+	}
+	return shrinks
+}
+
+// resizeDisks grows the disks of the server to the sizes of the spec and,
+// with spec.resizeFilesystem, their filesystems too. A disk UpCloud will
+// not grow while the server runs, and every disk when the filesystem is to
+// be grown, is returned instead for the caller to stop the server first.
+// The server is read again when a disk was grown.
+func (r *UpCloudVMReconciler) resizeDisks(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) (*upcloud.ServerDetails, []string, error) {
+	var offline []string
+	resized := false
+	for _, resize := range diskResizes(vm) {
+		stopped := serverDetails.State == upcloud.ServerStateStopped
+		if !stopped && (vm.Spec.ResizeFilesystem || serverDetails.State != upcloud.ServerStateStarted) {
+			offline = append(offline, resize.String())
+			continue
+		}
+		_, err := svc.ModifyStorage(ctx, &request.ModifyStorageRequest{UUID: resize.uuid, Size: resize.to})
+		if !stopped && isServerStateIllegal(err) {
+			offline = append(offline, resize.String())
+			continue
+		}
+		if err != nil {
+			return serverDetails, nil, fmt.Errorf("failed to resize storage %s: %w", resize.uuid, err)
+		}
+		resized = true
+		r.event(vm, corev1.EventTypeNormal, EventStorageResized,
+			"Resized disk %s (%s) from %d to %d GB", resize.title, resize.uuid, resize.from, resize.to)
+		if !vm.Spec.ResizeFilesystem {
+			continue
+		}
+		backup, err := svc.ResizeStorageFilesystem(ctx, &request.ResizeStorageFilesystemRequest{UUID: resize.uuid})
+		if err != nil {
+			// The disk has grown, the guest can still grow its filesystem
+			r.event(vm, corev1.EventTypeWarning, EventFilesystemResizeFailed,
+				"Failed to grow the filesystem of disk %s (%s), grow it from the guest: %v", resize.title, resize.uuid, err)
+			continue
+		}
+		r.event(vm, corev1.EventTypeNormal, EventFilesystemResized,
+			"Grew the filesystem of disk %s (%s), UpCloud kept backup %s of it", resize.title, resize.uuid, backup.UUID)
+	}
+	if !resized {
+		return serverDetails, offline, nil
+	}
+	serverDetails, err := svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{UUID: vm.Status.VMID})
+	if err != nil {
+		return serverDetails, nil, fmt.Errorf("failed to get UpCloud VM: %w", err)
+	}
+	recordServer(vm, serverDetails)
+	return serverDetails, offline, nil
+}
+
+// reconcileStorageDevices makes the disks of an existing server follow
+// spec.storageDevices: missing disks are created or cloned and attached once
+// online and the ones removed from the spec are detached, leaving the
+// storage in UpCloud. resizeDisks grows them. It returns the server as last
+// reported and whether a disk is still being prepared, in which case the
+// caller polls again.
+func (r *UpCloudVMReconciler) reconcileStorageDevices(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) (*upcloud.ServerDetails, bool, error) {
+	pending := false
+	for i := range vm.Spec.StorageDevices {
+		device := &vm.Spec.StorageDevices[i]
+		disk := deviceDisk(vm, device)
+		if disk == nil {
+			storage, err := r.provisionStorage(ctx, svc, vm, device, serverDetails)
+			if err != nil {
+				return serverDetails, false, err
+			}
+			vm.Status.StorageDevices = append(vm.Status.StorageDevices, v1alpha1.StorageDeviceStatus{
+				UUID:    storage.UUID,
+				Title:   device.Title,
+				Size:    storage.Size,
+				Tier:    storage.Tier,
+				Managed: true,
+			})
+			pending = true
+			continue
+		}
+
+		if disk.Address == "" {
+			// Wait for a new disk to come online before attaching it
+			storage, err := svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: disk.UUID})
+			if isStorageNotFound(err) && device.Action != v1alpha1.StorageActionAttach {
+				// Deleted before it was attached, provide a new one
+				forgetDisk(vm, disk.UUID)
+				pending = true
+				continue
+			}
+			if err != nil {
+				return serverDetails, false, fmt.Errorf("failed to get storage %s: %w", disk.UUID, err)
+			}
+			if storage.State != upcloud.StorageStateOnline {
+				pending = true
+				continue
+			}
+			if device.Action == v1alpha1.StorageActionClone && storage.Title != device.Title {
+				// UpCloud only changes storages that are online, the clone
+				// gets its title, owner label and backup rule now
+				if _, err := svc.ModifyStorage(ctx, &request.ModifyStorageRequest{
+					UUID:       disk.UUID,
+					Title:      device.Title,
+					Labels:     &[]upcloud.Label{ownerLabel(vm)},
+					BackupRule: backupRule(device.BackupRule),
+				}); err != nil {
+					return serverDetails, false, fmt.Errorf("failed to set up storage %s: %w", disk.UUID, err)
+				}
+			}
+			address := device.Address
+			if address == "" {
+				address = defaultStorageBus
+			}
+			serverDetails, err = svc.AttachStorage(ctx, &request.AttachStorageRequest{
+				ServerUUID:  vm.Status.VMID,
+				Type:        upcloud.StorageTypeDisk,
+				Address:     address,
+				StorageUUID: disk.UUID,
+			})
+			if err != nil {
+				return serverDetails, false, fmt.Errorf("failed to attach storage %s: %w", disk.UUID, err)
+			}
+			r.event(vm, corev1.EventTypeNormal, EventStorageAttached,
+				"Attached disk %s (%s) to UpCloud server %s", device.Title, disk.UUID, vm.Status.VMID)
+			recordServer(vm, serverDetails)
+		}
+	}
+
+	// Detach the disks removed from the spec, their data stays in UpCloud
+	for i := 0; i < len(vm.Status.StorageDevices); i++ {
+		disk := vm.Status.StorageDevices[i]
+		if !disk.Managed || specDevice(vm, disk.UUID, disk.Title) != nil {
+			continue
+		}
+		if disk.Address != "" {
+			var err error
+			serverDetails, err = svc.DetachStorage(ctx, &request.DetachStorageRequest{
+				ServerUUID: vm.Status.VMID,
+				Address:    disk.Address,
+			})
+			if err != nil {
+				return serverDetails, false, fmt.Errorf("failed to detach storage %s: %w", disk.UUID, err)
+			}
+			r.event(vm, corev1.EventTypeNormal, EventStorageDetached,
+				"Detached disk %s (%s) from UpCloud server %s, the storage is kept", disk.Title, disk.UUID, vm.Status.VMID)
+		}
+		forgetDisk(vm, disk.UUID)
+		i--
+	}
+	return serverDetails, pending, nil
+}
+
+// reconcileStorageRefs attaches the UpCloudStorages of spec.storageRefs to
+// the server once they are online in its zone, and detaches the ones removed
+// from the spec, leaving their storage alone. It returns the server as last
+// reported and why some storages cannot be attached yet.
+func (r *UpCloudVMReconciler) reconcileStorageRefs(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) (*upcloud.ServerDetails, []string, error) {
+	var waiting []string
+	for _, ref := range vm.Spec.StorageRefs {
+		if refDisk(vm, ref.Name) != nil {
+			continue
+		}
+		var storage v1alpha1.UpCloudStorage
+		err := r.Get(ctx, types.NamespacedName{Namespace: vm.Namespace, Name: ref.Name}, &storage)
+		if apiError.IsNotFound(err) {
+			waiting = append(waiting, fmt.Sprintf("UpCloudStorage %s not found", ref.Name))
+			continue
+		}
+		if err != nil {
+			return serverDetails, nil, fmt.Errorf("failed to get UpCloudStorage %s: %w", ref.Name, err)
+		}
+		if storage.Status.UUID == "" || !storage.DeletionTimestamp.IsZero() {
+			waiting = append(waiting, fmt.Sprintf("UpCloudStorage %s is %s", ref.Name, stateOrPending(storage.Status.State)))
+			continue
+		}
+		details, err := svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: storage.Status.UUID})
+		if err != nil {
+			return serverDetails, nil, fmt.Errorf("failed to get storage %s: %w", storage.Status.UUID, err)
+		}
+		switch {
+		case details.Zone != serverDetails.Zone:
+			waiting = append(waiting, fmt.Sprintf("UpCloudStorage %s is in zone %s, the server in %s", ref.Name, details.Zone, serverDetails.Zone))
+			continue
+		case details.State != upcloud.StorageStateOnline:
+			waiting = append(waiting, fmt.Sprintf("UpCloudStorage %s is %s", ref.Name, details.State))
+			continue
+		case len(details.ServerUUIDs) > 0 && details.ServerUUIDs[0] != vm.Status.VMID:
+			waiting = append(waiting, fmt.Sprintf("UpCloudStorage %s is attached to UpCloud server %s", ref.Name, details.ServerUUIDs[0]))
+			continue
+		}
+		if len(details.ServerUUIDs) == 0 {
+			address := ref.Address
+			if address == "" {
+				address = defaultStorageBus
+			}
+			serverDetails, err = svc.AttachStorage(ctx, &request.AttachStorageRequest{
+				ServerUUID:  vm.Status.VMID,
+				Type:        upcloud.StorageTypeDisk,
+				Address:     address,
+				StorageUUID: details.UUID,
+			})
+			if err != nil {
+				return serverDetails, nil, fmt.Errorf("failed to attach storage %s: %w", details.UUID, err)
+			}
+			r.event(vm, corev1.EventTypeNormal, EventStorageAttached,
+				"Attached UpCloudStorage %s (%s) to UpCloud server %s", ref.Name, details.UUID, vm.Status.VMID)
+			recordServer(vm, serverDetails)
+		}
+		for i := range vm.Status.StorageDevices {
+			if vm.Status.StorageDevices[i].UUID == details.UUID {
+				vm.Status.StorageDevices[i].StorageRef = ref.Name
+			}
+		}
+	}
+
+	// Detach the storages removed from the spec, their UpCloudStorage keeps them
+	for i := 0; i < len(vm.Status.StorageDevices); i++ {
+		disk := vm.Status.StorageDevices[i]
+		if disk.StorageRef == "" || specStorageRef(vm, disk.StorageRef) {
+			continue
+		}
+		var err error
+		serverDetails, err = svc.DetachStorage(ctx, &request.DetachStorageRequest{
+			ServerUUID: vm.Status.VMID,
+			Address:    disk.Address,
+		})
+		if err != nil {
+			return serverDetails, nil, fmt.Errorf("failed to detach storage %s: %w", disk.UUID, err)
+		}
+		r.event(vm, corev1.EventTypeNormal, EventStorageDetached,
+			"Detached UpCloudStorage %s (%s) from UpCloud server %s", disk.StorageRef, disk.UUID, vm.Status.VMID)
+		forgetDisk(vm, disk.UUID)
+		i--
+	}
+	return serverDetails, waiting, nil
+}
+
+// refDisk returns the disk in the status attached for the UpCloudStorage of
+// spec.storageRefs, or nil.
+func refDisk(vm *v1alpha1.UpCloudVM, name string) *v1alpha1.StorageDeviceStatus {
+	for i := range vm.Status.StorageDevices {
+		if disk := &vm.Status.StorageDevices[i]; disk.StorageRef == name && disk.Address != "" {
+			return disk
+		}
+	}
+	return nil
+}
+
+// specStorageRef reports whether spec.storageRefs names the UpCloudStorage.
+func specStorageRef(vm *v1alpha1.UpCloudVM, name string) bool {
+	for _, ref := range vm.Spec.StorageRefs {
+		if ref.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// stateOrPending returns the state of an object, or "pending" before it has one.
+func stateOrPending(state string) string {
+	if state == "" {
+		return "pending"
+	}
+	return state
+}
+
+// provisionStorage creates or clones the disk of a storage device in the
+// zone of the server. An attached storage already exists and is returned
+// as is, as is a disk created by an earlier reconcile whose UUID was not
+// recorded.
+func (r *UpCloudVMReconciler) provisionStorage(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, device *v1alpha1.StorageDevice, serverDetails *upcloud.ServerDetails) (*upcloud.StorageDetails, error) {
+	tier := device.Tier
+	if tier == "" && len(serverDetails.StorageDevices) > 0 {
+		tier = serverDetails.StorageDevices[0].Tier
+	}
+	if device.Action != v1alpha1.StorageActionAttach {
+		found, err := findDisk(ctx, svc, vm, device)
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			r.event(vm, corev1.EventTypeNormal, EventStorageAdopted,
+				"Adopted disk %s (%s) created earlier for this UpCloudVM", device.Title, found.UUID)
+			return &upcloud.StorageDetails{Storage: *found}, nil
+		}
+	}
+	switch device.Action {
+	case v1alpha1.StorageActionAttach:
+		storage, err := svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: device.Storage})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get storage %s: %w", device.Storage, err)
+		}
+		return storage, nil
+	case v1alpha1.StorageActionClone:
+		storage, err := svc.CloneStorage(ctx, &request.CloneStorageRequest{
+			UUID:      device.Storage,
+			Zone:      serverDetails.Zone,
+			Tier:      tier,
+			Title:     cloneTitle(vm, device),
+			Encrypted: upcloud.FromBool(device.Encrypted),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to clone storage %s: %w", device.Storage, err)
+		}
+		r.event(vm, corev1.EventTypeNormal, EventStorageCreated,
+			"Cloning disk %s (%s) from storage %s", device.Title, storage.UUID, device.Storage)
+		return storage, nil
+	default:
+		storage, err := svc.CreateStorage(ctx, &request.CreateStorageRequest{
+			Size:       device.Size,
+			Tier:       tier,
+			Title:      device.Title,
+			Zone:       serverDetails.Zone,
+			Encrypted:  upcloud.FromBool(device.Encrypted),
+			BackupRule: backupRule(device.BackupRule),
+			Labels:     []upcloud.Label{ownerLabel(vm)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage %s: %w", device.Title, err)
+		}
+		r.event(vm, corev1.EventTypeNormal, EventStorageCreated,
+			"Created disk %s (%s) of %d GB", device.Title, storage.UUID, storage.Size)
+		return storage, nil
+	}
+}
+
+// cloneTitle returns the title a disk is cloned with: UpCloud takes no
+// labels for clones, the UID of the VM in the title marks it as the VM's
+// until reconcileStorageDevices gives it the device's title and the owner
+// label once online.
+func cloneTitle(vm *v1alpha1.UpCloudVM, device *v1alpha1.StorageDevice) string {
+	return cutTitle(string(vm.UID) + " " + device.Title)
+}
+
+// cutTitle cuts a storage title to what UpCloud accepts, on a rune boundary.
+func cutTitle(title string) string {
+	if utf8.RuneCountInString(title) <= maxBackupTitle {
+		return title
+	}
+	return string([]rune(title)[:maxBackupTitle])
+}
+
+// findDisk returns the disk of the storage device created for the VM by an
+// earlier reconcile but missing from its status: a created disk carrying
+// the owner label and the device's title, or a clone still titled by
+// cloneTitle. Disks the status already records are not considered.
+func findDisk(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, device *v1alpha1.StorageDevice) (*upcloud.Storage, error) {
+	storages, err := svc.GetStorages(ctx, &request.GetStoragesRequest{
+		Access: upcloud.StorageAccessPrivate,
+		Type:   upcloud.StorageTypeNormal,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UpCloud storages: %w", err)
+	}
+	owner := ownerLabel(vm)
+	var found []upcloud.Storage
+	for _, storage := range storages.Storages {
+		if recordedDisk(vm, storage.UUID) {
+			continue
+		}
+		labelled := storage.Title == device.Title && containsLabel(storage.Labels, owner)
+		if labelled || storage.Title == cloneTitle(vm, device) {
+			found = append(found, storage)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &found[0], nil
+	}
+	uuids := make([]string, 0, len(found))
+	for _, storage := range found {
+		uuids = append(uuids, storage.UUID)
+	}
+	// Picking one would leave the others billed unnoticed
+	return nil, fmt.Errorf("found %d UpCloud storages for disk %s, expected at most one: %s",
+		len(uuids), device.Title, strings.Join(uuids, ", "))
+}
+
+// recordedDisk reports whether the status records the disk with the given UUID.
+func recordedDisk(vm *v1alpha1.UpCloudVM, uuid string) bool {
+	for _, disk := range vm.Status.StorageDevices {
+		if disk.UUID == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// containsLabel reports whether labels contain label.
+func containsLabel(labels []upcloud.Label, label upcloud.Label) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// offlineDisks lists the disks of the server that are not online, e.g.
+// still being restored from a backup. UpCloud does not start a server until
+// they are.
+func offlineDisks(ctx context.Context, svc cloud.Provider, serverDetails *upcloud.ServerDetails) ([]string, error) {
+	var offline []string
+	for _, d := range serverDetails.StorageDevices {
+		if d.Type != upcloud.StorageTypeDisk {
+			continue
+		}
+		storage, err := svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: d.UUID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get storage %s: %w", d.UUID, err)
+		}
+		if storage.State != upcloud.StorageStateOnline {
+			offline = append(offline, fmt.Sprintf("%s is %s", d.Title, storage.State))
+		}
+	}
+	return offline, nil
+}
+
+// detachAttachedStorages detaches the storages the spec attaches and the
+// UpCloudStorages of spec.storageRefs, so that deleting the server with its
+// disks leaves them alone.
+func detachAttachedStorages(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) error {
+	for _, d := range serverDetails.StorageDevices {
+		if !attachedStorage(vm, d) {
+			continue
+		}
+		if _, err := svc.DetachStorage(ctx, &request.DetachStorageRequest{
+			ServerUUID: serverDetails.UUID,
+			Address:    d.Address,
+		}); err != nil {
+			return fmt.Errorf("failed to detach storage %s: %w", d.UUID, err)
+		}
+	}
+	return nil
+}
+
+// attachedStorage reports whether the VM attached the existing storage d,
+// from its spec or an UpCloudStorage, rather than created it.
+func attachedStorage(vm *v1alpha1.UpCloudVM, d upcloud.ServerStorageDevice) bool {
+	for _, disk := range vm.Status.StorageDevices {
+		if disk.UUID == d.UUID && disk.StorageRef != "" {
+			return true
+		}
+	}
+	device := specDevice(vm, d.UUID, d.Title)
+	return device != nil && device.Action == v1alpha1.StorageActionAttach
+}
+
+// ownedStorages lists the storages of the server the VM created, as
+// storage/<uuid>.
+func ownedStorages(vm *v1alpha1.UpCloudVM, serverDetails *upcloud.ServerDetails) []string {
+	var owned []string
+	for _, d := range serverDetails.StorageDevices {
+		if !attachedStorage(vm, d) {
+			owned = append(owned, "storage/"+d.UUID)
+		}
+	}
+	return owned
+}
+
+// recordedOwnedStorages lists the disks in the status the VM created, as
+// storage/<uuid>, for when the server is not read.
+func recordedOwnedStorages(vm *v1alpha1.UpCloudVM) []string {
+	var owned []string
+	for _, disk := range vm.Status.StorageDevices {
+		if !attachedStorage(vm, upcloud.ServerStorageDevice{UUID: disk.UUID, Title: disk.Title}) {
+			owned = append(owned, "storage/"+disk.UUID)
+		}
+	}
+	return owned
+}
+
+// forgetDisk removes the disk from the status.
+func forgetDisk(vm *v1alpha1.UpCloudVM, uuid string) {
+	for i, disk := range vm.Status.StorageDevices {
+		if disk.UUID == uuid {
+			vm.Status.StorageDevices = append(vm.Status.StorageDevices[:i:i], vm.Status.StorageDevices[i+1:]...)
+			return
+		}
+	}
+}
+
+// isServerStateIllegal reports whether err says the server must be in
+// another state, e.g. stopped, for the request.
+func isServerStateIllegal(err error) bool {
+	var problem *upcloud.Problem
+	return errors.As(err, &problem) && problem.ErrorCode() == upcloud.ErrCodeServerStateIllegal
+}
+
+// isStorageNotFound reports whether err says the storage does not exist in UpCloud.
+func isStorageNotFound(err error) bool {
+	var problem *upcloud.Problem
+	return errors.As(err, &problem) && problem.ErrorCode() == upcloud.ErrCodeStorageNotFound
+}
@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apiError "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// AccountCheckInterval is how often the account of a ready
+// UpCloudProviderConfig is validated again to refresh its credit balance.
+const AccountCheckInterval = time.Hour
+
+// configCredentialsRefIndex indexes UpCloudProviderConfigs by the
+// namespace/name of their credentials Secret.
+const configCredentialsRefIndex = "spec.credentialsRef"
+
+// UpCloudProviderConfigReconciler validates the UpCloud account of an
+// UpCloudProviderConfig and reports it in the config's status
+type UpCloudProviderConfigReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Logger logr.Logger
+
+	// Cloud is the UpCloud API used to validate accounts. When nil, an SDK
+	// client is built from the config's credentials.
+	Cloud cloud.Provider
+	// APIBaseURL overrides the UpCloud API endpoint of SDK clients for
+	// configs that do not set one.
+	APIBaseURL string
+	// Clients caches SDK clients, shared with the UpCloudVM reconciler.
+	// When nil, a new client is built for every reconcile.
+	Clients *cloud.Pool
+}
+
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudproviderconfigs,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudproviderconfigs/status,verbs=get;update;patch
+
+// Reconcile validates the account of an UpCloudProviderConfig with GetAccount.
+// This happens when the config or its credentials Secret changes and every
+// AccountCheckInterval, so VMs referencing the config do not need to.
+func (r *UpCloudProviderConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	r.Logger = log.FromContext(ctx)
+
+	var config v1alpha1.UpCloudProviderConfig
+	if err := r.Get(ctx, req.NamespacedName, &config); err != nil {
+		if apiError.IsNotFound(err) {
+			r.Logger.Info("UpCloudProviderConfig resource not found. skip...")
+			return ctrl.Result{}, nil
+		}
+		r.Logger.Error(err, "Failed to get UpCloudProviderConfig")
+		return ctrl.Result{}, err
+	}
+
+	account, err := r.getAccount(ctx, &config)
+	if err != nil {
+		r.Logger.Error(err, "Failed to validate UpCloud account")
+		if err := r.setNotReady(ctx, &config, err); err != nil {
+			return ctrl.Result{}, err
+		}
+		var blocked *blockedError
+		if errors.As(err, &blocked) {
+			// Wait for the Secret to change rather than retrying
+			return ctrl.Result{}, nil
+		}
+		var problem *upcloud.Problem
+		if errors.As(err, &problem) {
+			// The API answered, so retrying right away will not help
+			return ctrl.Result{RequeueAfter: AccountCheckInterval}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	now := metav1.Now()
+	config.Status = v1alpha1.UpCloudProviderConfigStatus{
+		Ready:              true,
+		Username:           account.UserName,
+		Credits:            strconv.FormatFloat(account.Credits, 'f', -1, 64),
+		LastCheckedTime:    &now,
+		ObservedGeneration: config.Generation,
+	}
+	if err := r.Status().Update(ctx, &config); err != nil {
+		r.Logger.Error(err, "Failed to update UpCloudProviderConfig status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: AccountCheckInterval}, nil
+}
+
+// getAccount fetches the account of the config with its credentials.
+func (r *UpCloudProviderConfigReconciler) getAccount(ctx context.Context, config *v1alpha1.UpCloudProviderConfig) (*upcloud.Account, error) {
+	if r.Cloud != nil {
+		return r.Cloud.GetAccount(ctx)
+	}
+	creds, err := configCredentials(ctx, r.Client, config)
+	if err != nil {
+		return nil, err
+	}
+	// The pool's check of a new client is the account read
+	return r.Clients.Account(ctx, creds, clientSettings(r.APIBaseURL, config))
+}
+
+// setNotReady records in the status why the config's account cannot be used.
+func (r *UpCloudProviderConfigReconciler) setNotReady(ctx context.Context, config *v1alpha1.UpCloudProviderConfig, err error) error {
+	now := metav1.Now()
+	config.Status.Ready = false
+	config.Status.Message = err.Error()
+	config.Status.LastCheckedTime = &now
+	config.Status.ObservedGeneration = config.Generation
+	return r.Status().Update(ctx, config)
+}
+
+// configsForSecret maps a Secret to the UpCloudProviderConfigs that take
+// their credentials from it.
+func (r *UpCloudProviderConfigReconciler) configsForSecret(ctx context.Context, secret client.Object) []reconcile.Request {
+	name := types.NamespacedName{Namespace: secret.GetNamespace(), Name: secret.GetName()}
+	var configs v1alpha1.UpCloudProviderConfigList
+	if err := r.List(ctx, &configs, client.MatchingFields{configCredentialsRefIndex: name.String()}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list UpCloudProviderConfigs for credentials Secret", "secret", name)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(configs.Items))
+	for _, config := range configs.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: config.Name}})
+	}
+	return requests
+}
+
+// indexConfigCredentialsRef is the field indexer behind configCredentialsRefIndex.
+func indexConfigCredentialsRef(obj client.Object) []string {
+	ref := obj.(*v1alpha1.UpCloudProviderConfig).Spec.CredentialsRef
+	if ref == nil {
+		return nil
+	}
+	return []string{types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}.String()}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *UpCloudProviderConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.UpCloudProviderConfig{},
+		configCredentialsRefIndex, indexConfigCredentialsRef); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		// Status updates do not need another account check
+		For(&v1alpha1.UpCloudProviderConfig{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.configsForSecret)).
+		Complete(r)
+}
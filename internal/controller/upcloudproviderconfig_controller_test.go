@@ -0,0 +1,129 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	infrastructurev1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud/fake"
+	"github.com/harper1011/vm-controller/test/upcloudsim"
+)
+
+var _ = Describe("UpCloudProviderConfig Controller", func() {
+	const configName = "test-config"
+	const secretName = "upcloud-account"
+
+	ctx := context.Background()
+
+	typeNamespacedName := types.NamespacedName{Name: configName}
+
+	createConfig := func(spec infrastructurev1alpha1.UpCloudProviderConfigSpec) {
+		Expect(k8sClient.Create(ctx, &infrastructurev1alpha1.UpCloudProviderConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: configName},
+			Spec:       spec,
+		})).To(Succeed())
+	}
+
+	reconcileAndGet := func(r *UpCloudProviderConfigReconciler) (reconcile.Result, *infrastructurev1alpha1.UpCloudProviderConfig) {
+		result, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+		Expect(err).NotTo(HaveOccurred())
+		config := &infrastructurev1alpha1.UpCloudProviderConfig{}
+		Expect(k8sClient.Get(ctx, typeNamespacedName, config)).To(Succeed())
+		return result, config
+	}
+
+	AfterEach(func() {
+		config := &infrastructurev1alpha1.UpCloudProviderConfig{ObjectMeta: metav1.ObjectMeta{Name: configName}}
+		Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, config))).To(Succeed())
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: "default"}}
+		Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, secret))).To(Succeed())
+	})
+
+	It("should report the validated account in the status", func() {
+		createConfig(infrastructurev1alpha1.UpCloudProviderConfigSpec{Zone: "fi-hel1"})
+		provider := fake.NewProvider()
+
+		result, config := reconcileAndGet(&UpCloudProviderConfigReconciler{
+			Client: k8sClient,
+			Scheme: k8sClient.Scheme(),
+			Cloud:  provider,
+		})
+		Expect(result.RequeueAfter).To(Equal(AccountCheckInterval))
+		Expect(config.Status.Ready).To(BeTrue())
+		Expect(config.Status.Username).To(Equal("fake"))
+		Expect(config.Status.Credits).To(Equal("1000"))
+		Expect(config.Status.ObservedGeneration).To(Equal(config.Generation))
+		Expect(provider.Calls("GetAccount")).To(Equal(1))
+	})
+
+	It("should not be ready when the account is rejected", func() {
+		createConfig(infrastructurev1alpha1.UpCloudProviderConfigSpec{})
+		provider := fake.NewProvider()
+		provider.FailNext("GetAccount", &upcloud.Problem{
+			Type:   "https://developers.upcloud.com/1.3/errors#ERROR_" + upcloud.ErrCodeAuthenticationFailed,
+			Title:  "Authentication failed using the given username and password.",
+			Status: 401,
+		})
+
+		_, config := reconcileAndGet(&UpCloudProviderConfigReconciler{
+			Client: k8sClient,
+			Scheme: k8sClient.Scheme(),
+			Cloud:  provider,
+		})
+		Expect(config.Status.Ready).To(BeFalse())
+		Expect(config.Status.Message).To(ContainSubstring("Authentication failed"))
+	})
+
+	It("should validate the credentials Secret against the configured API endpoint", func() {
+		sim := upcloudsim.New(upcloudsim.Options{Credits: 42})
+		defer sim.Close()
+		createConfig(infrastructurev1alpha1.UpCloudProviderConfigSpec{
+			CredentialsRef: &infrastructurev1alpha1.CredentialsReference{Name: secretName, Namespace: "default"},
+			APIEndpoint:    sim.URL,
+		})
+		r := &UpCloudProviderConfigReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+
+		By("Reporting the missing Secret")
+		_, config := reconcileAndGet(r)
+		Expect(config.Status.Ready).To(BeFalse())
+		Expect(config.Status.Message).To(ContainSubstring("not found"))
+
+		By("Validating the account once the Secret exists")
+		Expect(k8sClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: "default"},
+			Data: map[string][]byte{
+				SecretKeyUsername: []byte(upcloudsim.DefaultUsername),
+				SecretKeyPassword: []byte(upcloudsim.DefaultPassword),
+			},
+		})).To(Succeed())
+		_, config = reconcileAndGet(r)
+		Expect(config.Status.Ready).To(BeTrue())
+		Expect(config.Status.Message).To(BeEmpty())
+		Expect(config.Status.Credits).To(Equal("42"))
+		Expect(sim.Requests("GET /account")).To(Equal(1))
+	})
+})
@@ -0,0 +1,579 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apiError "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// Status states of an UpCloudStorage, besides StateLost, StateDeleting and
+// the states of a blockedError.
+const (
+	StateCreating  = "Creating"
+	StateAvailable = "Available"
+	StateAttached  = "Attached"
+)
+
+// Reasons of the UpCloudStorage conditions and Events.
+const (
+	ReasonStorageOnline      = "StorageOnline"
+	ReasonStorageAttached    = "StorageAttached"
+	ReasonStorageDetached    = "StorageDetached"
+	ReasonStorageNotFound    = "StorageNotFound"
+	ReasonServerNotStopped   = "ServerNotStopped"
+	EventStorageAdopted      = "StorageAdopted"
+	EventStorageDeleted      = "StorageDeleted"
+	EventStorageLost         = "StorageLost"
+	EventStorageDeleteWaits  = "StorageDeleteWaits"
+	EventStorageLabelsSynced = "StorageLabelsSynced"
+)
+
+// UpCloudStorageReconciler reconciles an UpCloudStorage object: it creates
+// the storage in UpCloud, grows it and keeps its labels, and deletes it with
+// the object once no server uses it. UpCloudVMs attach it themselves.
+type UpCloudStorageReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Logger logr.Logger
+
+	// Cloud is the UpCloud API used to manage storages. When nil, an SDK
+	// client is built like for UpCloudVMs.
+	Cloud cloud.Provider
+	// APIBaseURL overrides the UpCloud API endpoint of SDK clients.
+	APIBaseURL string
+	// Clients caches SDK clients, shared with the UpCloudVM reconciler.
+	Clients *cloud.Pool
+	// Recorder records the lifecycle Events shown by kubectl describe.
+	Recorder record.EventRecorder
+	// ResyncInterval is how often storages are read from UpCloud to refresh
+	// their status. Defaults to DefaultResyncInterval.
+	ResyncInterval time.Duration
+}
+
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudstorages,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudstorages/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudstorages/finalizers,verbs=update
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudproviderconfigs,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile creates, grows, relabels and deletes the UpCloud storage of an
+// UpCloudStorage.
+func (r *UpCloudStorageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	r.Logger = log.FromContext(ctx)
+
+	var storage v1alpha1.UpCloudStorage
+	if err := r.Get(ctx, req.NamespacedName, &storage); err != nil {
+		if apiError.IsNotFound(err) {
+			r.Logger.Info("UpCloudStorage resource not found. skip...")
+			return ctrl.Result{}, nil
+		}
+		r.Logger.Error(err, "Failed to get UpCloudStorage")
+		return ctrl.Result{}, err
+	}
+	// Like for UpCloudVMs, the status is written once on the way out
+	oldStatus := storage.Status.DeepCopy()
+	defer func() {
+		if statusErr := r.updateStatus(ctx, &storage, oldStatus); statusErr != nil {
+			r.Logger.Error(statusErr, "Failed to update UpCloudStorage status")
+			if err == nil {
+				result, err = ctrl.Result{}, statusErr
+			}
+		}
+	}()
+
+	if !storage.DeletionTimestamp.IsZero() {
+		return r.reconcileDelete(ctx, &storage)
+	}
+
+	config, err := readyProviderConfig(ctx, r.Client, storage.Spec.ProviderConfigRef)
+	if err != nil {
+		return ctrl.Result{}, r.reportBlocked(&storage, err)
+	}
+	svc, err := r.getService(ctx, &storage, config)
+	if err != nil {
+		return ctrl.Result{}, r.reportBlocked(&storage, err)
+	}
+
+	if !containsString(storage.Finalizers, UPCloudFinalizer) {
+		storage.Finalizers = append(storage.Finalizers, UPCloudFinalizer)
+		if err := r.update(ctx, &storage); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if storage.Status.State == StateLost {
+		// A new empty storage would pass for the lost data
+		return ctrl.Result{}, nil
+	}
+	if storage.Status.UUID == "" {
+		// Like for servers, a storage created by an earlier reconcile whose
+		// status update was lost carries the owner label
+		found, err := r.findStorage(ctx, svc, &storage)
+		if err != nil {
+			r.Logger.Error(err, "Failed to look up UpCloud storage")
+			r.reportProblem(&storage, v1alpha1.ConditionReady, ReasonCreateFailed, err)
+			return ctrl.Result{}, err
+		}
+		if found != nil {
+			r.Logger.Info("Adopting existing UpCloud storage", "uuid", found.UUID)
+			r.event(&storage, corev1.EventTypeNormal, EventStorageAdopted,
+				"Adopted UpCloud storage %s labelled as owned by this UpCloudStorage", found.UUID)
+			storage.Status.UUID = found.UUID
+		} else {
+			details, err := r.createStorage(ctx, svc, &storage, config)
+			if err != nil {
+				r.Logger.Error(err, "Failed to create UpCloud storage")
+				r.reportProblem(&storage, v1alpha1.ConditionReady, ReasonCreateFailed, err)
+				return ctrl.Result{}, err
+			}
+			storage.Status.State = StateCreating
+			recordStorage(&storage, details)
+			return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+		}
+	}
+
+	details, err := svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: storage.Status.UUID})
+	if isStorageNotFound(err) {
+		message := fmt.Sprintf("UpCloud storage %s was deleted outside Kubernetes", storage.Status.UUID)
+		r.event(&storage, corev1.EventTypeWarning, EventStorageLost, "%s", message)
+		storage.Status.State = StateLost
+		setStorageCondition(&storage, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonStorageNotFound, message)
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		r.reportProblem(&storage, v1alpha1.ConditionSynced, ReasonSyncFailed, err)
+		return ctrl.Result{}, fmt.Errorf("failed to get UpCloud storage: %w", err)
+	}
+	recordStorage(&storage, details)
+	if details.State != upcloud.StorageStateOnline {
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	if err := r.applySpec(ctx, svc, &storage, details); err != nil {
+		r.reportProblem(&storage, v1alpha1.ConditionSynced, ReasonSyncFailed, err)
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+}
+
+// reconcileDelete deletes the storage from UpCloud and then removes the
+// finalizer. Without usable credentials a storage with no recorded UUID is
+// let go, as nothing is known to have been created; a recorded one waits
+// for the credentials, saying so in a Warning Event.
+func (r *UpCloudStorageReconciler) reconcileDelete(ctx context.Context, storage *v1alpha1.UpCloudStorage) (ctrl.Result, error) {
+	config, err := readyProviderConfig(ctx, r.Client, storage.Spec.ProviderConfigRef)
+	var svc cloud.Provider
+	if err == nil {
+		svc, err = r.getService(ctx, storage, config)
+	}
+	if err != nil {
+		if storage.Status.UUID == "" {
+			r.Logger.Info("Removing the finalizer without credentials, no UpCloud storage was recorded", "reason", err.Error())
+			storage.Finalizers = removeString(storage.Finalizers, UPCloudFinalizer)
+			return ctrl.Result{}, r.update(ctx, storage)
+		}
+		return ctrl.Result{}, r.reportDeleteBlocked(storage, err)
+	}
+
+	storage.Status.State = StateDeleting
+	deleted, err := r.deleteStorage(ctx, svc, storage)
+	if err != nil {
+		r.Logger.Error(err, "Failed to delete UpCloud storage")
+		r.reportProblem(storage, v1alpha1.ConditionReady, ReasonDeleteFailed, err)
+		return ctrl.Result{}, err
+	}
+	if !deleted {
+		// Come back once the servers have let go of it
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	storage.Finalizers = removeString(storage.Finalizers, UPCloudFinalizer)
+	return ctrl.Result{}, r.update(ctx, storage)
+}
+
+// getService returns the UpCloud API client for the storage. Its own
+// credentials Secret wins over the one of its UpCloudProviderConfig, which
+// wins over the manager's environment.
+func (r *UpCloudStorageReconciler) getService(ctx context.Context, storage *v1alpha1.UpCloudStorage, config *v1alpha1.UpCloudProviderConfig) (cloud.Provider, error) {
+	return referencedService(ctx, r.Client, r.Cloud, r.Clients, r.APIBaseURL, storage.Spec.CredentialsRef, storage.Namespace, config)
+}
+
+// findStorage returns the storage carrying the owner label of the
+// UpCloudStorage, or nil if there is none.
+func (r *UpCloudStorageReconciler) findStorage(ctx context.Context, svc cloud.Provider, storage *v1alpha1.UpCloudStorage) (*upcloud.Storage, error) {
+	owner := storageOwnerLabel(storage)
+	storages, err := svc.GetStorages(ctx, &request.GetStoragesRequest{
+		Access:  upcloud.StorageAccessPrivate,
+		Type:    upcloud.StorageTypeNormal,
+		Filters: []request.QueryFilter{request.FilterLabel{Label: owner}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UpCloud storages: %w", err)
+	}
+	switch len(storages.Storages) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &storages.Storages[0], nil
+	}
+	uuids := make([]string, 0, len(storages.Storages))
+	for _, found := range storages.Storages {
+		uuids = append(uuids, found.UUID)
+	}
+	// Picking one would leave the others billed unnoticed
+	return nil, fmt.Errorf("found %d UpCloud storages labelled %s=%s, expected at most one: %s",
+		len(uuids), OwnerLabelKey, owner.Value, strings.Join(uuids, ", "))
+}
+
+// createStorage creates the storage in the zone and tier of the spec,
+// falling back to those of the UpCloudProviderConfig.
+func (r *UpCloudStorageReconciler) createStorage(ctx context.Context, svc cloud.Provider, storage *v1alpha1.UpCloudStorage, config *v1alpha1.UpCloudProviderConfig) (*upcloud.StorageDetails, error) {
+	zone, tier := storage.Spec.Zone, storage.Spec.Tier
+	if config != nil {
+		if zone == "" {
+			zone = config.Spec.Zone
+		}
+		if tier == "" {
+			tier = config.Spec.StorageTier
+		}
+	}
+	if zone == "" {
+		return nil, errors.New("zone must be set on the UpCloudStorage or its UpCloudProviderConfig")
+	}
+	if tier == "" {
+		tier = defaultStorageTier
+	}
+	details, err := svc.CreateStorage(ctx, &request.CreateStorageRequest{
+		Size:      storage.Spec.Size,
+		Tier:      tier,
+		Title:     storage.Name,
+		Zone:      zone,
+		Encrypted: upcloud.FromBool(storage.Spec.Encrypted),
+		Labels:    storageLabels(storage),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UpCloud storage: %w", err)
+	}
+	r.event(storage, corev1.EventTypeNormal, EventStorageCreated,
+		"Created UpCloud storage %s of %d GB in zone %s", details.UUID, details.Size, zone)
+	return details, nil
+}
+
+// applySpec grows the storage and sets its labels to the spec. UpCloud may
+// only grow the storage of a stopped server; the Synced condition then says
+// so until the server stops or the storage is detached.
+func (r *UpCloudStorageReconciler) applySpec(ctx context.Context, svc cloud.Provider, storage *v1alpha1.UpCloudStorage, details *upcloud.StorageDetails) error {
+	if labels := storageLabels(storage); !equalLabels(labels, details.Labels) {
+		if _, err := svc.ModifyStorage(ctx, &request.ModifyStorageRequest{UUID: details.UUID, Labels: &labels}); err != nil {
+			return fmt.Errorf("failed to set the labels of UpCloud storage %s: %w", details.UUID, err)
+		}
+		r.event(storage, corev1.EventTypeNormal, EventStorageLabelsSynced, "Set the labels of UpCloud storage %s", details.UUID)
+	}
+
+	switch {
+	case storage.Spec.Size < details.Size:
+		setStorageCondition(storage, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonDiskShrinkRefused,
+			fmt.Sprintf("UpCloud cannot shrink storage %s from %d GB to %d GB", details.UUID, details.Size, storage.Spec.Size))
+		return nil
+	case storage.Spec.Size > details.Size:
+		_, err := svc.ModifyStorage(ctx, &request.ModifyStorageRequest{UUID: details.UUID, Size: storage.Spec.Size})
+		if isServerStateIllegal(err) {
+			setStorageCondition(storage, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonServerNotStopped,
+				fmt.Sprintf("UpCloud only grows storage %s while server %s is stopped", details.UUID, storage.Status.ServerUUID))
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resize UpCloud storage %s: %w", details.UUID, err)
+		}
+		r.event(storage, corev1.EventTypeNormal, EventStorageResized,
+			"Resized UpCloud storage %s from %d to %d GB", details.UUID, details.Size, storage.Spec.Size)
+		storage.Status.Size = storage.Spec.Size
+	}
+	setStorageCondition(storage, v1alpha1.ConditionSynced, metav1.ConditionTrue, ReasonSynced, "")
+	return nil
+}
+
+// deleteStorage deletes the storage from UpCloud. It returns false while
+// the storage is still attached to a server, which UpCloud refuses.
+func (r *UpCloudStorageReconciler) deleteStorage(ctx context.Context, svc cloud.Provider, storage *v1alpha1.UpCloudStorage) (bool, error) {
+	if storage.Status.UUID == "" {
+		// The storage may have been created by a reconcile whose status
+		// update was lost
+		found, err := r.findStorage(ctx, svc, storage)
+		if err != nil || found == nil {
+			return err == nil, err
+		}
+		storage.Status.UUID = found.UUID
+	}
+	details, err := svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: storage.Status.UUID})
+	if isStorageNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get UpCloud storage: %w", err)
+	}
+	recordStorage(storage, details)
+	storage.Status.State = StateDeleting
+	if len(details.ServerUUIDs) > 0 {
+		message := fmt.Sprintf("waiting for UpCloud server %s to detach the storage, remove it from the storageRefs of its UpCloudVM",
+			details.ServerUUIDs[0])
+		if cond := meta.FindStatusCondition(storage.Status.Conditions, v1alpha1.ConditionReady); cond == nil || cond.Message != message {
+			r.event(storage, corev1.EventTypeWarning, EventStorageDeleteWaits, "%s", message)
+		}
+		setStorageCondition(storage, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonDeleting, message)
+		return false, nil
+	}
+	err = svc.DeleteStorage(ctx, &request.DeleteStorageRequest{UUID: details.UUID})
+	if err != nil && !isStorageNotFound(err) {
+		return false, fmt.Errorf("failed to delete UpCloud storage: %w", err)
+	}
+	r.event(storage, corev1.EventTypeNormal, EventStorageDeleted, "Deleted UpCloud storage %s", details.UUID)
+	return true, nil
+}
+
+// recordStorage copies what UpCloud reports about the storage into the
+// status.
+func recordStorage(storage *v1alpha1.UpCloudStorage, details *upcloud.StorageDetails) {
+	storage.Status.UUID = details.UUID
+	storage.Status.StorageState = details.State
+	storage.Status.Size = details.Size
+	storage.Status.Tier = details.Tier
+	storage.Status.Zone = details.Zone
+	storage.Status.ServerUUID = ""
+	if len(details.ServerUUIDs) > 0 {
+		storage.Status.ServerUUID = details.ServerUUIDs[0]
+	}
+
+	if storage.Status.ServerUUID != "" {
+		setStorageCondition(storage, v1alpha1.ConditionAttached, metav1.ConditionTrue, ReasonStorageAttached,
+			fmt.Sprintf("attached to UpCloud server %s", storage.Status.ServerUUID))
+	} else {
+		setStorageCondition(storage, v1alpha1.ConditionAttached, metav1.ConditionFalse, ReasonStorageDetached, "")
+	}
+	if details.State != upcloud.StorageStateOnline {
+		setStorageCondition(storage, v1alpha1.ConditionReady, metav1.ConditionFalse, "Storage"+conditionReason(details.State),
+			fmt.Sprintf("UpCloud storage %s is %s", details.UUID, details.State))
+		return
+	}
+	setStorageCondition(storage, v1alpha1.ConditionReady, metav1.ConditionTrue, ReasonStorageOnline, "")
+	storage.Status.State = StateAvailable
+	if storage.Status.ServerUUID != "" {
+		storage.Status.State = StateAttached
+	}
+}
+
+// storageOwnerLabel returns the label marking a storage in UpCloud as
+// created for the UpCloudStorage.
+func storageOwnerLabel(storage *v1alpha1.UpCloudStorage) upcloud.Label {
+	return upcloud.Label{
+		Key:   OwnerLabelKey,
+		Value: fmt.Sprintf("%s/%s/%s", storage.Namespace, storage.Name, storage.UID),
+	}
+}
+
+// storageLabels returns the labels of the storage in UpCloud: those of the
+// spec, sorted by key, and the owner label. The CRD rejects an owner label
+// in the spec; one that slipped in is left out rather than overriding it.
+func storageLabels(storage *v1alpha1.UpCloudStorage) []upcloud.Label {
+	labels := make([]upcloud.Label, 0, len(storage.Spec.Labels)+1)
+	for key, value := range storage.Spec.Labels {
+		if key == OwnerLabelKey {
+			continue
+		}
+		labels = append(labels, upcloud.Label{Key: key, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Key < labels[j].Key })
+	return append(labels, storageOwnerLabel(storage))
+}
+
+// equalLabels reports whether a and b hold the same labels in any order.
+func equalLabels(a, b []upcloud.Label) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	values := make(map[string]string, len(a))
+	for _, label := range a {
+		values[label.Key] = label.Value
+	}
+	for _, label := range b {
+		if value, ok := values[label.Key]; !ok || value != label.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// setStorageCondition sets a condition of the storage.
+func setStorageCondition(storage *v1alpha1.UpCloudStorage, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&storage.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: storage.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// reportProblem sets the condition to False because of err and records a
+// warning Event, see setProblemCondition.
+func (r *UpCloudStorageReconciler) reportProblem(storage *v1alpha1.UpCloudStorage, conditionType, fallbackReason string, err error) {
+	reason, message := problemReason(err, fallbackReason)
+	setStorageCondition(storage, conditionType, metav1.ConditionFalse, reason, message)
+	r.event(storage, corev1.EventTypeWarning, reason, "%s", message)
+}
+
+// reportBlocked records in the status why the storage cannot be reconciled
+// when err is a blockedError, and returns any other error for a retry.
+func (r *UpCloudStorageReconciler) reportBlocked(storage *v1alpha1.UpCloudStorage, err error) error {
+	var blocked *blockedError
+	if !errors.As(err, &blocked) {
+		return err
+	}
+	r.Logger.Info("UpCloudStorage is blocked", "state", blocked.state, "reason", blocked.Error())
+	if storage.Status.State != blocked.state {
+		r.event(storage, corev1.EventTypeWarning, blocked.state, "%s", blocked.Error())
+	}
+	storage.Status.State = blocked.state
+	setStorageCondition(storage, v1alpha1.ConditionReady, metav1.ConditionFalse, blocked.state, blocked.Error())
+	return nil
+}
+
+// reportDeleteBlocked records in the status and a Warning Event that the
+// storage cannot be deleted from UpCloud because of err. It returns nil for
+// a blockedError, whose fix is watched, and err for a retry otherwise.
+func (r *UpCloudStorageReconciler) reportDeleteBlocked(storage *v1alpha1.UpCloudStorage, err error) error {
+	message := fmt.Sprintf("cannot delete UpCloud storage %s: %s", storage.Status.UUID, err)
+	if cond := meta.FindStatusCondition(storage.Status.Conditions, v1alpha1.ConditionReady); cond == nil || cond.Message != message {
+		r.event(storage, corev1.EventTypeWarning, EventStorageDeleteWaits, "%s", message)
+	}
+	var blocked *blockedError
+	if errors.As(err, &blocked) {
+		r.Logger.Info("UpCloudStorage deletion is blocked", "state", blocked.state, "reason", blocked.Error())
+		storage.Status.State = blocked.state
+		setStorageCondition(storage, v1alpha1.ConditionReady, metav1.ConditionFalse, blocked.state, message)
+		return nil
+	}
+	r.Logger.Error(err, "Failed to get the UpCloud client to delete the storage")
+	storage.Status.State = StateDeleting
+	setStorageCondition(storage, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonDeleting, message)
+	return err
+}
+
+// event records an Event for the storage, unless the reconciler has no Recorder.
+func (r *UpCloudStorageReconciler) event(storage *v1alpha1.UpCloudStorage, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(storage, eventType, reason, messageFmt, args...)
+}
+
+// updateStatus writes the status of the storage if it differs from oldStatus.
+func (r *UpCloudStorageReconciler) updateStatus(ctx context.Context, storage *v1alpha1.UpCloudStorage, oldStatus *v1alpha1.UpCloudStorageStatus) error {
+	if !storage.DeletionTimestamp.IsZero() && !containsString(storage.Finalizers, UPCloudFinalizer) {
+		// Released, the API server deletes the UpCloudStorage and rejects the write
+		return nil
+	}
+	storage.Status.ObservedGeneration = storage.Generation
+	if equality.Semantic.DeepEqual(oldStatus, &storage.Status) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Status().Update(ctx, storage))
+}
+
+// update writes the metadata and spec of the storage, keeping the status
+// being reconciled.
+func (r *UpCloudStorageReconciler) update(ctx context.Context, storage *v1alpha1.UpCloudStorage) error {
+	status := storage.Status.DeepCopy()
+	if err := r.Update(ctx, storage); err != nil {
+		return err
+	}
+	storage.Status = *status
+	return nil
+}
+
+// resyncInterval returns how long a storage waits for its next resync.
+func (r *UpCloudStorageReconciler) resyncInterval() time.Duration {
+	if r.ResyncInterval > 0 {
+		return r.ResyncInterval
+	}
+	return DefaultResyncInterval
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *UpCloudStorageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(context.Background(), &v1alpha1.UpCloudStorage{},
+		credentialsRefIndex, indexStorageCredentialsRef); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(context.Background(), &v1alpha1.UpCloudStorage{},
+		providerConfigRefIndex, indexStorageProviderConfigRef); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.UpCloudStorage{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.storagesForIndex(credentialsRefIndex))).
+		Watches(&v1alpha1.UpCloudProviderConfig{}, handler.EnqueueRequestsFromMapFunc(r.storagesForIndex(providerConfigRefIndex))).
+		Complete(r)
+}
+
+// indexStorageCredentialsRef indexes UpCloudStorages by the namespace/name
+// of their credentials Secret.
+func indexStorageCredentialsRef(obj client.Object) []string {
+	storage := obj.(*v1alpha1.UpCloudStorage)
+	if storage.Spec.CredentialsRef == nil {
+		return nil
+	}
+	return []string{credentialsSecret(storage.Spec.CredentialsRef, storage.Namespace).String()}
+}
+
+// indexStorageProviderConfigRef indexes UpCloudStorages by the name of
+// their UpCloudProviderConfig.
+func indexStorageProviderConfigRef(obj client.Object) []string {
+	storage := obj.(*v1alpha1.UpCloudStorage)
+	if storage.Spec.ProviderConfigRef == nil {
+		return nil
+	}
+	return []string{types.NamespacedName{Name: storage.Spec.ProviderConfigRef.Name}.String()}
+}
+
+// storagesForIndex returns a map function enqueuing the UpCloudStorages that
+// reference an object through the given index.
+func (r *UpCloudStorageReconciler) storagesForIndex(index string) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		key := client.ObjectKeyFromObject(obj).String()
+		var storages v1alpha1.UpCloudStorageList
+		if err := r.List(ctx, &storages, client.MatchingFields{index: key}); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to list UpCloudStorages", "index", index, "key", key)
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(storages.Items))
+		for _, storage := range storages.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&storage)})
+		}
+		return requests
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	infrastructurev1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud/fake"
+)
+
+var _ = Describe("UpCloudStorage Controller", func() {
+	const storageName = "test-storage"
+	const vmName = "storage-vm"
+
+	ctx := context.Background()
+
+	storageKey := types.NamespacedName{Name: storageName, Namespace: "default"}
+	vmKey := types.NamespacedName{Name: vmName, Namespace: "default"}
+	var provider *fake.Provider
+	var recorder *record.FakeRecorder
+	var storageReconciler *UpCloudStorageReconciler
+	var vmReconciler *UpCloudVMReconciler
+
+	BeforeEach(func() {
+		provider = fake.NewProvider()
+		recorder = record.NewFakeRecorder(100)
+		storageReconciler = &UpCloudStorageReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Cloud:    provider,
+			Recorder: recorder,
+		}
+		vmReconciler = &UpCloudVMReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Cloud:    provider,
+			Recorder: recorder,
+		}
+		Expect(k8sClient.Create(ctx, &infrastructurev1alpha1.UpCloudStorage{
+			ObjectMeta: metav1.ObjectMeta{Name: storageName, Namespace: "default"},
+			Spec: infrastructurev1alpha1.UpCloudStorageSpec{
+				Size:   20,
+				Zone:   "fi-hel1",
+				Labels: map[string]string{"app": "database"},
+			},
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		vm := &infrastructurev1alpha1.UpCloudVM{}
+		if err := k8sClient.Get(ctx, vmKey, vm); err == nil {
+			Expect(k8sClient.Delete(ctx, vm)).To(Succeed())
+			reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		}
+		storage := &infrastructurev1alpha1.UpCloudStorage{}
+		if err := k8sClient.Get(ctx, storageKey, storage); err == nil {
+			Expect(k8sClient.Delete(ctx, storage)).To(Succeed())
+			reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		}
+		Expect(errors.IsNotFound(k8sClient.Get(ctx, storageKey, storage))).To(BeTrue())
+	})
+
+	getStorage := func() *infrastructurev1alpha1.UpCloudStorage {
+		storage := &infrastructurev1alpha1.UpCloudStorage{}
+		Expect(k8sClient.Get(ctx, storageKey, storage)).To(Succeed())
+		return storage
+	}
+
+	createVM := func(refs ...infrastructurev1alpha1.StorageReference) {
+		Expect(k8sClient.Create(ctx, &infrastructurev1alpha1.UpCloudVM{
+			ObjectMeta: metav1.ObjectMeta{Name: vmName, Namespace: "default"},
+			Spec: infrastructurev1alpha1.UpCloudVMSpec{
+				StorageSize:     10,
+				Zone:            "fi-hel1",
+				Plan:            "1xCPU-1GB",
+				StorageTemplate: "01000000-0000-4000-8000-000030220200",
+				StorageRefs:     refs,
+			},
+		})).To(Succeed())
+	}
+
+	It("should create the storage and grow it", func() {
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		storage := getStorage()
+		Expect(storage.Finalizers).To(ContainElement(UPCloudFinalizer))
+		Expect(storage.Status.UUID).NotTo(BeEmpty())
+		Expect(storage.Status.State).To(Equal(StateAvailable))
+		Expect(storage.Status.Size).To(Equal(20))
+		Expect(storage.Status.Zone).To(Equal("fi-hel1"))
+		Expect(storage.Status.Tier).To(Equal(upcloud.StorageTierMaxIOPS))
+		Expect(meta.IsStatusConditionTrue(storage.Status.Conditions, infrastructurev1alpha1.ConditionReady)).To(BeTrue())
+		details, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: storage.Status.UUID})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(details.Title).To(Equal(storageName))
+		Expect(details.Labels).To(ContainElement(upcloud.Label{Key: "app", Value: "database"}))
+		Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventStorageCreated)))
+
+		storage.Spec.Size = 40
+		Expect(k8sClient.Update(ctx, storage)).To(Succeed())
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		Expect(getStorage().Status.Size).To(Equal(40))
+		Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventStorageResized)))
+	})
+
+	It("should adopt the storage it created when its status was lost", func() {
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		storage := getStorage()
+		uuid := storage.Status.UUID
+
+		By("Losing the status write after the storage was created")
+		storage.Status = infrastructurev1alpha1.UpCloudStorageStatus{}
+		Expect(k8sClient.Status().Update(ctx, storage)).To(Succeed())
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		Expect(getStorage().Status.UUID).To(Equal(uuid))
+		Expect(provider.Calls("CreateStorage")).To(Equal(1))
+		Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventStorageAdopted)))
+	})
+
+	It("should let go of a storage never created when its UpCloudProviderConfig is missing", func() {
+		storage := getStorage()
+		storage.Finalizers = append(storage.Finalizers, UPCloudFinalizer)
+		storage.Spec.ProviderConfigRef = &infrastructurev1alpha1.UpCloudProviderConfigReference{Name: "missing-config"}
+		Expect(k8sClient.Update(ctx, storage)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, storage)).To(Succeed())
+
+		_, err := storageReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: storageKey})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors.IsNotFound(k8sClient.Get(ctx, storageKey, storage))).To(BeTrue())
+		Expect(provider.Calls("GetStorages")).To(BeZero())
+	})
+
+	It("should warn that the delete waits for a missing UpCloudProviderConfig", func() {
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		storage := getStorage()
+		storage.Spec.ProviderConfigRef = &infrastructurev1alpha1.UpCloudProviderConfigReference{Name: "missing-config"}
+		Expect(k8sClient.Update(ctx, storage)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, storage)).To(Succeed())
+
+		_, err := storageReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: storageKey})
+		Expect(err).NotTo(HaveOccurred())
+		storage = getStorage()
+		Expect(storage.Status.State).To(Equal(StateProviderConfigNotReady))
+		ready := meta.FindStatusCondition(storage.Status.Conditions, infrastructurev1alpha1.ConditionReady)
+		Expect(ready.Message).To(HavePrefix("cannot delete UpCloud storage " + storage.Status.UUID))
+		Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning " + EventStorageDeleteWaits)))
+		Expect(provider.Calls("DeleteStorage")).To(BeZero())
+
+		By("Removing the reference to the UpCloudProviderConfig")
+		storage.Spec.ProviderConfigRef = nil
+		Expect(k8sClient.Update(ctx, storage)).To(Succeed())
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		Expect(errors.IsNotFound(k8sClient.Get(ctx, storageKey, storage))).To(BeTrue())
+		Expect(provider.Calls("DeleteStorage")).To(Equal(1))
+	})
+
+	It("should be attached to a VM and outlive it", func() {
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		uuid := getStorage().Status.UUID
+		createVM(infrastructurev1alpha1.StorageReference{Name: storageName})
+
+		By("Attaching the storage once the server runs")
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		vm := &infrastructurev1alpha1.UpCloudVM{}
+		Expect(k8sClient.Get(ctx, vmKey, vm)).To(Succeed())
+		server, ok := provider.Server(vm.Status.VMID)
+		Expect(ok).To(BeTrue())
+		Expect(server.StorageDevices).To(HaveLen(2))
+		Expect(server.StorageDevices[1].UUID).To(Equal(uuid))
+		Expect(vm.Status.StorageDevices[1].StorageRef).To(Equal(storageName))
+		Expect(vm.Status.StorageDevices[1].Managed).To(BeFalse())
+		Expect(meta.IsStatusConditionTrue(vm.Status.Conditions, infrastructurev1alpha1.ConditionSynced)).To(BeTrue())
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		Expect(getStorage().Status.State).To(Equal(StateAttached))
+		Expect(getStorage().Status.ServerUUID).To(Equal(vm.Status.VMID))
+
+		By("Waiting for the VM to detach it before deleting the storage")
+		Expect(k8sClient.Delete(ctx, getStorage())).To(Succeed())
+		result, err := storageReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: storageKey})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(serverPollInterval))
+		Expect(getStorage().Status.State).To(Equal(StateDeleting))
+		Expect(provider.Calls("DeleteStorage")).To(BeZero())
+
+		By("Detaching the storage when the VM is deleted")
+		Expect(k8sClient.Delete(ctx, vm)).To(Succeed())
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		Expect(provider.Servers()).To(Equal(0))
+		_, err = provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: uuid})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Deleting the storage once detached")
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		Expect(errors.IsNotFound(k8sClient.Get(ctx, storageKey, &infrastructurev1alpha1.UpCloudStorage{}))).To(BeTrue())
+		Expect(provider.Calls("DeleteStorage")).To(Equal(1))
+		Expect(recordedEvents(recorder)).To(ContainElements(
+			HavePrefix("Normal "+EventStorageAttached),
+			HavePrefix("Warning "+EventStorageDeleteWaits),
+			HavePrefix("Normal "+EventStorageDeleted),
+		))
+	})
+
+	It("should detach a storage removed from the storageRefs", func() {
+		createVM(infrastructurev1alpha1.StorageReference{Name: storageName})
+
+		By("Waiting for the storage to be created")
+		reconcileTimes(ctx, vmReconciler, vmKey, 5)
+		vm := &infrastructurev1alpha1.UpCloudVM{}
+		Expect(k8sClient.Get(ctx, vmKey, vm)).To(Succeed())
+		synced := meta.FindStatusCondition(vm.Status.Conditions, infrastructurev1alpha1.ConditionSynced)
+		Expect(synced.Reason).To(Equal(ReasonPreparingStorage))
+		Expect(synced.Message).To(ContainSubstring("UpCloudStorage " + storageName + " is pending"))
+
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		Expect(k8sClient.Get(ctx, vmKey, vm)).To(Succeed())
+		Expect(vm.Status.StorageDevices).To(HaveLen(2))
+
+		vm.Spec.StorageRefs = nil
+		Expect(k8sClient.Update(ctx, vm)).To(Succeed())
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		server, _ := provider.Server(vm.Status.VMID)
+		Expect(server.StorageDevices).To(HaveLen(1))
+		reconcileUntilSettled(ctx, storageReconciler, storageKey)
+		Expect(getStorage().Status.State).To(Equal(StateAvailable))
+		Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventStorageDetached)))
+	})
+})
+
+// reconcileTimes reconciles a resource that keeps polling, e.g. while it
+// waits for another one, the given number of times.
+func reconcileTimes(ctx context.Context, r reconcile.Reconciler, name types.NamespacedName, times int) {
+	for i := 0; i < times; i++ {
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: name})
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
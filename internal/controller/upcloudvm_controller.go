@@ -4,20 +4,30 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apiError "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
-	upCloudClient "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
-	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/service"
 	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
 )
 
 // UpCloudVMReconciler reconciles a UpCloudVM object
@@ -25,18 +35,86 @@ type UpCloudVMReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 	Logger logr.Logger
+
+	// Cloud is the UpCloud API used to manage servers. When nil, an SDK
+	// client is built from the credentials Secret of the VM or of its
+	// UpCloudProviderConfig, or from the UPCLOUD_USERNAME/UPCLOUD_PASSWORD
+	// env vars when neither has one.
+	Cloud cloud.Provider
+	// APIBaseURL overrides the UpCloud API endpoint of SDK clients, e.g. to
+	// point the controller at the test/upcloudsim simulator.
+	APIBaseURL string
+	// Clients caches SDK clients across reconciles. When nil, a new client
+	// is built for every reconcile.
+	Clients *cloud.Pool
+	// Catalogs caches the zones, plans and templates specs are checked
+	// against. When nil, they are read from UpCloud for every check.
+	Catalogs *cloud.CatalogCache
+	// Recorder records the lifecycle Events shown by kubectl describe.
+	Recorder record.EventRecorder
+	// ResyncInterval is how often running VMs are read from UpCloud to
+	// refresh their status and detect drift. Defaults to DefaultResyncInterval.
+	ResyncInterval time.Duration
 }
 
 const (
 	UPCloudFinalizer = "upcloud.finalizer"
+
+	// defaultStorageTier is used when neither the VM nor its UpCloudProviderConfig sets one
+	defaultStorageTier = "maxiops"
+
+	// serverPollInterval is how often a server is polled while it changes state
+	serverPollInterval = 10 * time.Second
+
+	// OwnerLabelKey labels every server and disk the controller creates
+	// with the namespace/name/UID of its UpCloudVM, so one whose UUID was
+	// never recorded can be found again instead of created twice
+	OwnerLabelKey = "vm-controller-owner"
 )
 
+// Status states of an UpCloudVM while its server is brought up, running or
+// stopped outside Kubernetes, and torn down.
+const (
+	StateProvisioning = "Provisioning"
+	StateStarting     = "Starting"
+	StateRunning      = "Running"
+	StateStopped      = "Stopped"
+	StateLost         = "Lost"
+	// StateInvalidSpec is set instead of creating a server from a spec the
+	// UpCloud account cannot fulfil
+	StateInvalidSpec = "InvalidSpec"
+	// StateAwaitingApproval and StateStopping precede StateStarting while a
+	// change that needs the server stopped is applied
+	StateAwaitingApproval = "AwaitingApproval"
+	StateStopping         = "Stopping"
+	StateDeleting         = "Deleting"
+)
+
+// Indexes of UpCloudVMs by the object key of their credentials Secret, of
+// their UpCloudProviderConfig and of their UpCloudStorages.
+const (
+	credentialsRefIndex    = "spec.credentialsRef"
+	providerConfigRefIndex = "spec.providerConfigRef"
+	// storageRefIndex indexes UpCloudVMs by the namespace/name of the
+	// UpCloudStorages they attach
+	storageRefIndex = "spec.storageRefs"
+)
+
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudvms,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudvms/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudvms/finalizers,verbs=update
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudproviderconfigs,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudstorages,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudvmsnapshots,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
 // Reconcile is part of the main Kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state specified by the user.
 // This function handles the creation, updating, and deletion of UpCloud VMs.
 // For more details, check Reconcile and its result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
-func (r *UpCloudVMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *UpCloudVMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	r.Logger = log.FromContext(ctx)
 
 	// Fetch the UpCloudVM resource
@@ -50,27 +128,36 @@ func (r *UpCloudVMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		r.Logger.Error(err, "Failed to get UpCloudVM")
 		return ctrl.Result{}, err
 	}
-	// Initialize the UpCloud API client and get service object
-	err, svc := r.getService()
-	if err != nil {
-		return ctrl.Result{}, err
-	}
+	// The steps below only change the status in memory. It is written once
+	// on the way out, failed steps included
+	oldStatus := upCloudVM.Status.DeepCopy()
+	defer func() {
+		if statusErr := r.updateStatus(ctx, &upCloudVM, oldStatus); statusErr != nil {
+			r.Logger.Error(statusErr, "Failed to update UpCloudVM status")
+			if err == nil {
+				result, err = ctrl.Result{}, statusErr
+			}
+		}
+	}()
 
-	// Handle deletion logic
+	// Handle deletion logic ahead of the credentials, a VM without a server
+	// to delete is released without them
 	if !upCloudVM.ObjectMeta.DeletionTimestamp.IsZero() {
-		r.Logger.Info("Deleting UpCloud VM")
-		if err := r.deleteUpCloudVM(svc, &upCloudVM); err != nil {
-			r.Logger.Error(err, "Failed to delete UpCloud VM")
-			return ctrl.Result{}, err
-		}
-		// Remove Finalizer from VM deletion
-		upCloudVM.ObjectMeta.Finalizers = removeString(upCloudVM.ObjectMeta.Finalizers, UPCloudFinalizer)
-		if err := r.Update(ctx, &upCloudVM); err != nil {
-			return ctrl.Result{}, err
-		}
-		return ctrl.Result{}, nil
+		return r.reconcileDelete(ctx, &upCloudVM)
 	}
 
+	// Look up the account settings shared through an UpCloudProviderConfig
+	config, err := r.getProviderConfig(ctx, &upCloudVM)
+	if err != nil {
+		return ctrl.Result{}, r.reportBlocked(&upCloudVM, err)
+	}
+	// Initialize the UpCloud API client and get service object
+	err, svc := r.getService(ctx, &upCloudVM, config)
+	if err != nil {
+		return ctrl.Result{}, r.reportBlocked(&upCloudVM, err)
+	}
+	clearBlocked(&upCloudVM)
+
 	// Create or update the UpCloud VM
 	// Add finalizer for this CR
 	if !containsString(upCloudVM.GetFinalizers(), UPCloudFinalizer) {
@@ -78,119 +165,322 @@ func (r *UpCloudVMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 			return ctrl.Result{}, err
 		}
 	}
+	if upCloudVM.Status.State == StateLost {
+		if upCloudVM.Spec.RecreatePolicy != v1alpha1.RecreatePolicyRecreate {
+			// Nothing to do until the policy allows a new server
+			return ctrl.Result{}, nil
+		}
+		forgetServer(&upCloudVM)
+	}
 	if upCloudVM.Status.VMID == "" {
-		// Create a new VM
-		r.Logger.Info("Creating new UpCloud VM")
-		vmID, ip, err := r.createUpCloudVM(svc, &upCloudVM)
+		// A server created by an earlier reconcile whose status update was lost
+		// carries the owner label; adopt it rather than paying for a duplicate
+		server, err := r.findUpCloudVM(ctx, svc, &upCloudVM)
 		if err != nil {
-			r.Logger.Error(err, "Failed to create UpCloud VM")
+			r.Logger.Error(err, "Failed to look up UpCloud VM")
+			r.reportProblem(&upCloudVM, v1alpha1.ConditionProvisioned, metav1.ConditionFalse, ReasonCreateFailed, err)
 			return ctrl.Result{}, err
 		}
-		upCloudVM.Status.VMID = vmID
-		upCloudVM.Status.IPAddress = ip
-		upCloudVM.Status.State = "Running"
-		if err := r.Status().Update(ctx, &upCloudVM); err != nil {
-			r.Logger.Error(err, "Failed to update UpCloudVM status")
-			return ctrl.Result{}, err
+		if server != nil {
+			r.Logger.Info("Adopting existing UpCloud VM", "uuid", server.UUID)
+			r.event(&upCloudVM, corev1.EventTypeNormal, EventServerAdopted,
+				"Adopted UpCloud server %s labelled as owned by this UpCloudVM", server.UUID)
+			upCloudVM.Status.VMID = server.UUID
+			setCondition(&upCloudVM, v1alpha1.ConditionProvisioned, metav1.ConditionTrue, ReasonServerAdopted,
+				fmt.Sprintf("adopted UpCloud server %s", server.UUID))
+			setServerState(&upCloudVM, server.State)
+		} else {
+			var snapshot *v1alpha1.UpCloudVMSnapshot
+			if ref := upCloudVM.Spec.SnapshotRef; ref != nil {
+				var waiting string
+				snapshot, waiting, err = r.completedSnapshot(ctx, &upCloudVM, ref.Name)
+				if err != nil {
+					return ctrl.Result{}, err
+				}
+				if waiting != "" {
+					// The disks are cloned from the backups once they are complete
+					setCondition(&upCloudVM, v1alpha1.ConditionProvisioned, metav1.ConditionFalse, ReasonSnapshotNotReady, waiting)
+					setCondition(&upCloudVM, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonNotProvisioned, "no UpCloud server has been created yet")
+					return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+				}
+			}
+			zone, plan, _ := serverPlacement(&upCloudVM, config)
+			var template string
+			var selector *v1alpha1.TemplateSelector
+			if snapshot == nil {
+				// The disks of a VM created from a snapshot are cloned from its backups
+				template, selector = templateSource(&upCloudVM)
+			}
+			template, valid, err := r.checkCatalog(ctx, svc, &upCloudVM, zone, plan, template, selector)
+			if err != nil {
+				r.Logger.Error(err, "Failed to resolve the template")
+				r.reportProblem(&upCloudVM, v1alpha1.ConditionProvisioned, metav1.ConditionFalse, ReasonCreateFailed, err)
+				return ctrl.Result{}, err
+			}
+			if !valid {
+				// Wait for a spec UpCloud can fulfil, the edit triggers a reconcile
+				upCloudVM.Status.State = StateInvalidSpec
+				message := meta.FindStatusCondition(upCloudVM.Status.Conditions, v1alpha1.ConditionInvalidSpec).Message
+				setCondition(&upCloudVM, v1alpha1.ConditionProvisioned, metav1.ConditionFalse, ReasonInvalidSpec, message)
+				setCondition(&upCloudVM, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonInvalidSpec, message)
+				return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+			}
+
+			// Create a new VM
+			r.Logger.Info("Creating new UpCloud VM")
+			serverDetails, err := r.createUpCloudVM(ctx, svc, &upCloudVM, config, template, snapshot)
+			if err != nil {
+				r.Logger.Error(err, "Failed to create UpCloud VM")
+				r.reportProblem(&upCloudVM, v1alpha1.ConditionProvisioned, metav1.ConditionFalse, ReasonCreateFailed, err)
+				setCondition(&upCloudVM, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonNotProvisioned, "no UpCloud server has been created yet")
+				return ctrl.Result{}, err
+			}
+			upCloudVM.Status.VMID = serverDetails.UUID
+			if snapshot == nil {
+				upCloudVM.Status.TemplateUUID = template
+			}
+			upCloudVM.Status.IPAddress = serverIPAddress(serverDetails)
+			setCondition(&upCloudVM, v1alpha1.ConditionProvisioned, metav1.ConditionTrue, ReasonServerCreated,
+				fmt.Sprintf("created UpCloud server %s", serverDetails.UUID))
+			setCondition(&upCloudVM, v1alpha1.ConditionSynced, metav1.ConditionTrue, ReasonSynced, "")
+			if len(upCloudVM.Spec.StorageRefs) == 0 && !wantsStopped(&upCloudVM) {
+				// UpCloudStorages are attached and parked servers stopped by
+				// the first update
+				upCloudVM.Status.AppliedSpecHash = specHash(&upCloudVM)
+			}
+			setServerState(&upCloudVM, serverDetails.State)
 		}
-	} else {
-		// Check and update the existing UpCloud VM
-		r.Logger.Info("Updating to UpCloud VM")
-		vmID, err := r.updateUpCloudVM(svc, &upCloudVM)
-		upCloudVM.Status.VMID = vmID
-		if err != nil {
-			r.Logger.Error(err, "Failed to update UpCloud VM")
-			return ctrl.Result{}, err
+		// Record the server right away, the next reconciles follow it until it runs
+		upCloudVM.Status.State = StateProvisioning
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	switch upCloudVM.Status.State {
+	case StateRunning, StateStopped, StateAwaitingApproval:
+	case StateStopping:
+		// Wait for the server to shut down before applying the change
+		stopped, result, err := r.waitForStop(ctx, svc, &upCloudVM)
+		if isServerNotFound(err) {
+			return r.serverLost(&upCloudVM), nil
 		}
+		if err != nil || !stopped {
+			return result, err
+		}
+	default:
+		// Poll the server until it is running
+		result, err := r.pollUpCloudVM(ctx, svc, &upCloudVM)
+		if isServerNotFound(err) {
+			return r.serverLost(&upCloudVM), nil
+		}
+		if err != nil || upCloudVM.Status.State != StateRunning && upCloudVM.Status.State != StateStopped {
+			return result, err
+		}
+		// Look for drift right away rather than after the first resync interval
 	}
 
-	return ctrl.Result{}, nil
+	// Check and update the existing UpCloud VM
+	r.Logger.Info("Updating to UpCloud VM")
+	result, err = r.updateUpCloudVM(ctx, svc, &upCloudVM)
+	if isServerNotFound(err) {
+		return r.serverLost(&upCloudVM), nil
+	}
+	if err != nil {
+		r.Logger.Error(err, "Failed to update UpCloud VM")
+		return ctrl.Result{}, err
+	}
+	if upCloudVM.Status.State == StateRunning || upCloudVM.Status.State == StateStopped {
+		// Back up settled servers only, not ones being stopped for a change
+		return r.runBackupPolicy(ctx, svc, &upCloudVM, result)
+	}
+	return result, nil
 }
 
-// getService initializes the UpCloud API client
-func (r *UpCloudVMReconciler) getService() (error, *service.Service) {
-	username := os.Getenv("UPCLOUD_USERNAME")
-	password := os.Getenv("UPCLOUD_PASSWORD")
+// getProviderConfig returns the ready UpCloudProviderConfig referenced by
+// the VM, or nil if it references none
+func (r *UpCloudVMReconciler) getProviderConfig(ctx context.Context, vm *v1alpha1.UpCloudVM) (*v1alpha1.UpCloudProviderConfig, error) {
+	return readyProviderConfig(ctx, r.Client, vm.Spec.ProviderConfigRef)
+}
 
-	if len(username) == 0 {
-		fmt.Fprintln(os.Stderr, "Username must be specified")
-		return errors.New("Username must be specified"), nil
+// getCredentials returns the UpCloud credentials for the VM. Its own
+// credentials Secret wins over the one of its UpCloudProviderConfig, which
+// wins over the manager's environment.
+func (r *UpCloudVMReconciler) getCredentials(ctx context.Context, vm *v1alpha1.UpCloudVM, config *v1alpha1.UpCloudProviderConfig) (cloud.Credentials, error) {
+	if vm.Spec.CredentialsRef != nil {
+		return readCredentials(ctx, r.Client, vmCredentialsSecret(vm))
 	}
-
-	if len(password) == 0 {
-		fmt.Fprintln(os.Stderr, "Password must be specified")
-		return errors.New("Password must be specified"), nil
+	if config != nil {
+		return configCredentials(ctx, r.Client, config)
 	}
-	svc := service.New(upCloudClient.New(username, password))
+	return envCredentials()
+}
 
-	// Following is some copied code from UpCloud Go SDK for error handling
-	// https://github.com/UpCloudLtd/upcloud-go-api?tab=readme-ov-file#error-handling
-	_, err := svc.GetAccount(context.Background())
+// getService initializes the UpCloud API client for the VM
+func (r *UpCloudVMReconciler) getService(ctx context.Context, vm *v1alpha1.UpCloudVM, config *v1alpha1.UpCloudProviderConfig) (error, cloud.Provider) {
+	if r.Cloud != nil && vm.Spec.CredentialsRef == nil {
+		return nil, r.Cloud
+	}
+	creds, err := r.getCredentials(ctx, vm, config)
 	if err != nil {
-		// `upcloud.Problem` is the error object returned by all of the `Service` methods.
-		//  You can differentiate between generic connection errors (like the API not being reachable) and service errors, which are errors returned in the response body by the API;
-		//	this is useful for gracefully recovering from certain types of errors;
-		var problem *upcloud.Problem
-
-		if errors.As(err, &problem) {
-			fmt.Println(problem.Status)        // HTTP status code returned by the API
-			fmt.Print(problem.Title)           // Short, human-readable description of the problem
-			fmt.Println(problem.CorrelationID) // Unique string that identifies the request that caused the problem; note that this field is not always populated
-			fmt.Println(problem.InvalidParams) // List of invalid request parameters
+		return err, nil
+	}
+	if r.Cloud != nil {
+		return nil, r.Cloud
+	}
+	// The pool only calls GetAccount for new or unhealthy clients
+	svc, err := r.Clients.Get(ctx, creds, clientSettings(r.APIBaseURL, config))
+	if err != nil {
+		return fmt.Errorf("failed to check UpCloud client: %w", err), nil
+	}
+	return nil, svc
+}
 
-			for _, invalidParam := range problem.InvalidParams {
-				fmt.Println(invalidParam.Name)   // Path to the request field that is invalid
-				fmt.Println(invalidParam.Reason) // Human-readable description of the problem with that particular field
-			}
-			// You can also check against the specific api error codes to programatically react to certain situations.
-			// Base `upcloud` package exports all the error codes that API can return.
-			// You can check which error code is return in which situation in UpCloud API docs -> https://developers.upcloud.com/1.3
-			if problem.ErrorCode() == upcloud.ErrCodeResourceAlreadyExists {
-				fmt.Println("Looks like we don't need to create this")
-			}
-			// `upcloud.Problem` implements the Error interface, so you can also just use it as any other error
-			fmt.Println(fmt.Errorf("we got an error from the UpCloud API: %w", problem))
+// reportBlocked records in the status why the VM cannot be reconciled when
+// err is a blockedError, and returns any other error for a retry.
+func (r *UpCloudVMReconciler) reportBlocked(vm *v1alpha1.UpCloudVM, err error) error {
+	var blocked *blockedError
+	if !errors.As(err, &blocked) {
+		r.Logger.Error(err, "UpCloud client is unusable")
+		var problem *upcloud.Problem
+		if errors.As(err, &problem) && problem.ErrorCode() == upcloud.ErrCodeAuthenticationFailed {
+			// The account was rejected when the client was checked
+			r.reportProblem(vm, v1alpha1.ConditionCredentialsValid, metav1.ConditionFalse, StateCredentialsError, err)
 		} else {
-			// This means you got an error, but it does not come from the API itself. This can happen, for example, if you have some connection issues,
-			// or if the UpCloud API is unreachable for some other reason
-			fmt.Println("We got a generic error!")
+			r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
 		}
-		return err, nil
+		return err
 	}
-	return nil, svc
+	// Wait for the referenced object to change rather than retrying
+	r.Logger.Info("UpCloudVM is blocked", "state", blocked.state, "reason", blocked.Error())
+	if vm.Status.State != blocked.state || vm.Status.Message != blocked.Error() {
+		r.event(vm, corev1.EventTypeWarning, blocked.state, "%s", blocked.Error())
+	}
+	vm.Status.State = blocked.state
+	vm.Status.Message = blocked.Error()
+	setCondition(vm, v1alpha1.ConditionCredentialsValid, metav1.ConditionFalse, blocked.state, blocked.Error())
+	setCondition(vm, v1alpha1.ConditionReady, metav1.ConditionFalse, blocked.state, blocked.Error())
+	return nil
+}
+
+// clearBlocked resets the status once the VM can be reconciled again.
+func clearBlocked(vm *v1alpha1.UpCloudVM) {
+	setCondition(vm, v1alpha1.ConditionCredentialsValid, metav1.ConditionTrue, ReasonCredentialsValid, "")
+	if vm.Status.State != StateCredentialsError && vm.Status.State != StateProviderConfigNotReady {
+		return
+	}
+	// An existing server is polled again to find out its state
+	vm.Status.State = ""
+	vm.Status.Message = ""
+}
+
+// setState records the VM's state.
+func setState(vm *v1alpha1.UpCloudVM, state string) {
+	vm.Status.State = state
+}
+
+// setSettledState sets the state of a VM with nothing left to apply from
+// the state of its server. Servers in maintenance keep the current state.
+func setSettledState(vm *v1alpha1.UpCloudVM, serverState string) {
+	switch serverState {
+	case upcloud.ServerStateStarted:
+		setState(vm, StateRunning)
+	case upcloud.ServerStateStopped:
+		setState(vm, StateStopped)
+	}
+}
+
+// updateStatus writes the status of the VM, stamped with the generation it
+// was computed for, if it differs from oldStatus. A VM whose finalizer was
+// just removed may already be gone.
+func (r *UpCloudVMReconciler) updateStatus(ctx context.Context, vm *v1alpha1.UpCloudVM, oldStatus *v1alpha1.UpCloudVMStatus) error {
+	if !vm.DeletionTimestamp.IsZero() && !containsString(vm.Finalizers, UPCloudFinalizer) {
+		// Released, the API server deletes the UpCloudVM and rejects the write
+		return nil
+	}
+	vm.Status.ObservedGeneration = vm.Generation
+	if equality.Semantic.DeepEqual(oldStatus, &vm.Status) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Status().Update(ctx, vm))
 }
 
 // add Finalizer to resource
 func (r *UpCloudVMReconciler) addFinalizer(ctx context.Context, vm *v1alpha1.UpCloudVM) error {
 	vm.SetFinalizers(append(vm.GetFinalizers(), UPCloudFinalizer))
+	return r.update(ctx, vm)
+}
+
+// update writes the metadata and spec of the VM. Update returns the stored
+// status, the one being reconciled is kept.
+func (r *UpCloudVMReconciler) update(ctx context.Context, vm *v1alpha1.UpCloudVM) error {
+	status := vm.Status.DeepCopy()
 	if err := r.Update(ctx, vm); err != nil {
 		return err
 	}
+	vm.Status = *status
 	return nil
 }
 
-// createUpCloudVM calls the UpCloud API to create a new VM
-func (r *UpCloudVMReconciler) createUpCloudVM(svc *service.Service, vm *v1alpha1.UpCloudVM) (string, string, error) {
+// serverPlacement returns the zone, plan and storage tier of the VM's
+// server, filling in the account defaults the VM leaves unset.
+func serverPlacement(vm *v1alpha1.UpCloudVM, config *v1alpha1.UpCloudProviderConfig) (zone, plan, tier string) {
+	zone, plan, tier = vm.Spec.Zone, vm.Spec.Plan, defaultStorageTier
+	if config != nil {
+		if zone == "" {
+			zone = config.Spec.Zone
+		}
+		if plan == "" {
+			plan = config.Spec.Plan
+		}
+		if config.Spec.StorageTier != "" {
+			tier = config.Spec.StorageTier
+		}
+	}
+	if vm.Spec.StorageTier != "" {
+		tier = vm.Spec.StorageTier
+	}
+	return zone, plan, tier
+}
+
+// createUpCloudVM calls the UpCloud API to create a new VM cloned from
+// template, or from the backups of snapshot when it is not nil
+func (r *UpCloudVMReconciler) createUpCloudVM(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM, config *v1alpha1.UpCloudProviderConfig,
+	template string, snapshot *v1alpha1.UpCloudVMSnapshot) (*upcloud.ServerDetails, error) {
+	zone, plan, tier := serverPlacement(vm, config)
+	if zone == "" {
+		return nil, errors.New("zone must be set on the UpCloudVM or its UpCloudProviderConfig")
+	}
+
+	storageDevices := []request.CreateServerStorageDevice{
+		{
+			Action:  "clone",
+			Storage: template,
+			Title:   vm.Name,
+			Size:    vm.Spec.StorageSize,
+			Tier:    tier,
+		},
+	}
+	if snapshot != nil {
+		// UpCloud clones backups within their zone only
+		if snapshot.Status.Zone != zone {
+			return nil, fmt.Errorf("UpCloudVMSnapshot %s is in zone %s, not %s", snapshot.Name, snapshot.Status.Zone, zone)
+		}
+		storageDevices = snapshotStorageDevices(vm, snapshot, tier)
+	}
+	for i := range vm.Spec.StorageDevices {
+		storageDevices = append(storageDevices, createServerStorageDevice(&vm.Spec.StorageDevices[i], tier))
+	}
+
 	// Use the UpCloud API to create a new VM
-	ctx := context.Background()
 	serverDetails, err := svc.CreateServer(ctx, &request.CreateServerRequest{
-		Title:    vm.Name,
-		Plan:     vm.Spec.Plan,
-		Zone:     vm.Spec.Zone,
-		TimeZone: vm.Spec.TimeZone,
-		StorageDevices: []request.CreateServerStorageDevice{
-			{
-				Action:  "clone",
-				Storage: vm.Spec.StorageTemplate,
-				Title:   vm.Name,
-				Size:    vm.Spec.StorageSize,
-				Tier:    "maxiops",
-			},
-		},
-		CoreNumber:   vm.Spec.CPU,
-		MemoryAmount: vm.Spec.Memory,
-		LoginUser:    vm.Spec.LoginUser,
-		UserData:     vm.Spec.UserData,
+		Labels:         &upcloud.LabelSlice{ownerLabel(vm), {Key: titleLabelKey, Value: vm.Name}},
+		Title:          vm.Name,
+		Plan:           plan,
+		Zone:           zone,
+		TimeZone:       vm.Spec.TimeZone,
+		StorageDevices: storageDevices,
+		CoreNumber:     vm.Spec.CPU,
+		MemoryAmount:   vm.Spec.Memory,
+		LoginUser:      vm.Spec.LoginUser,
+		UserData:       vm.Spec.UserData,
 		Networking: &request.CreateServerNetworking{
 			Interfaces: []request.CreateServerInterface{
 				{
@@ -205,90 +495,523 @@ func (r *UpCloudVMReconciler) createUpCloudVM(svc *service.Service, vm *v1alpha1
 		},
 	})
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create UpCloud VM: %w", err)
+		return nil, fmt.Errorf("failed to create UpCloud VM: %w", err)
+	}
+
+	r.Logger.Info("Created UpCloud VM", "uuid", serverDetails.UUID)
+	r.event(vm, corev1.EventTypeNormal, EventCreateRequested,
+		"Requested UpCloud server %s with plan %s in zone %s", serverDetails.UUID, plan, zone)
+	return serverDetails, nil
+}
+
+// ownerLabel returns the label identifying the servers created for the VM.
+// The UID tells apart a VM that was deleted and created again under the same name.
+func ownerLabel(vm *v1alpha1.UpCloudVM) upcloud.Label {
+	return upcloud.Label{
+		Key:   OwnerLabelKey,
+		Value: fmt.Sprintf("%s/%s/%s", vm.Namespace, vm.Name, vm.UID),
 	}
+}
 
-	serverDetails, err = svc.WaitForServerState(ctx, &request.WaitForServerStateRequest{
-		UUID:         serverDetails.UUID,
-		DesiredState: upcloud.ServerStateStarted,
+// findUpCloudVM returns the server carrying the VM's owner label, or nil if
+// there is none.
+func (r *UpCloudVMReconciler) findUpCloudVM(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM) (*upcloud.Server, error) {
+	servers, err := svc.GetServersWithFilters(ctx, &request.GetServersWithFiltersRequest{
+		Filters: []request.QueryFilter{request.FilterLabel{Label: ownerLabel(vm)}},
 	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to wait for server: %#v", err)
-		return "", "", err
+		return nil, fmt.Errorf("failed to list UpCloud VMs: %w", err)
+	}
+	switch len(servers.Servers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &servers.Servers[0], nil
 	}
+	uuids := make([]string, 0, len(servers.Servers))
+	for _, server := range servers.Servers {
+		uuids = append(uuids, server.UUID)
+	}
+	// Picking one would leave the others running unnoticed
+	return nil, fmt.Errorf("found %d UpCloud VMs labelled %s=%s, expected at most one: %s",
+		len(uuids), OwnerLabelKey, ownerLabel(vm).Value, strings.Join(uuids, ", "))
+}
 
-	fmt.Printf("Created UpCloud VM: %#v\n", serverDetails)
-	return serverDetails.UUID, serverDetails.IPAddresses[0].Address, nil
+// pollUpCloudVM moves the VM through the Provisioning, Starting and Running
+// states as its server comes up, starting the server if it is stopped. Only
+// a server the controller created or is starting itself is started: one
+// found stopped otherwise, e.g. after the state was reset by clearBlocked,
+// may have been stopped in the UpCloud console and is left to
+// updateUpCloudVM, which reports it as drift. The server of a VM whose
+// PowerState is Stopped is left stopped too.
+func (r *UpCloudVMReconciler) pollUpCloudVM(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM) (ctrl.Result, error) {
+	serverDetails, err := svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{
+		UUID: vm.Status.VMID,
+	})
+	if err != nil {
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return ctrl.Result{}, fmt.Errorf("failed to get UpCloud VM: %w", err)
+	}
+	recordServer(vm, serverDetails)
+
+	state := vm.Status.State
+	switch serverDetails.State {
+	case upcloud.ServerStateStarted:
+		state = StateRunning
+	case upcloud.ServerStateStopped:
+		if wantsStopped(vm) || state != StateProvisioning && state != StateStarting {
+			state = StateStopped
+			break
+		}
+		// Disks restored from a snapshot are in maintenance until the data is back
+		offline, err := offlineDisks(ctx, svc, serverDetails)
+		if err != nil {
+			r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+			return ctrl.Result{}, err
+		}
+		if len(offline) > 0 {
+			r.Logger.Info("Waiting for the disks to come online", "disks", offline)
+			return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+		}
+		_, err = svc.StartServer(ctx, &request.StartServerRequest{
+			UUID: vm.Status.VMID,
+		})
+		if err != nil {
+			r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+			return ctrl.Result{}, fmt.Errorf("failed to start UpCloud VM: %w", err)
+		}
+		state = StateStarting
+	default:
+		// Still in maintenance, e.g. cloning its storage, booting or being
+		// stopped in the console; the state stays as it is until it settles
+	}
+	if state == StateRunning && vm.Status.State != StateRunning {
+		r.event(vm, corev1.EventTypeNormal, EventServerStarted, "UpCloud server %s is running", vm.Status.VMID)
+	}
+	setState(vm, state)
+	if state != StateRunning && state != StateStopped {
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// serverIPAddress returns the first IP address of the server, if it has any
+func serverIPAddress(serverDetails *upcloud.ServerDetails) string {
+	if len(serverDetails.IPAddresses) == 0 {
+		return ""
+	}
+	return serverDetails.IPAddresses[0].Address
 }
 
-// updateUpCloudVM updates the UpCloud VM based on the changes in the Spec
-func (r *UpCloudVMReconciler) updateUpCloudVM(svc *service.Service, vm *v1alpha1.UpCloudVM) (string, error) {
-	ctx := context.Background()
+// updateUpCloudVM refreshes the status of a running VM from UpCloud and
+// applies the spec when its hash changed, or when the server drifted from it
+// and the VM asks for drift to be corrected. Only the fields that differ are
+// sent to UpCloud. It runs again every resync interval.
+func (r *UpCloudVMReconciler) updateUpCloudVM(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM) (ctrl.Result, error) {
 	// Get existing VM details
 	serverDetails, err := svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{
 		UUID: vm.Status.VMID,
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to get UpCloud VM: %w", err)
-	}
-
-	// Update labels if VM name changed
-	newLabelSlice := serverDetails.Labels
-	existTitle := serverDetails.Title
-	newTitle := vm.Name
-	if existTitle != newTitle {
-		newLabelSlice = append(newLabelSlice, upcloud.Label{Key: "title", Value: newTitle})
-	}
-	// Update VM server
-	serverDetails, err = svc.ModifyServer(ctx, &request.ModifyServerRequest{
-		Labels:       &newLabelSlice,
-		UUID:         serverDetails.UUID,
-		Title:        newTitle,
-		Plan:         vm.Spec.Plan,
-		Zone:         vm.Spec.Zone,
-		CoreNumber:   vm.Spec.CPU,
-		TimeZone:     vm.Spec.TimeZone,
-		MemoryAmount: vm.Spec.Memory,
-	})
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return ctrl.Result{}, fmt.Errorf("failed to get UpCloud VM: %w", err)
+	}
+	recordServer(vm, serverDetails)
+	if _, ok := vm.Annotations[v1alpha1.RestoreSnapshotAnnotation]; ok {
+		// The spec is applied once the disks are restored
+		return r.restoreSnapshot(ctx, svc, vm, serverDetails)
+	}
+	if done, result, err := r.restartServer(ctx, svc, vm, serverDetails); done {
+		return result, err
+	}
+
+	drift := specDrift(vm, serverDetails)
+	hash := specHash(vm)
+	if hash == vm.Status.AppliedSpecHash {
+		// The spec was applied before, the server can only have drifted
+		setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionTrue, ReasonSynced, "")
+		if len(drift) > 0 && !meta.IsStatusConditionTrue(vm.Status.Conditions, v1alpha1.ConditionDrifted) {
+			r.event(vm, corev1.EventTypeWarning, EventDriftDetected,
+				"UpCloud server %s was changed outside Kubernetes: %s", vm.Status.VMID, strings.Join(drift, "; "))
+		}
+		setDrifted(vm, drift)
+		if len(drift) == 0 || !vm.Spec.AutoCorrectDrift {
+			setSettledState(vm, serverDetails.State)
+			return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+		}
+		r.event(vm, corev1.EventTypeNormal, EventCorrectingDrift,
+			"Reverting UpCloud server %s to the spec: %s", vm.Status.VMID, strings.Join(drift, "; "))
+	}
+
+	// The zone and template of an existing server can no longer change
+	_, valid, err := r.checkCatalog(ctx, svc, vm, "", vm.Spec.Plan, "", nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to modify UpCloud VM: %w", err)
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return ctrl.Result{}, fmt.Errorf("failed to check the plan: %w", err)
 	}
-	// Wait updated VM server to be ready
-	serverDetails, err = svc.WaitForServerState(ctx, &request.WaitForServerStateRequest{
-		UUID:         serverDetails.UUID,
-		DesiredState: upcloud.ServerStateStarted,
-	})
+	if !valid {
+		invalid := meta.FindStatusCondition(vm.Status.Conditions, v1alpha1.ConditionInvalidSpec)
+		setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonInvalidSpec, invalid.Message)
+		setSettledState(vm, serverDetails.State)
+		return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+	}
+
+	// UpCloud cannot shrink disks, leave the server as it is until the spec
+	// asks for a size it can have
+	if shrinks := diskShrinks(vm); len(shrinks) > 0 {
+		message := "UpCloud cannot shrink disks: " + strings.Join(shrinks, "; ")
+		if synced := meta.FindStatusCondition(vm.Status.Conditions, v1alpha1.ConditionSynced); synced == nil ||
+			synced.Reason != ReasonDiskShrinkRefused || synced.Message != message {
+			r.event(vm, corev1.EventTypeWarning, EventDiskShrinkRefused, "%s", message)
+		}
+		setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonDiskShrinkRefused, message)
+		setSettledState(vm, serverDetails.State)
+		return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+	}
+
+	// Grow the disks UpCloud can grow while the server runs
+	serverDetails, offline, err := r.resizeDisks(ctx, svc, vm, serverDetails)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to wait for server: %#v", err)
-		return "", err
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return ctrl.Result{}, err
+	}
+
+	// UpCloud only changes the plan, CPU and memory of stopped servers
+	if changes := append(stopRequiredChanges(vm, serverDetails), offline...); len(changes) > 0 {
+		switch serverDetails.State {
+		case upcloud.ServerStateStopped:
+		case upcloud.ServerStateStarted:
+			return r.stopForChange(ctx, svc, vm, changes)
+		default:
+			// Wait for the server to leave maintenance
+			return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+		}
 	}
 
-	fmt.Printf("Updated UpCloud VM: %#v\n", serverDetails)
-	return serverDetails.UUID, nil
+	// Only send the fields that differ, a spec the server already matches
+	// costs no write
+	if req := modifyRequest(vm, serverDetails); req != nil {
+		serverDetails, err = svc.ModifyServer(ctx, req)
+		if err != nil {
+			r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+			return ctrl.Result{}, fmt.Errorf("failed to modify UpCloud VM: %w", err)
+		}
+		r.Logger.Info("Updated UpCloud VM", "uuid", serverDetails.UUID)
+		r.event(vm, corev1.EventTypeNormal, EventSpecApplied,
+			"Applied generation %d of the spec to UpCloud server %s", vm.Generation, vm.Status.VMID)
+	}
+
+	serverDetails, pending, err := r.reconcileStorageDevices(ctx, svc, vm, serverDetails)
+	if err != nil {
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return ctrl.Result{}, err
+	}
+	serverDetails, waiting, err := r.reconcileStorageRefs(ctx, svc, vm, serverDetails)
+	if err != nil {
+		r.reportProblem(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonSyncFailed, err)
+		return ctrl.Result{}, err
+	}
+	recordServer(vm, serverDetails)
+	if pending || len(waiting) > 0 {
+		// Attach the new disks and storages once UpCloud has prepared them
+		if pending {
+			waiting = append([]string{"new disks are not online yet"}, waiting...)
+		}
+		setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionFalse, ReasonPreparingStorage,
+			"waiting for storage: "+strings.Join(waiting, "; "))
+		setSettledState(vm, serverDetails.State)
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	vm.Status.AppliedSpecHash = hash
+	setCondition(vm, v1alpha1.ConditionSynced, metav1.ConditionTrue, ReasonSynced, "")
+	setDrifted(vm, specDrift(vm, serverDetails))
+	switch {
+	case wantsStopped(vm) && serverDetails.State == upcloud.ServerStateStarted:
+		return r.stopForPowerState(ctx, svc, vm)
+	case wantsStopped(vm) && serverDetails.State == upcloud.ServerStateStopped:
+		setState(vm, StateStopped)
+		return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+	case serverDetails.State != upcloud.ServerStateStarted:
+		// Poll the server until it is running again
+		setState(vm, StateStarting)
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	setState(vm, StateRunning)
+	return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+}
+
+// reconcileDelete deletes the server of a VM being deleted the way its
+// DeletionPolicy says, then removes the finalizer. The credentials are only
+// resolved when there is a server to delete: a VM without one, or whose
+// policy is Orphan, is released even when its Secret or
+// UpCloudProviderConfig is missing or broken.
+func (r *UpCloudVMReconciler) reconcileDelete(ctx context.Context, vm *v1alpha1.UpCloudVM) (ctrl.Result, error) {
+	r.Logger.Info("Deleting UpCloud VM")
+	if vm.Spec.DeletionProtection {
+		// The webhook refuses such deletions; keep the server until the
+		// protection is lifted, which triggers a reconcile
+		message := "spec.deletionProtection is set, set it to false to delete the UpCloudVM"
+		if deleting := meta.FindStatusCondition(vm.Status.Conditions, v1alpha1.ConditionDeleting); deleting == nil ||
+			deleting.Reason != ReasonDeletionProtected {
+			r.event(vm, corev1.EventTypeWarning, EventDeletionProtected, "Kept UpCloud server %s: %s", vm.Status.VMID, message)
+		}
+		setCondition(vm, v1alpha1.ConditionDeleting, metav1.ConditionFalse, ReasonDeletionProtected, message)
+		return ctrl.Result{}, nil
+	}
+	orphan := vm.Spec.DeletionPolicy == v1alpha1.DeletionPolicyOrphan
+	if vm.Status.State != StateDeleting && vm.Status.VMID != "" {
+		if orphan {
+			r.event(vm, corev1.EventTypeNormal, EventDeleteStarted, "Leaving UpCloud server %s as the deletionPolicy is Orphan", vm.Status.VMID)
+		} else {
+			r.event(vm, corev1.EventTypeNormal, EventDeleteStarted, "Deleting UpCloud server %s", vm.Status.VMID)
+		}
+	}
+	setState(vm, StateDeleting)
+	setCondition(vm, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonDeleting, "the UpCloudVM is being deleted")
+
+	var retained []string
+	switch {
+	case vm.Status.VMID == "":
+		// No server was recorded, there is nothing to delete
+	case orphan:
+		// Leave the server running as it is, storages attached included
+		retained = append([]string{"server/" + vm.Status.VMID}, recordedOwnedStorages(vm)...)
+	default:
+		config, err := r.getProviderConfig(ctx, vm)
+		var svc cloud.Provider
+		if err == nil {
+			err, svc = r.getService(ctx, vm, config)
+		}
+		if err != nil {
+			return ctrl.Result{}, r.reportDeleteBlocked(vm, err)
+		}
+		clearBlocked(vm)
+		deleted, kept, err := r.deleteUpCloudVM(ctx, svc, vm)
+		if err != nil {
+			r.Logger.Error(err, "Failed to delete UpCloud VM")
+			r.reportProblem(vm, v1alpha1.ConditionDeleting, metav1.ConditionTrue, ReasonDeleteFailed, err)
+			return ctrl.Result{}, err
+		}
+		if !deleted {
+			// Come back once the server has stopped
+			return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+		}
+		r.event(vm, corev1.EventTypeNormal, EventDeleteCompleted, "Deleted UpCloud server %s", vm.Status.VMID)
+		retained = kept
+	}
+	if len(retained) > 0 {
+		// The Event outlives the UpCloudVM, the annotation is in its last
+		// revision, both name what is left to clean up in UpCloud
+		r.event(vm, corev1.EventTypeNormal, EventResourcesRetained, "Kept %s as the deletionPolicy is %s",
+			strings.Join(retained, ", "), vm.Spec.DeletionPolicy)
+		if vm.Annotations == nil {
+			vm.Annotations = map[string]string{}
+		}
+		vm.Annotations[v1alpha1.RetainedResourcesAnnotation] = strings.Join(retained, ",")
+	}
+	// Remove Finalizer from VM deletion
+	vm.ObjectMeta.Finalizers = removeString(vm.ObjectMeta.Finalizers, UPCloudFinalizer)
+	if err := r.Update(ctx, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
 }
 
-// deleteUpCloudVM deletes the UpCloud VM
-func (r *UpCloudVMReconciler) deleteUpCloudVM(svc *service.Service, vm *v1alpha1.UpCloudVM) error {
-	if vm.Status.VMID == "" {
+// reportDeleteBlocked reports that the server of a VM being deleted cannot
+// be deleted without an UpCloud client. A Secret or UpCloudProviderConfig
+// that is not ready blocks the deletion until it changes; other errors are
+// returned to be retried.
+func (r *UpCloudVMReconciler) reportDeleteBlocked(vm *v1alpha1.UpCloudVM, err error) error {
+	message := fmt.Sprintf("cannot delete UpCloud server %s: %s", vm.Status.VMID, err)
+	if deleting := meta.FindStatusCondition(vm.Status.Conditions, v1alpha1.ConditionDeleting); deleting == nil || deleting.Message != message {
+		r.event(vm, corev1.EventTypeWarning, EventDeleteWaits, "%s", message)
+	}
+	var blocked *blockedError
+	if errors.As(err, &blocked) {
+		r.Logger.Info("UpCloudVM deletion is blocked", "state", blocked.state, "reason", blocked.Error())
+		setCondition(vm, v1alpha1.ConditionCredentialsValid, metav1.ConditionFalse, blocked.state, blocked.Error())
+		setCondition(vm, v1alpha1.ConditionDeleting, metav1.ConditionTrue, blocked.state, message)
 		return nil
 	}
+	r.Logger.Error(err, "Failed to get the UpCloud client to delete the server")
+	setCondition(vm, v1alpha1.ConditionDeleting, metav1.ConditionTrue, ReasonDeleteFailed, message)
+	return err
+}
 
-	err := svc.DeleteServerAndStorages(context.Background(), &request.DeleteServerAndStoragesRequest{
+// deleteUpCloudVM deletes the server of the VM, unless its DeletionPolicy
+// is Orphan. It returns false while the server is still stopping, as
+// UpCloud only deletes stopped servers, and lists the UpCloud resources it
+// kept as storage/<uuid>.
+func (r *UpCloudVMReconciler) deleteUpCloudVM(ctx context.Context, svc cloud.Provider, vm *v1alpha1.UpCloudVM) (bool, []string, error) {
+	serverDetails, err := svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{
 		UUID: vm.Status.VMID,
 	})
+	if isServerNotFound(err) {
+		// Already deleted outside Kubernetes
+		return true, nil, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to delete UpCloud VM: %w", err)
+		return false, nil, fmt.Errorf("failed to get UpCloud VM: %w", err)
 	}
-	return nil
+	vm.Status.ServerState = serverDetails.State
+	setCondition(vm, v1alpha1.ConditionDeleting, metav1.ConditionTrue, ReasonServerStopping,
+		fmt.Sprintf("waiting for UpCloud server %s to stop, it is %s", vm.Status.VMID, serverDetails.State))
+	switch serverDetails.State {
+	case upcloud.ServerStateStopped:
+	case upcloud.ServerStateStarted:
+		_, err = svc.StopServer(ctx, &request.StopServerRequest{
+			UUID:     vm.Status.VMID,
+			StopType: request.ServerStopTypeHard,
+		})
+		if isServerNotFound(err) {
+			return true, nil, nil
+		}
+		if err != nil {
+			return false, nil, fmt.Errorf("failed to stop UpCloud VM: %w", err)
+		}
+		return false, nil, nil
+	default:
+		// Wait for the server to leave maintenance
+		return false, nil, nil
+	}
+
+	// Storages the VM attached belong to someone else
+	if err := detachAttachedStorages(ctx, svc, vm, serverDetails); err != nil {
+		return false, nil, err
+	}
+	if vm.Spec.DeletionPolicy == v1alpha1.DeletionPolicyDeleteServerKeepStorage {
+		err = svc.DeleteServer(ctx, &request.DeleteServerRequest{
+			UUID: vm.Status.VMID,
+		})
+		if err != nil && !isServerNotFound(err) {
+			return false, nil, fmt.Errorf("failed to delete UpCloud VM: %w", err)
+		}
+		return true, ownedStorages(vm, serverDetails), nil
+	}
+	err = svc.DeleteServerAndStorages(ctx, &request.DeleteServerAndStoragesRequest{
+		UUID: vm.Status.VMID,
+	})
+	if err != nil && !isServerNotFound(err) {
+		return false, nil, fmt.Errorf("failed to delete UpCloud VM: %w", err)
+	}
+	return true, nil, nil
+}
+
+// isServerNotFound reports whether err says the server does not exist in UpCloud.
+func isServerNotFound(err error) bool {
+	var problem *upcloud.Problem
+	return errors.As(err, &problem) && problem.ErrorCode() == upcloud.ErrCodeServerNotFound
+}
+
+// serverLost handles a server that was deleted outside Kubernetes. Depending
+// on the VM's RecreatePolicy it is created again or the VM is marked Lost.
+func (r *UpCloudVMReconciler) serverLost(vm *v1alpha1.UpCloudVM) ctrl.Result {
+	r.Logger.Info("UpCloud VM was deleted outside Kubernetes", "uuid", vm.Status.VMID)
+	if vm.Spec.RecreatePolicy == v1alpha1.RecreatePolicyRecreate {
+		r.event(vm, corev1.EventTypeWarning, EventServerLost,
+			"UpCloud server %s was deleted outside Kubernetes, creating a new one", vm.Status.VMID)
+		forgetServer(vm)
+		return ctrl.Result{Requeue: true}
+	}
+	r.event(vm, corev1.EventTypeWarning, EventServerLost,
+		"UpCloud server %s was deleted outside Kubernetes, set spec.recreatePolicy to Recreate to create a new one", vm.Status.VMID)
+	message := fmt.Sprintf("UpCloud server %s was deleted outside Kubernetes", vm.Status.VMID)
+	setState(vm, StateLost)
+	setCondition(vm, v1alpha1.ConditionLost, metav1.ConditionTrue, ReasonServerNotFound, message)
+	setCondition(vm, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonServerNotFound, message)
+	setCondition(vm, v1alpha1.ConditionProvisioned, metav1.ConditionFalse, ReasonServerNotFound, message)
+	return ctrl.Result{}
+}
+
+// forgetServer clears the lost server from the status so that the next
+// reconcile creates a new one.
+func forgetServer(vm *v1alpha1.UpCloudVM) {
+	message := fmt.Sprintf("UpCloud server %s was deleted outside Kubernetes", vm.Status.VMID)
+	vm.Status.VMID = ""
+	vm.Status.State = ""
+	vm.Status.ServerState = ""
+	vm.Status.IPAddress = ""
+	vm.Status.IPAddresses = nil
+	vm.Status.StorageSize = 0
+	vm.Status.StorageDevices = nil
+	setCondition(vm, v1alpha1.ConditionProvisioned, metav1.ConditionFalse, ReasonServerNotFound, message)
+	setCondition(vm, v1alpha1.ConditionReady, metav1.ConditionFalse, ReasonServerNotFound, message)
+	setCondition(vm, v1alpha1.ConditionLost, metav1.ConditionFalse, ReasonRecreating, message+", creating a new one")
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *UpCloudVMReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(context.Background(), &v1alpha1.UpCloudVM{},
+		credentialsRefIndex, indexCredentialsRef); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(context.Background(), &v1alpha1.UpCloudVM{},
+		providerConfigRefIndex, indexProviderConfigRef); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(context.Background(), &v1alpha1.UpCloudVM{},
+		storageRefIndex, indexStorageRefs); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1alpha1.UpCloudVM{}).
+		// The controller's own status updates need no reconcile, the
+		// resync interval picks up changes made in UpCloud
+		For(&v1alpha1.UpCloudVM{}, builder.WithPredicates(predicate.Or(
+			predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.vmsForIndex(credentialsRefIndex))).
+		Watches(&v1alpha1.UpCloudProviderConfig{}, handler.EnqueueRequestsFromMapFunc(r.vmsForIndex(providerConfigRefIndex))).
+		Watches(&v1alpha1.UpCloudStorage{}, handler.EnqueueRequestsFromMapFunc(r.vmsForIndex(storageRefIndex))).
 		Complete(r)
 }
 
+// indexCredentialsRef is the field indexer behind credentialsRefIndex.
+func indexCredentialsRef(obj client.Object) []string {
+	vm := obj.(*v1alpha1.UpCloudVM)
+	if vm.Spec.CredentialsRef == nil {
+		return nil
+	}
+	return []string{vmCredentialsSecret(vm).String()}
+}
+
+// indexProviderConfigRef is the field indexer behind providerConfigRefIndex.
+func indexProviderConfigRef(obj client.Object) []string {
+	vm := obj.(*v1alpha1.UpCloudVM)
+	if vm.Spec.ProviderConfigRef == nil {
+		return nil
+	}
+	// Keyed like client.ObjectKeyFromObject of the cluster-scoped config
+	return []string{types.NamespacedName{Name: vm.Spec.ProviderConfigRef.Name}.String()}
+}
+
+// indexStorageRefs is the field indexer behind storageRefIndex.
+func indexStorageRefs(obj client.Object) []string {
+	vm := obj.(*v1alpha1.UpCloudVM)
+	keys := make([]string, 0, len(vm.Spec.StorageRefs))
+	for _, ref := range vm.Spec.StorageRefs {
+		keys = append(keys, types.NamespacedName{Namespace: vm.Namespace, Name: ref.Name}.String())
+	}
+	return keys
+}
+
+// vmsForIndex returns a map function enqueuing the UpCloudVMs that reference
+// an object through the given index, so they are reconciled again when it changes.
+func (r *UpCloudVMReconciler) vmsForIndex(index string) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		key := client.ObjectKeyFromObject(obj).String()
+		var vms v1alpha1.UpCloudVMList
+		if err := r.List(ctx, &vms, client.MatchingFields{index: key}); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to list UpCloudVMs", "index", index, "key", key)
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(vms.Items))
+		for _, vm := range vms.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&vm)})
+		}
+		return requests
+	}
+}
+
 // Helper functions
 func containsString(slice []string, s string) bool {
 	for _, item := range slice {
@@ -18,18 +18,60 @@ package controller
 
 import (
 	"context"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	upCloudClient "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
 	infrastructurev1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+	"github.com/harper1011/vm-controller/internal/cloud/fake"
+	"github.com/harper1011/vm-controller/test/upcloudsim"
 )
 
+// reconcileUntilSettled reconciles the named resource until the reconciler
+// stops polling it, as it does while a server changes state, and at most
+// requeues it for the periodic resync.
+func reconcileUntilSettled(ctx context.Context, r reconcile.Reconciler, name types.NamespacedName) {
+	for i := 0; i < 10; i++ {
+		result, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: name})
+		Expect(err).NotTo(HaveOccurred())
+		if !result.Requeue && result.RequeueAfter != serverPollInterval {
+			return
+		}
+	}
+	Fail("reconciling " + name.String() + " did not settle")
+}
+
+// recordedEvents drains the events recorded so far, formatted by the fake
+// recorder as "<type> <reason> <message>".
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
 var _ = Describe("UpCloudVM Controller", func() {
 	Context("When reconciling a resource", func() {
 		const resourceName = "test-resource"
@@ -41,8 +83,20 @@ var _ = Describe("UpCloudVM Controller", func() {
 			Namespace: "default", // TODO(user):Modify as needed
 		}
 		upcloudvm := &infrastructurev1alpha1.UpCloudVM{}
+		var provider *fake.Provider
+		var recorder *record.FakeRecorder
+		var controllerReconciler *UpCloudVMReconciler
 
 		BeforeEach(func() {
+			provider = fake.NewProvider()
+			recorder = record.NewFakeRecorder(100)
+			controllerReconciler = &UpCloudVMReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Cloud:    provider,
+				Recorder: recorder,
+			}
+
 			By("creating the custom resource for the Kind UpCloudVM")
 			err := k8sClient.Get(ctx, typeNamespacedName, upcloudvm)
 			if err != nil && errors.IsNotFound(err) {
@@ -51,34 +105,1310 @@ var _ = Describe("UpCloudVM Controller", func() {
 						Name:      resourceName,
 						Namespace: "default",
 					},
-					// TODO(user): Specify other spec details if needed.
+					Spec: infrastructurev1alpha1.UpCloudVMSpec{
+						CPU:             1,
+						Memory:          1024,
+						StorageSize:     10,
+						Zone:            "fi-hel1",
+						Plan:            "1xCPU-1GB",
+						TimeZone:        "UTC",
+						StorageTemplate: "01000000-0000-4000-8000-000030220200",
+					},
 				}
 				Expect(k8sClient.Create(ctx, resource)).To(Succeed())
 			}
 		})
 
 		AfterEach(func() {
-			// TODO(user): Cleanup logic after each test, like removing the resource instance.
 			resource := &infrastructurev1alpha1.UpCloudVM{}
 			err := k8sClient.Get(ctx, typeNamespacedName, resource)
+			if errors.IsNotFound(err) {
+				return
+			}
 			Expect(err).NotTo(HaveOccurred())
 
 			By("Cleanup the specific resource instance UpCloudVM")
 			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+
+			By("Reconciling the deletion to release the finalizer")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, resource))).To(BeTrue())
 		})
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
-			controllerReconciler := &UpCloudVMReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+
+			By("Recording the created server in the status right away")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Finalizers).To(ContainElement(UPCloudFinalizer))
+			Expect(upcloudvm.Status.VMID).NotTo(BeEmpty())
+			Expect(upcloudvm.Status.State).To(Equal(StateProvisioning))
+			server, ok := provider.Server(upcloudvm.Status.VMID)
+			Expect(ok).To(BeTrue())
+			Expect(server.Plan).To(Equal("1xCPU-1GB"))
+			Expect(upcloudvm.Status.IPAddress).To(Equal(server.IPAddresses[0].Address))
+
+			By("Marking the VM running once the server has started")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(provider.Calls("WaitForServerState")).To(BeZero())
+
+			By("Reporting the VM ready through its conditions")
+			Expect(upcloudvm.Status.ServerState).To(Equal(upcloud.ServerStateStarted))
+			Expect(upcloudvm.Status.ObservedGeneration).To(Equal(upcloudvm.Generation))
+			for _, conditionType := range []string{
+				infrastructurev1alpha1.ConditionReady,
+				infrastructurev1alpha1.ConditionProvisioned,
+				infrastructurev1alpha1.ConditionCredentialsValid,
+				infrastructurev1alpha1.ConditionSynced,
+			} {
+				Expect(meta.IsStatusConditionTrue(upcloudvm.Status.Conditions, conditionType)).To(BeTrue(), conditionType)
+			}
+
+			By("Recording the lifecycle as Events")
+			Expect(recordedEvents(recorder)).To(ContainElements(
+				HavePrefix("Normal "+EventCreateRequested+" Requested UpCloud server "+upcloudvm.Status.VMID),
+				HavePrefix("Normal "+EventServerStarted),
+			))
+		})
+
+		It("should report a failed creation in the Provisioned condition", func() {
+			provider.FailNext("CreateServer", &upcloud.Problem{
+				Type:          "https://developers.upcloud.com/1.3/errors#ERROR_PLAN_NOT_FOUND",
+				Title:         "The plan 1xCPU-1GB does not exist.",
+				Status:        http.StatusNotFound,
+				CorrelationID: "01HX3ZQ",
+			})
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).To(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			provisioned := meta.FindStatusCondition(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionProvisioned)
+			Expect(provisioned).NotTo(BeNil())
+			Expect(provisioned.Status).To(Equal(metav1.ConditionFalse))
+			Expect(provisioned.Reason).To(Equal("PlanNotFound"))
+			Expect(provisioned.Message).To(ContainSubstring("correlation ID 01HX3ZQ"))
+			Expect(meta.IsStatusConditionFalse(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionReady)).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElement(And(
+				HavePrefix("Warning PlanNotFound"),
+				ContainSubstring("error code PLAN_NOT_FOUND, correlation ID 01HX3ZQ"),
+			)))
+
+			By("Creating the server on the next attempt")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(meta.IsStatusConditionTrue(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionReady)).To(BeTrue())
+		})
+
+		It("should refuse a spec the UpCloud catalog cannot fulfil", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.Plan = "8xCPU-32GB"
+			upcloudvm.Spec.StorageTemplate = "01000000-0000-4000-8000-000099999999"
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(DefaultResyncInterval))
+
+			By("Listing the valid choices instead of creating the server")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateInvalidSpec))
+			Expect(provider.Calls("CreateServer")).To(BeZero())
+			invalid := meta.FindStatusCondition(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionInvalidSpec)
+			Expect(invalid).NotTo(BeNil())
+			Expect(invalid.Status).To(Equal(metav1.ConditionTrue))
+			Expect(invalid.Message).To(ContainSubstring(`plan "8xCPU-32GB" does not exist, valid plans: 1xCPU-1GB`))
+			Expect(invalid.Message).To(ContainSubstring("01000000-0000-4000-8000-000030220200 (Ubuntu Server 22.04 LTS"))
+			Expect(meta.IsStatusConditionFalse(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionProvisioned)).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning " + EventInvalidSpec)))
+
+			By("Creating the server once the spec is fixed")
+			upcloudvm.Spec.Plan = "1xCPU-1GB"
+			upcloudvm.Spec.StorageTemplate = "01000000-0000-4000-8000-000030220200"
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(meta.IsStatusConditionFalse(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionInvalidSpec)).To(BeTrue())
+		})
+
+		It("should resolve a template selector when creating the server", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.StorageTemplate = ""
+			upcloudvm.Spec.TemplateSelector = &infrastructurev1alpha1.TemplateSelector{OS: "Ubuntu"}
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(upcloudvm.Status.TemplateUUID).To(Equal("01000000-0000-4000-8000-000030240200"))
+			expectClonedFrom := func(template string) {
+				server, ok := provider.Server(upcloudvm.Status.VMID)
+				Expect(ok).To(BeTrue())
+				disk, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: server.StorageDevices[0].UUID})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(disk.Origin).To(Equal(template))
+			}
+			expectClonedFrom("01000000-0000-4000-8000-000030240200")
+
+			By("Cloning a lost server's replacement from the same template")
+			upcloudvm.Spec.RecreatePolicy = infrastructurev1alpha1.RecreatePolicyRecreate
+			upcloudvm.Spec.TemplateSelector.Version = "22.04"
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			provider.RemoveServer(upcloudvm.Status.VMID)
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(upcloudvm.Status.TemplateUUID).To(Equal("01000000-0000-4000-8000-000030240200"))
+			expectClonedFrom("01000000-0000-4000-8000-000030240200")
+		})
+
+		It("should poll the server through its states without blocking", func() {
+			step := func() reconcile.Result {
+				result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: typeNamespacedName,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+				return result
 			}
+			step()
+			vmID := upcloudvm.Status.VMID
+
+			By("Staying in Provisioning while the server is in maintenance")
+			provider.SetServerState(vmID, upcloud.ServerStateMaintenance)
+			Expect(step().RequeueAfter).To(BeNumerically(">", 0))
+			Expect(upcloudvm.Status.State).To(Equal(StateProvisioning))
+
+			By("Starting a server that came up stopped")
+			provider.SetServerState(vmID, upcloud.ServerStateStopped)
+			Expect(step().RequeueAfter).To(BeNumerically(">", 0))
+			Expect(upcloudvm.Status.State).To(Equal(StateStarting))
+			Expect(provider.Calls("StartServer")).To(Equal(1))
 
+			By("Becoming Running once the server has started")
+			Expect(step()).To(Equal(reconcile.Result{RequeueAfter: DefaultResyncInterval}))
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(upcloudvm.Status.VMID).To(Equal(vmID))
+			Expect(provider.Servers()).To(Equal(1))
+		})
+
+		It("should adopt its server when the VMID was not recorded", func() {
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
 				NamespacedName: typeNamespacedName,
 			})
 			Expect(err).NotTo(HaveOccurred())
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+			server, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(server.Labels).To(ContainElement(ownerLabel(upcloudvm)))
+
+			By("Losing the status written after CreateServer")
+			upcloudvm.Status = infrastructurev1alpha1.UpCloudVMStatus{}
+			Expect(k8sClient.Status().Update(ctx, upcloudvm)).To(Succeed())
+
+			By("Finding the labelled server instead of creating another one")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.VMID).To(Equal(vmID))
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(upcloudvm.Status.IPAddress).To(Equal(server.IPAddresses[0].Address))
+			Expect(provider.Calls("CreateServer")).To(Equal(1))
+			Expect(provider.Servers()).To(Equal(1))
+		})
+
+		It("should report drift found on resync without correcting it", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+			recordedEvents(recorder)
+
+			By("Stopping and resizing the server in the UpCloud console")
+			provider.SetServerState(vmID, upcloud.ServerStateStopped)
+			_, err := provider.ModifyServer(ctx, &request.ModifyServerRequest{UUID: vmID, CoreNumber: 2})
+			Expect(err).NotTo(HaveOccurred())
+			modifyCalls := provider.Calls("ModifyServer")
+
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(DefaultResyncInterval))
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateStopped))
+			Expect(upcloudvm.Status.CPU).To(Equal(2))
+			Expect(upcloudvm.Status.LastSyncTime).NotTo(BeNil())
+			drifted := meta.FindStatusCondition(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionDrifted)
+			Expect(drifted).NotTo(BeNil())
+			Expect(drifted.Status).To(Equal(metav1.ConditionTrue))
+			Expect(drifted.Message).To(ContainSubstring("cpu: spec 1, server 2"))
+			Expect(drifted.Message).To(ContainSubstring("state: spec started, server stopped"))
+			Expect(meta.IsStatusConditionFalse(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionReady)).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning " + EventDriftDetected)))
+			Expect(provider.Calls("ModifyServer")).To(Equal(modifyCalls))
+			Expect(provider.Calls("StartServer")).To(BeZero())
+		})
+
+		It("should not start a server stopped outside Kubernetes when its state was reset", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+
+			By("Stopping the server in the UpCloud console while the credentials were broken")
+			provider.SetServerState(vmID, upcloud.ServerStateStopped)
+			upcloudvm.Status.State = StateCredentialsError
+			Expect(k8sClient.Status().Update(ctx, upcloudvm)).To(Succeed())
+
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateStopped))
+			drifted := meta.FindStatusCondition(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionDrifted)
+			Expect(drifted).NotTo(BeNil())
+			Expect(drifted.Status).To(Equal(metav1.ConditionTrue))
+			Expect(drifted.Message).To(ContainSubstring("state: spec started, server stopped"))
+			Expect(provider.Calls("StartServer")).To(BeZero())
+
+			By("Starting it once the VM corrects drift")
+			upcloudvm.Spec.AutoCorrectDrift = true
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(server.State).To(Equal(upcloud.ServerStateStarted))
+			Expect(provider.Calls("StartServer")).To(Equal(1))
+		})
+
+		It("should correct drift when the VM asks for it", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.AutoCorrectDrift = true
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+
+			By("Stopping and resizing the server in the UpCloud console")
+			provider.SetServerState(vmID, upcloud.ServerStateStopped)
+			_, err := provider.ModifyServer(ctx, &request.ModifyServerRequest{UUID: vmID, CoreNumber: 2})
+			Expect(err).NotTo(HaveOccurred())
+
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(server.CoreNumber).To(Equal(1))
+			Expect(server.State).To(Equal(upcloud.ServerStateStarted))
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(meta.IsStatusConditionFalse(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionDrifted)).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventCorrectingDrift)))
+		})
+
+		It("should only modify the server for fields that changed", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+			Expect(upcloudvm.Status.AppliedSpecHash).NotTo(BeEmpty())
+			Expect(provider.Calls("ModifyServer")).To(BeZero())
+
+			By("Resyncing an unchanged VM")
+			reads := provider.Calls("GetServerDetails")
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(provider.Calls("GetServerDetails")).To(Equal(reads + 1))
+			Expect(provider.Calls("ModifyServer")).To(BeZero())
+
+			By("Changing a spec field the server already matches")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.AutoCorrectDrift = true
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Calls("ModifyServer")).To(BeZero())
+
+			By("Renaming the server and duplicating its title label outside Kubernetes")
+			server, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			labels := append(server.Labels, upcloud.Label{Key: "title", Value: "renamed"}, upcloud.Label{Key: "title", Value: "renamed"})
+			_, err = provider.ModifyServer(ctx, &request.ModifyServerRequest{UUID: vmID, Title: "renamed", Labels: &labels})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.TimeZone = "Europe/Helsinki"
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Calls("ModifyServer")).To(Equal(2))
+
+			server, ok = provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(server.Title).To(Equal(resourceName))
+			Expect(server.Timezone).To(Equal("Europe/Helsinki"))
+			var titles []string
+			for _, l := range server.Labels {
+				if l.Key == "title" {
+					titles = append(titles, l.Value)
+				}
+			}
+			Expect(titles).To(Equal([]string{resourceName}))
+			Expect(server.Labels).To(ContainElement(ownerLabel(upcloudvm)))
+
+			By("Resyncing the applied spec")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Calls("ModifyServer")).To(Equal(2))
+		})
+
+		It("should mark the VM lost when its server is deleted outside Kubernetes", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			provider.RemoveServer(upcloudvm.Status.VMID)
+
+			By("Reporting the Lost condition instead of failing")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateLost))
+			lost := meta.FindStatusCondition(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionLost)
+			Expect(lost).NotTo(BeNil())
+			Expect(lost.Status).To(Equal(metav1.ConditionTrue))
+			Expect(lost.Reason).To(Equal(ReasonServerNotFound))
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning " + EventServerLost)))
+
+			By("Leaving it alone on the next reconcile")
+			getCalls := provider.Calls("GetServerDetails")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Calls("GetServerDetails")).To(Equal(getCalls))
+			Expect(provider.Calls("CreateServer")).To(Equal(1))
+
+			By("Releasing the finalizer without a server to delete")
+			Expect(k8sClient.Delete(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, upcloudvm))).To(BeTrue())
+		})
+
+		It("should recreate a server deleted outside Kubernetes when the policy says so", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.RecreatePolicy = infrastructurev1alpha1.RecreatePolicyRecreate
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+			provider.RemoveServer(vmID)
+
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.VMID).NotTo(BeEmpty())
+			Expect(upcloudvm.Status.VMID).NotTo(Equal(vmID))
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(meta.IsStatusConditionFalse(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionLost)).To(BeTrue())
+			Expect(provider.Calls("CreateServer")).To(Equal(2))
+			Expect(provider.Servers()).To(Equal(1))
+		})
+
+		It("should stop the server to change its plan", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+			upcloudvm.Spec.Plan = "2xCPU-4GB"
+			upcloudvm.Spec.CPU = 2
+			upcloudvm.Spec.Memory = 4096
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			By("Asking the server to shut down first")
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(serverPollInterval))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateStopping))
+			Expect(upcloudvm.Status.StopRequestedTime).NotTo(BeNil())
+			Expect(provider.Calls("StopServer")).To(Equal(1))
+
+			By("Applying the change and starting the server again")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(server.Plan).To(Equal("2xCPU-4GB"))
+			Expect(server.State).To(Equal(upcloud.ServerStateStarted))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(upcloudvm.Status.Plan).To(Equal("2xCPU-4GB"))
+			Expect(upcloudvm.Status.StopRequestedTime).To(BeNil())
+			Expect(meta.IsStatusConditionTrue(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionSynced)).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElements(
+				HavePrefix("Normal "+EventResizeRequiresStop),
+				HavePrefix("Normal "+EventSpecApplied),
+			))
+		})
+
+		It("should not reject a plan change when the catalog cannot be read", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.Plan = "2xCPU-4GB"
+			upcloudvm.Spec.CPU = 2
+			upcloudvm.Spec.Memory = 4096
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			provider.FailNext("GetPlans", &upcloud.Problem{
+				Type:   "https://developers.upcloud.com/1.3/errors#ERROR_SERVICE_UNAVAILABLE",
+				Title:  "The service is temporarily unavailable.",
+				Status: http.StatusServiceUnavailable,
+			})
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateStopping))
+			Expect(meta.IsStatusConditionTrue(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionInvalidSpec)).To(BeFalse())
+		})
+
+		It("should stop the server hard when it ignores the soft stop", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			provider.IgnoreSoftStop()
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.Memory = 2048
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateStopping))
+
+			By("Waiting the stop timeout when the request time was not recorded")
+			upcloudvm.Status.StopRequestedTime = nil
+			Expect(k8sClient.Status().Update(ctx, upcloudvm)).To(Succeed())
+			reconcileTimes(ctx, controllerReconciler, typeNamespacedName, 1)
+			Expect(provider.Calls("StopServer")).To(Equal(1))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.StopRequestedTime).NotTo(BeNil())
+
+			By("Stopping it hard once the stop timeout has passed")
+			backdated := metav1.NewTime(upcloudvm.Status.StopRequestedTime.Add(-defaultStopTimeout - time.Second))
+			upcloudvm.Status.StopRequestedTime = &backdated
+			Expect(k8sClient.Status().Update(ctx, upcloudvm)).To(Succeed())
+			reconcileTimes(ctx, controllerReconciler, typeNamespacedName, 1)
+			Expect(provider.Calls("StopServer")).To(Equal(2))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.HardStopRequestedTime).NotTo(BeNil())
+
+			By("Asking for the hard stop only once")
+			provider.SetServerState(upcloudvm.Status.VMID, upcloud.ServerStateStarted)
+			reconcileTimes(ctx, controllerReconciler, typeNamespacedName, 1)
+			Expect(provider.Calls("StopServer")).To(Equal(2))
+			provider.SetServerState(upcloudvm.Status.VMID, upcloud.ServerStateStopped)
+
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, ok := provider.Server(upcloudvm.Status.VMID)
+			Expect(ok).To(BeTrue())
+			Expect(server.MemoryAmount).To(Equal(2048))
+			Expect(provider.Calls("StopServer")).To(Equal(2))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.HardStopRequestedTime).To(BeNil())
+			var timedOut []string
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning "+EventSoftStopTimedOut), &timedOut))
+			Expect(timedOut).To(HaveLen(1))
+		})
+
+		It("should wait for approval before stopping the server", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.DisruptionPolicy = infrastructurev1alpha1.DisruptionPolicyRequireApproval
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.CPU = 2
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateAwaitingApproval))
+			synced := meta.FindStatusCondition(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionSynced)
+			Expect(synced).NotTo(BeNil())
+			Expect(synced.Reason).To(Equal(ReasonRestartNotApproved))
+			Expect(provider.Calls("StopServer")).To(BeZero())
+
+			By("Restarting once the annotation approves it")
+			upcloudvm.Annotations = map[string]string{infrastructurev1alpha1.ApproveRestartAnnotation: "true"}
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(upcloudvm.Annotations).NotTo(HaveKey(infrastructurev1alpha1.ApproveRestartAnnotation))
+			server, ok := provider.Server(upcloudvm.Status.VMID)
+			Expect(ok).To(BeTrue())
+			Expect(server.CoreNumber).To(Equal(2))
+		})
+
+		It("should park the server while the powerState is Stopped", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+			upcloudvm.Spec.PowerState = infrastructurev1alpha1.PowerStateStopped
+			upcloudvm.Spec.StopType = "hard"
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			server, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(server.State).To(Equal(upcloud.ServerStateStopped))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateStopped))
+			Expect(upcloudvm.Status.StopRequestedTime).To(BeNil())
+			Expect(meta.IsStatusConditionTrue(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionSynced)).To(BeTrue())
+			Expect(meta.IsStatusConditionTrue(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionDrifted)).To(BeFalse())
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventServerStopping)))
+
+			By("Staying stopped on resync")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Calls("StartServer")).To(BeZero())
+
+			By("Handling a restart request without starting the server")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Annotations = map[string]string{infrastructurev1alpha1.RestartAnnotation: "2024-05-15T10:30:00Z"}
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Calls("RestartServer")).To(BeZero())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.LastRestartTime).NotTo(BeNil())
+
+			By("Starting the server again")
+			upcloudvm.Spec.PowerState = infrastructurev1alpha1.PowerStateRunning
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, _ = provider.Server(vmID)
+			Expect(server.State).To(Equal(upcloud.ServerStateStarted))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(provider.Calls("RestartServer")).To(BeZero())
+		})
+
+		It("should restart the server once per restart request", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Annotations = map[string]string{infrastructurev1alpha1.RestartAnnotation: "2024-05-15T10:30:00Z"}
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			Expect(provider.Calls("RestartServer")).To(Equal(1))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(upcloudvm.Status.LastRestartTime.UTC().Format(time.RFC3339)).To(Equal("2024-05-15T10:30:00Z"))
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventServerRestarted)))
+
+			By("Ignoring the handled request on resync")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Calls("RestartServer")).To(Equal(1))
+
+			By("Restarting again for a later request")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Annotations[infrastructurev1alpha1.RestartAnnotation] = "2024-05-15T11:00:00Z"
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Calls("RestartServer")).To(Equal(2))
+		})
+
+		It("should create the server of a parked VM stopped", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.PowerState = infrastructurev1alpha1.PowerStateStopped
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateStopped))
+			server, ok := provider.Server(upcloudvm.Status.VMID)
+			Expect(ok).To(BeTrue())
+			Expect(server.State).To(Equal(upcloud.ServerStateStopped))
+		})
+
+		It("should create, attach, grow and detach data disks", func() {
+			shared := provider.AddStorage("fi-hel1", "shared", 20)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.StorageDevices = []infrastructurev1alpha1.StorageDevice{
+				{Title: "data", Size: 50},
+				{Title: "shared", Action: infrastructurev1alpha1.StorageActionAttach, Storage: shared},
+			}
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			By("Creating and attaching the disks along with the server")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+			server, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(server.StorageDevices).To(HaveLen(3))
+			Expect(upcloudvm.Status.StorageDevices).To(HaveLen(3))
+			Expect(upcloudvm.Status.StorageDevices[0].Managed).To(BeFalse())
+			Expect(upcloudvm.Status.StorageDevices[1].Managed).To(BeTrue())
+			Expect(upcloudvm.Status.StorageDevices[2].UUID).To(Equal(shared))
+
+			By("Creating and attaching a disk added later")
+			upcloudvm.Spec.StorageDevices = append(upcloudvm.Spec.StorageDevices,
+				infrastructurev1alpha1.StorageDevice{Title: "logs", Size: 10})
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, _ = provider.Server(vmID)
+			Expect(server.StorageDevices).To(HaveLen(4))
+			Expect(server.StorageDevices[3].Title).To(Equal("logs"))
+			Expect(recordedEvents(recorder)).To(ContainElements(
+				HavePrefix("Normal "+EventStorageCreated),
+				HavePrefix("Normal "+EventStorageAttached),
+			))
+
+			By("Stopping the server to grow a disk")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.StorageDevices[0].Size = 80
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, _ = provider.Server(vmID)
+			Expect(server.StorageDevices[1].Size).To(Equal(80))
+			Expect(server.State).To(Equal(upcloud.ServerStateStarted))
+			Expect(provider.Calls("StopServer")).To(Equal(1))
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventStorageResized)))
+
+			By("Detaching a disk removed from the spec without deleting it")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			logs := upcloudvm.Status.StorageDevices[3].UUID
+			upcloudvm.Spec.StorageDevices = upcloudvm.Spec.StorageDevices[:2]
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, _ = provider.Server(vmID)
+			Expect(server.StorageDevices).To(HaveLen(3))
+			_, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: logs})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.StorageDevices).To(HaveLen(3))
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventStorageDetached)))
+
+			By("Keeping the attached storage when the VM is deleted")
+			Expect(k8sClient.Delete(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Servers()).To(Equal(0))
+			_, err = provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: shared})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should adopt disks whose UUIDs were not recorded", func() {
+			golden := provider.AddStorage("fi-hel1", "golden", 10)
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.StorageDevices = []infrastructurev1alpha1.StorageDevice{
+				{Title: "data", Size: 20},
+				{Title: "copy", Action: infrastructurev1alpha1.StorageActionClone, Storage: golden},
+			}
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileTimes(ctx, controllerReconciler, typeNamespacedName, 1)
+			Expect(provider.Calls("CreateStorage")).To(Equal(1))
+			Expect(provider.Calls("CloneStorage")).To(Equal(1))
+
+			By("Losing the status update that recorded the disks")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Status.StorageDevices = upcloudvm.Status.StorageDevices[:1]
+			Expect(k8sClient.Status().Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			Expect(provider.Calls("CreateStorage")).To(Equal(1))
+			Expect(provider.Calls("CloneStorage")).To(Equal(1))
+			server, _ := provider.Server(upcloudvm.Status.VMID)
+			Expect(server.StorageDevices).To(HaveLen(3))
+			Expect(server.StorageDevices[1].Title).To(Equal("data"))
+			Expect(server.StorageDevices[2].Title).To(Equal("copy"))
+			clone, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: server.StorageDevices[2].UUID})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(clone.Labels).To(ContainElement(ownerLabel(upcloudvm)))
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventStorageAdopted)))
+		})
+
+		It("should grow the system disk without a stop when UpCloud allows it", func() {
+			provider.ResizeOnline()
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.StorageSize).To(Equal(10))
+			upcloudvm.Spec.StorageSize = 30
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.StorageSize).To(Equal(30))
+			Expect(upcloudvm.Status.StorageDevices[0].Size).To(Equal(30))
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(meta.IsStatusConditionTrue(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionSynced)).To(BeTrue())
+			Expect(provider.Calls("StopServer")).To(BeZero())
+			Expect(provider.Calls("ResizeStorageFilesystem")).To(BeZero())
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Normal " + EventStorageResized)))
+		})
+
+		It("should stop the server to grow the system disk and its filesystem", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.StorageSize = 30
+			upcloudvm.Spec.ResizeFilesystem = true
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(serverPollInterval))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateStopping))
+
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			server, ok := provider.Server(upcloudvm.Status.VMID)
+			Expect(ok).To(BeTrue())
+			Expect(server.StorageDevices[0].Size).To(Equal(30))
+			Expect(server.State).To(Equal(upcloud.ServerStateStarted))
+			Expect(provider.Calls("ResizeStorageFilesystem")).To(Equal(1))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.StorageSize).To(Equal(30))
+			Expect(recordedEvents(recorder)).To(ContainElements(
+				HavePrefix("Normal "+EventResizeRequiresStop),
+				HavePrefix("Normal "+EventStorageResized),
+				HavePrefix("Normal "+EventFilesystemResized),
+			))
+		})
+
+		It("should refuse to shrink a disk", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			// Grown in the UpCloud console, the spec stays within the CRD's minimum
+			provider.ResizeOnline()
+			server, _ := provider.Server(upcloudvm.Status.VMID)
+			_, err := provider.ModifyStorage(ctx, &request.ModifyStorageRequest{UUID: server.StorageDevices[0].UUID, Size: 20})
+			Expect(err).NotTo(HaveOccurred())
+			modifyStorageCalls := provider.Calls("ModifyStorage")
+			upcloudvm.Spec.StorageSize = 15
+			upcloudvm.Spec.Memory = 2048
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			synced := meta.FindStatusCondition(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionSynced)
+			Expect(synced).NotTo(BeNil())
+			Expect(synced.Status).To(Equal(metav1.ConditionFalse))
+			Expect(synced.Reason).To(Equal(ReasonDiskShrinkRefused))
+			Expect(synced.Message).To(ContainSubstring("is 20 GB, the spec asks for 15 GB"))
+			Expect(upcloudvm.Status.State).To(Equal(StateRunning))
+			Expect(provider.Calls("ModifyServer")).To(BeZero())
+			Expect(provider.Calls("ModifyStorage")).To(Equal(modifyStorageCalls))
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning " + EventDiskShrinkRefused)))
+		})
+
+		It("should back up the disks on the policy's schedule and prune old backups", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.StorageDevices = []infrastructurev1alpha1.StorageDevice{{Title: "data", Size: 20}}
+			upcloudvm.Spec.BackupPolicy = &infrastructurev1alpha1.BackupPolicy{
+				Schedule: "0 3 * * *",
+				MaxAge:   &metav1.Duration{Duration: 24 * time.Hour},
+				Disks:    []string{resourceName},
+			}
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+
+			By("Scheduling the first run without backing up right away")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.NextBackupTime).NotTo(BeNil())
+			Expect(upcloudvm.Status.NextBackupTime.UTC().Hour()).To(Equal(3))
+			Expect(provider.Calls("CreateBackup")).To(BeZero())
+
+			runDue := func() {
+				Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+				upcloudvm.Status.NextBackupTime = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+				Expect(k8sClient.Status().Update(ctx, upcloudvm)).To(Succeed())
+				result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.RequeueAfter).To(BeNumerically("<=", 24*time.Hour))
+				Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			}
+
+			By("Backing up the system disk only once the run is due")
+			runDue()
+			Expect(provider.Calls("CreateBackup")).To(Equal(1))
+			Expect(upcloudvm.Status.Backups).To(HaveLen(1))
+			first := upcloudvm.Status.Backups[0]
+			Expect(first.StorageUUID).To(Equal(upcloudvm.Status.StorageDevices[0].UUID))
+			Expect(upcloudvm.Status.LastBackupTime).NotTo(BeNil())
+			Expect(upcloudvm.Status.NextBackupTime.After(time.Now())).To(BeTrue())
+			Expect(meta.IsStatusConditionTrue(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionBackedUp)).To(BeTrue())
+			backup, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: first.BackupUUID})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backup.Title).To(HavePrefix(policyBackupPrefix + resourceName + " "))
+
+			By("Finding the backup again when the status lost it")
+			upcloudvm.Status.Backups = nil
+			Expect(k8sClient.Status().Update(ctx, upcloudvm)).To(Succeed())
+			runDue()
+			Expect(provider.Calls("CreateBackup")).To(Equal(1))
+			Expect(upcloudvm.Status.Backups).To(HaveLen(1))
+			Expect(upcloudvm.Status.Backups[0].BackupUUID).To(Equal(first.BackupUUID))
+			Expect(upcloudvm.Status.Backups[0].Title).To(Equal(resourceName))
+
+			By("Deleting backups past their maximum age")
+			upcloudvm.Status.Backups[0].Time = metav1.Time{Time: time.Now().Add(-48 * time.Hour)}
+			Expect(k8sClient.Status().Update(ctx, upcloudvm)).To(Succeed())
+			runDue()
+			Expect(provider.Calls("CreateBackup")).To(Equal(2))
+			Expect(upcloudvm.Status.Backups).To(HaveLen(1))
+			Expect(upcloudvm.Status.Backups[0].BackupUUID).NotTo(Equal(first.BackupUUID))
+			_, err = provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: first.BackupUUID})
+			Expect(isStorageNotFound(err)).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElements(
+				HavePrefix("Normal "+EventBackupsTaken),
+				HavePrefix("Normal "+EventBackupsPruned),
+			))
+		})
+
+		It("should cut long policy backup titles on a rune boundary", func() {
+			now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+			title := policyBackupTitle(strings.Repeat("ä", 64), now)
+			Expect(utf8.ValidString(title)).To(BeTrue())
+			Expect(utf8.RuneCountInString(title)).To(Equal(maxBackupTitle))
+			Expect(title).To(HavePrefix(policyBackupPrefix))
+			Expect(title).To(HaveSuffix(" 20240501-0300"))
+		})
+
+		It("should delete the server when the resource is deleted", func() {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Servers()).To(Equal(1))
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, upcloudvm)).To(Succeed())
+
+			By("Stopping the server first")
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(upcloudvm.Status.State).To(Equal(StateDeleting))
+			Expect(provider.Calls("StopServer")).To(Equal(1))
+
+			By("Deleting the stopped server")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Servers()).To(Equal(0))
+			Expect(provider.Calls("DeleteServerAndStorages")).To(Equal(1))
+			Expect(recordedEvents(recorder)).To(ContainElements(
+				HavePrefix("Normal "+EventDeleteStarted),
+				HavePrefix("Normal "+EventDeleteCompleted),
+			))
+		})
+
+		It("should keep the disks when the deletionPolicy is DeleteServerKeepStorage", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.DeletionPolicy = infrastructurev1alpha1.DeletionPolicyDeleteServerKeepStorage
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			disk := upcloudvm.Status.StorageDevices[0].UUID
+
+			Expect(k8sClient.Delete(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, upcloudvm))).To(BeTrue())
+			Expect(provider.Servers()).To(Equal(0))
+			Expect(provider.Calls("DeleteServerAndStorages")).To(BeZero())
+			_, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: disk})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recordedEvents(recorder)).To(ContainElements(
+				HavePrefix("Normal "+EventDeleteCompleted),
+				And(HavePrefix("Normal "+EventResourcesRetained), ContainSubstring("storage/"+disk)),
+			))
+		})
+
+		It("should leave the server alone when the deletionPolicy is Orphan", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.DeletionPolicy = infrastructurev1alpha1.DeletionPolicyOrphan
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			vmID := upcloudvm.Status.VMID
+
+			Expect(k8sClient.Delete(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, upcloudvm))).To(BeTrue())
+			server, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(server.State).To(Equal(upcloud.ServerStateStarted))
+			Expect(provider.Calls("StopServer")).To(BeZero())
+			events := recordedEvents(recorder)
+			Expect(events).To(ContainElement(
+				And(HavePrefix("Normal "+EventResourcesRetained), ContainSubstring("server/"+vmID)),
+			))
+			Expect(events).NotTo(ContainElement(HavePrefix("Normal " + EventDeleteCompleted)))
+		})
+
+		It("should keep the server of a protected VM deleted past the webhook", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			upcloudvm.Spec.DeletionProtection = true
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(provider.Servers()).To(Equal(1))
+			Expect(provider.Calls("StopServer")).To(BeZero())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, upcloudvm)).To(Succeed())
+			deleting := meta.FindStatusCondition(upcloudvm.Status.Conditions, infrastructurev1alpha1.ConditionDeleting)
+			Expect(deleting).NotTo(BeNil())
+			Expect(deleting.Reason).To(Equal(ReasonDeletionProtected))
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning " + EventDeletionProtected)))
+
+			By("Deleting the server once the protection is lifted")
+			upcloudvm.Spec.DeletionProtection = false
+			Expect(k8sClient.Update(ctx, upcloudvm)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, upcloudvm))).To(BeTrue())
+			Expect(provider.Servers()).To(Equal(0))
+		})
+	})
+
+	Context("When the credentials come from a Secret", func() {
+		const resourceName = "secret-resource"
+		const secretName = "upcloud-credentials"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: "default",
+		}
+		var provider *fake.Provider
+		var controllerReconciler *UpCloudVMReconciler
+
+		reconcileAndGet := func() *infrastructurev1alpha1.UpCloudVM {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			resource := &infrastructurev1alpha1.UpCloudVM{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			return resource
+		}
+
+		BeforeEach(func() {
+			provider = fake.NewProvider()
+			controllerReconciler = &UpCloudVMReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+				Cloud:  provider,
+			}
+
+			resource := &infrastructurev1alpha1.UpCloudVM{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: "default",
+				},
+				Spec: infrastructurev1alpha1.UpCloudVMSpec{
+					CPU:             1,
+					Memory:          1024,
+					StorageSize:     10,
+					Zone:            "fi-hel1",
+					Plan:            "1xCPU-1GB",
+					TimeZone:        "UTC",
+					StorageTemplate: "01000000-0000-4000-8000-000030220200",
+					CredentialsRef:  &infrastructurev1alpha1.LocalCredentialsReference{Name: secretName},
+				},
+			}
+			Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: "default"}}
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, secret))).To(Succeed())
+
+			resource := &infrastructurev1alpha1.UpCloudVM{}
+			err := k8sClient.Get(ctx, typeNamespacedName, resource)
+			if errors.IsNotFound(err) {
+				// Deleted by the test
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			resource.Finalizers = nil
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, resource))).To(Succeed())
+		})
+
+		newSecret := func() *corev1.Secret {
+			return &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: "default"},
+				Data:       map[string][]byte{SecretKeyToken: []byte("token")},
+			}
+		}
+
+		It("should report a missing Secret in the status", func() {
+			resource := reconcileAndGet()
+			Expect(resource.Status.State).To(Equal(StateCredentialsError))
+			Expect(resource.Status.Message).To(ContainSubstring("default/" + secretName + " not found"))
+			credentialsValid := meta.FindStatusCondition(resource.Status.Conditions, infrastructurev1alpha1.ConditionCredentialsValid)
+			Expect(credentialsValid).NotTo(BeNil())
+			Expect(credentialsValid.Status).To(Equal(metav1.ConditionFalse))
+			Expect(credentialsValid.Reason).To(Equal(StateCredentialsError))
+			Expect(provider.Calls("CreateServer")).To(BeZero())
+		})
+
+		It("should report a malformed Secret in the status", func() {
+			Expect(k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: "default"},
+				Data:       map[string][]byte{SecretKeyUsername: []byte("user")},
+			})).To(Succeed())
+
+			resource := reconcileAndGet()
+			Expect(resource.Status.State).To(Equal(StateCredentialsError))
+			Expect(resource.Status.Message).To(ContainSubstring("malformed"))
+			Expect(provider.Calls("CreateServer")).To(BeZero())
+		})
+
+		It("should create the server once the Secret is valid", func() {
+			Expect(reconcileAndGet().Status.State).To(Equal(StateCredentialsError))
+
+			Expect(k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: "default"},
+				Data:       map[string][]byte{SecretKeyToken: []byte("token")},
+			})).To(Succeed())
+
+			resource := reconcileAndGet()
+			Expect(resource.Status.State).To(Equal(StateRunning))
+			Expect(resource.Status.Message).To(BeEmpty())
+			Expect(resource.Status.VMID).NotTo(BeEmpty())
+		})
+
+		It("should wait for the Secret to delete the server", func() {
+			recorder := record.NewFakeRecorder(100)
+			controllerReconciler.Recorder = recorder
+			Expect(k8sClient.Create(ctx, newSecret())).To(Succeed())
+			vmID := reconcileAndGet().Status.VMID
+			Expect(k8sClient.Delete(ctx, newSecret())).To(Succeed())
+
+			resource := &infrastructurev1alpha1.UpCloudVM{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+			resource = reconcileAndGet()
+			Expect(resource.Status.State).To(Equal(StateDeleting))
+			Expect(meta.FindStatusCondition(resource.Status.Conditions, infrastructurev1alpha1.ConditionDeleting).Reason).
+				To(Equal(StateCredentialsError))
+			_, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning " + EventDeleteWaits)))
+
+			By("Restoring the Secret")
+			Expect(k8sClient.Create(ctx, newSecret())).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, resource))).To(BeTrue())
+			Expect(provider.Servers()).To(BeZero())
+		})
+
+		It("should release an orphaning VM without its Secret", func() {
+			Expect(k8sClient.Create(ctx, newSecret())).To(Succeed())
+			resource := reconcileAndGet()
+			vmID := resource.Status.VMID
+			resource.Spec.DeletionPolicy = infrastructurev1alpha1.DeletionPolicyOrphan
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, newSecret())).To(Succeed())
+
+			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, resource))).To(BeTrue())
+			_, ok := provider.Server(vmID)
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("When the VM references an UpCloudProviderConfig", func() {
+		const resourceName = "configured-resource"
+		const configName = "vm-test-config"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: "default",
+		}
+		var provider *fake.Provider
+		var controllerReconciler *UpCloudVMReconciler
+
+		reconcileAndGet := func() *infrastructurev1alpha1.UpCloudVM {
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			resource := &infrastructurev1alpha1.UpCloudVM{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			return resource
+		}
+
+		BeforeEach(func() {
+			provider = fake.NewProvider()
+			controllerReconciler = &UpCloudVMReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+				Cloud:  provider,
+			}
+
+			config := &infrastructurev1alpha1.UpCloudProviderConfig{
+				ObjectMeta: metav1.ObjectMeta{Name: configName},
+				Spec: infrastructurev1alpha1.UpCloudProviderConfigSpec{
+					Zone:        "de-fra1",
+					Plan:        "2xCPU-4GB",
+					StorageTier: "standard",
+				},
+			}
+			Expect(k8sClient.Create(ctx, config)).To(Succeed())
+
+			resource := &infrastructurev1alpha1.UpCloudVM{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: "default",
+				},
+				Spec: infrastructurev1alpha1.UpCloudVMSpec{
+					CPU:               2,
+					Memory:            4096,
+					StorageSize:       10,
+					TimeZone:          "UTC",
+					StorageTemplate:   "01000000-0000-4000-8000-000030220200",
+					ProviderConfigRef: &infrastructurev1alpha1.UpCloudProviderConfigReference{Name: configName},
+				},
+			}
+			Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			resource := &infrastructurev1alpha1.UpCloudVM{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Finalizers = nil
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, resource))).To(Succeed())
+
+			config := &infrastructurev1alpha1.UpCloudProviderConfig{ObjectMeta: metav1.ObjectMeta{Name: configName}}
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, config))).To(Succeed())
+		})
+
+		It("should wait for the config to become ready", func() {
+			resource := reconcileAndGet()
+			Expect(resource.Status.State).To(Equal(StateProviderConfigNotReady))
+			Expect(provider.Calls("CreateServer")).To(BeZero())
+		})
+
+		It("should create the server with the config's defaults", func() {
+			config := &infrastructurev1alpha1.UpCloudProviderConfig{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: configName}, config)).To(Succeed())
+			config.Status.Ready = true
+			Expect(k8sClient.Status().Update(ctx, config)).To(Succeed())
+
+			resource := reconcileAndGet()
+			Expect(resource.Status.State).To(Equal(StateRunning))
+			server, ok := provider.Server(resource.Status.VMID)
+			Expect(ok).To(BeTrue())
+			Expect(server.Zone).To(Equal("de-fra1"))
+			Expect(server.Plan).To(Equal("2xCPU-4GB"))
+			Expect(server.StorageDevices[0].Tier).To(Equal("standard"))
+			Expect(provider.Calls("GetAccount")).To(BeZero())
+		})
+	})
+
+	Context("When reconciling against the UpCloud API simulator", func() {
+		const resourceName = "simulated-resource"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: "default",
+		}
+		var sim *upcloudsim.Server
+		var controllerReconciler *UpCloudVMReconciler
+
+		BeforeEach(func() {
+			sim = upcloudsim.New(upcloudsim.Options{})
+			controllerReconciler = &UpCloudVMReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+				Cloud: cloud.NewUpCloudProvider(upcloudsim.DefaultUsername, upcloudsim.DefaultPassword,
+					upCloudClient.WithBaseURL(sim.URL)),
+			}
+
+			resource := &infrastructurev1alpha1.UpCloudVM{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: "default",
+				},
+				Spec: infrastructurev1alpha1.UpCloudVMSpec{
+					CPU:             1,
+					Memory:          1024,
+					StorageSize:     10,
+					Zone:            "fi-hel1",
+					Plan:            "1xCPU-1GB",
+					TimeZone:        "UTC",
+					StorageTemplate: "01000000-0000-4000-8000-000030220200",
+				},
+			}
+			Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			sim.Close()
+		})
+
+		It("should create and delete the server through the UpCloud SDK", func() {
+			By("Reconciling the created resource")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+
+			resource := &infrastructurev1alpha1.UpCloudVM{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.VMID).NotTo(BeEmpty())
+			server, ok := sim.ServerDetails(resource.Status.VMID)
+			Expect(ok).To(BeTrue())
+			Expect(server.StorageDevices).To(HaveLen(1))
+			Expect(server.StorageDevices[0].Size).To(Equal(10))
+
+			By("Deleting the resource")
+			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(sim.ServerCount()).To(BeZero())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, resource))).To(BeTrue())
+		})
+
+		It("should report an API problem of the client check in the status and an Event", func() {
+			GinkgoT().Setenv("UPCLOUD_USERNAME", upcloudsim.DefaultUsername)
+			GinkgoT().Setenv("UPCLOUD_PASSWORD", upcloudsim.DefaultPassword)
+			recorder := record.NewFakeRecorder(100)
+			controllerReconciler = &UpCloudVMReconciler{
+				Client:     k8sClient,
+				Scheme:     k8sClient.Scheme(),
+				Clients:    cloud.NewPool(),
+				APIBaseURL: sim.URL,
+				Recorder:   recorder,
+			}
+			sim.InjectFailure(upcloudsim.Failure{
+				Method: http.MethodGet,
+				Path:   "/account",
+				Status: http.StatusServiceUnavailable,
+				Code:   "SERVICE_UNAVAILABLE",
+			})
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+			resource := &infrastructurev1alpha1.UpCloudVM{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			synced := meta.FindStatusCondition(resource.Status.Conditions, infrastructurev1alpha1.ConditionSynced)
+			Expect(synced).NotTo(BeNil())
+			Expect(synced.Status).To(Equal(metav1.ConditionFalse))
+			Expect(synced.Reason).To(Equal("ServiceUnavailable"))
+			Expect(synced.Message).To(ContainSubstring("error code SERVICE_UNAVAILABLE"))
+			Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning ServiceUnavailable")))
+
+			By("Creating the server once the API recovers")
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.VMID).NotTo(BeEmpty())
+
+			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+			reconcileUntilSettled(ctx, controllerReconciler, typeNamespacedName)
 		})
 	})
 })
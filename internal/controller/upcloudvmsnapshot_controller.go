@@ -0,0 +1,426 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apiError "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// Status states of an UpCloudVMSnapshot, besides StateDeleting and the
+// states of a blockedError.
+const (
+	StatePending    = "Pending"
+	StateInProgress = "InProgress"
+	StateCompleted  = "Completed"
+	StateFailed     = "Failed"
+)
+
+// Reasons of the UpCloudVMSnapshot conditions and Events.
+const (
+	ReasonVMNotFound        = "VMNotFound"
+	ReasonVMNotProvisioned  = "VMNotProvisioned"
+	ReasonBackupInProgress  = "BackupInProgress"
+	ReasonBackupFailed      = "BackupFailed"
+	ReasonBackupNotFound    = "BackupNotFound"
+	ReasonSnapshotCompleted = "SnapshotCompleted"
+	EventSnapshotStarted    = "SnapshotStarted"
+	EventSnapshotCompleted  = "SnapshotCompleted"
+	EventSnapshotFailed     = "SnapshotFailed"
+	EventBackupsDeleted     = "BackupsDeleted"
+)
+
+// snapshotVMRefIndex indexes UpCloudVMSnapshots by the namespace/name of
+// their UpCloudVM.
+const snapshotVMRefIndex = "spec.vmRef"
+
+// maxBackupTitle is the longest storage title UpCloud accepts.
+const maxBackupTitle = 64
+
+// UpCloudVMSnapshotReconciler reconciles an UpCloudVMSnapshot object: it
+// backs up every disk of the server of an UpCloudVM with CreateBackup,
+// follows the backups until they are complete, and deletes them with the
+// snapshot. Restoring is up to the UpCloudVM reconciler.
+type UpCloudVMSnapshotReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Logger logr.Logger
+
+	// Cloud is the UpCloud API used to back up disks. When nil, an SDK
+	// client is built like for UpCloudVMs.
+	Cloud cloud.Provider
+	// APIBaseURL overrides the UpCloud API endpoint of SDK clients.
+	APIBaseURL string
+	// Clients caches SDK clients, shared with the UpCloudVM reconciler.
+	Clients *cloud.Pool
+	// Recorder records the lifecycle Events shown by kubectl describe.
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudvmsnapshots,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudvmsnapshots/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudvmsnapshots/finalizers,verbs=update
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudvms,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.github.com,resources=upcloudproviderconfigs,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile takes the backups of an UpCloudVMSnapshot once its UpCloudVM
+// has a server, and deletes them when the snapshot is deleted.
+func (r *UpCloudVMSnapshotReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	r.Logger = log.FromContext(ctx)
+
+	var snapshot v1alpha1.UpCloudVMSnapshot
+	if err := r.Get(ctx, req.NamespacedName, &snapshot); err != nil {
+		if apiError.IsNotFound(err) {
+			r.Logger.Info("UpCloudVMSnapshot resource not found. skip...")
+			return ctrl.Result{}, nil
+		}
+		r.Logger.Error(err, "Failed to get UpCloudVMSnapshot")
+		return ctrl.Result{}, err
+	}
+	// Like for UpCloudVMs, the status is written once on the way out
+	oldStatus := snapshot.Status.DeepCopy()
+	defer func() {
+		if statusErr := r.updateStatus(ctx, &snapshot, oldStatus); statusErr != nil {
+			r.Logger.Error(statusErr, "Failed to update UpCloudVMSnapshot status")
+			if err == nil {
+				result, err = ctrl.Result{}, statusErr
+			}
+		}
+	}()
+
+	if !snapshot.DeletionTimestamp.IsZero() {
+		if !containsString(snapshot.Finalizers, UPCloudFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		snapshot.Status.State = StateDeleting
+		if err := r.deleteBackups(ctx, &snapshot); err != nil {
+			r.Logger.Error(err, "Failed to delete UpCloud backups")
+			r.reportProblem(&snapshot, ReasonDeleteFailed, err)
+			return ctrl.Result{}, r.reportBlocked(&snapshot, err)
+		}
+		snapshot.Finalizers = removeString(snapshot.Finalizers, UPCloudFinalizer)
+		return ctrl.Result{}, r.update(ctx, &snapshot)
+	}
+
+	if !containsString(snapshot.Finalizers, UPCloudFinalizer) {
+		snapshot.Finalizers = append(snapshot.Finalizers, UPCloudFinalizer)
+		if err := r.update(ctx, &snapshot); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	switch snapshot.Status.State {
+	case StateCompleted, StateFailed:
+		// A snapshot is taken once
+		return ctrl.Result{}, nil
+	case StateInProgress:
+		return r.followBackups(ctx, &snapshot)
+	}
+	return r.takeBackups(ctx, &snapshot)
+}
+
+// takeBackups backs up every disk of the VM's server. Disks backed up by an
+// earlier, failed attempt are not backed up again.
+func (r *UpCloudVMSnapshotReconciler) takeBackups(ctx context.Context, snapshot *v1alpha1.UpCloudVMSnapshot) (ctrl.Result, error) {
+	var vm v1alpha1.UpCloudVM
+	err := r.Get(ctx, types.NamespacedName{Namespace: snapshot.Namespace, Name: snapshot.Spec.VMRef.Name}, &vm)
+	if apiError.IsNotFound(err) {
+		// The VM's creation triggers a reconcile
+		snapshot.Status.State = StatePending
+		setSnapshotCondition(snapshot, metav1.ConditionFalse, ReasonVMNotFound,
+			fmt.Sprintf("UpCloudVM %s not found", snapshot.Spec.VMRef.Name))
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if snapshot.Status.VMID == "" && (vm.Status.VMID == "" || vm.Status.State == StateProvisioning || vm.Status.State == StateLost) {
+		snapshot.Status.State = StatePending
+		setSnapshotCondition(snapshot, metav1.ConditionFalse, ReasonVMNotProvisioned,
+			fmt.Sprintf("waiting for UpCloudVM %s to have a server", vm.Name))
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	if snapshot.Status.VMID != "" && snapshot.Status.VMID != vm.Status.VMID {
+		// The server was replaced halfway, the backups would not belong together
+		return r.fail(snapshot, ReasonBackupFailed,
+			fmt.Sprintf("UpCloudVM %s no longer has server %s", vm.Name, snapshot.Status.VMID)), nil
+	}
+
+	if len(snapshot.Status.Backups) == 0 {
+		// The backups belong to the account of the VM's credentials
+		snapshot.Status.CredentialsRef = vm.Spec.CredentialsRef.DeepCopy()
+		snapshot.Status.ProviderConfigRef = vm.Spec.ProviderConfigRef.DeepCopy()
+	}
+	svc, err := r.snapshotService(ctx, snapshot)
+	if err != nil {
+		return ctrl.Result{}, r.reportBlocked(snapshot, err)
+	}
+	serverDetails, err := svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{UUID: vm.Status.VMID})
+	if err != nil {
+		r.reportProblem(snapshot, ReasonBackupFailed, err)
+		return ctrl.Result{}, fmt.Errorf("failed to get UpCloud VM: %w", err)
+	}
+	snapshot.Status.VMID = serverDetails.UUID
+	snapshot.Status.Zone = serverDetails.Zone
+
+	// Backups taken by an attempt whose status update was lost are found by
+	// the snapshot's UID in their title
+	taken, err := titledBackups(ctx, svc, backupTitlePrefix(snapshot))
+	if err != nil {
+		r.reportProblem(snapshot, ReasonBackupFailed, err)
+		return ctrl.Result{}, err
+	}
+	for _, device := range serverDetails.StorageDevices {
+		if device.Type != upcloud.StorageTypeDisk || snapshotBackup(snapshot, device.UUID) != nil {
+			continue
+		}
+		var backup upcloud.Storage
+		if found := taken[device.UUID]; len(found) > 0 {
+			backup = found[0]
+		} else {
+			details, err := svc.CreateBackup(ctx, &request.CreateBackupRequest{
+				UUID:  device.UUID,
+				Title: backupTitle(snapshot, device.Title),
+			})
+			if err != nil {
+				r.reportProblem(snapshot, ReasonBackupFailed, err)
+				return ctrl.Result{}, fmt.Errorf("failed to back up storage %s: %w", device.UUID, err)
+			}
+			backup = details.Storage
+		}
+		snapshot.Status.Backups = append(snapshot.Status.Backups, v1alpha1.SnapshotBackup{
+			StorageUUID: device.UUID,
+			Title:       device.Title,
+			Address:     device.Address,
+			Size:        device.Size,
+			BackupUUID:  backup.UUID,
+			State:       backup.State,
+		})
+	}
+	r.event(snapshot, corev1.EventTypeNormal, EventSnapshotStarted,
+		"Backing up %d disks of UpCloud server %s", len(snapshot.Status.Backups), snapshot.Status.VMID)
+	snapshot.Status.State = StateInProgress
+	setSnapshotCondition(snapshot, metav1.ConditionFalse, ReasonBackupInProgress, "waiting for UpCloud to complete the backups")
+	return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+}
+
+// followBackups polls the backups until UpCloud reports all of them online.
+func (r *UpCloudVMSnapshotReconciler) followBackups(ctx context.Context, snapshot *v1alpha1.UpCloudVMSnapshot) (ctrl.Result, error) {
+	svc, err := r.snapshotService(ctx, snapshot)
+	if err != nil {
+		return ctrl.Result{}, r.reportBlocked(snapshot, err)
+	}
+	complete := true
+	for i := range snapshot.Status.Backups {
+		backup := &snapshot.Status.Backups[i]
+		details, err := svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: backup.BackupUUID})
+		if isStorageNotFound(err) {
+			return r.fail(snapshot, ReasonBackupNotFound,
+				fmt.Sprintf("backup %s of disk %s was deleted before it completed", backup.BackupUUID, backup.Title)), nil
+		}
+		if err != nil {
+			r.reportProblem(snapshot, ReasonBackupFailed, err)
+			return ctrl.Result{}, fmt.Errorf("failed to get UpCloud backup: %w", err)
+		}
+		backup.State = details.State
+		if details.State == upcloud.StorageStateError {
+			return r.fail(snapshot, ReasonBackupFailed,
+				fmt.Sprintf("UpCloud failed to back up disk %s (%s)", backup.Title, backup.StorageUUID)), nil
+		}
+		complete = complete && details.State == upcloud.StorageStateOnline
+	}
+	if !complete {
+		return ctrl.Result{RequeueAfter: serverPollInterval}, nil
+	}
+	now := metav1.Now()
+	snapshot.Status.CompletionTime = &now
+	snapshot.Status.State = StateCompleted
+	setSnapshotCondition(snapshot, metav1.ConditionTrue, ReasonSnapshotCompleted, "")
+	r.event(snapshot, corev1.EventTypeNormal, EventSnapshotCompleted,
+		"Backed up %d disks of UpCloud server %s", len(snapshot.Status.Backups), snapshot.Status.VMID)
+	return ctrl.Result{}, nil
+}
+
+// fail marks the snapshot failed for good. Its backups are kept until it is
+// deleted.
+func (r *UpCloudVMSnapshotReconciler) fail(snapshot *v1alpha1.UpCloudVMSnapshot, reason, message string) ctrl.Result {
+	snapshot.Status.State = StateFailed
+	setSnapshotCondition(snapshot, metav1.ConditionFalse, reason, message)
+	r.event(snapshot, corev1.EventTypeWarning, EventSnapshotFailed, "%s", message)
+	return ctrl.Result{}
+}
+
+// deleteBackups deletes the backups of the snapshot from UpCloud.
+func (r *UpCloudVMSnapshotReconciler) deleteBackups(ctx context.Context, snapshot *v1alpha1.UpCloudVMSnapshot) error {
+	if len(snapshot.Status.Backups) == 0 {
+		return nil
+	}
+	svc, err := r.snapshotService(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	for len(snapshot.Status.Backups) > 0 {
+		backup := snapshot.Status.Backups[0]
+		err := svc.DeleteStorage(ctx, &request.DeleteStorageRequest{UUID: backup.BackupUUID})
+		if err != nil && !isStorageNotFound(err) {
+			return fmt.Errorf("failed to delete UpCloud backup %s: %w", backup.BackupUUID, err)
+		}
+		snapshot.Status.Backups = snapshot.Status.Backups[1:]
+	}
+	r.event(snapshot, corev1.EventTypeNormal, EventBackupsDeleted, "Deleted the UpCloud backups of the snapshot")
+	return nil
+}
+
+// snapshotService returns the UpCloud API client of the credentials the
+// VM had when the backups were taken, recorded in the status.
+func (r *UpCloudVMSnapshotReconciler) snapshotService(ctx context.Context, snapshot *v1alpha1.UpCloudVMSnapshot) (cloud.Provider, error) {
+	config, err := readyProviderConfig(ctx, r.Client, snapshot.Status.ProviderConfigRef)
+	if err != nil {
+		return nil, err
+	}
+	return referencedService(ctx, r.Client, r.Cloud, r.Clients, r.APIBaseURL, snapshot.Status.CredentialsRef, snapshot.Namespace, config)
+}
+
+// snapshotBackup returns the backup of the storage in the snapshot, or nil.
+func snapshotBackup(snapshot *v1alpha1.UpCloudVMSnapshot, storageUUID string) *v1alpha1.SnapshotBackup {
+	for i := range snapshot.Status.Backups {
+		if snapshot.Status.Backups[i].StorageUUID == storageUUID {
+			return &snapshot.Status.Backups[i]
+		}
+	}
+	return nil
+}
+
+// backupTitlePrefix returns the start of the titles of the snapshot's
+// backups: its UID, which no other snapshot shares.
+func backupTitlePrefix(snapshot *v1alpha1.UpCloudVMSnapshot) string {
+	return string(snapshot.UID) + " "
+}
+
+// backupTitle returns the title of the backup of a disk, cut to what
+// UpCloud accepts.
+func backupTitle(snapshot *v1alpha1.UpCloudVMSnapshot, diskTitle string) string {
+	return cutTitle(backupTitlePrefix(snapshot) + snapshot.Name + " " + diskTitle)
+}
+
+// setSnapshotCondition sets the Ready condition of the snapshot.
+func setSnapshotCondition(snapshot *v1alpha1.UpCloudVMSnapshot, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&snapshot.Status.Conditions, metav1.Condition{
+		Type:               v1alpha1.ConditionReady,
+		Status:             status,
+		ObservedGeneration: snapshot.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// reportProblem sets Ready to False because of err and records a warning
+// Event, see setProblemCondition.
+func (r *UpCloudVMSnapshotReconciler) reportProblem(snapshot *v1alpha1.UpCloudVMSnapshot, fallbackReason string, err error) {
+	reason, message := problemReason(err, fallbackReason)
+	setSnapshotCondition(snapshot, metav1.ConditionFalse, reason, message)
+	r.event(snapshot, corev1.EventTypeWarning, reason, "%s", message)
+}
+
+// reportBlocked records in the status why the snapshot cannot be
+// reconciled when err is a blockedError, and returns any other error for a
+// retry. The state is kept, a snapshot in progress goes on once unblocked.
+func (r *UpCloudVMSnapshotReconciler) reportBlocked(snapshot *v1alpha1.UpCloudVMSnapshot, err error) error {
+	var blocked *blockedError
+	if !errors.As(err, &blocked) {
+		return err
+	}
+	r.Logger.Info("UpCloudVMSnapshot is blocked", "state", blocked.state, "reason", blocked.Error())
+	setSnapshotCondition(snapshot, metav1.ConditionFalse, blocked.state, blocked.Error())
+	return nil
+}
+
+// event records an Event for the snapshot, unless the reconciler has no Recorder.
+func (r *UpCloudVMSnapshotReconciler) event(snapshot *v1alpha1.UpCloudVMSnapshot, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(snapshot, eventType, reason, messageFmt, args...)
+}
+
+// updateStatus writes the status of the snapshot if it differs from oldStatus.
+func (r *UpCloudVMSnapshotReconciler) updateStatus(ctx context.Context, snapshot *v1alpha1.UpCloudVMSnapshot, oldStatus *v1alpha1.UpCloudVMSnapshotStatus) error {
+	if !snapshot.DeletionTimestamp.IsZero() && !containsString(snapshot.Finalizers, UPCloudFinalizer) {
+		// Released, the API server deletes the UpCloudVMSnapshot and rejects the write
+		return nil
+	}
+	snapshot.Status.ObservedGeneration = snapshot.Generation
+	if equality.Semantic.DeepEqual(oldStatus, &snapshot.Status) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Status().Update(ctx, snapshot))
+}
+
+// update writes the metadata and spec of the snapshot, keeping the status
+// being reconciled.
+func (r *UpCloudVMSnapshotReconciler) update(ctx context.Context, snapshot *v1alpha1.UpCloudVMSnapshot) error {
+	status := snapshot.Status.DeepCopy()
+	if err := r.Update(ctx, snapshot); err != nil {
+		return err
+	}
+	snapshot.Status = *status
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *UpCloudVMSnapshotReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1alpha1.UpCloudVMSnapshot{},
+		snapshotVMRefIndex, indexSnapshotVMRef); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.UpCloudVMSnapshot{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		// Pending snapshots go on once their VM has a server
+		Watches(&v1alpha1.UpCloudVM{}, handler.EnqueueRequestsFromMapFunc(r.snapshotsForVM)).
+		Complete(r)
+}
+
+// indexSnapshotVMRef is the field indexer behind snapshotVMRefIndex.
+func indexSnapshotVMRef(obj client.Object) []string {
+	snapshot := obj.(*v1alpha1.UpCloudVMSnapshot)
+	return []string{types.NamespacedName{Namespace: snapshot.Namespace, Name: snapshot.Spec.VMRef.Name}.String()}
+}
+
+// snapshotsForVM enqueues the pending UpCloudVMSnapshots of a VM.
+func (r *UpCloudVMSnapshotReconciler) snapshotsForVM(ctx context.Context, obj client.Object) []reconcile.Request {
+	key := client.ObjectKeyFromObject(obj).String()
+	var snapshots v1alpha1.UpCloudVMSnapshotList
+	if err := r.List(ctx, &snapshots, client.MatchingFields{snapshotVMRefIndex: key}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list UpCloudVMSnapshots", "key", key)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, snapshot := range snapshots.Items {
+		if snapshot.Status.State == "" || snapshot.Status.State == StatePending {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&snapshot)})
+		}
+	}
+	return requests
+}
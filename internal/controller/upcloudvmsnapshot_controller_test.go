@@ -0,0 +1,312 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	infrastructurev1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud/fake"
+)
+
+var _ = Describe("UpCloudVMSnapshot Controller", func() {
+	const snapshotName = "test-snapshot"
+	const vmName = "snapshot-vm"
+	const cloneName = "snapshot-clone"
+
+	ctx := context.Background()
+
+	snapshotKey := types.NamespacedName{Name: snapshotName, Namespace: "default"}
+	vmKey := types.NamespacedName{Name: vmName, Namespace: "default"}
+	cloneKey := types.NamespacedName{Name: cloneName, Namespace: "default"}
+	var provider *fake.Provider
+	var recorder *record.FakeRecorder
+	var snapshotReconciler *UpCloudVMSnapshotReconciler
+	var vmReconciler *UpCloudVMReconciler
+
+	BeforeEach(func() {
+		provider = fake.NewProvider()
+		recorder = record.NewFakeRecorder(100)
+		snapshotReconciler = &UpCloudVMSnapshotReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Cloud:    provider,
+			Recorder: recorder,
+		}
+		vmReconciler = &UpCloudVMReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Cloud:    provider,
+			Recorder: recorder,
+		}
+		Expect(k8sClient.Create(ctx, &infrastructurev1alpha1.UpCloudVM{
+			ObjectMeta: metav1.ObjectMeta{Name: vmName, Namespace: "default"},
+			Spec: infrastructurev1alpha1.UpCloudVMSpec{
+				StorageSize:     10,
+				Zone:            "fi-hel1",
+				Plan:            "1xCPU-1GB",
+				StorageTemplate: "01000000-0000-4000-8000-000030220200",
+				StorageDevices:  []infrastructurev1alpha1.StorageDevice{{Title: "data", Size: 20}},
+			},
+		})).To(Succeed())
+		Expect(k8sClient.Create(ctx, &infrastructurev1alpha1.UpCloudVMSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: snapshotName, Namespace: "default"},
+			Spec: infrastructurev1alpha1.UpCloudVMSnapshotSpec{
+				VMRef: infrastructurev1alpha1.UpCloudVMReference{Name: vmName},
+			},
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		for _, key := range []types.NamespacedName{cloneKey, vmKey} {
+			vm := &infrastructurev1alpha1.UpCloudVM{}
+			if err := k8sClient.Get(ctx, key, vm); err == nil {
+				Expect(k8sClient.Delete(ctx, vm)).To(Succeed())
+				reconcileUntilSettled(ctx, vmReconciler, key)
+			}
+		}
+		snapshot := &infrastructurev1alpha1.UpCloudVMSnapshot{}
+		if err := k8sClient.Get(ctx, snapshotKey, snapshot); err == nil {
+			Expect(k8sClient.Delete(ctx, snapshot)).To(Succeed())
+			reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		}
+		Expect(errors.IsNotFound(k8sClient.Get(ctx, snapshotKey, snapshot))).To(BeTrue())
+	})
+
+	getSnapshot := func() *infrastructurev1alpha1.UpCloudVMSnapshot {
+		snapshot := &infrastructurev1alpha1.UpCloudVMSnapshot{}
+		Expect(k8sClient.Get(ctx, snapshotKey, snapshot)).To(Succeed())
+		return snapshot
+	}
+
+	getVM := func(key types.NamespacedName) *infrastructurev1alpha1.UpCloudVM {
+		vm := &infrastructurev1alpha1.UpCloudVM{}
+		Expect(k8sClient.Get(ctx, key, vm)).To(Succeed())
+		return vm
+	}
+
+	It("should back up every disk once the VM has a server", func() {
+		By("Waiting for the server")
+		reconcileTimes(ctx, snapshotReconciler, snapshotKey, 2)
+		snapshot := getSnapshot()
+		Expect(snapshot.Status.State).To(Equal(StatePending))
+		Expect(meta.FindStatusCondition(snapshot.Status.Conditions, infrastructurev1alpha1.ConditionReady).Reason).
+			To(Equal(ReasonVMNotProvisioned))
+
+		By("Backing up the system and data disks")
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		snapshot = getSnapshot()
+		Expect(snapshot.Status.State).To(Equal(StateCompleted))
+		Expect(snapshot.Status.VMID).To(Equal(getVM(vmKey).Status.VMID))
+		Expect(snapshot.Status.Zone).To(Equal("fi-hel1"))
+		Expect(snapshot.Status.CompletionTime).NotTo(BeNil())
+		Expect(snapshot.Status.Backups).To(HaveLen(2))
+		Expect(snapshot.Status.Backups[1].Title).To(Equal("data"))
+		Expect(snapshot.Status.Backups[1].Size).To(Equal(20))
+		Expect(meta.IsStatusConditionTrue(snapshot.Status.Conditions, infrastructurev1alpha1.ConditionReady)).To(BeTrue())
+		backup, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: snapshot.Status.Backups[0].BackupUUID})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backup.Type).To(Equal(upcloud.StorageTypeBackup))
+		Expect(backup.Origin).To(Equal(snapshot.Status.Backups[0].StorageUUID))
+		Expect(provider.Calls("CreateBackup")).To(Equal(2))
+
+		By("Deleting the backups with the snapshot")
+		Expect(k8sClient.Delete(ctx, snapshot)).To(Succeed())
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		Expect(errors.IsNotFound(k8sClient.Get(ctx, snapshotKey, snapshot))).To(BeTrue())
+		_, err = provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: backup.UUID})
+		Expect(isStorageNotFound(err)).To(BeTrue())
+		Expect(recordedEvents(recorder)).To(ContainElements(
+			HavePrefix("Normal "+EventSnapshotStarted),
+			HavePrefix("Normal "+EventSnapshotCompleted),
+			HavePrefix("Normal "+EventBackupsDeleted),
+		))
+	})
+
+	It("should find the backups it took when its status was lost", func() {
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		snapshot := getSnapshot()
+		Expect(snapshot.Status.State).To(Equal(StateCompleted))
+		backups := snapshot.Status.Backups
+		backup, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: backups[0].BackupUUID})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backup.Title).To(HavePrefix(string(snapshot.UID) + " "))
+
+		By("Losing the status write after the backups were taken")
+		snapshot.Status = infrastructurev1alpha1.UpCloudVMSnapshotStatus{}
+		Expect(k8sClient.Status().Update(ctx, snapshot)).To(Succeed())
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		snapshot = getSnapshot()
+		Expect(snapshot.Status.State).To(Equal(StateCompleted))
+		Expect(snapshot.Status.Backups).To(HaveLen(2))
+		Expect(snapshot.Status.Backups[0].BackupUUID).To(Equal(backups[0].BackupUUID))
+		Expect(snapshot.Status.Backups[1].BackupUUID).To(Equal(backups[1].BackupUUID))
+		Expect(provider.Calls("CreateBackup")).To(Equal(2))
+	})
+
+	It("should delete the backups with the VM's credentials once the VM is gone", func() {
+		newSecret := func() *corev1.Secret {
+			return &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "snapshot-credentials", Namespace: "default"},
+				Data:       map[string][]byte{SecretKeyToken: []byte("token")},
+			}
+		}
+		Expect(k8sClient.Create(ctx, newSecret())).To(Succeed())
+		vm := getVM(vmKey)
+		vm.Spec.CredentialsRef = &infrastructurev1alpha1.LocalCredentialsReference{Name: "snapshot-credentials"}
+		Expect(k8sClient.Update(ctx, vm)).To(Succeed())
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		snapshot := getSnapshot()
+		Expect(snapshot.Status.State).To(Equal(StateCompleted))
+		Expect(snapshot.Status.CredentialsRef).To(Equal(vm.Spec.CredentialsRef))
+		backupUUID := snapshot.Status.Backups[0].BackupUUID
+
+		By("Deleting the VM, its Secret and then the snapshot")
+		Expect(k8sClient.Delete(ctx, vm)).To(Succeed())
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		Expect(k8sClient.Delete(ctx, newSecret())).To(Succeed())
+		Expect(k8sClient.Delete(ctx, snapshot)).To(Succeed())
+		reconcileTimes(ctx, snapshotReconciler, snapshotKey, 1)
+		snapshot = getSnapshot()
+		Expect(meta.FindStatusCondition(snapshot.Status.Conditions, infrastructurev1alpha1.ConditionReady).Reason).
+			To(Equal(StateCredentialsError))
+		_, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: backupUUID})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Restoring the Secret")
+		Expect(k8sClient.Create(ctx, newSecret())).To(Succeed())
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		Expect(errors.IsNotFound(k8sClient.Get(ctx, snapshotKey, snapshot))).To(BeTrue())
+		_, err = provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: backupUUID})
+		Expect(isStorageNotFound(err)).To(BeTrue())
+		Expect(k8sClient.Delete(ctx, newSecret())).To(Succeed())
+	})
+
+	It("should restore the VM's disks from the snapshot", func() {
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+
+		vm := getVM(vmKey)
+		vm.Annotations = map[string]string{infrastructurev1alpha1.RestoreSnapshotAnnotation: snapshotName}
+		Expect(k8sClient.Update(ctx, vm)).To(Succeed())
+		reconcileTimes(ctx, vmReconciler, vmKey, 2)
+
+		vm = getVM(vmKey)
+		Expect(vm.Annotations).NotTo(HaveKey(infrastructurev1alpha1.RestoreSnapshotAnnotation))
+		Expect(vm.Status.State).To(Equal(StateStarting))
+		Expect(provider.Calls("StopServer")).To(Equal(1))
+		Expect(provider.Calls("RestoreBackup")).To(Equal(2))
+
+		By("Waiting for the restored disks to come online")
+		server, _ := provider.Server(vm.Status.VMID)
+		provider.SetStorageState(server.StorageDevices[0].UUID, upcloud.StorageStateMaintenance)
+		reconcileTimes(ctx, vmReconciler, vmKey, 2)
+		Expect(getVM(vmKey).Status.State).To(Equal(StateStarting))
+		Expect(provider.Calls("StartServer")).To(BeZero())
+
+		provider.SetStorageState(server.StorageDevices[0].UUID, upcloud.StorageStateOnline)
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		Expect(getVM(vmKey).Status.State).To(Equal(StateRunning))
+		server, _ = provider.Server(vm.Status.VMID)
+		Expect(server.State).To(Equal(upcloud.ServerStateStarted))
+		Expect(recordedEvents(recorder)).To(ContainElements(
+			HavePrefix("Normal "+EventResizeRequiresStop),
+			HavePrefix("Normal "+EventSnapshotRestored),
+		))
+	})
+
+	It("should cut long backup titles on a rune boundary", func() {
+		snapshot := getSnapshot()
+		title := backupTitle(snapshot, strings.Repeat("ä", maxBackupTitle))
+		Expect(utf8.ValidString(title)).To(BeTrue())
+		Expect(utf8.RuneCountInString(title)).To(Equal(maxBackupTitle))
+		Expect(title).To(HavePrefix(backupTitlePrefix(snapshot)))
+	})
+
+	It("should refuse to restore a snapshot of another server", func() {
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		snapshot := getSnapshot()
+		snapshot.Status.VMID = "00000000-0000-4000-8000-000000000000"
+		Expect(k8sClient.Status().Update(ctx, snapshot)).To(Succeed())
+
+		vm := getVM(vmKey)
+		vm.Annotations = map[string]string{infrastructurev1alpha1.RestoreSnapshotAnnotation: snapshotName}
+		Expect(k8sClient.Update(ctx, vm)).To(Succeed())
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+
+		vm = getVM(vmKey)
+		Expect(vm.Annotations).NotTo(HaveKey(infrastructurev1alpha1.RestoreSnapshotAnnotation))
+		Expect(meta.FindStatusCondition(vm.Status.Conditions, infrastructurev1alpha1.ConditionSynced).Reason).
+			To(Equal(ReasonSnapshotRestoreFailed))
+		Expect(provider.Calls("StopServer")).To(BeZero())
+		Expect(recordedEvents(recorder)).To(ContainElement(HavePrefix("Warning " + EventSnapshotRestoreFailed)))
+	})
+
+	It("should create a new VM with disks cloned from the snapshot", func() {
+		Expect(k8sClient.Create(ctx, &infrastructurev1alpha1.UpCloudVM{
+			ObjectMeta: metav1.ObjectMeta{Name: cloneName, Namespace: "default"},
+			Spec: infrastructurev1alpha1.UpCloudVMSpec{
+				StorageSize: 10,
+				Zone:        "fi-hel1",
+				Plan:        "1xCPU-1GB",
+				SnapshotRef: &infrastructurev1alpha1.SnapshotReference{Name: snapshotName},
+			},
+		})).To(Succeed())
+
+		By("Waiting for the snapshot to complete")
+		reconcileTimes(ctx, vmReconciler, cloneKey, 2)
+		clone := getVM(cloneKey)
+		Expect(clone.Status.VMID).To(BeEmpty())
+		Expect(meta.FindStatusCondition(clone.Status.Conditions, infrastructurev1alpha1.ConditionProvisioned).Reason).
+			To(Equal(ReasonSnapshotNotReady))
+
+		reconcileUntilSettled(ctx, vmReconciler, vmKey)
+		reconcileUntilSettled(ctx, snapshotReconciler, snapshotKey)
+		reconcileUntilSettled(ctx, vmReconciler, cloneKey)
+		clone = getVM(cloneKey)
+		Expect(clone.Status.State).To(Equal(StateRunning))
+		Expect(clone.Status.TemplateUUID).To(BeEmpty())
+		server, ok := provider.Server(clone.Status.VMID)
+		Expect(ok).To(BeTrue())
+		Expect(server.StorageDevices).To(HaveLen(2))
+		snapshot := getSnapshot()
+		for i, device := range server.StorageDevices {
+			details, err := provider.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: device.UUID})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(details.Origin).To(Equal(snapshot.Status.Backups[i].BackupUUID))
+		}
+		Expect(server.StorageDevices[0].Title).To(Equal(cloneName))
+		Expect(server.StorageDevices[1].Title).To(Equal("data"))
+	})
+})
@@ -0,0 +1,54 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2024, time.May, 15, 10, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, time.May, 15, 10, 45, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2024, time.May, 16, 10, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.May, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 2 * * sun", time.Date(2024, time.May, 19, 2, 0, 0, 0, time.UTC)},
+		{"0 2 * * 7", time.Date(2024, time.May, 19, 2, 0, 0, 0, time.UTC)},
+		{"0 3 1 * *", time.Date(2024, time.June, 1, 3, 0, 0, 0, time.UTC)},
+		{"0 4 1-7 jan,jul mon-fri", time.Date(2024, time.July, 1, 4, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 9 15 5 *", time.Date(2025, time.May, 15, 9, 0, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2024, time.May, 15, 10, 45, 0, 0, time.UTC)},
+	} {
+		schedule, err := Parse(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+			continue
+		}
+		if next := schedule.Next(from); !next.Equal(tc.next) {
+			t.Errorf("%q: expected %s, got %s", tc.expr, tc.next, next)
+		}
+	}
+
+	schedule, err := Parse("0 0 30 feb *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := schedule.Next(from); !next.IsZero() {
+		t.Errorf("expected February 30 to never come, got %s", next)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@often",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
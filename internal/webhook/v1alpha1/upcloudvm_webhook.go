@@ -0,0 +1,546 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	infrastructurev1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+	"github.com/harper1011/vm-controller/internal/schedule"
+)
+
+// log is for logging in this package.
+var upcloudvmlog = logf.Log.WithName("upcloudvm-resource")
+
+// customPlan is the plan of servers sized by their CPU and memory alone.
+const customPlan = cloud.CustomPlan
+
+// Limits UpCloud puts on the size of servers with the custom plan.
+const (
+	customMaxCPU       = 20
+	customMinMemory    = 1024
+	customMaxMemory    = 131072
+	customMemoryFactor = 1024
+)
+
+// Ranges of the sizes of any server, kept in line with the markers of
+// UpCloudVMSpec so the webhook and the CRD schema agree.
+const (
+	minCPU         = 1
+	maxCPU         = 128
+	minMemory      = 1024
+	maxMemory      = 1048576
+	minStorageSize = 10
+	maxStorageSize = 4096
+)
+
+// UpCloudVMDefaults are the values the defaulting webhook gives the fields
+// an UpCloudVM and its UpCloudProviderConfig leave unset. Empty values leave
+// the field unset.
+type UpCloudVMDefaults struct {
+	Zone        string
+	Plan        string
+	TimeZone    string
+	StorageSize int
+	StorageTier string
+}
+
+var (
+	// zonePattern matches UpCloud zone IDs such as fi-hel1.
+	zonePattern = regexp.MustCompile(`^[a-z]{2}-[a-z]{3}[0-9]+$`)
+	// planPattern matches UpCloud plan names such as 2xCPU-4GB or
+	// DEV-1xCPU-1GB-10GB, capturing their cores and memory in GB.
+	planPattern = regexp.MustCompile(`^(?:[A-Z]+-)?([0-9]+)xCPU-([0-9]+)GB(?:-[0-9]+GB)?$`)
+	// uuidPattern matches the UUIDs of UpCloud storages.
+	uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// CatalogSource returns the UpCloud catalog of the account a VM uses. The
+// UpCloudVM reconciler implements it.
+type CatalogSource interface {
+	Catalog(ctx context.Context, vm *infrastructurev1alpha1.UpCloudVM) (*cloud.Catalog, error)
+}
+
+// SetupUpCloudVMWebhookWithManager registers the webhook for UpCloudVM in the manager.
+func SetupUpCloudVMWebhookWithManager(mgr ctrl.Manager, defaults UpCloudVMDefaults, catalogs CatalogSource) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&infrastructurev1alpha1.UpCloudVM{}).
+		WithValidator(&UpCloudVMCustomValidator{Catalogs: catalogs}).
+		WithDefaulter(&UpCloudVMCustomDefaulter{Client: mgr.GetClient(), Defaults: defaults}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-infrastructure-github-com-v1alpha1-upcloudvm,mutating=true,failurePolicy=fail,sideEffects=None,groups=infrastructure.github.com,resources=upcloudvms,verbs=create,versions=v1alpha1,name=mupcloudvm-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// UpCloudVMCustomDefaulter fills in the fields a new UpCloudVM leaves unset,
+// first from its UpCloudProviderConfig and then from the manager's Defaults.
+// Existing VMs are not defaulted, as their zone can no longer change.
+type UpCloudVMCustomDefaulter struct {
+	// Client reads the UpCloudProviderConfig referenced by the VM.
+	Client   client.Reader
+	Defaults UpCloudVMDefaults
+}
+
+var _ webhook.CustomDefaulter = &UpCloudVMCustomDefaulter{}
+
+// Default implements webhook.CustomDefaulter.
+func (d *UpCloudVMCustomDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	vm, ok := obj.(*infrastructurev1alpha1.UpCloudVM)
+	if !ok {
+		return fmt.Errorf("expected an UpCloudVM object but got %T", obj)
+	}
+	upcloudvmlog.V(1).Info("Defaulting for UpCloudVM", "name", vm.GetName())
+
+	defaults := d.Defaults
+	if ref := vm.Spec.ProviderConfigRef; ref != nil && d.Client != nil {
+		var config infrastructurev1alpha1.UpCloudProviderConfig
+		err := d.Client.Get(ctx, types.NamespacedName{Name: ref.Name}, &config)
+		switch {
+		case apierrors.IsNotFound(err):
+			// The controller waits for the config, keep the manager's defaults
+		case err != nil:
+			return fmt.Errorf("failed to get UpCloudProviderConfig %s: %w", ref.Name, err)
+		default:
+			defaults.Zone = firstNonEmpty(config.Spec.Zone, defaults.Zone)
+			defaults.Plan = firstNonEmpty(config.Spec.Plan, defaults.Plan)
+			defaults.StorageTier = firstNonEmpty(config.Spec.StorageTier, defaults.StorageTier)
+		}
+	}
+
+	spec := &vm.Spec
+	spec.Zone = firstNonEmpty(spec.Zone, defaults.Zone)
+	if spec.Plan == "" && (spec.CPU != 0 || spec.Memory != 0) {
+		// A VM sized by hand does not get the default plan's size
+		spec.Plan = customPlan
+	}
+	spec.Plan = firstNonEmpty(spec.Plan, defaults.Plan)
+	spec.TimeZone = firstNonEmpty(spec.TimeZone, defaults.TimeZone)
+	spec.StorageTier = firstNonEmpty(spec.StorageTier, defaults.StorageTier)
+	if spec.StorageSize == 0 {
+		spec.StorageSize = defaults.StorageSize
+	}
+	return nil
+}
+
+// firstNonEmpty returns the first of values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// +kubebuilder:webhook:path=/validate-infrastructure-github-com-v1alpha1-upcloudvm,mutating=false,failurePolicy=fail,sideEffects=None,groups=infrastructure.github.com,resources=upcloudvms,verbs=create;update;delete,versions=v1alpha1,name=vupcloudvm-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// UpCloudVMCustomValidator rejects UpCloudVMs UpCloud would refuse to create,
+// and changes to the fields of a provisioned server UpCloud cannot modify.
+type UpCloudVMCustomValidator struct {
+	// Catalogs, when set, checks the zone, plan and template against what
+	// the UpCloud account offers. A catalog that cannot be read only adds
+	// a warning, the reconciler checks the spec again.
+	Catalogs CatalogSource
+}
+
+var _ webhook.CustomValidator = &UpCloudVMCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator.
+func (v *UpCloudVMCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	vm, ok := obj.(*infrastructurev1alpha1.UpCloudVM)
+	if !ok {
+		return nil, fmt.Errorf("expected an UpCloudVM object but got %T", obj)
+	}
+	upcloudvmlog.V(1).Info("Validation for UpCloudVM upon creation", "name", vm.GetName())
+
+	path := field.NewPath("spec")
+	allErrs := append(validateSpec(vm, path), validateAnnotations(vm)...)
+	if len(allErrs) > 0 {
+		return nil, invalid(vm, allErrs)
+	}
+	warnings, allErrs := v.validateCatalog(ctx, vm, nil, path)
+	return warnings, invalid(vm, allErrs)
+}
+
+// ValidateUpdate implements webhook.CustomValidator.
+func (v *UpCloudVMCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	vm, ok := newObj.(*infrastructurev1alpha1.UpCloudVM)
+	if !ok {
+		return nil, fmt.Errorf("expected an UpCloudVM object for the newObj but got %T", newObj)
+	}
+	old, ok := oldObj.(*infrastructurev1alpha1.UpCloudVM)
+	if !ok {
+		return nil, fmt.Errorf("expected an UpCloudVM object for the oldObj but got %T", oldObj)
+	}
+	upcloudvmlog.V(1).Info("Validation for UpCloudVM upon update", "name", vm.GetName())
+
+	if !vm.DeletionTimestamp.IsZero() {
+		// Let the finalizer go whatever the spec says
+		return nil, nil
+	}
+	path := field.NewPath("spec")
+	allErrs := append(validateSpec(vm, path), validateAnnotations(vm)...)
+	if old.Status.VMID != "" {
+		allErrs = append(allErrs, validateImmutable(&old.Spec, &vm.Spec, path)...)
+	}
+	if len(allErrs) > 0 {
+		return nil, invalid(vm, allErrs)
+	}
+	warnings, allErrs := v.validateCatalog(ctx, vm, old, path)
+	return warnings, invalid(vm, allErrs)
+}
+
+// ValidateDelete implements webhook.CustomValidator. It refuses to delete a
+// VM with DeletionProtection.
+func (v *UpCloudVMCustomValidator) ValidateDelete(_ context.Context, obj runtime.Object) (admission.Warnings, error) {
+	vm, ok := obj.(*infrastructurev1alpha1.UpCloudVM)
+	if !ok {
+		return nil, fmt.Errorf("expected an UpCloudVM object but got %T", obj)
+	}
+	upcloudvmlog.V(1).Info("Validation for UpCloudVM upon deletion", "name", vm.GetName())
+
+	if vm.Spec.DeletionProtection {
+		return nil, apierrors.NewForbidden(infrastructurev1alpha1.GroupVersion.WithResource("upcloudvms").GroupResource(), vm.Name,
+			errors.New("spec.deletionProtection is set, set it to false before deleting the UpCloudVM"))
+	}
+	return nil, nil
+}
+
+// validateCatalog checks the zone, plan and template of vm against the
+// UpCloud catalog, and that its template selector picks a template. On update only the fields that changed from old are
+// checked, so a template UpCloud has since retired does not block edits.
+func (v *UpCloudVMCustomValidator) validateCatalog(ctx context.Context, vm, old *infrastructurev1alpha1.UpCloudVM, path *field.Path) (admission.Warnings, field.ErrorList) {
+	if v.Catalogs == nil {
+		return nil, nil
+	}
+	zone, plan, template, selector := vm.Spec.Zone, vm.Spec.Plan, vm.Spec.StorageTemplate, vm.Spec.TemplateSelector
+	if old != nil {
+		if zone == old.Spec.Zone {
+			zone = ""
+		}
+		if plan == old.Spec.Plan {
+			plan = ""
+		}
+		if template == old.Spec.StorageTemplate {
+			template = ""
+		}
+		if reflect.DeepEqual(selector, old.Spec.TemplateSelector) {
+			selector = nil
+		}
+	}
+	if zone == "" && plan == "" && template == "" && selector == nil {
+		return nil, nil
+	}
+	catalog, err := v.Catalogs.Catalog(ctx, vm)
+	if err != nil {
+		return admission.Warnings{fmt.Sprintf("the spec was not checked against the UpCloud catalog: %v", err)}, nil
+	}
+	var allErrs field.ErrorList
+	if err := catalog.CheckZone(zone); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("zone"), zone, err.Error()))
+	}
+	if err := catalog.CheckPlan(plan); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("plan"), plan, err.Error()))
+	}
+	if err := catalog.CheckTemplate(template); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("storagetemplate"), template, err.Error()))
+	}
+	if selector != nil {
+		if _, err := catalog.ResolveTemplate(cloud.TemplateSelector(*selector)); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("templateSelector"), selector, err.Error()))
+		}
+	}
+	return nil, allErrs
+}
+
+// invalid turns allErrs into the Invalid error returned to the API server,
+// or nil when there are none.
+func invalid(vm *infrastructurev1alpha1.UpCloudVM, allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(infrastructurev1alpha1.GroupVersion.WithKind("UpCloudVM").GroupKind(), vm.Name, allErrs)
+}
+
+// validateSpec checks the formats of the zone, plan and storage template or
+// template selector, and the CPU and memory against the plan. Fields left unset are filled in
+// from the UpCloudProviderConfig and are not checked.
+func validateSpec(vm *infrastructurev1alpha1.UpCloudVM, path *field.Path) field.ErrorList {
+	spec := &vm.Spec
+	var allErrs field.ErrorList
+	if spec.Zone != "" && !zonePattern.MatchString(spec.Zone) {
+		allErrs = append(allErrs, field.Invalid(path.Child("zone"), spec.Zone,
+			"must be an UpCloud zone ID such as fi-hel1"))
+	}
+	switch {
+	case spec.SnapshotRef != nil && (spec.StorageTemplate != "" || spec.TemplateSelector != nil):
+		allErrs = append(allErrs, field.Forbidden(path.Child("snapshotRef"),
+			"cannot be set together with storagetemplate or templateSelector, the disks come from the snapshot"))
+	case spec.SnapshotRef != nil:
+	case spec.StorageTemplate == "" && spec.TemplateSelector == nil:
+		allErrs = append(allErrs, field.Required(path.Child("storagetemplate"), "set storagetemplate, templateSelector or snapshotRef"))
+	case spec.StorageTemplate != "" && spec.TemplateSelector != nil:
+		allErrs = append(allErrs, field.Forbidden(path.Child("templateSelector"), "cannot be set together with storagetemplate"))
+	case spec.StorageTemplate != "" && !uuidPattern.MatchString(spec.StorageTemplate):
+		allErrs = append(allErrs, field.Invalid(path.Child("storagetemplate"), spec.StorageTemplate,
+			"must be the UUID of an UpCloud template storage"))
+	case spec.TemplateSelector != nil:
+		allErrs = append(allErrs, validateTemplateSelector(spec.TemplateSelector, path.Child("templateSelector"))...)
+	}
+	allErrs = append(allErrs, validateRange(path.Child("cpu"), spec.CPU, minCPU, maxCPU)...)
+	allErrs = append(allErrs, validateRange(path.Child("memory"), spec.Memory, minMemory, maxMemory)...)
+	allErrs = append(allErrs, validateRange(path.Child("storagesize"), spec.StorageSize, minStorageSize, maxStorageSize)...)
+	allErrs = append(allErrs, validateStorageDevices(vm.Name, spec.StorageDevices, path.Child("storageDevices"))...)
+	allErrs = append(allErrs, validateBackupPolicy(spec.BackupPolicy, path.Child("backupPolicy"))...)
+	return append(allErrs, validatePlan(spec, path)...)
+}
+
+// validateAnnotations checks that a restart is requested with a time.
+func validateAnnotations(vm *infrastructurev1alpha1.UpCloudVM) field.ErrorList {
+	value, ok := vm.Annotations[infrastructurev1alpha1.RestartAnnotation]
+	if !ok {
+		return nil
+	}
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		return field.ErrorList{field.Invalid(
+			field.NewPath("metadata", "annotations").Key(infrastructurev1alpha1.RestartAnnotation), value,
+			"must be an RFC 3339 time such as 2024-05-15T10:30:00Z")}
+	}
+	return nil
+}
+
+// validateBackupPolicy checks that the schedule parses and runs at all.
+func validateBackupPolicy(policy *infrastructurev1alpha1.BackupPolicy, path *field.Path) field.ErrorList {
+	if policy == nil {
+		return nil
+	}
+	var allErrs field.ErrorList
+	cron, err := schedule.Parse(policy.Schedule)
+	switch {
+	case err != nil:
+		allErrs = append(allErrs, field.Invalid(path.Child("schedule"), policy.Schedule, err.Error()))
+	case cron.Next(time.Now()).IsZero():
+		allErrs = append(allErrs, field.Invalid(path.Child("schedule"), policy.Schedule, "never runs"))
+	}
+	if policy.MaxAge != nil && policy.MaxAge.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("maxAge"), policy.MaxAge.Duration.String(), "must be positive"))
+	}
+	for i, title := range policy.Disks {
+		if title == "" {
+			allErrs = append(allErrs, field.Required(path.Child("disks").Index(i), "the title of a disk"))
+		}
+	}
+	return allErrs
+}
+
+// validateStorageDevices checks that each disk has a title of its own and
+// the fields its action needs. The system disk is titled after the VM.
+func validateStorageDevices(name string, devices []infrastructurev1alpha1.StorageDevice, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	titles := map[string]bool{}
+	for i := range devices {
+		device := &devices[i]
+		devicePath := path.Index(i)
+		switch {
+		case device.Title == "":
+			allErrs = append(allErrs, field.Required(devicePath.Child("title"), ""))
+		case device.Title == name:
+			allErrs = append(allErrs, field.Invalid(devicePath.Child("title"), device.Title,
+				"is the title of the system disk"))
+		case titles[device.Title]:
+			allErrs = append(allErrs, field.Duplicate(devicePath.Child("title"), device.Title))
+		}
+		titles[device.Title] = true
+
+		switch device.Action {
+		case "", infrastructurev1alpha1.StorageActionCreate:
+			if device.Size == 0 {
+				allErrs = append(allErrs, field.Required(devicePath.Child("size"), "a created disk needs a size"))
+			}
+			if device.Storage != "" {
+				allErrs = append(allErrs, field.Forbidden(devicePath.Child("storage"), "only applies to cloned and attached disks"))
+			}
+		case infrastructurev1alpha1.StorageActionClone, infrastructurev1alpha1.StorageActionAttach:
+			if device.Storage == "" {
+				allErrs = append(allErrs, field.Required(devicePath.Child("storage"),
+					fmt.Sprintf("the UUID of the storage to %s", device.Action)))
+			} else if !uuidPattern.MatchString(device.Storage) {
+				allErrs = append(allErrs, field.Invalid(devicePath.Child("storage"), device.Storage, "must be the UUID of an UpCloud storage"))
+			}
+		default:
+			allErrs = append(allErrs, field.NotSupported(devicePath.Child("action"), device.Action,
+				[]string{string(infrastructurev1alpha1.StorageActionCreate), string(infrastructurev1alpha1.StorageActionClone),
+					string(infrastructurev1alpha1.StorageActionAttach)}))
+		}
+		if device.Action == infrastructurev1alpha1.StorageActionAttach {
+			if device.Tier != "" {
+				allErrs = append(allErrs, field.Forbidden(devicePath.Child("tier"), "only applies to created and cloned disks"))
+			}
+			if device.Encrypted {
+				allErrs = append(allErrs, field.Forbidden(devicePath.Child("encrypted"), "only applies to created and cloned disks"))
+			}
+			if device.BackupRule != nil {
+				allErrs = append(allErrs, field.Forbidden(devicePath.Child("backupRule"), "only applies to created and cloned disks"))
+			}
+		}
+		allErrs = append(allErrs, validateRange(devicePath.Child("size"), device.Size, 1, maxStorageSize)...)
+	}
+	return allErrs
+}
+
+// validateTemplateSelector checks that the selector sets exactly one of
+// its title, title pattern and OS, and that the pattern compiles.
+func validateTemplateSelector(selector *infrastructurev1alpha1.TemplateSelector, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	set := 0
+	for _, value := range []string{selector.Title, selector.TitlePattern, selector.OS} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		allErrs = append(allErrs, field.Invalid(path, selector, "must set exactly one of title, titlePattern and os"))
+	}
+	if selector.TitlePattern != "" {
+		if _, err := regexp.Compile(selector.TitlePattern); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("titlePattern"), selector.TitlePattern, err.Error()))
+		}
+	}
+	if selector.Version != "" && selector.OS == "" {
+		allErrs = append(allErrs, field.Forbidden(path.Child("version"), "can only be set with os"))
+	}
+	return allErrs
+}
+
+// validateRange checks that value is unset or between low and high.
+func validateRange(path *field.Path, value, low, high int) field.ErrorList {
+	if value != 0 && (value < low || value > high) {
+		return field.ErrorList{field.Invalid(path, value, fmt.Sprintf("must be between %d and %d", low, high))}
+	}
+	return nil
+}
+
+// validatePlan checks that the CPU and memory fit the plan: a named plan
+// fixes both, while the custom plan needs them within UpCloud's limits.
+func validatePlan(spec *infrastructurev1alpha1.UpCloudVMSpec, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	switch {
+	case spec.Plan == "":
+	case spec.Plan == customPlan:
+		if spec.CPU < 1 || spec.CPU > customMaxCPU {
+			allErrs = append(allErrs, field.Invalid(path.Child("cpu"), spec.CPU,
+				fmt.Sprintf("must be between 1 and %d with the %s plan", customMaxCPU, customPlan)))
+		}
+		if spec.Memory < customMinMemory || spec.Memory > customMaxMemory || spec.Memory%customMemoryFactor != 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child("memory"), spec.Memory,
+				fmt.Sprintf("must be a multiple of %d MiB between %d and %d with the %s plan",
+					customMemoryFactor, customMinMemory, customMaxMemory, customPlan)))
+		}
+	default:
+		m := planPattern.FindStringSubmatch(spec.Plan)
+		if m == nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("plan"), spec.Plan,
+				fmt.Sprintf("must be %s or an UpCloud plan name such as 2xCPU-4GB", customPlan)))
+			break
+		}
+		cpu, _ := strconv.Atoi(m[1])
+		memoryGB, _ := strconv.Atoi(m[2])
+		if spec.CPU != 0 && spec.CPU != cpu {
+			allErrs = append(allErrs, field.Invalid(path.Child("cpu"), spec.CPU,
+				fmt.Sprintf("plan %s has %d CPU cores, leave cpu unset or use the %s plan", spec.Plan, cpu, customPlan)))
+		}
+		if spec.Memory != 0 && spec.Memory != memoryGB*1024 {
+			allErrs = append(allErrs, field.Invalid(path.Child("memory"), spec.Memory,
+				fmt.Sprintf("plan %s has %d MiB of memory, leave memory unset or use the %s plan", spec.Plan, memoryGB*1024, customPlan)))
+		}
+	}
+	return allErrs
+}
+
+// validateImmutable rejects changes to the fields UpCloud only reads when
+// it creates the server.
+func validateImmutable(old, spec *infrastructurev1alpha1.UpCloudVMSpec, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	immutable := func(name string, oldValue, value interface{}) {
+		if !reflect.DeepEqual(oldValue, value) {
+			allErrs = append(allErrs, field.Forbidden(path.Child(name),
+				"cannot be changed once the UpCloud server exists"))
+		}
+	}
+	immutable("zone", old.Zone, spec.Zone)
+	immutable("storagetemplate", old.StorageTemplate, spec.StorageTemplate)
+	immutable("templateSelector", old.TemplateSelector, spec.TemplateSelector)
+	immutable("snapshotRef", old.SnapshotRef, spec.SnapshotRef)
+	immutable("storageTier", old.StorageTier, spec.StorageTier)
+	immutable("login_user", old.LoginUser, spec.LoginUser)
+	immutable("user_data", old.UserData, spec.UserData)
+
+	if spec.StorageSize != 0 && spec.StorageSize < old.StorageSize {
+		allErrs = append(allErrs, field.Invalid(path.Child("storagesize"), spec.StorageSize,
+			fmt.Sprintf("cannot shrink below %d GB, UpCloud only grows disks", old.StorageSize)))
+	}
+
+	// A disk keeps where it came from; renaming its entry replaces it instead
+	oldDevices := map[string]*infrastructurev1alpha1.StorageDevice{}
+	for i := range old.StorageDevices {
+		oldDevices[old.StorageDevices[i].Title] = &old.StorageDevices[i]
+	}
+	for i := range spec.StorageDevices {
+		device := &spec.StorageDevices[i]
+		oldDevice, ok := oldDevices[device.Title]
+		if !ok {
+			continue
+		}
+		devicePath := path.Child("storageDevices").Index(i)
+		for _, f := range []struct {
+			name    string
+			changed bool
+		}{
+			{"action", oldDevice.Action != device.Action},
+			{"storage", oldDevice.Storage != device.Storage},
+			{"tier", oldDevice.Tier != device.Tier},
+			{"encrypted", oldDevice.Encrypted != device.Encrypted},
+			{"address", oldDevice.Address != device.Address},
+		} {
+			if f.changed {
+				allErrs = append(allErrs, field.Forbidden(devicePath.Child(f.name),
+					"cannot be changed once the disk exists, give the disk a new title to replace it"))
+			}
+		}
+		if device.Size < oldDevice.Size {
+			allErrs = append(allErrs, field.Invalid(devicePath.Child("size"), device.Size,
+				fmt.Sprintf("cannot shrink below %d GB, UpCloud only grows disks", oldDevice.Size)))
+		}
+	}
+	return allErrs
+}
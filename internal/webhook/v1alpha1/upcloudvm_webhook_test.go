@@ -0,0 +1,442 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+
+	infrastructurev1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
+)
+
+// stubCatalogs serves a fixed catalog, or err when it is set.
+type stubCatalogs struct {
+	catalog *cloud.Catalog
+	err     error
+}
+
+func (s *stubCatalogs) Catalog(context.Context, *infrastructurev1alpha1.UpCloudVM) (*cloud.Catalog, error) {
+	return s.catalog, s.err
+}
+
+var _ = Describe("UpCloudVM Webhook", func() {
+	var (
+		ctx       context.Context
+		obj       *infrastructurev1alpha1.UpCloudVM
+		oldObj    *infrastructurev1alpha1.UpCloudVM
+		validator UpCloudVMCustomValidator
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		obj = &infrastructurev1alpha1.UpCloudVM{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-vm", Namespace: "default"},
+			Spec: infrastructurev1alpha1.UpCloudVMSpec{
+				CPU:             1,
+				Memory:          1024,
+				StorageSize:     10,
+				Zone:            "fi-hel1",
+				Plan:            "1xCPU-1GB",
+				TimeZone:        "UTC",
+				StorageTemplate: "01000000-0000-4000-8000-000030220200",
+			},
+		}
+		oldObj = obj.DeepCopy()
+		oldObj.Status.VMID = "00000000-0000-4000-8000-000000000001"
+		validator = UpCloudVMCustomValidator{}
+	})
+
+	// expectInvalid checks that err rejects exactly the given fields.
+	expectInvalid := func(err error, fields ...string) {
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected an Invalid error, got %v", err)
+		var got []string
+		for _, cause := range err.(*apierrors.StatusError).ErrStatus.Details.Causes {
+			got = append(got, cause.Field)
+		}
+		Expect(got).To(ConsistOf(fields))
+	}
+
+	Context("When creating UpCloudVM under Validating Webhook", func() {
+		It("Should admit a valid spec", func() {
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should admit a spec leaving the zone, plan, CPU and memory to the defaults", func() {
+			obj.Spec.Zone = ""
+			obj.Spec.Plan = ""
+			obj.Spec.CPU = 0
+			obj.Spec.Memory = 0
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should deny malformed zone, plan and template", func() {
+			obj.Spec.Zone = "Helsinki"
+			obj.Spec.Plan = "small"
+			obj.Spec.StorageTemplate = "Ubuntu 22.04"
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.zone", "spec.plan", "spec.storagetemplate")
+		})
+
+		It("Should deny a missing template", func() {
+			obj.Spec.StorageTemplate = ""
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.storagetemplate")
+		})
+
+		It("Should admit a template selector instead of a template UUID", func() {
+			obj.Spec.StorageTemplate = ""
+			obj.Spec.TemplateSelector = &infrastructurev1alpha1.TemplateSelector{OS: "Ubuntu", Version: "22.04"}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should admit a snapshot instead of a template, but not both", func() {
+			obj.Spec.SnapshotRef = &infrastructurev1alpha1.SnapshotReference{Name: "nightly"}
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.snapshotRef")
+
+			obj.Spec.StorageTemplate = ""
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should deny a template selector that is ambiguous or malformed", func() {
+			obj.Spec.TemplateSelector = &infrastructurev1alpha1.TemplateSelector{OS: "Ubuntu"}
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.templateSelector")
+
+			obj.Spec.StorageTemplate = ""
+			obj.Spec.TemplateSelector = &infrastructurev1alpha1.TemplateSelector{Title: "Ubuntu", TitlePattern: "(", Version: "22.04"}
+			_, err = validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.templateSelector", "spec.templateSelector.titlePattern", "spec.templateSelector.version")
+		})
+
+		It("Should deny a backup schedule that does not parse or never runs", func() {
+			obj.Spec.BackupPolicy = &infrastructurev1alpha1.BackupPolicy{Schedule: "0 3 * * *", KeepLast: 7}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.BackupPolicy.Schedule = "0 25 * * *"
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.backupPolicy.schedule")
+
+			obj.Spec.BackupPolicy.Schedule = "0 0 31 feb *"
+			_, err = validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.backupPolicy.schedule")
+		})
+
+		It("Should deny a restart requested without a time", func() {
+			obj.Annotations = map[string]string{infrastructurev1alpha1.RestartAnnotation: "2024-05-15T10:30:00Z"}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Annotations[infrastructurev1alpha1.RestartAnnotation] = "now"
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "metadata.annotations[infrastructure.github.com/restart]")
+		})
+
+		It("Should deny CPU and memory that do not match a named plan", func() {
+			obj.Spec.Plan = "2xCPU-4GB"
+			obj.Spec.CPU = 4
+			obj.Spec.Memory = 2048
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.cpu", "spec.memory")
+
+			obj.Spec.CPU = 2
+			obj.Spec.Memory = 4096
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should deny sizes out of range", func() {
+			obj.Spec.Plan = ""
+			obj.Spec.CPU = 200
+			obj.Spec.Memory = 512
+			obj.Spec.StorageSize = 5000
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.cpu", "spec.memory", "spec.storagesize")
+		})
+
+		It("Should accept plan names with a prefix and a disk size", func() {
+			obj.Spec.Plan = "DEV-1xCPU-1GB-10GB"
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should check CPU and memory against the limits of the custom plan", func() {
+			obj.Spec.Plan = "custom"
+			obj.Spec.CPU = 3
+			obj.Spec.Memory = 6144
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.CPU = 0
+			obj.Spec.Memory = 1500
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.cpu", "spec.memory")
+		})
+	})
+
+	Context("When validating the storage devices of UpCloudVM", func() {
+		It("Should admit created, cloned and attached disks", func() {
+			obj.Spec.StorageDevices = []infrastructurev1alpha1.StorageDevice{
+				{Title: "data", Size: 50, BackupRule: &infrastructurev1alpha1.BackupRule{Interval: "daily", Time: "0430", Retention: 7}},
+				{Title: "copy", Action: infrastructurev1alpha1.StorageActionClone, Storage: "01000000-0000-4000-8000-000000000010"},
+				{Title: "shared", Action: infrastructurev1alpha1.StorageActionAttach, Storage: "01000000-0000-4000-8000-000000000011", Address: "virtio:3"},
+			}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should deny disks missing what their action needs", func() {
+			obj.Spec.StorageDevices = []infrastructurev1alpha1.StorageDevice{
+				{Title: "data", Storage: "01000000-0000-4000-8000-000000000010"},
+				{Title: "copy", Action: infrastructurev1alpha1.StorageActionClone},
+				{Title: "shared", Action: infrastructurev1alpha1.StorageActionAttach, Storage: "01000000-0000-4000-8000-000000000011", Tier: "hdd", Encrypted: true},
+			}
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.storageDevices[0].size", "spec.storageDevices[0].storage",
+				"spec.storageDevices[1].storage", "spec.storageDevices[2].tier", "spec.storageDevices[2].encrypted")
+		})
+
+		It("Should deny duplicate titles and the title of the system disk", func() {
+			obj.Spec.StorageDevices = []infrastructurev1alpha1.StorageDevice{
+				{Title: "data", Size: 10},
+				{Title: "data", Size: 20},
+				{Title: "test-vm", Size: 10},
+			}
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.storageDevices[1].title", "spec.storageDevices[2].title")
+		})
+
+		It("Should only let an existing disk grow", func() {
+			oldObj.Spec.StorageDevices = []infrastructurev1alpha1.StorageDevice{{Title: "data", Size: 50, Tier: "maxiops"}}
+			obj = oldObj.DeepCopy()
+			obj.Spec.StorageDevices[0].Size = 100
+			obj.Spec.StorageDevices = append(obj.Spec.StorageDevices, infrastructurev1alpha1.StorageDevice{Title: "logs", Size: 10})
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+
+			obj.Spec.StorageDevices[0].Size = 20
+			obj.Spec.StorageDevices[0].Tier = "hdd"
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			expectInvalid(err, "spec.storageDevices[0].size", "spec.storageDevices[0].tier")
+		})
+	})
+
+	Context("When updating UpCloudVM under Validating Webhook", func() {
+		It("Should deny changes to the zone, template and tier once the server exists", func() {
+			obj.Spec.Zone = "de-fra1"
+			obj.Spec.StorageTemplate = "01000000-0000-4000-8000-000030240200"
+			obj.Spec.StorageTier = "hdd"
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			expectInvalid(err, "spec.zone", "spec.storagetemplate", "spec.storageTier")
+		})
+
+		It("Should deny changes to the template selector once the server exists", func() {
+			oldObj.Spec.StorageTemplate = ""
+			oldObj.Spec.TemplateSelector = &infrastructurev1alpha1.TemplateSelector{OS: "Ubuntu"}
+			obj = oldObj.DeepCopy()
+			obj.Spec.TemplateSelector.Version = "22.04"
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			expectInvalid(err, "spec.templateSelector")
+		})
+
+		It("Should deny shrinking the system disk once the server exists", func() {
+			obj.Spec.StorageSize = 20
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+
+			oldObj.Spec.StorageSize = 20
+			obj.Spec.StorageSize = 10
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			expectInvalid(err, "spec.storagesize")
+		})
+
+		It("Should admit changes to the zone before the server exists", func() {
+			oldObj.Status.VMID = ""
+			obj.Spec.Zone = "de-fra1"
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+		})
+
+		It("Should admit changes to the plan of an existing server", func() {
+			obj.Spec.Plan = "2xCPU-4GB"
+			obj.Spec.CPU = 2
+			obj.Spec.Memory = 4096
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+		})
+
+		It("Should admit updates of a VM being deleted", func() {
+			now := metav1.Now()
+			obj.DeletionTimestamp = &now
+			obj.Spec.Zone = "de-fra1"
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+		})
+	})
+
+	Context("When deleting UpCloudVM under Validating Webhook", func() {
+		It("Should deny deleting a protected VM until the protection is lifted", func() {
+			obj.Spec.DeletionProtection = true
+			_, err := validator.ValidateDelete(ctx, obj)
+			Expect(apierrors.IsForbidden(err)).To(BeTrue(), "expected a Forbidden error, got %v", err)
+
+			By("Admitting the update lifting the protection, then the deletion")
+			oldObj.Spec.DeletionProtection = true
+			obj.Spec.DeletionProtection = false
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+			Expect(validator.ValidateDelete(ctx, obj)).To(BeNil())
+		})
+	})
+
+	Context("When validating UpCloudVM against the UpCloud catalog", func() {
+		var catalogs *stubCatalogs
+
+		BeforeEach(func() {
+			catalogs = &stubCatalogs{catalog: &cloud.Catalog{
+				Zones:     []upcloud.Zone{{ID: "fi-hel1"}, {ID: "de-fra1"}},
+				Plans:     []upcloud.Plan{{Name: "1xCPU-1GB"}, {Name: "2xCPU-4GB"}},
+				Templates: []upcloud.Storage{{UUID: "01000000-0000-4000-8000-000030220200", Title: "Ubuntu Server 22.04 LTS"}},
+			}}
+			validator.Catalogs = catalogs
+		})
+
+		It("Should admit a spec the account offers", func() {
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should deny a zone, plan and template the account does not offer", func() {
+			obj.Spec.Zone = "us-nyc1"
+			obj.Spec.Plan = "4xCPU-8GB"
+			obj.Spec.CPU = 0
+			obj.Spec.Memory = 0
+			obj.Spec.StorageTemplate = "01000000-0000-4000-8000-000030240200"
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.zone", "spec.plan", "spec.storagetemplate")
+			Expect(err.Error()).To(ContainSubstring("valid zones: de-fra1, fi-hel1"))
+			Expect(err.Error()).To(ContainSubstring("valid plans: 1xCPU-1GB, 2xCPU-4GB, custom"))
+			Expect(err.Error()).To(ContainSubstring("01000000-0000-4000-8000-000030220200 (Ubuntu Server 22.04 LTS)"))
+		})
+
+		It("Should deny a template selector no template matches", func() {
+			obj.Spec.StorageTemplate = ""
+			obj.Spec.TemplateSelector = &infrastructurev1alpha1.TemplateSelector{OS: "Ubuntu"}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.TemplateSelector.OS = "Debian"
+			_, err := validator.ValidateCreate(ctx, obj)
+			expectInvalid(err, "spec.templateSelector")
+			Expect(err.Error()).To(ContainSubstring(`no template matches OS "Debian"`))
+		})
+
+		It("Should only check the fields an update changes", func() {
+			catalogs.catalog.Zones = nil
+			obj.Spec.Plan = "2xCPU-4GB"
+			obj.Spec.CPU = 2
+			obj.Spec.Memory = 4096
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+
+			obj.Spec.Plan = "4xCPU-8GB"
+			obj.Spec.CPU = 4
+			obj.Spec.Memory = 8192
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			expectInvalid(err, "spec.plan")
+		})
+
+		It("Should admit the VM with a warning when the catalog cannot be read", func() {
+			catalogs.err = errors.New("connection refused")
+			obj.Spec.Zone = "us-nyc1"
+			warnings, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ConsistOf(ContainSubstring("connection refused")))
+		})
+	})
+
+	Context("When creating UpCloudVM under Defaulting Webhook", func() {
+		var defaulter UpCloudVMCustomDefaulter
+
+		BeforeEach(func() {
+			scheme := runtime.NewScheme()
+			Expect(infrastructurev1alpha1.AddToScheme(scheme)).To(Succeed())
+			config := &infrastructurev1alpha1.UpCloudProviderConfig{
+				ObjectMeta: metav1.ObjectMeta{Name: "account"},
+				Spec: infrastructurev1alpha1.UpCloudProviderConfigSpec{
+					Zone:        "de-fra1",
+					Plan:        "2xCPU-4GB",
+					StorageTier: "standard",
+				},
+			}
+			defaulter = UpCloudVMCustomDefaulter{
+				Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(config).Build(),
+				Defaults: UpCloudVMDefaults{
+					Zone:        "fi-hel1",
+					Plan:        "1xCPU-1GB",
+					TimeZone:    "UTC",
+					StorageSize: 25,
+					StorageTier: "maxiops",
+				},
+			}
+			obj.Spec = infrastructurev1alpha1.UpCloudVMSpec{
+				StorageTemplate: "01000000-0000-4000-8000-000030220200",
+			}
+		})
+
+		It("Should fill in the defaults of the manager", func() {
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Zone).To(Equal("fi-hel1"))
+			Expect(obj.Spec.Plan).To(Equal("1xCPU-1GB"))
+			Expect(obj.Spec.TimeZone).To(Equal("UTC"))
+			Expect(obj.Spec.StorageSize).To(Equal(25))
+			Expect(obj.Spec.StorageTier).To(Equal("maxiops"))
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should prefer the defaults of the UpCloudProviderConfig", func() {
+			obj.Spec.ProviderConfigRef = &infrastructurev1alpha1.UpCloudProviderConfigReference{Name: "account"}
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Zone).To(Equal("de-fra1"))
+			Expect(obj.Spec.Plan).To(Equal("2xCPU-4GB"))
+			Expect(obj.Spec.StorageTier).To(Equal("standard"))
+			Expect(obj.Spec.TimeZone).To(Equal("UTC"))
+		})
+
+		It("Should keep the manager's defaults while the UpCloudProviderConfig is missing", func() {
+			obj.Spec.ProviderConfigRef = &infrastructurev1alpha1.UpCloudProviderConfigReference{Name: "missing"}
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Zone).To(Equal("fi-hel1"))
+		})
+
+		It("Should keep the fields the VM sets", func() {
+			obj.Spec.Zone = "nl-ams1"
+			obj.Spec.Plan = "4xCPU-8GB"
+			obj.Spec.TimeZone = "Europe/Helsinki"
+			obj.Spec.StorageSize = 50
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Zone).To(Equal("nl-ams1"))
+			Expect(obj.Spec.Plan).To(Equal("4xCPU-8GB"))
+			Expect(obj.Spec.TimeZone).To(Equal("Europe/Helsinki"))
+			Expect(obj.Spec.StorageSize).To(Equal(50))
+		})
+
+		It("Should use the custom plan for a VM sized by CPU and memory", func() {
+			obj.Spec.CPU = 3
+			obj.Spec.Memory = 6144
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Plan).To(Equal("custom"))
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+	})
+})
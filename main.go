@@ -3,9 +3,12 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	v1alpha1 "github.com/harper1011/vm-controller/api/v1alpha1"
+	"github.com/harper1011/vm-controller/internal/cloud"
 	controller "github.com/harper1011/vm-controller/internal/controller"
+	webhookinfrastructurev1alpha1 "github.com/harper1011/vm-controller/internal/webhook/v1alpha1"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -30,10 +33,27 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var upCloudAPIURL string
+	var resyncInterval time.Duration
+	var vmDefaults webhookinfrastructurev1alpha1.UpCloudVMDefaults
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080",
 		"The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&upCloudAPIURL, "upcloud-api-url", "",
+		"Override the UpCloud API base URL. Defaults to the public API.")
+	flag.DurationVar(&resyncInterval, "resync-interval", controller.DefaultResyncInterval,
+		"How often running VMs are read from UpCloud to refresh their status and detect drift.")
+	flag.StringVar(&vmDefaults.Zone, "default-zone", "",
+		"Zone of new UpCloudVMs that neither set one nor get one from their UpCloudProviderConfig.")
+	flag.StringVar(&vmDefaults.Plan, "default-plan", "",
+		"Plan of new UpCloudVMs that neither set one nor get one from their UpCloudProviderConfig.")
+	flag.StringVar(&vmDefaults.TimeZone, "default-timezone", "UTC",
+		"Time zone of new UpCloudVMs that do not set one.")
+	flag.IntVar(&vmDefaults.StorageSize, "default-storage-size", 25,
+		"Size in GB of the system disk of new UpCloudVMs that do not set one.")
+	flag.StringVar(&vmDefaults.StorageTier, "default-storage-tier", "maxiops",
+		"Storage tier of new UpCloudVMs that neither set one nor get one from their UpCloudProviderConfig.")
 
 	opts := zap.Options{
 		Development: true,
@@ -61,16 +81,72 @@ func main() {
 		os.Exit(1)
 	}
 
+	// UpCloud clients are shared by the controllers and the webhook, and
+	// health-checked in the background
+	clients := cloud.NewPool()
+	if err := mgr.Add(clients); err != nil {
+		setupLog.Error(err, "unable to set up UpCloud client pool")
+		os.Exit(1)
+	}
+
 	// Create a new UpCloudVM reconciler and register it with the manager
-	if err := (&controller.UpCloudVMReconciler{
-		Client: mgr.GetClient(),
-		Logger: ctrl.Log.WithName("controller").WithName("UpCloudVM"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	vmReconciler := &controller.UpCloudVMReconciler{
+		Client:         mgr.GetClient(),
+		Logger:         ctrl.Log.WithName("controller").WithName("UpCloudVM"),
+		Scheme:         mgr.GetScheme(),
+		APIBaseURL:     upCloudAPIURL,
+		Clients:        clients,
+		Recorder:       mgr.GetEventRecorderFor("upcloudvm-controller"),
+		ResyncInterval: resyncInterval,
+		Catalogs:       cloud.NewCatalogCache(),
+	}
+	if err := vmReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "UpCloudVM")
 		os.Exit(1)
 	}
+	if err := (&controller.UpCloudProviderConfigReconciler{
+		Client:     mgr.GetClient(),
+		Logger:     ctrl.Log.WithName("controller").WithName("UpCloudProviderConfig"),
+		Scheme:     mgr.GetScheme(),
+		APIBaseURL: upCloudAPIURL,
+		Clients:    clients,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UpCloudProviderConfig")
+		os.Exit(1)
+	}
+	if err := (&controller.UpCloudStorageReconciler{
+		Client:         mgr.GetClient(),
+		Logger:         ctrl.Log.WithName("controller").WithName("UpCloudStorage"),
+		Scheme:         mgr.GetScheme(),
+		APIBaseURL:     upCloudAPIURL,
+		Clients:        clients,
+		Recorder:       mgr.GetEventRecorderFor("upcloudstorage-controller"),
+		ResyncInterval: resyncInterval,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UpCloudStorage")
+		os.Exit(1)
+	}
+	if err := (&controller.UpCloudVMSnapshotReconciler{
+		Client:     mgr.GetClient(),
+		Logger:     ctrl.Log.WithName("controller").WithName("UpCloudVMSnapshot"),
+		Scheme:     mgr.GetScheme(),
+		APIBaseURL: upCloudAPIURL,
+		Clients:    clients,
+		Recorder:   mgr.GetEventRecorderFor("upcloudvmsnapshot-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UpCloudVMSnapshot")
+		os.Exit(1)
+	}
 
+	// As in cmd/main.go the webhooks are on unless disabled, deletionProtection
+	// relies on them; a host without a serving certificate sets ENABLE_WEBHOOKS=false
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err := webhookinfrastructurev1alpha1.SetupUpCloudVMWebhookWithManager(mgr, vmDefaults, vmReconciler); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "UpCloudVM")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
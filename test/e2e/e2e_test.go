@@ -18,12 +18,15 @@ package e2e
 
 import (
 	"fmt"
+	"net/url"
 	"os/exec"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	"github.com/harper1011/vm-controller/test/upcloudsim"
 	"github.com/harper1011/vm-controller/test/utils"
 )
 
@@ -118,5 +121,82 @@ var _ = Describe("controller", Ordered, func() {
 			EventuallyWithOffset(1, verifyControllerUp, time.Minute, time.Second).Should(Succeed())
 
 		})
+
+		It("should manage an UpCloudVM against the UpCloud API simulator", func() {
+			By("starting the UpCloud API simulator on the host")
+			sim := upcloudsim.New(upcloudsim.Options{
+				Addr:            "0.0.0.0:0",
+				TransitionDelay: 2 * time.Second,
+			})
+			defer sim.Close()
+			simURL, err := url.Parse(sim.URL)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			hostAddress, err := utils.GetKindHostAddress()
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			apiURL := fmt.Sprintf("http://%s:%s", hostAddress, simURL.Port())
+
+			By("pointing the controller-manager at the simulator")
+			cmd := exec.Command("kubectl", "set", "env", "deployment/vm-controller-controller-manager",
+				"UPCLOUD_USERNAME="+upcloudsim.DefaultUsername,
+				"UPCLOUD_PASSWORD="+upcloudsim.DefaultPassword,
+				"-n", namespace,
+			)
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			cmd = exec.Command("kubectl", "patch", "deployment/vm-controller-controller-manager",
+				"--type=json", "-n", namespace, "-p",
+				fmt.Sprintf(`[{"op":"add","path":"/spec/template/spec/containers/0/args/-","value":"--upcloud-api-url=%s"}]`, apiURL),
+			)
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			cmd = exec.Command("kubectl", "rollout", "status", "deployment/vm-controller-controller-manager",
+				"-n", namespace, "--timeout=2m")
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+			By("creating an UpCloudVM")
+			cmd = exec.Command("kubectl", "apply", "-n", namespace, "-f", "-")
+			cmd.Stdin = strings.NewReader(`apiVersion: infrastructure.github.com/v1alpha1
+kind: UpCloudVM
+metadata:
+  name: e2e-vm
+spec:
+  cpu: 1
+  memory: 1024
+  storagesize: 10
+  zone: fi-hel1
+  plan: 1xCPU-1GB
+  timezone: UTC
+  storagetemplate: 01000000-0000-4000-8000-000030220200
+`)
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+			By("waiting for the server to be created in the simulator")
+			var vmID string
+			verifyVMCreated := func() error {
+				cmd = exec.Command("kubectl", "get", "upcloudvm", "e2e-vm",
+					"-o", "jsonpath={.status.vmID}", "-n", namespace)
+				output, err := utils.Run(cmd)
+				if err != nil {
+					return err
+				}
+				vmID = string(output)
+				if vmID == "" {
+					return fmt.Errorf("status.vmID is not set yet")
+				}
+				if _, ok := sim.ServerDetails(vmID); !ok {
+					return fmt.Errorf("server %s does not exist in the simulator", vmID)
+				}
+				return nil
+			}
+			EventuallyWithOffset(1, verifyVMCreated, 2*time.Minute, time.Second).Should(Succeed())
+
+			By("deleting the UpCloudVM")
+			cmd = exec.Command("kubectl", "delete", "upcloudvm", "e2e-vm", "-n", namespace, "--timeout=2m")
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			EventuallyWithOffset(1, sim.ServerCount, time.Minute, time.Second).Should(BeZero())
+		})
 	})
 })
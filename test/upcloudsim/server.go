@@ -0,0 +1,1092 @@
+// Package upcloudsim is an in-process simulator for the subset of the
+// UpCloud 1.3 REST API used by the controller. It lets the envtest and e2e
+// suites run against the real UpCloud SDK without network access.
+//
+// Servers and storages move through transient states (maintenance, cloning)
+// for Options.TransitionDelay before settling, and failures can be injected
+// either randomly (Options.FailureRate) or per endpoint (InjectFailure).
+package upcloudsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+)
+
+// Default credentials accepted by the simulator.
+const (
+	DefaultUsername = "upcloudsim"
+	DefaultPassword = "upcloudsim"
+)
+
+// Options configures a simulator.
+type Options struct {
+	// Username and Password are the HTTP basic auth credentials the
+	// simulator accepts. They default to DefaultUsername/DefaultPassword.
+	Username string
+	Password string
+	// Token, when set, is also accepted as a bearer token.
+	Token string
+	// Credits is reported by the account endpoint.
+	Credits float64
+	// Latency is added to every request before it is handled.
+	Latency time.Duration
+	// TransitionDelay is how long servers stay in maintenance while starting
+	// or stopping, and how long storages stay in cloning.
+	TransitionDelay time.Duration
+	// FailureRate is the probability, between 0 and 1, that any request
+	// fails with a 500 error.
+	FailureRate float64
+	// Addr is the address to listen on. Defaults to 127.0.0.1:0.
+	Addr string
+}
+
+// Failure describes an injected API error.
+type Failure struct {
+	// Method and Path select the requests that fail. Path is matched as a
+	// prefix of the request path without the /1.3 version prefix, e.g.
+	// "/server" fails every server endpoint. An empty Method matches any.
+	Method string
+	Path   string
+	// Status is the HTTP status code returned.
+	Status int
+	// Code is the UpCloud error code, e.g. upcloud.ErrCodeServerStateIllegal.
+	Code string
+	// Times is how many requests fail before the failure is cleared. Zero
+	// means once.
+	Times int
+}
+
+// Server is a running simulator.
+type Server struct {
+	// URL is the base URL to hand to the UpCloud client, without the API
+	// version suffix.
+	URL string
+
+	opts Options
+	http *httptest.Server
+	rand *rand.Rand
+
+	mu       sync.Mutex
+	next     int
+	servers  map[string]*server
+	storages map[string]*storage
+	failures []*Failure
+	requests map[string]int
+}
+
+type server struct {
+	details upcloud.ServerDetails
+	target  string
+	readyAt time.Time
+}
+
+type storage struct {
+	details upcloud.StorageDetails
+	target  string
+	readyAt time.Time
+}
+
+// Templates seeded into every simulator, keyed by UUID.
+var Templates = map[string]string{
+	"01000000-0000-4000-8000-000030220200": "Ubuntu Server 22.04 LTS (Jammy Jellyfish)",
+	"01000000-0000-4000-8000-000030240200": "Ubuntu Server 24.04 LTS (Noble Numbat)",
+	"01000000-0000-4000-8000-000020070100": "Debian GNU/Linux 12 (Bookworm)",
+}
+
+// Zones offered by every simulator.
+var Zones = []upcloud.Zone{
+	{ID: "de-fra1", Description: "Frankfurt #1", Public: upcloud.True},
+	{ID: "fi-hel1", Description: "Helsinki #1", Public: upcloud.True},
+	{ID: "fi-hel2", Description: "Helsinki #2", Public: upcloud.True},
+	{ID: "nl-ams1", Description: "Amsterdam #1", Public: upcloud.True},
+	{ID: "us-nyc1", Description: "New York #1", Public: upcloud.True},
+}
+
+// Plans offered by every simulator.
+var Plans = []upcloud.Plan{
+	{Name: "1xCPU-1GB", CoreNumber: 1, MemoryAmount: 1024, StorageSize: 25, StorageTier: "maxiops", PublicTrafficOut: 1024},
+	{Name: "1xCPU-2GB", CoreNumber: 1, MemoryAmount: 2048, StorageSize: 50, StorageTier: "maxiops", PublicTrafficOut: 2048},
+	{Name: "2xCPU-4GB", CoreNumber: 2, MemoryAmount: 4096, StorageSize: 80, StorageTier: "maxiops", PublicTrafficOut: 4096},
+	{Name: "4xCPU-8GB", CoreNumber: 4, MemoryAmount: 8192, StorageSize: 160, StorageTier: "maxiops", PublicTrafficOut: 5120},
+}
+
+// New starts a simulator. Call Close when done.
+func New(opts Options) *Server {
+	if opts.Username == "" {
+		opts.Username = DefaultUsername
+	}
+	if opts.Password == "" {
+		opts.Password = DefaultPassword
+	}
+	s := &Server{
+		opts:     opts,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		servers:  map[string]*server{},
+		storages: map[string]*storage{},
+		requests: map[string]int{},
+	}
+	for uuid, title := range Templates {
+		s.storages[uuid] = &storage{details: upcloud.StorageDetails{Storage: upcloud.Storage{
+			UUID:         uuid,
+			Title:        title,
+			Access:       upcloud.StorageAccessPublic,
+			Type:         upcloud.StorageTypeTemplate,
+			TemplateType: upcloud.StorageTemplateTypeCloudInit,
+			State:        upcloud.StorageStateOnline,
+			Size:         4,
+			Zone:         "",
+		}}}
+	}
+
+	s.http = httptest.NewUnstartedServer(s.routes())
+	if opts.Addr != "" {
+		l, err := net.Listen("tcp", opts.Addr)
+		if err != nil {
+			panic(fmt.Sprintf("upcloudsim: failed to listen on %v: %v", opts.Addr, err))
+		}
+		s.http.Listener.Close()
+		s.http.Listener = l
+	}
+	s.http.Start()
+	s.URL = s.http.URL
+	return s
+}
+
+// Close shuts the simulator down.
+func (s *Server) Close() {
+	s.http.Close()
+}
+
+// InjectFailure makes matching requests fail until it has been hit
+// f.Times times.
+func (s *Server) InjectFailure(f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.Times == 0 {
+		f.Times = 1
+	}
+	s.failures = append(s.failures, &f)
+}
+
+// Requests returns how many requests matching "METHOD /path" (without the
+// /1.3 prefix, with UUIDs kept) have been served.
+func (s *Server) Requests(methodAndPath string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[methodAndPath]
+}
+
+// ServerDetails returns the current state of a server.
+func (s *Server) ServerDetails(uuid string) (upcloud.ServerDetails, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv, ok := s.servers[uuid]
+	if !ok {
+		return upcloud.ServerDetails{}, false
+	}
+	srv.settle(time.Now())
+	return srv.details, true
+}
+
+// ServerCount returns the number of servers.
+func (s *Server) ServerCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.servers)
+}
+
+// SetServerState forces a server into a state, simulating a change made in
+// the UpCloud console.
+func (s *Server) SetServerState(uuid, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if srv, ok := s.servers[uuid]; ok {
+		srv.details.State = state
+		srv.target = ""
+	}
+}
+
+// DeleteServer removes a server behind the controller's back.
+func (s *Server) DeleteServer(uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.servers, uuid)
+}
+
+func (s *server) settle(now time.Time) {
+	if s.target != "" && !now.Before(s.readyAt) {
+		s.details.State = s.target
+		s.target = ""
+	}
+}
+
+func (s *storage) settle(now time.Time) {
+	if s.target != "" && !now.Before(s.readyAt) {
+		s.details.State = s.target
+		s.target = ""
+	}
+}
+
+// transition moves a server into maintenance and schedules its arrival in
+// the target state.
+func (s *Server) transition(srv *server, target string) {
+	if s.opts.TransitionDelay <= 0 {
+		srv.details.State = target
+		srv.target = ""
+		return
+	}
+	srv.details.State = upcloud.ServerStateMaintenance
+	srv.target = target
+	srv.readyAt = time.Now().Add(s.opts.TransitionDelay)
+}
+
+func (s *Server) uuid(prefix byte) string {
+	s.next++
+	return fmt.Sprintf("%02x%06x-5151-4000-8000-%012x", prefix, s.next, s.next)
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /1.3/account", s.getAccount)
+	mux.HandleFunc("GET /1.3/server", s.listServers)
+	mux.HandleFunc("GET /1.3/server/{$}", s.listServers)
+	mux.HandleFunc("POST /1.3/server", s.createServer)
+	mux.HandleFunc("GET /1.3/server/{uuid}", s.getServer)
+	mux.HandleFunc("PUT /1.3/server/{uuid}", s.modifyServer)
+	mux.HandleFunc("POST /1.3/server/{uuid}/start", s.startServer)
+	mux.HandleFunc("POST /1.3/server/{uuid}/stop", s.stopServer)
+	mux.HandleFunc("POST /1.3/server/{uuid}/restart", s.restartServer)
+	mux.HandleFunc("DELETE /1.3/server/{uuid}", s.deleteServer)
+	mux.HandleFunc("DELETE /1.3/server/{uuid}/{$}", s.deleteServer)
+	mux.HandleFunc("GET /1.3/zone", s.listZones)
+	mux.HandleFunc("GET /1.3/plan", s.listPlans)
+	mux.HandleFunc("GET /1.3/storage/public", s.listStorages)
+	mux.HandleFunc("GET /1.3/storage/private", s.listStorages)
+	mux.HandleFunc("GET /1.3/storage/template", s.listStorages)
+	mux.HandleFunc("GET /1.3/storage/{access}/{type}", s.listStorages)
+	mux.HandleFunc("GET /1.3/storage/{uuid}", s.getStorage)
+	mux.HandleFunc("POST /1.3/storage", s.createStorage)
+	mux.HandleFunc("PUT /1.3/storage/{uuid}", s.modifyStorage)
+	mux.HandleFunc("DELETE /1.3/storage/{uuid}", s.deleteStorage)
+	mux.HandleFunc("POST /1.3/storage/{uuid}/clone", s.cloneStorage)
+	mux.HandleFunc("POST /1.3/storage/{uuid}/resize", s.resizeStorageFilesystem)
+	mux.HandleFunc("POST /1.3/storage/{uuid}/backup", s.createBackup)
+	mux.HandleFunc("POST /1.3/storage/{uuid}/restore", s.restoreBackup)
+	mux.HandleFunc("POST /1.3/server/{uuid}/storage/attach", s.attachStorage)
+	mux.HandleFunc("POST /1.3/server/{uuid}/storage/detach", s.detachStorage)
+	return s.middleware(mux)
+}
+
+// authenticated reports whether the request carries the simulator's
+// credentials.
+func (s *Server) authenticated(r *http.Request) bool {
+	if s.opts.Token != "" && r.Header.Get("Authorization") == "Bearer "+s.opts.Token {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && user == s.opts.Username && pass == s.opts.Password
+}
+
+// middleware applies latency, authentication and failure injection before
+// handing the request to the API handlers.
+func (s *Server) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.Latency > 0 {
+			time.Sleep(s.opts.Latency)
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/1.3")
+
+		s.mu.Lock()
+		s.requests[r.Method+" "+path]++
+		if !s.authenticated(r) {
+			s.mu.Unlock()
+			writeError(w, http.StatusUnauthorized, upcloud.ErrCodeAuthenticationFailed,
+				"Authentication failed using the given username and password.")
+			return
+		}
+		if f := s.matchFailure(r.Method, path); f != nil {
+			s.mu.Unlock()
+			writeError(w, f.Status, f.Code, fmt.Sprintf("Injected failure for %s %s.", r.Method, path))
+			return
+		}
+		if s.opts.FailureRate > 0 && s.rand.Float64() < s.opts.FailureRate {
+			s.mu.Unlock()
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Injected random failure.")
+			return
+		}
+		s.mu.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// matchFailure consumes and returns the first injected failure matching the
+// request. The caller must hold s.mu.
+func (s *Server) matchFailure(method, path string) *Failure {
+	for i, f := range s.failures {
+		if (f.Method == "" || f.Method == method) && strings.HasPrefix(path, f.Path) {
+			f.Times--
+			if f.Times <= 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+			return f
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the legacy {"error": {...}} format that the
+// server endpoints of the 1.3 API still use.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]string{
+			"error_code":    code,
+			"error_message": message,
+		},
+	})
+}
+
+func (s *Server) getAccount(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"account": upcloud.Account{
+			UserName: s.opts.Username,
+			Credits:  s.opts.Credits,
+		},
+	})
+}
+
+func (s *Server) listServers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	filters := r.URL.Query()["label"]
+	list := []wireServer{}
+	for _, srv := range s.servers {
+		srv.settle(now)
+		if matchesLabels(srv.details.Labels, filters) {
+			list = append(list, toWireServer(&srv.details))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"servers": map[string]interface{}{"server": list},
+	})
+}
+
+// matchesLabels reports whether labels satisfy every "key" or "key=value"
+// filter.
+func matchesLabels(labels upcloud.LabelSlice, filters []string) bool {
+	for _, f := range filters {
+		key, value, hasValue := strings.Cut(f, "=")
+		found := false
+		for _, l := range labels {
+			if l.Key == key && (!hasValue || l.Value == value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) createServer(w http.ResponseWriter, r *http.Request) {
+	var body createServerBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BODY_MALFORMED", err.Error())
+		return
+	}
+	req := body.Server
+	if req.Title == "" {
+		writeError(w, http.StatusBadRequest, upcloud.ErrCodeServerTitleMissing, "The server title is missing.")
+		return
+	}
+	if req.Zone == "" {
+		writeError(w, http.StatusBadRequest, "ZONE_MISSING", "The zone is missing.")
+		return
+	}
+	if len(req.StorageDevices.StorageDevice) == 0 {
+		writeError(w, http.StatusBadRequest, upcloud.ErrCodeStorageDeviceMissing, "At least one storage device is required.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	srv := &server{details: upcloud.ServerDetails{
+		Server: upcloud.Server{
+			UUID:         s.uuid(0x00),
+			Title:        req.Title,
+			Hostname:     req.Hostname,
+			Plan:         req.Plan,
+			Zone:         req.Zone,
+			CoreNumber:   int(req.CoreNumber),
+			MemoryAmount: int(req.MemoryAmount),
+		},
+		Timezone:     req.TimeZone,
+		SimpleBackup: req.SimpleBackup,
+	}}
+	if srv.details.Plan == "" {
+		srv.details.Plan = "custom"
+	}
+	if req.Labels != nil {
+		srv.details.Labels = append(upcloud.LabelSlice{}, *req.Labels...)
+	}
+
+	var created []*storage
+	for i, d := range req.StorageDevices.StorageDevice {
+		st, status, code, msg := s.storageForDevice(srv.details.Zone, d)
+		if st == nil {
+			for _, c := range created {
+				delete(s.storages, c.details.UUID)
+			}
+			writeError(w, status, code, msg)
+			return
+		}
+		st.details.ServerUUIDs = upcloud.ServerUUIDSlice{srv.details.UUID}
+		created = append(created, st)
+		address := d.Address
+		if address == "" {
+			address = fmt.Sprintf("virtio:%d", i)
+		}
+		srv.details.StorageDevices = append(srv.details.StorageDevices, upcloud.ServerStorageDevice{
+			Address:   address,
+			Encrypted: st.details.Encrypted,
+			UUID:      st.details.UUID,
+			Size:      st.details.Size,
+			Tier:      st.details.Tier,
+			Title:     st.details.Title,
+			Type:      upcloud.StorageTypeDisk,
+			BootDisk:  btoi(i == 0),
+		})
+	}
+
+	if req.Networking != nil && len(req.Networking.Interfaces.Interface) > 0 {
+		for _, iface := range req.Networking.Interfaces.Interface {
+			for _, ip := range iface.IPAddresses.IPAddress {
+				srv.details.IPAddresses = append(srv.details.IPAddresses, s.ipAddress(srv.details.UUID, iface.Type, ip.Family))
+			}
+		}
+	} else {
+		srv.details.IPAddresses = append(srv.details.IPAddresses, s.ipAddress(srv.details.UUID, upcloud.IPAddressAccessPublic, upcloud.IPAddressFamilyIPv4))
+	}
+
+	s.servers[srv.details.UUID] = srv
+	s.transition(srv, upcloud.ServerStateStarted)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"server": toWireServerDetails(&srv.details)})
+}
+
+// storageForDevice creates the storage backing a create-server storage
+// device. On failure it returns nil and the error to report. The caller
+// must hold s.mu.
+func (s *Server) storageForDevice(zone string, d storageDeviceBody) (*storage, int, string, string) {
+	tier := d.Tier
+	if tier == "" {
+		tier = upcloud.StorageTierMaxIOPS
+	}
+	switch d.Action {
+	case "clone":
+		src, ok := s.storages[d.Storage]
+		if !ok {
+			return nil, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", d.Storage)
+		}
+		size := int(d.Size)
+		if size < src.details.Size {
+			size = src.details.Size
+		}
+		st := s.newStorage(zone, d.Title, tier, size, d.Encrypted)
+		st.details.Origin = src.details.UUID
+		st.details.BackupRule = d.BackupRule
+		return st, 0, "", ""
+	case "create":
+		if d.Size <= 0 {
+			return nil, http.StatusBadRequest, upcloud.ErrCodeStorageDeviceInvalid, "The storage size is invalid."
+		}
+		st := s.newStorage(zone, d.Title, tier, int(d.Size), d.Encrypted)
+		st.details.BackupRule = d.BackupRule
+		return st, 0, "", ""
+	case "attach":
+		st, ok := s.storages[d.Storage]
+		if !ok {
+			return nil, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", d.Storage)
+		}
+		if len(st.details.ServerUUIDs) > 0 {
+			return nil, http.StatusConflict, upcloud.ErrCodeStorageAttached, fmt.Sprintf("The storage %s is already attached.", d.Storage)
+		}
+		return st, 0, "", ""
+	default:
+		return nil, http.StatusBadRequest, upcloud.ErrCodeStorageDeviceInvalid, fmt.Sprintf("Unknown storage action %q.", d.Action)
+	}
+}
+
+// newStorage registers an empty normal storage. The caller must hold s.mu.
+func (s *Server) newStorage(zone, title, tier string, size int, encrypted upcloud.Boolean) *storage {
+	st := &storage{details: upcloud.StorageDetails{Storage: upcloud.Storage{
+		UUID:      s.uuid(0x01),
+		Title:     title,
+		Access:    upcloud.StorageAccessPrivate,
+		Type:      upcloud.StorageTypeNormal,
+		State:     upcloud.StorageStateOnline,
+		Size:      size,
+		Tier:      tier,
+		Zone:      zone,
+		Encrypted: encrypted,
+		Created:   time.Now().UTC(),
+	}}}
+	s.storages[st.details.UUID] = st
+	return st
+}
+
+// ipAddress allocates an address. The caller must hold s.mu.
+func (s *Server) ipAddress(serverUUID, access, family string) upcloud.IPAddress {
+	s.next++
+	address := fmt.Sprintf("10.%d.%d.%d", (s.next>>16)&0xff, (s.next>>8)&0xff, s.next&0xff)
+	if family == upcloud.IPAddressFamilyIPv6 {
+		address = fmt.Sprintf("2a04:3540:1000:310::%x", s.next)
+	} else if access == upcloud.IPAddressAccessPublic {
+		address = fmt.Sprintf("94.237.%d.%d", (s.next>>8)&0xff, s.next&0xff)
+	}
+	return upcloud.IPAddress{
+		Access:     access,
+		Address:    address,
+		Family:     family,
+		ServerUUID: serverUUID,
+	}
+}
+
+// lookupServer returns the settled server or writes a not-found error. The
+// caller must hold s.mu.
+func (s *Server) lookupServer(w http.ResponseWriter, r *http.Request) *server {
+	uuid := r.PathValue("uuid")
+	srv, ok := s.servers[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeServerNotFound, fmt.Sprintf("The server %s does not exist.", uuid))
+		return nil
+	}
+	srv.settle(time.Now())
+	return srv
+}
+
+func (s *Server) getServer(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv := s.lookupServer(w, r)
+	if srv == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"server": toWireServerDetails(&srv.details)})
+}
+
+func (s *Server) modifyServer(w http.ResponseWriter, r *http.Request) {
+	var body modifyServerBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BODY_MALFORMED", err.Error())
+		return
+	}
+	req := body.Server
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv := s.lookupServer(w, r)
+	if srv == nil {
+		return
+	}
+	d := &srv.details
+
+	resize := (req.Plan != "" && req.Plan != d.Plan) ||
+		(req.CoreNumber != 0 && int(req.CoreNumber) != d.CoreNumber) ||
+		(req.MemoryAmount != 0 && int(req.MemoryAmount) != d.MemoryAmount)
+	if resize && d.State != upcloud.ServerStateStopped {
+		writeError(w, http.StatusConflict, upcloud.ErrCodeServerStateIllegal,
+			"The server must be stopped before its plan, CPU or memory can be changed.")
+		return
+	}
+	if req.Zone != "" && req.Zone != d.Zone {
+		writeError(w, http.StatusBadRequest, "ZONE_INVALID", "The zone of an existing server cannot be changed.")
+		return
+	}
+
+	if req.Plan != "" {
+		d.Plan = req.Plan
+	}
+	if req.CoreNumber != 0 {
+		d.CoreNumber = int(req.CoreNumber)
+	}
+	if req.MemoryAmount != 0 {
+		d.MemoryAmount = int(req.MemoryAmount)
+	}
+	if req.Title != "" {
+		d.Title = req.Title
+	}
+	if req.Hostname != "" {
+		d.Hostname = req.Hostname
+	}
+	if req.TimeZone != "" {
+		d.Timezone = req.TimeZone
+	}
+	if req.SimpleBackup != "" {
+		d.SimpleBackup = req.SimpleBackup
+	}
+	if req.Labels != nil {
+		d.Labels = append(upcloud.LabelSlice{}, *req.Labels...)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"server": toWireServerDetails(d)})
+}
+
+func (s *Server) startServer(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv := s.lookupServer(w, r)
+	if srv == nil {
+		return
+	}
+	if srv.details.State != upcloud.ServerStateStopped {
+		writeError(w, http.StatusBadRequest, upcloud.ErrCodeServerStateIllegal, "The server is not stopped.")
+		return
+	}
+	s.transition(srv, upcloud.ServerStateStarted)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"server": toWireServerDetails(&srv.details)})
+}
+
+func (s *Server) stopServer(w http.ResponseWriter, r *http.Request) {
+	var body stopServerBody
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv := s.lookupServer(w, r)
+	if srv == nil {
+		return
+	}
+	if srv.details.State != upcloud.ServerStateStarted {
+		writeError(w, http.StatusBadRequest, upcloud.ErrCodeServerStateIllegal, "The server is not started.")
+		return
+	}
+	if body.StopServer.StopType == upcloud.StopTypeHard {
+		srv.details.State = upcloud.ServerStateStopped
+		srv.target = ""
+	} else {
+		s.transition(srv, upcloud.ServerStateStopped)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"server": toWireServerDetails(&srv.details)})
+}
+
+func (s *Server) restartServer(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv := s.lookupServer(w, r)
+	if srv == nil {
+		return
+	}
+	if srv.details.State != upcloud.ServerStateStarted {
+		writeError(w, http.StatusBadRequest, upcloud.ErrCodeServerStateIllegal, "The server is not started.")
+		return
+	}
+	s.transition(srv, upcloud.ServerStateStarted)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"server": toWireServerDetails(&srv.details)})
+}
+
+func (s *Server) deleteServer(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv := s.lookupServer(w, r)
+	if srv == nil {
+		return
+	}
+	if srv.details.State != upcloud.ServerStateStopped {
+		writeError(w, http.StatusBadRequest, upcloud.ErrCodeServerStateIllegal, "The server must be stopped before it can be deleted.")
+		return
+	}
+	deleteStorages := r.URL.Query().Get("storages") == "1"
+	for _, d := range srv.details.StorageDevices {
+		if deleteStorages {
+			delete(s.storages, d.UUID)
+		} else if st, ok := s.storages[d.UUID]; ok {
+			st.details.ServerUUIDs = nil
+		}
+	}
+	delete(s.servers, srv.details.UUID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listZones(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"zones": map[string]interface{}{"zone": Zones},
+	})
+}
+
+func (s *Server) listPlans(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"plans": map[string]interface{}{"plan": Plans},
+	})
+}
+
+// listStorages lists the storages of an access type (public, private) or a
+// type (template, backup, ...), or both as in /storage/public/template.
+func (s *Server) listStorages(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var access, typ string
+	for _, v := range strings.Split(strings.TrimPrefix(r.URL.Path, "/1.3/storage/"), "/") {
+		switch v {
+		case upcloud.StorageAccessPublic, upcloud.StorageAccessPrivate:
+			access = v
+		default:
+			typ = v
+		}
+	}
+	filters := r.URL.Query()["label"]
+	now := time.Now()
+	list := []upcloud.Storage{}
+	for _, st := range s.storages {
+		st.settle(now)
+		if (access == "" || st.details.Access == access) && (typ == "" || st.details.Type == typ) &&
+			matchesLabels(st.details.Labels, filters) {
+			list = append(list, st.details.Storage)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UUID < list[j].UUID })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"storages": map[string]interface{}{"storage": list},
+	})
+}
+
+func (s *Server) getStorage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := r.PathValue("uuid")
+	st, ok := s.storages[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", uuid))
+		return
+	}
+	st.settle(time.Now())
+	writeJSON(w, http.StatusOK, map[string]interface{}{"storage": toWireStorage(&st.details)})
+}
+
+func (s *Server) cloneStorage(w http.ResponseWriter, r *http.Request) {
+	var body cloneStorageBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BODY_MALFORMED", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := r.PathValue("uuid")
+	src, ok := s.storages[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", uuid))
+		return
+	}
+	tier := body.Storage.Tier
+	if tier == "" {
+		tier = src.details.Tier
+	}
+	encrypted := src.details.Encrypted
+	if body.Storage.Encrypted.Bool() {
+		encrypted = upcloud.True
+	}
+	st := s.newStorage(body.Storage.Zone, body.Storage.Title, tier, src.details.Size, encrypted)
+	st.details.Origin = src.details.UUID
+	if s.opts.TransitionDelay > 0 {
+		st.details.State = upcloud.StorageStateCloning
+		st.target = upcloud.StorageStateOnline
+		st.readyAt = time.Now().Add(s.opts.TransitionDelay)
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"storage": toWireStorage(&st.details)})
+}
+
+func (s *Server) createStorage(w http.ResponseWriter, r *http.Request) {
+	var body createStorageBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BODY_MALFORMED", err.Error())
+		return
+	}
+	if body.Storage.Size <= 0 {
+		writeError(w, http.StatusBadRequest, upcloud.ErrCodeStorageInvalid, "The storage size is invalid.")
+		return
+	}
+	if body.Storage.Zone == "" {
+		writeError(w, http.StatusBadRequest, "ZONE_MISSING", "The zone is missing.")
+		return
+	}
+	tier := body.Storage.Tier
+	if tier == "" {
+		tier = upcloud.StorageTierMaxIOPS
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.newStorage(body.Storage.Zone, body.Storage.Title, tier, int(body.Storage.Size), body.Storage.Encrypted)
+	st.details.BackupRule = body.Storage.BackupRule
+	st.details.Labels = body.Storage.Labels
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"storage": toWireStorage(&st.details)})
+}
+
+// modifyStorage changes the title, size or backup rule of a storage. Like
+// UpCloud, it refuses to shrink a disk or resize one of a running server.
+func (s *Server) modifyStorage(w http.ResponseWriter, r *http.Request) {
+	var body modifyStorageBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BODY_MALFORMED", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := r.PathValue("uuid")
+	st, ok := s.storages[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", uuid))
+		return
+	}
+	size := int(body.Storage.Size)
+	if size != 0 && size != st.details.Size {
+		if size < st.details.Size {
+			writeError(w, http.StatusBadRequest, upcloud.ErrCodeStorageInvalid, "The storage cannot be shrunk.")
+			return
+		}
+		for _, serverUUID := range st.details.ServerUUIDs {
+			if srv, ok := s.servers[serverUUID]; ok && srv.details.State != upcloud.ServerStateStopped {
+				writeError(w, http.StatusBadRequest, upcloud.ErrCodeServerStateIllegal, "The server must be stopped to resize its storage.")
+				return
+			}
+		}
+		st.details.Size = size
+	}
+	if body.Storage.Title != "" {
+		st.details.Title = body.Storage.Title
+	}
+	if body.Storage.BackupRule != nil {
+		st.details.BackupRule = body.Storage.BackupRule
+	}
+	if body.Storage.Labels != nil {
+		st.details.Labels = *body.Storage.Labels
+	}
+	s.refreshDevices(st)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"storage": toWireStorage(&st.details)})
+}
+
+// refreshDevices copies the title and size of st to the servers it is
+// attached to. The caller must hold s.mu.
+func (s *Server) refreshDevices(st *storage) {
+	for _, serverUUID := range st.details.ServerUUIDs {
+		srv, ok := s.servers[serverUUID]
+		if !ok {
+			continue
+		}
+		for i := range srv.details.StorageDevices {
+			if srv.details.StorageDevices[i].UUID == st.details.UUID {
+				srv.details.StorageDevices[i].Size = st.details.Size
+				srv.details.StorageDevices[i].Title = st.details.Title
+			}
+		}
+	}
+}
+
+// deleteStorage deletes a storage. Like UpCloud, it refuses to delete an
+// attached one.
+func (s *Server) deleteStorage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := r.PathValue("uuid")
+	st, ok := s.storages[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", uuid))
+		return
+	}
+	if len(st.details.ServerUUIDs) > 0 {
+		writeError(w, http.StatusConflict, upcloud.ErrCodeStorageAttached, "The storage is attached to a server.")
+		return
+	}
+	delete(s.storages, uuid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resizeStorageFilesystem pretends to grow the last partition of a storage
+// of a stopped server and returns the backup UpCloud takes beforehand.
+func (s *Server) resizeStorageFilesystem(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := r.PathValue("uuid")
+	st, ok := s.storages[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", uuid))
+		return
+	}
+	for _, serverUUID := range st.details.ServerUUIDs {
+		if srv, ok := s.servers[serverUUID]; ok && srv.details.State != upcloud.ServerStateStopped {
+			writeError(w, http.StatusBadRequest, upcloud.ErrCodeServerStateIllegal, "The server must be stopped to resize its storage.")
+			return
+		}
+	}
+	backup := s.newStorage(st.details.Zone, st.details.Title+" (resize backup)", st.details.Tier, st.details.Size, st.details.Encrypted)
+	backup.details.Type = upcloud.StorageTypeBackup
+	backup.details.Origin = st.details.UUID
+	writeJSON(w, http.StatusOK, map[string]interface{}{"resize_backup": backup.details.Storage})
+}
+
+// createBackup takes a backup of a storage, which stays in maintenance for
+// the TransitionDelay.
+func (s *Server) createBackup(w http.ResponseWriter, r *http.Request) {
+	var body createBackupBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BODY_MALFORMED", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := r.PathValue("uuid")
+	st, ok := s.storages[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", uuid))
+		return
+	}
+	backup := s.newStorage(st.details.Zone, body.Storage.Title, st.details.Tier, st.details.Size, st.details.Encrypted)
+	backup.details.Type = upcloud.StorageTypeBackup
+	backup.details.Origin = st.details.UUID
+	if s.opts.TransitionDelay > 0 {
+		backup.details.State = upcloud.StorageStateMaintenance
+		backup.target = upcloud.StorageStateOnline
+		backup.readyAt = time.Now().Add(s.opts.TransitionDelay)
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"storage": toWireStorage(&backup.details)})
+}
+
+// restoreBackup restores the storage a backup was taken of, which must be
+// detached or belong to a stopped server.
+func (s *Server) restoreBackup(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := r.PathValue("uuid")
+	backup, ok := s.storages[uuid]
+	if !ok || backup.details.Type != upcloud.StorageTypeBackup {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The backup %s does not exist.", uuid))
+		return
+	}
+	st, ok := s.storages[backup.details.Origin]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", backup.details.Origin))
+		return
+	}
+	for _, serverUUID := range st.details.ServerUUIDs {
+		if srv, ok := s.servers[serverUUID]; ok && srv.details.State != upcloud.ServerStateStopped {
+			writeError(w, http.StatusBadRequest, upcloud.ErrCodeServerStateIllegal, "The server must be stopped to restore its storage.")
+			return
+		}
+	}
+	st.details.Size = backup.details.Size
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) attachStorage(w http.ResponseWriter, r *http.Request) {
+	var body storageDeviceActionBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BODY_MALFORMED", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv := s.lookupServer(w, r)
+	if srv == nil {
+		return
+	}
+	d := body.StorageDevice
+	st, ok := s.storages[d.Storage]
+	if !ok {
+		writeError(w, http.StatusNotFound, upcloud.ErrCodeStorageNotFound, fmt.Sprintf("The storage %s does not exist.", d.Storage))
+		return
+	}
+	st.settle(time.Now())
+	if st.details.State != upcloud.StorageStateOnline {
+		writeError(w, http.StatusConflict, upcloud.ErrCodeStorageStateIllegal, fmt.Sprintf("The storage %s is %s.", d.Storage, st.details.State))
+		return
+	}
+	if len(st.details.ServerUUIDs) > 0 {
+		writeError(w, http.StatusConflict, upcloud.ErrCodeStorageAttached, fmt.Sprintf("The storage %s is already attached.", d.Storage))
+		return
+	}
+	address := d.Address
+	if address == "" {
+		address = "virtio"
+	}
+	used := map[string]bool{}
+	for _, dev := range srv.details.StorageDevices {
+		used[dev.Address] = true
+	}
+	if !strings.Contains(address, ":") {
+		bus := address
+		for i := 0; used[address] || address == bus; i++ {
+			address = fmt.Sprintf("%s:%d", bus, i)
+		}
+	} else if used[address] {
+		writeError(w, http.StatusConflict, upcloud.ErrCodeDeviceAddressInUse, fmt.Sprintf("The address %s is in use.", address))
+		return
+	}
+	st.details.ServerUUIDs = upcloud.ServerUUIDSlice{srv.details.UUID}
+	srv.details.StorageDevices = append(srv.details.StorageDevices, upcloud.ServerStorageDevice{
+		Address:   address,
+		Encrypted: st.details.Encrypted,
+		UUID:      st.details.UUID,
+		Size:      st.details.Size,
+		Tier:      st.details.Tier,
+		Title:     st.details.Title,
+		Type:      upcloud.StorageTypeDisk,
+	})
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"server": toWireServerDetails(&srv.details)})
+}
+
+func (s *Server) detachStorage(w http.ResponseWriter, r *http.Request) {
+	var body storageDeviceActionBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BODY_MALFORMED", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv := s.lookupServer(w, r)
+	if srv == nil {
+		return
+	}
+	for i, dev := range srv.details.StorageDevices {
+		if dev.Address != body.StorageDevice.Address {
+			continue
+		}
+		if st, ok := s.storages[dev.UUID]; ok {
+			st.details.ServerUUIDs = nil
+		}
+		srv.details.StorageDevices = append(srv.details.StorageDevices[:i:i], srv.details.StorageDevices[i+1:]...)
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"server": toWireServerDetails(&srv.details)})
+		return
+	}
+	writeError(w, http.StatusBadRequest, upcloud.ErrCodeDeviceAddressNotInUse,
+		fmt.Sprintf("No storage is attached at %s.", body.StorageDevice.Address))
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,354 @@
+package upcloudsim
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	upCloudClient "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/service"
+)
+
+func newService(sim *Server, username, password string) *service.Service {
+	return service.New(upCloudClient.New(username, password, upCloudClient.WithBaseURL(sim.URL)))
+}
+
+func createRequest() *request.CreateServerRequest {
+	return &request.CreateServerRequest{
+		Title:        "test",
+		Zone:         "fi-hel1",
+		Plan:         "1xCPU-1GB",
+		CoreNumber:   1,
+		MemoryAmount: 1024,
+		Labels:       &upcloud.LabelSlice{{Key: "owner", Value: "default.test"}},
+		StorageDevices: []request.CreateServerStorageDevice{{
+			Action:  request.CreateServerStorageDeviceActionClone,
+			Storage: "01000000-0000-4000-8000-000030220200",
+			Title:   "test",
+			Size:    10,
+		}},
+		Networking: &request.CreateServerNetworking{
+			Interfaces: []request.CreateServerInterface{{
+				Type:        upcloud.NetworkTypeUtility,
+				IPAddresses: []request.CreateServerIPAddress{{Family: upcloud.IPAddressFamilyIPv4}},
+			}},
+		},
+	}
+}
+
+func problemCode(t *testing.T, err error) string {
+	t.Helper()
+	var problem *upcloud.Problem
+	if !errors.As(err, &problem) {
+		t.Fatalf("expected an upcloud.Problem, got %v", err)
+	}
+	return problem.ErrorCode()
+}
+
+func TestAccount(t *testing.T) {
+	sim := New(Options{Credits: 42})
+	defer sim.Close()
+	ctx := context.Background()
+
+	account, err := newService(sim, DefaultUsername, DefaultPassword).GetAccount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.UserName != DefaultUsername || account.Credits != 42 {
+		t.Errorf("unexpected account %+v", account)
+	}
+
+	_, err = newService(sim, DefaultUsername, "wrong").GetAccount(ctx)
+	if code := problemCode(t, err); code != upcloud.ErrCodeAuthenticationFailed {
+		t.Errorf("expected %s, got %s", upcloud.ErrCodeAuthenticationFailed, code)
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	sim := New(Options{TransitionDelay: 50 * time.Millisecond})
+	defer sim.Close()
+	ctx := context.Background()
+	svc := newService(sim, DefaultUsername, DefaultPassword)
+
+	created, err := svc.CreateServer(ctx, createRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.State != upcloud.ServerStateMaintenance {
+		t.Errorf("expected a new server to be in maintenance, got %s", created.State)
+	}
+	if len(created.StorageDevices) != 1 || created.StorageDevices[0].Size != 10 {
+		t.Errorf("unexpected storage devices %+v", created.StorageDevices)
+	}
+	if len(created.IPAddresses) != 1 || created.IPAddresses[0].Access != upcloud.IPAddressAccessUtility {
+		t.Errorf("unexpected IP addresses %+v", created.IPAddresses)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	details, err := svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{UUID: created.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.State != upcloud.ServerStateStarted {
+		t.Errorf("expected the server to have started, got %s", details.State)
+	}
+	if len(details.Labels) != 1 || details.Labels[0].Value != "default.test" {
+		t.Errorf("unexpected labels %+v", details.Labels)
+	}
+
+	servers, err := svc.GetServersWithFilters(ctx, &request.GetServersWithFiltersRequest{
+		Filters: []request.QueryFilter{request.FilterLabel{Label: upcloud.Label{Key: "owner", Value: "default.test"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers.Servers) != 1 || servers.Servers[0].UUID != created.UUID {
+		t.Errorf("label filter returned %+v", servers.Servers)
+	}
+
+	_, err = svc.ModifyServer(ctx, &request.ModifyServerRequest{UUID: created.UUID, CoreNumber: 2})
+	if code := problemCode(t, err); code != upcloud.ErrCodeServerStateIllegal {
+		t.Errorf("expected resizing a started server to fail with %s, got %s", upcloud.ErrCodeServerStateIllegal, code)
+	}
+	err = svc.DeleteServerAndStorages(ctx, &request.DeleteServerAndStoragesRequest{UUID: created.UUID})
+	if code := problemCode(t, err); code != upcloud.ErrCodeServerStateIllegal {
+		t.Errorf("expected deleting a started server to fail with %s, got %s", upcloud.ErrCodeServerStateIllegal, code)
+	}
+
+	if _, err := svc.StopServer(ctx, &request.StopServerRequest{UUID: created.UUID, StopType: request.ServerStopTypeHard}); err != nil {
+		t.Fatal(err)
+	}
+	modified, err := svc.ModifyServer(ctx, &request.ModifyServerRequest{UUID: created.UUID, CoreNumber: 2, MemoryAmount: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified.CoreNumber != 2 || modified.MemoryAmount != 2048 {
+		t.Errorf("modify not applied: %+v", modified.Server)
+	}
+
+	if err := svc.DeleteServerAndStorages(ctx, &request.DeleteServerAndStoragesRequest{UUID: created.UUID}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{UUID: created.UUID})
+	if code := problemCode(t, err); code != upcloud.ErrCodeServerNotFound {
+		t.Errorf("expected %s after deletion, got %s", upcloud.ErrCodeServerNotFound, code)
+	}
+	_, err = svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: created.StorageDevices[0].UUID})
+	if code := problemCode(t, err); code != upcloud.ErrCodeStorageNotFound {
+		t.Errorf("expected the storage to be deleted with the server, got %s", code)
+	}
+}
+
+func TestCloneStorage(t *testing.T) {
+	sim := New(Options{})
+	defer sim.Close()
+	ctx := context.Background()
+	svc := newService(sim, DefaultUsername, DefaultPassword)
+
+	clone, err := svc.CloneStorage(ctx, &request.CloneStorageRequest{
+		UUID:  "01000000-0000-4000-8000-000020070100",
+		Zone:  "de-fra1",
+		Title: "clone",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.Zone != "de-fra1" || clone.Origin != "01000000-0000-4000-8000-000020070100" || clone.State != upcloud.StorageStateOnline {
+		t.Errorf("unexpected clone %+v", clone.Storage)
+	}
+}
+
+func TestResizeStorage(t *testing.T) {
+	sim := New(Options{TransitionDelay: 10 * time.Millisecond})
+	defer sim.Close()
+	ctx := context.Background()
+	svc := newService(sim, DefaultUsername, DefaultPassword)
+
+	created, err := svc.CreateServer(ctx, createRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	disk := created.StorageDevices[0].UUID
+
+	_, err = svc.ModifyStorage(ctx, &request.ModifyStorageRequest{UUID: disk, Size: 20})
+	if code := problemCode(t, err); code != upcloud.ErrCodeServerStateIllegal {
+		t.Errorf("expected resizing the disk of a started server to fail with %s, got %s", upcloud.ErrCodeServerStateIllegal, code)
+	}
+	if _, err := svc.StopServer(ctx, &request.StopServerRequest{UUID: created.UUID, StopType: request.ServerStopTypeHard}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.ModifyStorage(ctx, &request.ModifyStorageRequest{UUID: disk, Size: 5})
+	if code := problemCode(t, err); code != upcloud.ErrCodeStorageInvalid {
+		t.Errorf("expected shrinking the disk to fail with %s, got %s", upcloud.ErrCodeStorageInvalid, code)
+	}
+	if _, err := svc.ModifyStorage(ctx, &request.ModifyStorageRequest{UUID: disk, Size: 20}); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := svc.ResizeStorageFilesystem(ctx, &request.ResizeStorageFilesystemRequest{UUID: disk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.Origin != disk || backup.Type != upcloud.StorageTypeBackup {
+		t.Errorf("unexpected resize backup %+v", backup)
+	}
+	details, err := svc.GetServerDetails(ctx, &request.GetServerDetailsRequest{UUID: created.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.StorageDevices[0].Size != 20 {
+		t.Errorf("expected the server's disk to have grown to 20 GB, got %d", details.StorageDevices[0].Size)
+	}
+}
+
+func TestDeleteStorage(t *testing.T) {
+	sim := New(Options{TransitionDelay: 10 * time.Millisecond})
+	defer sim.Close()
+	ctx := context.Background()
+	svc := newService(sim, DefaultUsername, DefaultPassword)
+
+	created, err := svc.CreateServer(ctx, createRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.DeleteStorage(ctx, &request.DeleteStorageRequest{UUID: created.StorageDevices[0].UUID})
+	if code := problemCode(t, err); code != upcloud.ErrCodeStorageAttached {
+		t.Errorf("expected deleting an attached disk to fail with %s, got %s", upcloud.ErrCodeStorageAttached, code)
+	}
+
+	storage, err := svc.CreateStorage(ctx, &request.CreateStorageRequest{
+		Size:   10,
+		Tier:   upcloud.StorageTierMaxIOPS,
+		Title:  "data",
+		Zone:   "fi-hel1",
+		Labels: []upcloud.Label{{Key: "app", Value: "database"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.Labels) != 1 || storage.Labels[0].Value != "database" {
+		t.Errorf("expected the storage to keep its labels, got %+v", storage.Labels)
+	}
+	if err := svc.DeleteStorage(ctx, &request.DeleteStorageRequest{UUID: storage.UUID}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: storage.UUID})
+	if code := problemCode(t, err); code != upcloud.ErrCodeStorageNotFound {
+		t.Errorf("expected the deleted storage to be gone, got %s", code)
+	}
+}
+
+func TestBackupStorage(t *testing.T) {
+	sim := New(Options{TransitionDelay: 10 * time.Millisecond})
+	defer sim.Close()
+	ctx := context.Background()
+	svc := newService(sim, DefaultUsername, DefaultPassword)
+
+	created, err := svc.CreateServer(ctx, createRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	disk := created.StorageDevices[0].UUID
+
+	backup, err := svc.CreateBackup(ctx, &request.CreateBackupRequest{UUID: disk, Title: "nightly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.State != upcloud.StorageStateMaintenance {
+		t.Errorf("expected the backup to be in maintenance while it is taken, got %s", backup.State)
+	}
+	time.Sleep(20 * time.Millisecond)
+	details, err := svc.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: backup.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.State != upcloud.StorageStateOnline || details.Type != upcloud.StorageTypeBackup || details.Origin != disk {
+		t.Errorf("unexpected backup %+v", details.Storage)
+	}
+
+	err = svc.RestoreBackup(ctx, &request.RestoreBackupRequest{UUID: backup.UUID})
+	if code := problemCode(t, err); code != upcloud.ErrCodeServerStateIllegal {
+		t.Errorf("expected restoring the disk of a started server to fail with %s, got %s", upcloud.ErrCodeServerStateIllegal, code)
+	}
+	if _, err := svc.StopServer(ctx, &request.StopServerRequest{UUID: created.UUID, StopType: request.ServerStopTypeHard}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.RestoreBackup(ctx, &request.RestoreBackupRequest{UUID: backup.UUID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInjectFailure(t *testing.T) {
+	sim := New(Options{})
+	defer sim.Close()
+	ctx := context.Background()
+	svc := newService(sim, DefaultUsername, DefaultPassword)
+
+	sim.InjectFailure(Failure{
+		Method: http.MethodPost,
+		Path:   "/server",
+		Status: http.StatusConflict,
+		Code:   upcloud.ErrCodeServerCreatingLimitReached,
+	})
+	_, err := svc.CreateServer(ctx, createRequest())
+	if code := problemCode(t, err); code != upcloud.ErrCodeServerCreatingLimitReached {
+		t.Errorf("expected the injected failure, got %s", code)
+	}
+	if _, err := svc.CreateServer(ctx, createRequest()); err != nil {
+		t.Errorf("the injected failure should only fire once: %v", err)
+	}
+	if got := sim.Requests("POST /server"); got != 2 {
+		t.Errorf("expected 2 create requests, got %d", got)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	sim := New(Options{})
+	defer sim.Close()
+	ctx := context.Background()
+	svc := newService(sim, DefaultUsername, DefaultPassword)
+
+	zones, err := svc.GetZones(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones.Zones) != len(Zones) || zones.Zones[0].ID != Zones[0].ID || !zones.Zones[0].Public.Bool() {
+		t.Fatalf("unexpected zones %+v", zones.Zones)
+	}
+
+	plans, err := svc.GetPlans(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans.Plans) != len(Plans) || plans.Plans[0] != Plans[0] {
+		t.Fatalf("unexpected plans %+v", plans.Plans)
+	}
+
+	if _, err := svc.CreateServer(ctx, createRequest()); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := svc.GetStorages(ctx, &request.GetStoragesRequest{Type: upcloud.StorageTypeTemplate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates.Storages) != len(Templates) {
+		t.Fatalf("expected %d templates, got %+v", len(Templates), templates.Storages)
+	}
+	for _, st := range templates.Storages {
+		if st.Title != Templates[st.UUID] {
+			t.Errorf("unexpected template %+v", st)
+		}
+	}
+	public, err := svc.GetStorages(ctx, &request.GetStoragesRequest{Access: upcloud.StorageAccessPublic, Type: upcloud.StorageTypeTemplate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(public.Storages) != len(Templates) {
+		t.Fatalf("expected %d public templates, got %d", len(Templates), len(public.Storages))
+	}
+}
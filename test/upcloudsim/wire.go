@@ -0,0 +1,234 @@
+package upcloudsim
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+)
+
+// The UpCloud API wraps every list in an object named after its element
+// ({"labels": {"label": [...]}}) and encodes some numbers as strings. The
+// SDK only implements the decoding side of that format, so the encoding
+// side lives here.
+
+type wireServer struct {
+	CoreNumber   int                `json:"core_number,string"`
+	Hostname     string             `json:"hostname"`
+	License      float64            `json:"license"`
+	MemoryAmount int                `json:"memory_amount,string"`
+	Plan         string             `json:"plan"`
+	Progress     int                `json:"progress,string"`
+	State        string             `json:"state"`
+	Tags         wireTags           `json:"tags"`
+	Title        string             `json:"title"`
+	UUID         string             `json:"uuid"`
+	Zone         string             `json:"zone"`
+	Labels       upcloud.LabelSlice `json:"labels"`
+}
+
+type wireTags struct {
+	Tag []string `json:"tag"`
+}
+
+type wireServerDetails struct {
+	wireServer
+	BootOrder      string             `json:"boot_order"`
+	Firewall       string             `json:"firewall"`
+	IPAddresses    wireIPAddresses    `json:"ip_addresses"`
+	NICModel       string             `json:"nic_model"`
+	SimpleBackup   string             `json:"simple_backup"`
+	StorageDevices wireStorageDevices `json:"storage_devices"`
+	Timezone       string             `json:"timezone"`
+	VideoModel     string             `json:"video_model"`
+}
+
+type wireIPAddresses struct {
+	IPAddress []upcloud.IPAddress `json:"ip_address"`
+}
+
+type wireStorageDevices struct {
+	StorageDevice []upcloud.ServerStorageDevice `json:"storage_device"`
+}
+
+type wireStorage struct {
+	upcloud.Storage
+	BackupRule  *upcloud.BackupRule `json:"backup_rule,omitempty"`
+	BackupUUIDs wireBackups         `json:"backups"`
+	ServerUUIDs wireServers         `json:"servers"`
+}
+
+type wireBackups struct {
+	Backup []string `json:"backup"`
+}
+
+type wireServers struct {
+	Server []string `json:"server"`
+}
+
+func toWireServer(s *upcloud.ServerDetails) wireServer {
+	return wireServer{
+		CoreNumber:   s.CoreNumber,
+		Hostname:     s.Hostname,
+		License:      s.License,
+		MemoryAmount: s.MemoryAmount,
+		Plan:         s.Plan,
+		Progress:     s.Progress,
+		State:        s.State,
+		Tags:         wireTags{Tag: append([]string{}, s.Tags...)},
+		Title:        s.Title,
+		UUID:         s.UUID,
+		Zone:         s.Zone,
+		Labels:       s.Labels,
+	}
+}
+
+func toWireServerDetails(s *upcloud.ServerDetails) wireServerDetails {
+	return wireServerDetails{
+		wireServer:     toWireServer(s),
+		BootOrder:      s.BootOrder,
+		Firewall:       s.Firewall,
+		IPAddresses:    wireIPAddresses{IPAddress: append([]upcloud.IPAddress{}, s.IPAddresses...)},
+		NICModel:       s.NICModel,
+		SimpleBackup:   s.SimpleBackup,
+		StorageDevices: wireStorageDevices{StorageDevice: append([]upcloud.ServerStorageDevice{}, s.StorageDevices...)},
+		Timezone:       s.Timezone,
+		VideoModel:     s.VideoModel,
+	}
+}
+
+func toWireStorage(s *upcloud.StorageDetails) wireStorage {
+	return wireStorage{
+		Storage:     s.Storage,
+		BackupRule:  s.BackupRule,
+		BackupUUIDs: wireBackups{Backup: append([]string{}, s.BackupUUIDs...)},
+		ServerUUIDs: wireServers{Server: append([]string{}, s.ServerUUIDs...)},
+	}
+}
+
+// flexInt decodes a JSON number whether or not it is quoted; the API
+// accepts both and the SDK sends both depending on the request type.
+type flexInt int
+
+func (i *flexInt) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s == "" {
+			*i = 0
+			return nil
+		}
+		n, err := strconv.Atoi(s)
+		*i = flexInt(n)
+		return err
+	}
+	var n int
+	err := json.Unmarshal(b, &n)
+	*i = flexInt(n)
+	return err
+}
+
+type createServerBody struct {
+	Server struct {
+		CoreNumber   flexInt             `json:"core_number"`
+		Hostname     string              `json:"hostname"`
+		Labels       *upcloud.LabelSlice `json:"labels"`
+		MemoryAmount flexInt             `json:"memory_amount"`
+		Plan         string              `json:"plan"`
+		TimeZone     string              `json:"timezone"`
+		Title        string              `json:"title"`
+		Zone         string              `json:"zone"`
+		SimpleBackup string              `json:"simple_backup"`
+		Networking   *struct {
+			Interfaces struct {
+				Interface []struct {
+					Type        string `json:"type"`
+					IPAddresses struct {
+						IPAddress []struct {
+							Family string `json:"family"`
+						} `json:"ip_address"`
+					} `json:"ip_addresses"`
+				} `json:"interface"`
+			} `json:"interfaces"`
+		} `json:"networking"`
+		StorageDevices struct {
+			StorageDevice []storageDeviceBody `json:"storage_device"`
+		} `json:"storage_devices"`
+	} `json:"server"`
+}
+
+type storageDeviceBody struct {
+	Action     string              `json:"action"`
+	Address    string              `json:"address"`
+	Encrypted  upcloud.Boolean     `json:"encrypted"`
+	Storage    string              `json:"storage"`
+	Title      string              `json:"title"`
+	Size       flexInt             `json:"size"`
+	Tier       string              `json:"tier"`
+	Type       string              `json:"type"`
+	BackupRule *upcloud.BackupRule `json:"backup_rule"`
+}
+
+type modifyServerBody struct {
+	Server struct {
+		CoreNumber   flexInt             `json:"core_number"`
+		Hostname     string              `json:"hostname"`
+		Labels       *upcloud.LabelSlice `json:"labels"`
+		MemoryAmount flexInt             `json:"memory_amount"`
+		Plan         string              `json:"plan"`
+		TimeZone     string              `json:"timezone"`
+		Title        string              `json:"title"`
+		Zone         string              `json:"zone"`
+		SimpleBackup string              `json:"simple_backup"`
+	} `json:"server"`
+}
+
+type stopServerBody struct {
+	StopServer struct {
+		StopType string  `json:"stop_type"`
+		Timeout  flexInt `json:"timeout"`
+	} `json:"stop_server"`
+}
+
+type cloneStorageBody struct {
+	Storage struct {
+		Zone      string          `json:"zone"`
+		Tier      string          `json:"tier"`
+		Title     string          `json:"title"`
+		Encrypted upcloud.Boolean `json:"encrypted"`
+	} `json:"storage"`
+}
+
+type createBackupBody struct {
+	Storage struct {
+		Title string `json:"title"`
+	} `json:"storage"`
+}
+
+type createStorageBody struct {
+	Storage struct {
+		Size       flexInt             `json:"size"`
+		Tier       string              `json:"tier"`
+		Title      string              `json:"title"`
+		Zone       string              `json:"zone"`
+		Encrypted  upcloud.Boolean     `json:"encrypted"`
+		BackupRule *upcloud.BackupRule `json:"backup_rule"`
+		Labels     []upcloud.Label     `json:"labels"`
+	} `json:"storage"`
+}
+
+type modifyStorageBody struct {
+	Storage struct {
+		Size       flexInt             `json:"size"`
+		Title      string              `json:"title"`
+		BackupRule *upcloud.BackupRule `json:"backup_rule"`
+		Labels     *[]upcloud.Label    `json:"labels"`
+	} `json:"storage"`
+}
+
+type storageDeviceActionBody struct {
+	StorageDevice struct {
+		Type    string `json:"type"`
+		Address string `json:"address"`
+		Storage string `json:"storage"`
+	} `json:"storage_device"`
+}
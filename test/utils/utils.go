@@ -115,6 +115,23 @@ func LoadImageToKindClusterWithName(name string) error {
 	return err
 }
 
+// GetKindHostAddress returns the address at which pods in the kind cluster
+// can reach the host, i.e. the gateway of the kind docker network.
+func GetKindHostAddress() (string, error) {
+	cmd := exec.Command("docker", "network", "inspect", "kind",
+		"-f", "{{range .IPAM.Config}}{{.Gateway}}{{\"\\n\"}}{{end}}")
+	output, err := Run(cmd)
+	if err != nil {
+		return "", err
+	}
+	for _, gateway := range GetNonEmptyLines(string(output)) {
+		if !strings.Contains(gateway, ":") {
+			return gateway, nil
+		}
+	}
+	return "", fmt.Errorf("no IPv4 gateway found for the kind network in %q", string(output))
+}
+
 // GetNonEmptyLines converts given command output string into individual objects
 // according to line breakers, and ignores the empty elements in it.
 func GetNonEmptyLines(output string) []string {